@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+
+	"jbpmn-engine/workflow"
+
+	"github.com/gorilla/mux"
+)
+
+// StatusChangeRequest is the optional JSON body of the cancel, suspend and resume
+// endpoints.
+type StatusChangeRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// cancelInstance cancels an instance and its child instances.
+func (s *Server) cancelInstance(w http.ResponseWriter, r *http.Request) {
+	s.changeStatus(w, r, s.engine.Cancel)
+}
+
+// suspendInstance pauses an instance until it is resumed.
+func (s *Server) suspendInstance(w http.ResponseWriter, r *http.Request) {
+	s.changeStatus(w, r, s.engine.Suspend)
+}
+
+// resumeInstance continues a suspended instance.
+func (s *Server) resumeInstance(w http.ResponseWriter, r *http.Request) {
+	s.changeStatus(w, r, s.engine.Resume)
+}
+
+// MoveRequest is the JSON body of the move endpoint.
+type MoveRequest struct {
+	Node      string                 `json:"node"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+	Execute   bool                   `json:"execute,omitempty"`
+	Operator  string                 `json:"operator"`
+	Reason    string                 `json:"reason,omitempty"`
+}
+
+// moveInstance puts an instance on any node of its definition. If the target node
+// is executed, the response reflects the next wait state.
+func (s *Server) moveInstance(w http.ResponseWriter, r *http.Request) {
+	var req MoveRequest
+	if err := readJSONBody(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	instance, err := s.engine.Move(r.Context(), mux.Vars(r)["instance_id"], workflow.MoveOptions{
+		Node:      req.Node,
+		Variables: req.Variables,
+		Execute:   req.Execute,
+		Operator:  req.Operator,
+		Reason:    req.Reason,
+	})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newInstanceResponse(instance))
+}
+
+// RetryRequest is the optional JSON body of the retry endpoint.
+type RetryRequest struct {
+	Operator string `json:"operator,omitempty"`
+}
+
+// retryInstance executes the node an instance failed at again. The response
+// reflects the next wait state, or the new incident if the node failed again.
+func (s *Server) retryInstance(w http.ResponseWriter, r *http.Request) {
+	var req RetryRequest
+	if err := readJSONBody(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	instance, err := s.engine.Retry(r.Context(), mux.Vars(r)["instance_id"], req.Operator)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newInstanceResponse(instance))
+}
+
+func (s *Server) changeStatus(w http.ResponseWriter, r *http.Request, action func(instanceID, reason string) (*workflow.WorkflowInstance, error)) {
+	var req StatusChangeRequest
+	if err := readJSONBody(r, &req); err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	instance, err := action(mux.Vars(r)["instance_id"], req.Reason)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newInstanceResponse(instance))
+}
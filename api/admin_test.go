@@ -0,0 +1,321 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (s *testServer) post(t *testing.T, path, body string) *http.Response {
+	t.Helper()
+	return s.do(t, http.MethodPost, path, "application/json", "", body)
+}
+
+func (s *testServer) history(t *testing.T, instanceID string) []HistoryEntry {
+	t.Helper()
+	resp := s.do(t, http.MethodGet, "/api/v1/instances/"+instanceID+"/history", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var history []HistoryEntry
+	decode(t, resp, &history)
+	return history
+}
+
+func TestSuspendHoldsTimersAndFormsUntilResumed(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+
+	resp := s.post(t, "/api/v1/instances/"+inst.ID+"/suspend", `{"reason": "incident 42"}`)
+	expectStatus(t, resp, http.StatusOK)
+	var suspended InstanceResponse
+	decode(t, resp, &suspended)
+	if suspended.Status != "suspended" || suspended.StatusReason != "incident 42" {
+		t.Errorf("status = %q (%q), want suspended (incident 42)", suspended.Status, suspended.StatusReason)
+	}
+
+	resp = s.post(t, "/api/v1/instances/"+inst.ID+"/form", `{"user_name": "Ada", "user_age": 36}`)
+	expectStatus(t, resp, http.StatusConflict)
+	if err := decodeError(t, resp); err.Code != "instance_not_active" {
+		t.Errorf("code = %q", err.Code)
+	}
+	expectStatus(t, s.post(t, "/api/v1/instances/"+inst.ID+"/suspend", ""), http.StatusConflict)
+
+	// The form times out while the instance is suspended.
+	s.clock.Advance(2 * time.Minute)
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID, "", "", "")
+	var held InstanceResponse
+	decode(t, resp, &held)
+	if held.CurrentNode != "collect_info_form" {
+		t.Fatalf("suspended instance moved to %s", held.CurrentNode)
+	}
+
+	resp = s.post(t, "/api/v1/instances/"+inst.ID+"/resume", "")
+	expectStatus(t, resp, http.StatusOK)
+	var resumed InstanceResponse
+	decode(t, resp, &resumed)
+	if resumed.Status != "active" || resumed.CurrentNode != "timeout_message_end" {
+		t.Errorf("resumed instance is %s at %s, want active at timeout_message_end", resumed.Status, resumed.CurrentNode)
+	}
+
+	var events []string
+	for _, h := range s.history(t, inst.ID) {
+		if h.Event != "" {
+			events = append(events, h.Event+":"+h.NodeID+":"+h.Detail)
+		}
+	}
+	if got, want := strings.Join(events, ","), "suspended:collect_info_form:incident 42,resumed:collect_info_form:"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+}
+
+func TestResumeActiveInstance(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	resp := s.post(t, "/api/v1/instances/"+inst.ID+"/resume", "")
+	expectStatus(t, resp, http.StatusConflict)
+	if err := decodeError(t, resp); err.Code != "instance_not_suspended" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestCancelCascadesToChildren(t *testing.T) {
+	s := newTestServer(t)
+	parent := s.start(t, "my_first_workflow")
+	resp := s.post(t, "/api/v1/workflows/approval_process/instances", `{"parent_instance_id": "`+parent.ID+`"}`)
+	expectStatus(t, resp, http.StatusCreated)
+	var child InstanceResponse
+	decode(t, resp, &child)
+	if child.ParentID != parent.ID {
+		t.Fatalf("parent_instance_id = %q, want %q", child.ParentID, parent.ID)
+	}
+
+	resp = s.post(t, "/api/v1/instances/"+parent.ID+"/cancel", `{"reason": "duplicate order"}`)
+	expectStatus(t, resp, http.StatusOK)
+	var cancelled InstanceResponse
+	decode(t, resp, &cancelled)
+	if cancelled.Status != "cancelled" || cancelled.StatusReason != "duplicate order" {
+		t.Errorf("status = %q (%q)", cancelled.Status, cancelled.StatusReason)
+	}
+
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+child.ID, "", "", "")
+	var cancelledChild InstanceResponse
+	decode(t, resp, &cancelledChild)
+	if cancelledChild.Status != "cancelled" || !strings.Contains(cancelledChild.StatusReason, parent.ID) {
+		t.Errorf("child status = %q (%q)", cancelledChild.Status, cancelledChild.StatusReason)
+	}
+
+	// Cancelled instances ignore their timers and cannot be cancelled again.
+	s.clock.Advance(time.Hour)
+	history := s.history(t, child.ID)
+	if last := history[len(history)-1]; last.Event != "cancelled" {
+		t.Errorf("last history entry = %+v, want the cancellation", last)
+	}
+	expectStatus(t, s.post(t, "/api/v1/instances/"+parent.ID+"/cancel", ""), http.StatusConflict)
+	expectStatus(t, s.post(t, "/api/v1/instances/"+parent.ID+"/resume", ""), http.StatusConflict)
+}
+
+func TestStartWithUnknownParent(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.post(t, "/api/v1/workflows/my_first_workflow/instances", `{"parent_instance_id": "missing"}`)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	if err := decodeError(t, resp); err.Fields["parent_instance_id"] == "" {
+		t.Errorf("error = %+v", err)
+	}
+}
+
+func TestSuspendUnknownInstance(t *testing.T) {
+	s := newTestServer(t)
+	expectStatus(t, s.post(t, "/api/v1/instances/missing/suspend", ""), http.StatusNotFound)
+}
+
+func TestMoveAndExecute(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	expectStatus(t, s.post(t, "/api/v1/instances/"+inst.ID+"/form", `{"user_name": "Ada", "user_age": 36}`), http.StatusOK)
+
+	// Rewind the finished instance to re-run the script with a corrected age.
+	resp := s.post(t, "/api/v1/instances/"+inst.ID+"/move",
+		`{"node": "process_data_script", "variables": {"user_age": 12, "user_name": null}, "execute": true, "operator": "ops@example.com", "reason": "wrong age"}`)
+	expectStatus(t, resp, http.StatusOK)
+	var moved InstanceResponse
+	decode(t, resp, &moved)
+	if moved.CurrentNode != "under_age_end" {
+		t.Errorf("instance is at %s, want under_age_end", moved.CurrentNode)
+	}
+	if _, ok := moved.Context["user_name"]; ok || moved.Context["user_age"] != float64(12) {
+		t.Errorf("context = %v", moved.Context)
+	}
+
+	var found bool
+	for _, h := range s.history(t, inst.ID) {
+		if h.Event == "moved" {
+			found = true
+			if h.NodeID != "process_data_script" || h.Operator != "ops@example.com" || h.Detail != "wrong age" {
+				t.Errorf("move entry = %+v", h)
+			}
+		}
+	}
+	if !found {
+		t.Error("history has no move entry")
+	}
+}
+
+func TestMoveAndWait(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "approval_process")
+
+	resp := s.post(t, "/api/v1/instances/"+inst.ID+"/move", `{"node": "timeout_handler", "operator": "ops"}`)
+	expectStatus(t, resp, http.StatusOK)
+	var moved InstanceResponse
+	decode(t, resp, &moved)
+	if moved.CurrentNode != "timeout_handler" {
+		t.Fatalf("instance is at %s, want timeout_handler", moved.CurrentNode)
+	}
+
+	// The form's timer was left behind with the form.
+	s.clock.Advance(time.Hour)
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID, "", "", "")
+	var waiting InstanceResponse
+	decode(t, resp, &waiting)
+	if waiting.CurrentNode != "timeout_handler" {
+		t.Errorf("waiting instance moved on to %s", waiting.CurrentNode)
+	}
+}
+
+func TestMoveValidation(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+
+	resp := s.post(t, "/api/v1/instances/"+inst.ID+"/move", `{"node": "no_such_node"}`)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	if err := decodeError(t, resp); err.Fields["node"] == "" || err.Fields["operator"] == "" {
+		t.Errorf("error = %+v", err)
+	}
+
+	expectStatus(t, s.post(t, "/api/v1/instances/"+inst.ID+"/cancel", ""), http.StatusOK)
+	resp = s.post(t, "/api/v1/instances/"+inst.ID+"/move", `{"node": "collect_info_form", "operator": "ops"}`)
+	expectStatus(t, resp, http.StatusConflict)
+}
+
+const failingGateway = `{
+  "id": "routing",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "route"},
+    {"id": "route", "type": "gateway", "conditions": [
+      {"when": "amount >= 100", "next": "large"},
+      {"when": "amount < 100", "next": "small"}
+    ]},
+    {"id": "large", "type": "end"},
+    {"id": "small", "type": "end"}
+  ]
+}`
+
+func TestIncidentAndRetry(t *testing.T) {
+	s := newTestServer(t)
+	expectStatus(t, s.post(t, "/api/v1/definitions", failingGateway), http.StatusCreated)
+	ok := s.start(t, "my_first_workflow")
+	failed := s.start(t, "routing")
+	if failed.Incident == "" || !strings.Contains(failed.Incident, "no matching gateway condition") {
+		t.Fatalf("incident = %q", failed.Incident)
+	}
+
+	resp := s.do(t, http.MethodGet, "/api/v1/instances?incident=true", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var incidents []InstanceResponse
+	decode(t, resp, &incidents)
+	if len(incidents) != 1 || incidents[0].ID != failed.ID {
+		t.Errorf("instances with incidents = %+v", incidents)
+	}
+
+	resp = s.post(t, "/api/v1/instances/"+failed.ID+"/retry", `{"operator": "ops"}`)
+	expectStatus(t, resp, http.StatusOK)
+	var retried InstanceResponse
+	decode(t, resp, &retried)
+	if retried.CurrentNode != "route" || retried.Incident == "" {
+		t.Errorf("retried instance is at %s with incident %q, want a new incident at route", retried.CurrentNode, retried.Incident)
+	}
+	var events []string
+	for _, entry := range s.history(t, failed.ID) {
+		if entry.Event != "" {
+			events = append(events, entry.Event+"/"+entry.Operator)
+		}
+	}
+	if got := strings.Join(events, ","); got != "incident/,retried/ops,incident/" {
+		t.Errorf("events = %s", got)
+	}
+
+	// Moving the instance on resolves the incident.
+	expectStatus(t, s.post(t, "/api/v1/instances/"+failed.ID+"/move", `{"node": "small", "operator": "ops"}`), http.StatusOK)
+	resp = s.post(t, "/api/v1/instances/"+failed.ID+"/retry", "")
+	expectStatus(t, resp, http.StatusConflict)
+	if err := decodeError(t, resp); err.Code != "no_incident" {
+		t.Errorf("code = %q", err.Code)
+	}
+	expectStatus(t, s.post(t, "/api/v1/instances/"+ok.ID+"/retry", ""), http.StatusConflict)
+}
+
+func TestListInstances(t *testing.T) {
+	s := newTestServer(t)
+	first := s.start(t, "my_first_workflow")
+	s.start(t, "approval_process")
+	last := s.start(t, "my_first_workflow")
+	expectStatus(t, s.post(t, "/api/v1/instances/"+first.ID+"/suspend", ""), http.StatusOK)
+
+	list := func(query string) []string {
+		t.Helper()
+		resp := s.do(t, http.MethodGet, "/api/v1/instances"+query, "", "", "")
+		expectStatus(t, resp, http.StatusOK)
+		var instances []InstanceResponse
+		decode(t, resp, &instances)
+		ids := make([]string, 0, len(instances))
+		for _, instance := range instances {
+			ids = append(ids, instance.ID)
+		}
+		return ids
+	}
+	if got := list("?workflow_id=my_first_workflow"); len(got) != 2 {
+		t.Errorf("my_first_workflow instances = %v", got)
+	}
+	if got := list("?workflow_id=my_first_workflow&status=active"); len(got) != 1 || got[0] != last.ID {
+		t.Errorf("active my_first_workflow instances = %v, want [%s]", got, last.ID)
+	}
+	if got := list("?limit=2"); len(got) != 2 {
+		t.Errorf("limited list = %v", got)
+	}
+	expectStatus(t, s.do(t, http.MethodGet, "/api/v1/instances?limit=many", "", "", ""), http.StatusBadRequest)
+}
+
+// tallyOrder logs while it counts the order lines, then fails in check.
+const tallyOrder = `{
+  "id": "tally_order",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "tally"},
+    {"id": "tally", "type": "script", "script": {
+      "code": "console.log('tallying', process_data.order);\nconsole.warn('lines:', process_data.order.lines.length);\nreturn {count: process_data.order.lines.length};"
+    }, "next": "check"},
+    {"id": "check", "type": "script", "script": {
+      "code": "console.error('too many lines');\nthrow new Error('rejected');"
+    }, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptLogs(t *testing.T) {
+	s := newTestServer(t)
+	expectStatus(t, s.post(t, "/api/v1/definitions", tallyOrder), http.StatusCreated)
+	resp := s.post(t, "/api/v1/workflows/tally_order/instances", `{"variables": {"order": {"lines": [1, 2]}}}`)
+	expectStatus(t, resp, http.StatusCreated)
+	var inst InstanceResponse
+	decode(t, resp, &inst)
+
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID+"/logs", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var logs []LogEntry
+	decode(t, resp, &logs)
+	if len(logs) != 3 || logs[0].NodeID != "tally" || logs[0].Level != "log" || logs[0].Message != `tallying {"lines":[1,2]}` || logs[0].NodeInstanceID == "" || logs[0].CreatedAt.IsZero() {
+		t.Errorf("logs = %+v", logs)
+	}
+
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/unknown/logs", "", "", "")
+	expectStatus(t, resp, http.StatusNotFound)
+}
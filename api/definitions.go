@@ -0,0 +1,179 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"jbpmn-engine/workflow"
+
+	"github.com/gorilla/mux"
+)
+
+// maxDefinitionSize limits the size of a deployed definition document.
+const maxDefinitionSize = 1 << 20
+
+// DefinitionResponse describes one stored version of a workflow definition.
+type DefinitionResponse struct {
+	ID          string            `json:"id"`
+	Version     int               `json:"version"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Links       map[string]string `json:"links"`
+}
+
+// DefinitionDetail is the response of the definition endpoint: the requested
+// version, its document and every stored version.
+type DefinitionDetail struct {
+	DefinitionResponse
+	Definition *workflow.Workflow   `json:"definition"`
+	Versions   []DefinitionResponse `json:"versions"`
+}
+
+// ValidationResponse is the response of a dry-run deployment.
+type ValidationResponse struct {
+	Valid      bool                       `json:"valid"`
+	WorkflowID string                     `json:"workflow_id,omitempty"`
+	Issues     []workflow.ValidationIssue `json:"issues"`
+	// Warnings lists parts of a valid definition that are likely mistakes; see
+	// workflow.Warnings.
+	Warnings []workflow.ValidationIssue `json:"warnings,omitempty"`
+}
+
+func definitionURL(id string) string { return Prefix + "/definitions/" + id }
+
+func newDefinitionResponse(info workflow.DefinitionInfo) DefinitionResponse {
+	return DefinitionResponse{
+		ID:          info.WorkflowID,
+		Version:     info.Version,
+		Name:        info.Name,
+		Description: info.Meta.Description,
+		Source:      info.Source,
+		CreatedAt:   info.CreatedAt,
+		Links: map[string]string{
+			"self":      fmt.Sprintf("%s?version=%d", definitionURL(info.WorkflowID), info.Version),
+			"instances": Prefix + "/workflows/" + info.WorkflowID + "/instances",
+		},
+	}
+}
+
+// deployDefinition validates a workflow JSON document and stores it as a new
+// version. With ?dryRun=true it only reports the validation result.
+func (s *Server) deployDefinition(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if v := r.URL.Query().Get("dryRun"); v != "" {
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			s.writeError(w, r, badRequest("dryRun must be true or false"))
+			return
+		}
+		dryRun = parsed
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxDefinitionSize+1))
+	if err != nil {
+		s.writeError(w, r, badRequest("Failed to read request body: %v", err))
+		return
+	}
+	if len(data) > maxDefinitionSize {
+		s.writeError(w, r, &Error{Status: http.StatusRequestEntityTooLarge, Code: "definition_too_large",
+			Message: fmt.Sprintf("Definitions are limited to %d bytes.", maxDefinitionSize)})
+		return
+	}
+
+	if dryRun {
+		resp := ValidationResponse{Valid: true, Issues: []workflow.ValidationIssue{}}
+		wf, err := s.engine.ValidateDefinition(data)
+		var defErr *workflow.DefinitionError
+		switch {
+		case errors.As(err, &defErr):
+			resp.Valid = false
+			resp.Issues = defErr.Issues
+		case err != nil:
+			s.writeError(w, r, err)
+			return
+		default:
+			resp.WorkflowID = wf.ID
+			resp.Warnings = workflow.Warnings(wf, data)
+		}
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	info, created, err := s.engine.Deploy(data, "api")
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	resp := newDefinitionResponse(*info)
+	w.Header().Set("Location", resp.Links["self"])
+	writeJSON(w, status, resp)
+}
+
+// listDefinitions lists the latest version of every stored definition.
+func (s *Server) listDefinitions(w http.ResponseWriter, r *http.Request) {
+	infos, err := s.engine.Definitions()
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := make([]DefinitionResponse, 0, len(infos))
+	for _, info := range infos {
+		resp = append(resp, newDefinitionResponse(info))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getDefinition returns a definition with its version history. It describes the
+// latest version unless ?version= asks for another one.
+func (s *Server) getDefinition(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["workflow_id"]
+	infos, err := s.engine.DefinitionVersions(id)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	selected := infos[len(infos)-1]
+	if v := r.URL.Query().Get("version"); v != "" {
+		version, err := strconv.Atoi(v)
+		if err != nil {
+			s.writeError(w, r, badRequest("version must be a number"))
+			return
+		}
+		found := false
+		for _, info := range infos {
+			if info.Version == version {
+				selected, found = info, true
+			}
+		}
+		if !found {
+			s.writeError(w, r, fmt.Errorf("%w: '%s' version %d", workflow.ErrDefinitionNotFound, id, version))
+			return
+		}
+	}
+
+	wf, err := s.engine.DefinitionVersion(id, selected.Version)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := DefinitionDetail{
+		DefinitionResponse: newDefinitionResponse(selected),
+		Definition:         wf,
+		Versions:           make([]DefinitionResponse, 0, len(infos)),
+	}
+	for _, info := range infos {
+		resp.Versions = append(resp.Versions, newDefinitionResponse(info))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
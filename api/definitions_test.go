@@ -0,0 +1,394 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jbpmn-engine/workflow"
+)
+
+const reviewV1 = `{
+  "id": "review",
+  "name": "Review",
+  "meta": {"description": "Collects a review"},
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "review_form"},
+    {"id": "review_form", "type": "form", "next": "done", "fields": [{"name": "comment", "type": "text", "required": true}]},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+const reviewV2 = `{
+  "id": "review",
+  "name": "Review",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestDeployDefinition(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := s.post(t, "/api/v1/definitions", reviewV1)
+	expectStatus(t, resp, http.StatusCreated)
+	var v1 DefinitionResponse
+	decode(t, resp, &v1)
+	if v1.ID != "review" || v1.Version != 1 || v1.Source != "api" || v1.Description != "Collects a review" {
+		t.Errorf("deployed = %+v", v1)
+	}
+	if loc := resp.Header.Get("Location"); loc != "/api/v1/definitions/review?version=1" {
+		t.Errorf("Location = %q", loc)
+	}
+
+	// Deploying the same document again does not create a version.
+	resp = s.post(t, "/api/v1/definitions", reviewV1)
+	expectStatus(t, resp, http.StatusOK)
+
+	inst := s.start(t, "review")
+	if inst.CurrentNode != "review_form" {
+		t.Fatalf("instance is at %s, want review_form", inst.CurrentNode)
+	}
+
+	resp = s.post(t, "/api/v1/definitions", reviewV2)
+	expectStatus(t, resp, http.StatusCreated)
+	var v2 DefinitionResponse
+	decode(t, resp, &v2)
+	if v2.Version != 2 {
+		t.Errorf("version = %d, want 2", v2.Version)
+	}
+
+	// New instances use version 2; the running one stays on version 1.
+	if next := s.start(t, "review"); next.CurrentNode != "done" {
+		t.Errorf("new instance is at %s, want done", next.CurrentNode)
+	}
+	resp = s.post(t, "/api/v1/instances/"+inst.ID+"/form", `{"comment": "fine"}`)
+	expectStatus(t, resp, http.StatusOK)
+	var finished InstanceResponse
+	decode(t, resp, &finished)
+	if finished.CurrentNode != "done" || finished.Context["comment"] != "fine" {
+		t.Errorf("instance = %+v", finished)
+	}
+}
+
+func TestListAndGetDefinitions(t *testing.T) {
+	s := newTestServer(t)
+	expectStatus(t, s.post(t, "/api/v1/definitions", reviewV1), http.StatusCreated)
+	expectStatus(t, s.post(t, "/api/v1/definitions", reviewV2), http.StatusCreated)
+
+	resp := s.do(t, http.MethodGet, "/api/v1/definitions", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var list []DefinitionResponse
+	decode(t, resp, &list)
+	var ids []string
+	for _, d := range list {
+		ids = append(ids, d.ID)
+		if d.ID == "review" && d.Version != 2 {
+			t.Errorf("review is listed at version %d, want 2", d.Version)
+		}
+	}
+	if got := strings.Join(ids, ","); got != "approval_process,my_first_workflow,review" {
+		t.Errorf("definitions = %s", got)
+	}
+
+	resp = s.do(t, http.MethodGet, "/api/v1/definitions/review?version=1", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var detail DefinitionDetail
+	decode(t, resp, &detail)
+	if detail.Version != 1 || len(detail.Definition.Nodes) != 3 || len(detail.Versions) != 2 {
+		t.Errorf("detail = %+v", detail)
+	}
+
+	expectStatus(t, s.do(t, http.MethodGet, "/api/v1/definitions/review?version=7", "", "", ""), http.StatusNotFound)
+	expectStatus(t, s.do(t, http.MethodGet, "/api/v1/definitions/unknown", "", "", ""), http.StatusNotFound)
+}
+
+func TestDeployInvalidDefinition(t *testing.T) {
+	s := newTestServer(t)
+	invalid := strings.Replace(reviewV1, `"next": "done"`, `"next": "dnoe"`, 1)
+
+	resp := s.post(t, "/api/v1/definitions", invalid)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	err := decodeError(t, resp)
+	if err.Code != "invalid_definition" || !strings.Contains(err.Fields["nodes[1].next"], "dnoe") {
+		t.Errorf("error = %+v", err)
+	}
+	expectStatus(t, s.do(t, http.MethodGet, "/api/v1/definitions/review", "", "", ""), http.StatusNotFound)
+}
+
+func TestDeployDryRun(t *testing.T) {
+	s := newTestServer(t)
+
+	resp := s.post(t, "/api/v1/definitions?dryRun=true", reviewV1)
+	expectStatus(t, resp, http.StatusOK)
+	var valid ValidationResponse
+	decode(t, resp, &valid)
+	if !valid.Valid || valid.WorkflowID != "review" {
+		t.Errorf("result = %+v", valid)
+	}
+	expectStatus(t, s.do(t, http.MethodGet, "/api/v1/definitions/review", "", "", ""), http.StatusNotFound)
+
+	resp = s.post(t, "/api/v1/definitions?dryRun=true", "{\n  \"id\": \"broken\",\n  \"nodes\": [,]\n}")
+	expectStatus(t, resp, http.StatusOK)
+	var invalid ValidationResponse
+	decode(t, resp, &invalid)
+	if invalid.Valid || len(invalid.Issues) != 1 || invalid.Issues[0].Line != 3 || invalid.Issues[0].Column != 13 {
+		t.Errorf("result = %+v", invalid)
+	}
+}
+
+func TestDeployDryRunReportsStructuralIssues(t *testing.T) {
+	s := newTestServer(t)
+	definition := `{
+  "id": "structure",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "check"},
+    {"id": "check", "type": "gateway", "conditions": [{"when": "amount > 100", "next": "done"}]},
+    {"id": "orphan", "type": "form", "next": "done", "timeout": {"duration": "soon", "next": "done"}},
+    {"id": "loop", "type": "script", "next": "loop", "script": {"code": "dmFyIHggPSA7", "encoding": "base64"}},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+	resp := s.post(t, "/api/v1/definitions?dryRun=true", definition)
+	expectStatus(t, resp, http.StatusOK)
+	var result ValidationResponse
+	decode(t, resp, &result)
+
+	got := make(map[string]string)
+	for _, issue := range result.Issues {
+		got[issue.Location()] += issue.Message + ";"
+	}
+	for location, want := range map[string]string{
+		"nodes[1].conditions (line 5, column 54)":       "else branch",
+		"nodes[2].timeout.duration (line 6, column 78)": "soon",
+		"nodes[2] (line 6, column 5)":                   "cannot be reached",
+		"nodes[3] (line 7, column 5)":                   "reaches an end",
+		"nodes[3].script.code (line 7, column 73)":      "compiling",
+	} {
+		if !strings.Contains(got[location], want) {
+			t.Errorf("issues at %s = %q, want %q; all issues: %v", location, got[location], want, result.Issues)
+		}
+	}
+}
+
+func TestReloadDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "review.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var s *testServer
+	reload := func() []workflow.FileReload {
+		t.Helper()
+		report, err := s.engine.ReloadDefinitions()
+		if err != nil {
+			t.Fatalf("reload: %v", err)
+		}
+		return report.Files
+	}
+
+	write(reviewV1)
+	s = newTestServerFrom(t, dir)
+	if files := reload(); len(files) != 0 {
+		t.Errorf("reload without changes reported %+v", files)
+	}
+	inst := s.start(t, "review")
+
+	// A valid edit is deployed as a new version for new instances.
+	write(reviewV2)
+	files := reload()
+	if len(files) != 1 || files[0].Action != workflow.ReloadUpdated || files[0].WorkflowID != "review" || files[0].Version != 2 {
+		t.Fatalf("report = %+v", files)
+	}
+	if next := s.start(t, "review"); next.CurrentNode != "done" {
+		t.Errorf("new instance is at %s, want done", next.CurrentNode)
+	}
+
+	// An invalid edit is rejected and version 2 stays in use.
+	write(strings.Replace(reviewV2, `"next": "done"`, `"next": "nowhere"`, 1))
+	files = reload()
+	if len(files) != 1 || files[0].Action != workflow.ReloadRejected || files[0].Version != 2 || files[0].Err == nil {
+		t.Fatalf("report = %+v", files)
+	}
+	if next := s.start(t, "review"); next.CurrentNode != "done" {
+		t.Errorf("new instance is at %s, want done", next.CurrentNode)
+	}
+
+	// A removed file can no longer be started, but running instances finish.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	files = reload()
+	if len(files) != 1 || files[0].Action != workflow.ReloadRemoved || files[0].WorkflowID != "review" {
+		t.Fatalf("report = %+v", files)
+	}
+	expectStatus(t, s.post(t, "/api/v1/workflows/review/instances", ""), http.StatusNotFound)
+	expectStatus(t, s.post(t, "/api/v1/instances/"+inst.ID+"/form", `{"comment": "fine"}`), http.StatusOK)
+
+	// Restoring the file makes the workflow startable again.
+	write(reviewV1)
+	files = reload()
+	if len(files) != 1 || files[0].Action != workflow.ReloadAdded || files[0].Version != 3 {
+		t.Fatalf("report = %+v", files)
+	}
+	if next := s.start(t, "review"); next.CurrentNode != "review_form" {
+		t.Errorf("new instance is at %s, want review_form", next.CurrentNode)
+	}
+}
+
+// priceOrder asks for a net amount and computes its gross amount with lib/pricing.
+const priceOrder = `{
+  "id": "price_order",
+  "libraries": ["lib/pricing"],
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "order_form"},
+    {"id": "order_form", "type": "form", "next": "price", "fields": [{"name": "net", "type": "number", "required": true}]},
+    {"id": "price", "type": "script", "script": {"code": "cHJvY2Vzc19kYXRhLmdyb3NzID0gcmVxdWlyZSgibGliL3ByaWNpbmciKS5ncm9zcyhwcm9jZXNzX2RhdGEubmV0KTs=", "encoding": "base64"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptLibraries(t *testing.T) {
+	root := t.TempDir()
+	workflows, libraries := filepath.Join(root, "workflows"), filepath.Join(root, "scripts")
+	write := func(file, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(workflows, "price_order.json"), priceOrder)
+	write(filepath.Join(libraries, "lib", "pricing.js"), `exports.gross = function (net) { return net * 1.2; };`)
+	s := newTestServerFrom(t, workflows, workflow.WithScriptLibraries(libraries))
+	before := s.start(t, "price_order")
+
+	// A changed library makes a new version of every definition using it.
+	write(filepath.Join(libraries, "lib", "pricing.js"), `exports.gross = function (net) { return net * 1.5; };`)
+	report, err := s.engine.ReloadDefinitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || report.Files[0].WorkflowID != "price_order" || report.Files[0].Version != 2 {
+		t.Fatalf("report = %+v", report.Files)
+	}
+	after := s.start(t, "price_order")
+
+	// Each instance uses the library of the version it started with.
+	for _, c := range []struct {
+		id    string
+		gross float64
+	}{{before.ID, 120}, {after.ID, 150}} {
+		resp := s.post(t, "/api/v1/instances/"+c.id+"/form", `{"net": 100}`)
+		expectStatus(t, resp, http.StatusOK)
+		var inst InstanceResponse
+		decode(t, resp, &inst)
+		if inst.CurrentNode != "done" || inst.Context["gross"] != c.gross {
+			t.Errorf("instance is at %s with context %v, want done with gross %v", inst.CurrentNode, inst.Context, c.gross)
+		}
+	}
+
+	// Libraries must exist in the library directory.
+	missing := strings.Replace(strings.Replace(priceOrder, `"price_order"`, `"price_quote"`, 1), "lib/pricing", "lib/quotes", 1)
+	resp := s.post(t, "/api/v1/definitions?dryRun=true", missing)
+	expectStatus(t, resp, http.StatusOK)
+	var result ValidationResponse
+	decode(t, resp, &result)
+	if result.Valid || len(result.Issues) != 1 || result.Issues[0].Path != "libraries[0]" || !strings.Contains(result.Issues[0].Message, "lib/quotes") {
+		t.Errorf("validation = %+v", result)
+	}
+	resp = s.post(t, "/api/v1/definitions", missing)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	if err := decodeError(t, resp); err.Fields["libraries[0]"] == "" {
+		t.Errorf("error = %+v", err)
+	}
+}
+
+// chargeOrder runs a script from charge.js after its form, and two inline scripts,
+// one of them base64 encoded.
+const chargeOrder = `{
+  "id": "charge_order",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "plain"},
+    {"id": "plain", "type": "script", "script": {"code": "process_data.fee = 2;"}, "next": "encoded"},
+    {"id": "encoded", "type": "script", "script": {"code": "cmV0dXJuIHtlbmNvZGVkOiB0cnVlfTs=", "encoding": "base64"}, "next": "order_form"},
+    {"id": "order_form", "type": "form", "next": "charge", "fields": [{"name": "net", "type": "number"}]},
+    {"id": "charge", "type": "script", "script": {"file": "charge.js"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptCodeAndFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("charge_order.json", chargeOrder)
+	write("charge.js", `return {charged: process_data.net + process_data.fee};`)
+	s := newTestServerFrom(t, dir)
+	before := s.start(t, "charge_order")
+	if before.Context["fee"] != 2.0 || before.Context["encoded"] != true {
+		t.Fatalf("context = %v", before.Context)
+	}
+
+	// Editing the file makes a new version; the running instance keeps the old code.
+	write("charge.js", `return {charged: (process_data.net + process_data.fee) * 2};`)
+	report, err := s.engine.ReloadDefinitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Files) != 1 || report.Files[0].Version != 2 {
+		t.Fatalf("report = %+v", report.Files)
+	}
+	after := s.start(t, "charge_order")
+	for _, c := range []struct {
+		id      string
+		charged float64
+	}{{before.ID, 12}, {after.ID, 24}} {
+		resp := s.post(t, "/api/v1/instances/"+c.id+"/form", `{"net": 10}`)
+		expectStatus(t, resp, http.StatusOK)
+		var inst InstanceResponse
+		decode(t, resp, &inst)
+		if inst.Context["charged"] != c.charged {
+			t.Errorf("context = %v, want charged %v", inst.Context, c.charged)
+		}
+	}
+
+	// The stored version holds the file with its hash.
+	resp := s.do(t, http.MethodGet, "/api/v1/definitions/charge_order?version=1", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var stored DefinitionDetail
+	decode(t, resp, &stored)
+	code := `return {charged: process_data.net + process_data.fee};`
+	sum := sha256.Sum256([]byte(code))
+	if file := stored.Definition.ScriptFiles["charge.js"]; file.Code != code || file.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("script_files = %+v", stored.Definition.ScriptFiles)
+	}
+
+	// Files cannot be read through the API, nor outside the definition's directory.
+	for definition, field := range map[string]string{
+		chargeOrder: "nodes[4].script.file",
+		strings.Replace(chargeOrder, `"charge.js"`, `"../charge.js"`, 1):             "nodes[4].script.file",
+		strings.Replace(chargeOrder, `"encoding": "base64"`, `"encoding": "hex"`, 1): "nodes[2].script.encoding",
+	} {
+		resp := s.post(t, "/api/v1/definitions", definition)
+		expectStatus(t, resp, http.StatusUnprocessableEntity)
+		if err := decodeError(t, resp); err.Fields[field] == "" {
+			t.Errorf("error = %+v, want an issue at %s", err, field)
+		}
+	}
+}
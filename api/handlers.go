@@ -0,0 +1,465 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"jbpmn-engine/db"
+	"jbpmn-engine/workflow"
+
+	"github.com/gorilla/mux"
+)
+
+// InstanceResponse is the JSON representation of a workflow instance.
+type InstanceResponse struct {
+	ID              string                 `json:"id"`
+	WorkflowID      string                 `json:"workflow_id"`
+	BusinessKey     string                 `json:"business_key,omitempty"`
+	ParentID        string                 `json:"parent_instance_id,omitempty"`
+	Status          string                 `json:"status"`
+	StatusReason    string                 `json:"status_reason,omitempty"`
+	Incident        string                 `json:"incident,omitempty"`
+	CurrentNode     string                 `json:"current_node"`
+	CurrentNodeType string                 `json:"current_node_type"`
+	Ended           bool                   `json:"ended"`
+	WaitingSignal   string                 `json:"waiting_signal,omitempty"`
+	ExpiresAt       *time.Time             `json:"expires_at,omitempty"`
+	Context         map[string]interface{} `json:"context"`
+	CreatedAt       time.Time              `json:"created_at"`
+	UpdatedAt       time.Time              `json:"updated_at"`
+	Links           map[string]string      `json:"links"`
+}
+
+// HistoryEntry is one node execution in the response of the history endpoint.
+// Administrative actions such as suspending or moving the instance appear as entries
+// with an event, its reason as detail and, for moves, the operator.
+type HistoryEntry struct {
+	ID            string     `json:"id"`
+	NodeID        string     `json:"node_id"`
+	Event         string     `json:"event,omitempty"`
+	Detail        string     `json:"detail,omitempty"`
+	Operator      string     `json:"operator,omitempty"`
+	WaitingSignal string     `json:"waiting_signal,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// LogEntry is one console call of a script in the response of the logs endpoint.
+// NodeInstanceID is the history entry of the node execution that ran the script.
+type LogEntry struct {
+	ID             int64     `json:"id"`
+	NodeID         string    `json:"node_id"`
+	NodeInstanceID string    `json:"node_instance_id"`
+	Level          string    `json:"level"`
+	Message        string    `json:"message"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// FormResponse describes the form an instance is waiting for.
+type FormResponse struct {
+	InstanceID string               `json:"instance_id"`
+	Node       string               `json:"node"`
+	Fields     []workflow.FormField `json:"fields"`
+	Values     map[string]string    `json:"values,omitempty"`
+	Action     string               `json:"action"`
+}
+
+func instanceURL(id string) string { return Prefix + "/instances/" + id }
+func formURL(id string) string     { return instanceURL(id) + "/form" }
+
+func newInstanceResponse(instance *workflow.WorkflowInstance) *InstanceResponse {
+	resp := &InstanceResponse{
+		ID:              instance.ID,
+		WorkflowID:      instance.WorkflowID,
+		BusinessKey:     instance.BusinessKey,
+		ParentID:        instance.ParentInstanceID,
+		Status:          instance.Status,
+		StatusReason:    instance.StatusReason,
+		Incident:        instance.Incident,
+		CurrentNode:     instance.CurrentNode,
+		CurrentNodeType: instance.CurrentNodeDef.Type,
+		Ended:           instance.CurrentNodeDef.Type == "end",
+		WaitingSignal:   instance.WaitingSignal,
+		ExpiresAt:       instance.ExpiresAt,
+		Context:         instance.Context,
+		CreatedAt:       instance.CreatedAt,
+		UpdatedAt:       instance.UpdatedAt,
+		Links: map[string]string{
+			"self":    instanceURL(instance.ID),
+			"history": instanceURL(instance.ID) + "/history",
+			"logs":    instanceURL(instance.ID) + "/logs",
+		},
+	}
+	if instance.CurrentNodeDef.Type == "form" {
+		resp.Links["form"] = formURL(instance.ID)
+	}
+	return resp
+}
+
+// StartRequest is the optional JSON body of a start request.
+type StartRequest struct {
+	Variables   map[string]interface{} `json:"variables,omitempty"`
+	BusinessKey string                 `json:"business_key,omitempty"`
+	StartNode   string                 `json:"start_node,omitempty"`
+	ParentID    string                 `json:"parent_instance_id,omitempty"`
+}
+
+// startInstance creates a new instance of a workflow definition and responds once
+// it has reached its first wait state. A repeated request with the same
+// Idempotency-Key returns the instance created by the first one.
+func (s *Server) startInstance(w http.ResponseWriter, r *http.Request) {
+	workflowID := mux.Vars(r)["workflow_id"]
+
+	var req StartRequest
+	if r.Method == http.MethodPost {
+		if err := readJSONBody(r, &req); err != nil {
+			s.writeError(w, r, err)
+			return
+		}
+	}
+
+	instance, replayed, err := s.engine.StartOnce(r.Context(), idempotencyKey(r), workflowID, workflow.StartOptions{
+		Variables:   req.Variables,
+		BusinessKey: req.BusinessKey,
+		StartNode:   req.StartNode,
+
+		ParentInstanceID: req.ParentID,
+	})
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	markReplayed(w, replayed)
+
+	if wantsHTML(r) {
+		target := instanceURL(instance.ID)
+		if instance.CurrentNodeDef.Type == "form" {
+			target = formURL(instance.ID)
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Location", instanceURL(instance.ID))
+	writeJSON(w, http.StatusCreated, newInstanceResponse(instance))
+}
+
+// idempotencyKey returns the client-supplied Idempotency-Key header, if any.
+func idempotencyKey(r *http.Request) string {
+	return strings.TrimSpace(r.Header.Get("Idempotency-Key"))
+}
+
+// markReplayed flags responses to requests that repeated an earlier Idempotency-Key.
+func markReplayed(w http.ResponseWriter, replayed bool) {
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+}
+
+// readJSONBody decodes an optional JSON request body into v. An empty body leaves v
+// unchanged.
+func readJSONBody(r *http.Request, v interface{}) error {
+	if r.Body == nil {
+		return nil
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return badRequest("Request body must be a JSON object: %v", err)
+	}
+	return nil
+}
+
+// getInstance returns the state of an instance. HTML clients get the end page of
+// finished instances.
+func (s *Server) getInstance(w http.ResponseWriter, r *http.Request) {
+	instance, err := s.engine.GetInstance(mux.Vars(r)["instance_id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if !wantsHTML(r) {
+		writeJSON(w, http.StatusOK, newInstanceResponse(instance))
+		return
+	}
+
+	if endHTML := instance.CurrentNodeDef.EndHTML(); instance.CurrentNodeDef.Type == "end" && endHTML != "" {
+		s.renderEndPage(w, r, instance, endHTML)
+		return
+	}
+	var body strings.Builder
+	statusBody.Execute(&body, newInstanceResponse(instance))
+	writeHTML(w, http.StatusOK, "Instance "+instance.ID, template.HTML(body.String()))
+}
+
+// listInstances lists instances, most recent first. The workflow_id, status and
+// incident=true query parameters filter the list and limit caps its length.
+func (s *Server) listInstances(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := db.InstanceFilter{WorkflowID: query.Get("workflow_id"), Status: query.Get("status")}
+	if v := query.Get("incident"); v != "" {
+		incidents, err := strconv.ParseBool(v)
+		if err != nil {
+			s.writeError(w, r, badRequest("incident must be true or false"))
+			return
+		}
+		filter.IncidentsOnly = incidents
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			s.writeError(w, r, badRequest("limit must be a positive number"))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	instances, err := s.engine.Instances(filter)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	resp := make([]*InstanceResponse, 0, len(instances))
+	for _, instance := range instances {
+		resp = append(resp, newInstanceResponse(instance))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+var statusBody = template.Must(template.New("status").Parse(`<p>Workflow <code>{{.WorkflowID}}</code> is at node <code>{{.CurrentNode}}</code> ({{.CurrentNodeType}}).</p>
+{{if .WaitingSignal}}<p>Waiting for signal <code>{{.WaitingSignal}}</code>.</p>{{end}}
+{{with .Links.form}}<p><a href="{{.}}">Fill in the form</a></p>{{end}}`))
+
+// templateVariable matches the {{variable}} placeholders used in end pages, which
+// are not valid Go template actions on their own.
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+var templateKeywords = map[string]bool{
+	"end": true, "else": true, "break": true, "continue": true, "nil": true, "true": true, "false": true,
+}
+
+// renderEndPage executes the end node HTML as a template over the instance context.
+func (s *Server) renderEndPage(w http.ResponseWriter, r *http.Request, instance *workflow.WorkflowInstance, endHTML string) {
+	source := templateVariable.ReplaceAllStringFunc(endHTML, func(m string) string {
+		name := templateVariable.FindStringSubmatch(m)[1]
+		if templateKeywords[name] {
+			return m
+		}
+		return fmt.Sprintf(`{{index . %q}}`, name)
+	})
+	tmpl, err := template.New("end").Option("missingkey=zero").Parse(source)
+	if err != nil {
+		s.writeError(w, r, fmt.Errorf("invalid end page of node %s: %w", instance.CurrentNode, err))
+		return
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, instance.Context); err != nil {
+		s.writeError(w, r, fmt.Errorf("failed to render end page of node %s: %w", instance.CurrentNode, err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, body.String())
+}
+
+// getHistory returns the nodes an instance passed through, oldest first.
+func (s *Server) getHistory(w http.ResponseWriter, r *http.Request) {
+	history, err := s.engine.History(mux.Vars(r)["instance_id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	entries := make([]HistoryEntry, 0, len(history))
+	for _, rec := range history {
+		entries = append(entries, HistoryEntry{
+			ID:            rec.ID,
+			NodeID:        rec.NodeID,
+			Event:         rec.Event,
+			Detail:        rec.Detail,
+			Operator:      rec.Operator,
+			WaitingSignal: rec.WaitingSignal,
+			ExpiresAt:     rec.ExpiresAt,
+			CreatedAt:     rec.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// getLogs returns the console output of an instance's scripts, oldest first.
+func (s *Server) getLogs(w http.ResponseWriter, r *http.Request) {
+	logs, err := s.engine.ScriptLogs(mux.Vars(r)["instance_id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	entries := make([]LogEntry, 0, len(logs))
+	for _, rec := range logs {
+		entries = append(entries, LogEntry{
+			ID:             rec.ID,
+			NodeID:         rec.NodeID,
+			NodeInstanceID: rec.NodeInstanceID,
+			Level:          rec.Level,
+			Message:        rec.Message,
+			CreatedAt:      rec.CreatedAt,
+		})
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// pendingForm loads an instance and checks that it is waiting at a form node.
+func (s *Server) pendingForm(instanceID string) (*workflow.WorkflowInstance, error) {
+	instance, err := s.engine.GetInstance(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if instance.CurrentNodeDef.Type != "form" || instance.CurrentNodeDef.Fields == nil {
+		return nil, fmt.Errorf("%w: instance %s is at %s node '%s'",
+			workflow.ErrNoPendingForm, instanceID, instance.CurrentNodeDef.Type, instance.CurrentNode)
+	}
+	return instance, nil
+}
+
+// getForm renders the pending form as HTML, or describes its fields as JSON.
+func (s *Server) getForm(w http.ResponseWriter, r *http.Request) {
+	instance, err := s.pendingForm(mux.Vars(r)["instance_id"])
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	if wantsHTML(r) {
+		s.renderForm(w, r, instance, http.StatusOK, nil)
+		return
+	}
+	values := make(map[string]string)
+	for _, field := range instance.CurrentNodeDef.Fields {
+		if v, ok := instance.Context[field.Key()]; ok {
+			values[field.Key()] = fmt.Sprintf("%v", v)
+		}
+	}
+	writeJSON(w, http.StatusOK, FormResponse{
+		InstanceID: instance.ID,
+		Node:       instance.CurrentNode,
+		Fields:     instance.CurrentNodeDef.Fields,
+		Values:     values,
+		Action:     formURL(instance.ID),
+	})
+}
+
+func (s *Server) renderForm(w http.ResponseWriter, r *http.Request, instance *workflow.WorkflowInstance, status int, fieldErrors map[string]string) {
+	form, err := workflow.GenerateHTMLForm(instance.CurrentNodeDef.Fields, instance.Context, instance.ID, fieldErrors)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	title := instance.CurrentNodeDef.Name
+	if title == "" {
+		title = instance.CurrentNode
+	}
+	writeHTML(w, status, title, form)
+}
+
+// submitForm validates a form submission and advances the instance. It accepts
+// form-encoded bodies from browsers and JSON objects from API clients. A repeated
+// submission with the same Idempotency-Key is not applied again.
+func (s *Server) submitForm(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	input, err := readFormInput(r)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+
+	replayed, err := s.engine.SubmitFormOnce(r.Context(), idempotencyKey(r), instanceID, input)
+	if err != nil {
+		apiErr := toError(err)
+		if apiErr.Status == http.StatusUnprocessableEntity && wantsHTML(r) {
+			if instance, loadErr := s.pendingForm(instanceID); loadErr == nil {
+				s.renderForm(w, r, instance, http.StatusUnprocessableEntity, apiErr.Fields)
+				return
+			}
+		}
+		s.writeError(w, r, apiErr)
+		return
+	}
+	markReplayed(w, replayed)
+
+	if wantsHTML(r) {
+		http.Redirect(w, r, instanceURL(instanceID), http.StatusSeeOther)
+		return
+	}
+	instance, err := s.engine.GetInstance(instanceID)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newInstanceResponse(instance))
+}
+
+// readFormInput reads submitted field values from a JSON object or a form-encoded body.
+func readFormInput(r *http.Request) (map[string]string, error) {
+	input := make(map[string]string)
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return nil, badRequest("Request body must be a JSON object: %v", err)
+		}
+		for key, value := range body {
+			switch v := value.(type) {
+			case nil:
+			case string:
+				input[key] = v
+			case float64:
+				input[key] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				input[key] = fmt.Sprintf("%v", v)
+			}
+		}
+		return input, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, badRequest("Failed to parse form submission: %v", err)
+	}
+	for key, values := range r.PostForm {
+		if len(values) > 0 {
+			input[key] = values[0]
+		}
+	}
+	return input, nil
+}
+
+// SignalResponse acknowledges an emitted signal.
+type SignalResponse struct {
+	Signal  string `json:"signal"`
+	Message string `json:"message"`
+}
+
+// emitSignal resumes the instances waiting for a signal. Resumed instances continue
+// asynchronously, so the response is 202 Accepted. A repeated request with the same
+// Idempotency-Key is acknowledged without resuming anything again.
+func (s *Server) emitSignal(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["signal_name"]
+	replayed, err := s.engine.SignalOnce(r.Context(), idempotencyKey(r), name)
+	if err != nil {
+		s.writeError(w, r, err)
+		return
+	}
+	markReplayed(w, replayed)
+	writeJSON(w, http.StatusAccepted, SignalResponse{
+		Signal:  name,
+		Message: fmt.Sprintf("Signal '%s' emitted.", name),
+	})
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"jbpmn-engine/workflow"
+)
+
+// Error is an API error. It is written as the JSON envelope
+// {"error": {"code": ..., "message": ..., "fields": ...}} with the given status.
+type Error struct {
+	Status  int               `json:"-"`
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type errorEnvelope struct {
+	Error *Error `json:"error"`
+}
+
+// toError maps engine errors to API errors with the matching status code.
+func toError(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	var validationErr *workflow.FormValidationError
+	var inputErr *workflow.InputValidationError
+	var definitionErr *workflow.DefinitionError
+	switch {
+	case errors.As(err, &validationErr):
+		return &Error{Status: http.StatusUnprocessableEntity, Code: "validation_failed",
+			Message: "The submitted data is invalid.", Fields: validationErr.Fields}
+	case errors.As(err, &inputErr):
+		return &Error{Status: http.StatusUnprocessableEntity, Code: "invalid_input",
+			Message: "The start input does not match the workflow definition.", Fields: inputErr.Fields}
+	case errors.As(err, &definitionErr):
+		fields := make(map[string]string, len(definitionErr.Issues))
+		for _, issue := range definitionErr.Issues {
+			key := issue.Path
+			if key == "" {
+				key = issue.Location()
+			}
+			if fields[key] != "" {
+				fields[key] += "; "
+			}
+			fields[key] += issue.Message
+		}
+		return &Error{Status: http.StatusUnprocessableEntity, Code: "invalid_definition",
+			Message: "The workflow definition is invalid.", Fields: fields}
+	case errors.Is(err, workflow.ErrInstanceNotFound):
+		return &Error{Status: http.StatusNotFound, Code: "instance_not_found", Message: err.Error()}
+	case errors.Is(err, workflow.ErrDefinitionNotFound):
+		return &Error{Status: http.StatusNotFound, Code: "definition_not_found", Message: err.Error()}
+	case errors.Is(err, workflow.ErrNoPendingForm):
+		return &Error{Status: http.StatusConflict, Code: "no_pending_form", Message: err.Error()}
+	case errors.Is(err, workflow.ErrInstanceNotActive):
+		return &Error{Status: http.StatusConflict, Code: "instance_not_active", Message: err.Error()}
+	case errors.Is(err, workflow.ErrInstanceNotSuspended):
+		return &Error{Status: http.StatusConflict, Code: "instance_not_suspended", Message: err.Error()}
+	case errors.Is(err, workflow.ErrInstanceBusy):
+		return &Error{Status: http.StatusConflict, Code: "instance_busy", Message: err.Error()}
+	case errors.Is(err, workflow.ErrNoIncident):
+		return &Error{Status: http.StatusConflict, Code: "no_incident", Message: err.Error()}
+	case errors.Is(err, workflow.ErrIdempotencyKeyConflict):
+		return &Error{Status: http.StatusConflict, Code: "idempotency_key_conflict", Message: err.Error()}
+	case errors.Is(err, workflow.ErrShuttingDown):
+		return &Error{Status: http.StatusServiceUnavailable, Code: "shutting_down", Message: err.Error()}
+	default:
+		return &Error{Status: http.StatusInternalServerError, Code: "internal_error", Message: err.Error()}
+	}
+}
+
+// badRequest returns a 400 error for a malformed request.
+func badRequest(format string, args ...interface{}) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: "bad_request", Message: fmt.Sprintf(format, args...)}
+}
+
+// writeError writes err as a JSON envelope, or as a short HTML page for clients
+// that prefer HTML. Server errors are logged.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := toError(err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		s.logger.Error("Request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+	}
+
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(apiErr.Status)
+		errorPage.Execute(w, apiErr)
+		return
+	}
+	writeJSON(w, apiErr.Status, errorEnvelope{Error: apiErr})
+}
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html><html><head><title>Error</title></head><body>
+<h1>{{.Status}} {{.Code}}</h1>
+<p>{{.Message}}</p>
+{{if .Fields}}<ul>{{range $field, $msg := .Fields}}<li><code>{{$field}}</code>: {{$msg}}</li>{{end}}</ul>{{end}}
+</body></html>
+`))
+
+// writeJSON writes v as JSON with the given status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// wantsHTML reports whether the client prefers text/html over application/json
+// according to its Accept header. Clients without a preference get JSON.
+func wantsHTML(r *http.Request) bool {
+	htmlQ, jsonQ := -1.0, -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		case "application/json":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+	return htmlQ > 0 && htmlQ > jsonQ
+}
+
+// writeHTML writes a complete HTML page.
+func writeHTML(w http.ResponseWriter, status int, title string, body template.HTML) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	page.Execute(w, struct {
+		Title string
+		Body  template.HTML
+	}{title, body})
+}
+
+var page = template.Must(template.New("page").Parse(`<!DOCTYPE html><html><head><title>{{.Title}}</title></head><body>
+<h1>{{.Title}}</h1>
+{{.Body}}
+</body></html>
+`))
@@ -0,0 +1,135 @@
+// Package api exposes a workflow engine over HTTP.
+//
+// All endpoints live under /api/v1. Responses are JSON unless the client prefers
+// text/html, in which case forms, end pages and errors are rendered as HTML. Errors
+// use a single envelope:
+//
+//	{"error": {"code": "instance_not_found", "message": "...", "fields": {...}}}
+//
+// The unversioned routes of earlier releases (/start, /signal, /status, /form)
+// are kept as aliases of their /api/v1 equivalents.
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"jbpmn-engine/workflow"
+
+	"github.com/gorilla/mux"
+)
+
+// Prefix is the path prefix of the current API version.
+const Prefix = "/api/v1"
+
+// Server routes HTTP requests to a workflow engine.
+type Server struct {
+	engine *workflow.Engine
+	logger *slog.Logger
+	router *mux.Router
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithLogger sets the logger used for request errors. The default is slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// NewServer returns a Server for engine with all routes registered.
+func NewServer(engine *workflow.Engine, opts ...Option) *Server {
+	s := &Server{
+		engine: engine,
+		logger: slog.Default(),
+		router: mux.NewRouter(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.routes()
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Router returns the underlying router so embedders can mount additional routes.
+func (s *Server) Router() *mux.Router {
+	return s.router
+}
+
+func (s *Server) routes() {
+	// Routes are registered on the root router rather than a PathPrefix subrouter so
+	// that a method mismatch is reported as 405 instead of 404.
+	v1 := func(path string, handler http.HandlerFunc, methods ...string) {
+		s.router.HandleFunc(Prefix+path, handler).Methods(methods...)
+	}
+	v1("/definitions", s.listDefinitions, http.MethodGet)
+	v1("/definitions", s.deployDefinition, http.MethodPost)
+	v1("/definitions/{workflow_id}", s.getDefinition, http.MethodGet)
+	v1("/workflows/{workflow_id}/instances", s.startInstance, http.MethodPost)
+	v1("/instances", s.listInstances, http.MethodGet)
+	v1("/instances/{instance_id}", s.getInstance, http.MethodGet)
+	v1("/instances/{instance_id}/history", s.getHistory, http.MethodGet)
+	v1("/instances/{instance_id}/logs", s.getLogs, http.MethodGet)
+	v1("/instances/{instance_id}/form", s.getForm, http.MethodGet)
+	v1("/instances/{instance_id}/form", s.submitForm, http.MethodPost)
+	v1("/instances/{instance_id}/cancel", s.cancelInstance, http.MethodPost)
+	v1("/instances/{instance_id}/suspend", s.suspendInstance, http.MethodPost)
+	v1("/instances/{instance_id}/resume", s.resumeInstance, http.MethodPost)
+	v1("/instances/{instance_id}/move", s.moveInstance, http.MethodPost)
+	v1("/instances/{instance_id}/retry", s.retryInstance, http.MethodPost)
+	v1("/signals/{signal_name}", s.emitSignal, http.MethodPost)
+
+	// Unversioned routes kept for existing clients and bookmarked form links.
+	s.router.HandleFunc("/start/{workflow_id}", s.startInstance).Methods(http.MethodGet, http.MethodPost)
+	s.router.HandleFunc("/signal/{signal_name}", s.emitSignal).Methods(http.MethodGet, http.MethodPost)
+	s.router.HandleFunc("/status/{instance_id}", s.getInstance).Methods(http.MethodGet)
+	s.router.HandleFunc("/form/{instance_id}", s.getForm).Methods(http.MethodGet)
+	s.router.HandleFunc("/form/{instance_id}", s.submitForm).Methods(http.MethodPost)
+
+	s.router.HandleFunc("/", s.index).Methods(http.MethodGet)
+
+	s.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.writeError(w, r, &Error{Status: http.StatusNotFound, Code: "route_not_found",
+			Message: fmt.Sprintf("No route for %s %s.", r.Method, r.URL.Path)})
+	})
+	s.router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.writeError(w, r, &Error{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed",
+			Message: fmt.Sprintf("Method %s is not allowed for %s.", r.Method, r.URL.Path)})
+	})
+}
+
+// index lists the available routes.
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, `<!DOCTYPE html><html><head><title>JBPMN Workflow Engine</title></head><body>
+<h1>JBPMN Workflow Engine</h1>
+<p>Available routes:</p>
+<ul>
+<li><code>GET /api/v1/definitions</code> - Latest version of every deployed definition</li>
+<li><code>POST /api/v1/definitions</code> - Validate and deploy a definition (<code>?dryRun=true</code> only validates)</li>
+<li><code>GET /api/v1/definitions/{workflow_id}</code> - A definition and its versions</li>
+<li><code>POST /api/v1/workflows/{workflow_id}/instances</code> - Start a new workflow instance</li>
+<li><code>GET /api/v1/instances</code> - Instances, filtered by <code>workflow_id</code>, <code>status</code> or <code>incident=true</code></li>
+<li><code>GET /api/v1/instances/{instance_id}</code> - Current state and context of an instance</li>
+<li><code>GET /api/v1/instances/{instance_id}/history</code> - Nodes the instance has passed through</li>
+<li><code>GET /api/v1/instances/{instance_id}/logs</code> - Console output of the instance's scripts</li>
+<li><code>GET /api/v1/instances/{instance_id}/form</code> - The form the instance is waiting for</li>
+<li><code>POST /api/v1/instances/{instance_id}/form</code> - Submit form data</li>
+<li><code>POST /api/v1/instances/{instance_id}/cancel</code> - Cancel an instance and its children</li>
+<li><code>POST /api/v1/instances/{instance_id}/suspend</code> - Pause an instance</li>
+<li><code>POST /api/v1/instances/{instance_id}/resume</code> - Continue a suspended instance</li>
+<li><code>POST /api/v1/instances/{instance_id}/move</code> - Move an instance to any node of its workflow</li>
+<li><code>POST /api/v1/instances/{instance_id}/retry</code> - Execute the node an instance failed at again</li>
+<li><code>POST /api/v1/signals/{signal_name}</code> - Resume instances waiting for a signal</li>
+</ul>
+</body></html>
+`)
+}
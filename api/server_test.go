@@ -0,0 +1,561 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"jbpmn-engine/clock"
+	"jbpmn-engine/db"
+	"jbpmn-engine/workflow"
+)
+
+type testServer struct {
+	*httptest.Server
+	engine *workflow.Engine
+	clock  *clock.Fake
+}
+
+// newTestServer serves the bundled workflows from an in-memory store. Instances
+// run inline, so every request returns once they reach their next wait state.
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	return newTestServerFrom(t, "../workflows")
+}
+
+// newTestServerFrom is newTestServer with the definitions in dir and further engine
+// options.
+func newTestServerFrom(t *testing.T, dir string, opts ...workflow.Option) *testServer {
+	t.Helper()
+	store, err := db.OpenInMemory()
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	fake := clock.NewFake(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	store.SetClock(fake)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	engine, err := workflow.New(append([]workflow.Option{
+		workflow.WithStore(store),
+		workflow.WithDefinitionSource(workflow.NewDirSource(dir)),
+		workflow.WithClock(fake),
+		workflow.WithLogger(logger),
+		workflow.WithExecutor(&workflow.InlineExecutor{}),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("creating engine: %v", err)
+	}
+	if err := engine.LoadDefinitions(); err != nil {
+		t.Fatalf("loading definitions: %v", err)
+	}
+
+	srv := httptest.NewServer(NewServer(engine, WithLogger(logger)))
+	t.Cleanup(func() {
+		srv.Close()
+		engine.Close()
+		store.Close()
+	})
+	return &testServer{Server: srv, engine: engine, clock: fake}
+}
+
+func (s *testServer) do(t *testing.T, method, path, contentType, accept, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// doWithKey sends a JSON request with an Idempotency-Key header.
+func (s *testServer) doWithKey(t *testing.T, method, path, key, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, s.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func (s *testServer) start(t *testing.T, workflowID string) InstanceResponse {
+	t.Helper()
+	resp := s.do(t, http.MethodPost, "/api/v1/workflows/"+workflowID+"/instances", "", "", "")
+	expectStatus(t, resp, http.StatusCreated)
+	var inst InstanceResponse
+	decode(t, resp, &inst)
+	return inst
+}
+
+func expectStatus(t *testing.T, resp *http.Response, want int) {
+	t.Helper()
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s %s: status %d, want %d; body: %s", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, want, body)
+	}
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Fatalf("Content-Type = %q, want application/json", ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+}
+
+func decodeError(t *testing.T, resp *http.Response) *Error {
+	t.Helper()
+	var envelope struct {
+		Error *Error `json:"error"`
+	}
+	decode(t, resp, &envelope)
+	if envelope.Error == nil {
+		t.Fatal("response has no error envelope")
+	}
+	return envelope.Error
+}
+
+func TestStartInstance(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodPost, "/api/v1/workflows/my_first_workflow/instances", "", "", "")
+	expectStatus(t, resp, http.StatusCreated)
+
+	var inst InstanceResponse
+	decode(t, resp, &inst)
+	if inst.CurrentNode != "collect_info_form" || inst.CurrentNodeType != "form" {
+		t.Errorf("instance is at %s (%s), want the form", inst.CurrentNode, inst.CurrentNodeType)
+	}
+	if got, want := resp.Header.Get("Location"), "/api/v1/instances/"+inst.ID; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+	if inst.Links["form"] != "/api/v1/instances/"+inst.ID+"/form" {
+		t.Errorf("links = %v", inst.Links)
+	}
+}
+
+func TestStartWithVariablesAndBusinessKey(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodPost, "/api/v1/workflows/approval_process/instances", "application/json", "",
+		`{"variables": {"requester": "ada", "amount": 250}, "business_key": "PO-1001"}`)
+	expectStatus(t, resp, http.StatusCreated)
+
+	var inst InstanceResponse
+	decode(t, resp, &inst)
+	if inst.BusinessKey != "PO-1001" || inst.CurrentNode != "request_approval" {
+		t.Errorf("instance = %+v", inst)
+	}
+	if inst.Context["requester"] != "ada" || inst.Context["amount"] != float64(250) {
+		t.Errorf("context = %v", inst.Context)
+	}
+
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID, "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var reloaded InstanceResponse
+	decode(t, resp, &reloaded)
+	if reloaded.BusinessKey != "PO-1001" {
+		t.Errorf("business key was not stored: %+v", reloaded)
+	}
+}
+
+func TestStartWithInvalidInput(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodPost, "/api/v1/workflows/approval_process/instances", "application/json", "",
+		`{"variables": {"amount": "a lot"}, "start_node": "request_approval"}`)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	if err := decodeError(t, resp); err.Code != "invalid_input" || err.Fields["start_node"] == "" {
+		t.Errorf("error = %+v", err)
+	}
+
+	resp = s.do(t, http.MethodPost, "/api/v1/workflows/approval_process/instances", "application/json", "",
+		`{"variables": {"amount": "a lot"}}`)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	if err := decodeError(t, resp); err.Fields["amount"] != "must be of type number" {
+		t.Errorf("error = %+v", err)
+	}
+
+	resp = s.do(t, http.MethodPost, "/api/v1/workflows/approval_process/instances", "application/json", "", `[1, 2]`)
+	expectStatus(t, resp, http.StatusBadRequest)
+}
+
+func TestIdempotentStart(t *testing.T) {
+	s := newTestServer(t)
+	path := "/api/v1/workflows/approval_process/instances"
+
+	resp := s.doWithKey(t, http.MethodPost, path, "req-1", `{"business_key": "PO-1"}`)
+	expectStatus(t, resp, http.StatusCreated)
+	var first InstanceResponse
+	decode(t, resp, &first)
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("first request marked as replayed")
+	}
+
+	resp = s.doWithKey(t, http.MethodPost, path, "req-1", `{"business_key": "PO-1"}`)
+	expectStatus(t, resp, http.StatusCreated)
+	var second InstanceResponse
+	decode(t, resp, &second)
+	if second.ID != first.ID || resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Errorf("retry created %s (replayed=%q), want %s", second.ID, resp.Header.Get("Idempotent-Replayed"), first.ID)
+	}
+
+	// Reusing the key for another request is a conflict, not a replay.
+	resp = s.doWithKey(t, http.MethodPost, path, "req-1", `{"business_key": "PO-2"}`)
+	expectStatus(t, resp, http.StatusConflict)
+	if err := decodeError(t, resp); err.Code != "idempotency_key_conflict" {
+		t.Errorf("code = %q", err.Code)
+	}
+
+	resp = s.doWithKey(t, http.MethodPost, path, "req-2", `{}`)
+	expectStatus(t, resp, http.StatusCreated)
+	var other InstanceResponse
+	decode(t, resp, &other)
+	if other.ID == first.ID {
+		t.Error("a different key returned the same instance")
+	}
+
+	// After the retention window the key is forgotten.
+	s.clock.Advance(25 * time.Hour)
+	resp = s.doWithKey(t, http.MethodPost, path, "req-1", `{}`)
+	expectStatus(t, resp, http.StatusCreated)
+	var later InstanceResponse
+	decode(t, resp, &later)
+	if later.ID == first.ID {
+		t.Error("key was still honoured after the retention window")
+	}
+}
+
+func TestIdempotentStartFailureReleasesKey(t *testing.T) {
+	s := newTestServer(t)
+	path := "/api/v1/workflows/approval_process/instances"
+	expectStatus(t, s.doWithKey(t, http.MethodPost, path, "k", `{"variables": {"amount": "x"}}`), http.StatusUnprocessableEntity)
+	expectStatus(t, s.doWithKey(t, http.MethodPost, path, "k", `{"variables": {"amount": 5}}`), http.StatusCreated)
+}
+
+// slowStartStore holds SaveNewInstance until release is closed, so requests can
+// arrive between claiming an idempotency key and creating the instance.
+type slowStartStore struct {
+	*db.SQLiteStore
+	saving  chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStartStore) SaveNewInstance(instanceID, workflowID string, workflowVersion int, businessKey, initialNodeID, context, waitingSignal string, expiresAt *time.Time) (string, string, error) {
+	close(s.saving)
+	<-s.release
+	return s.SQLiteStore.SaveNewInstance(instanceID, workflowID, workflowVersion, businessKey, initialNodeID, context, waitingSignal, expiresAt)
+}
+
+func TestIdempotentStartRetriedWhileStarting(t *testing.T) {
+	store, err := db.OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	slow := &slowStartStore{SQLiteStore: store, saving: make(chan struct{}), release: make(chan struct{})}
+	s := newTestServerFrom(t, "../workflows", workflow.WithStore(slow))
+	path := "/api/v1/workflows/approval_process/instances"
+
+	responses := make(chan *http.Response, 2)
+	go func() { responses <- s.doWithKey(t, http.MethodPost, path, "req-1", `{}`) }()
+	<-slow.saving
+	go func() { responses <- s.doWithKey(t, http.MethodPost, path, "req-1", `{}`) }()
+	time.Sleep(50 * time.Millisecond) // let the retry find the key held
+	close(slow.release)
+
+	var ids []string
+	replayed := 0
+	for range 2 {
+		resp := <-responses
+		expectStatus(t, resp, http.StatusCreated)
+		var inst InstanceResponse
+		decode(t, resp, &inst)
+		ids = append(ids, inst.ID)
+		if resp.Header.Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if ids[0] != ids[1] || replayed != 1 {
+		t.Errorf("instances = %v with %d replayed, want the same instance once replayed", ids, replayed)
+	}
+}
+
+func TestIdempotentFormSubmission(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	path := "/api/v1/instances/" + inst.ID + "/form"
+
+	// A rejected submission does not consume the key.
+	expectStatus(t, s.doWithKey(t, http.MethodPost, path, "submit-1", `{"user_age": 20}`), http.StatusUnprocessableEntity)
+
+	resp := s.doWithKey(t, http.MethodPost, path, "submit-1", `{"user_name": "Ada", "user_age": 40}`)
+	expectStatus(t, resp, http.StatusOK)
+
+	// The retry succeeds instead of failing with 409 now that the form is done.
+	resp = s.doWithKey(t, http.MethodPost, path, "submit-1", `{"user_name": "Ada", "user_age": 40}`)
+	expectStatus(t, resp, http.StatusOK)
+	if resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("retry not marked as replayed")
+	}
+	var done InstanceResponse
+	decode(t, resp, &done)
+	if done.CurrentNode != "adult_path_end" {
+		t.Errorf("instance is at %s", done.CurrentNode)
+	}
+
+	expectStatus(t, s.doWithKey(t, http.MethodPost, path, "submit-2", `{"user_name": "Ada", "user_age": 40}`), http.StatusConflict)
+
+	resp = s.doWithKey(t, http.MethodPost, path, "submit-1", `{"user_name": "Ada", "user_age": 41}`)
+	expectStatus(t, resp, http.StatusConflict)
+	if err := decodeError(t, resp); err.Code != "idempotency_key_conflict" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestIdempotentSignal(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.doWithKey(t, http.MethodPost, "/api/v1/signals/approved", "sig-1", "")
+	expectStatus(t, resp, http.StatusAccepted)
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Error("first signal marked as replayed")
+	}
+	resp = s.doWithKey(t, http.MethodPost, "/api/v1/signals/approved", "sig-1", "")
+	expectStatus(t, resp, http.StatusAccepted)
+	if resp.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("repeated signal not marked as replayed")
+	}
+}
+
+func TestStartUnknownWorkflow(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodPost, "/api/v1/workflows/nope/instances", "", "", "")
+	expectStatus(t, resp, http.StatusNotFound)
+	if err := decodeError(t, resp); err.Code != "definition_not_found" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestGetUnknownInstance(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodGet, "/api/v1/instances/missing", "", "", "")
+	expectStatus(t, resp, http.StatusNotFound)
+	if err := decodeError(t, resp); err.Code != "instance_not_found" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestSubmitFormJSON(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+
+	resp := s.do(t, http.MethodPost, "/api/v1/instances/"+inst.ID+"/form", "application/json", "",
+		`{"user_name": "Ada", "user_age": 36}`)
+	expectStatus(t, resp, http.StatusOK)
+
+	var done InstanceResponse
+	decode(t, resp, &done)
+	if !done.Ended || done.CurrentNode != "adult_path_end" {
+		t.Errorf("instance is at %s (ended=%v), want adult_path_end", done.CurrentNode, done.Ended)
+	}
+	if done.Context["user_age"] != float64(36) {
+		t.Errorf("user_age = %#v", done.Context["user_age"])
+	}
+}
+
+func TestSubmitFormValidationFailed(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+
+	resp := s.do(t, http.MethodPost, "/api/v1/instances/"+inst.ID+"/form", "application/json", "",
+		`{"user_age": "old"}`)
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	err := decodeError(t, resp)
+	if err.Code != "validation_failed" || err.Fields["user_name"] == "" || err.Fields["user_age"] == "" {
+		t.Errorf("error = %+v", err)
+	}
+}
+
+func TestSubmitFormWhenNotWaiting(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	form := url.Values{"user_name": {"Ada"}, "user_age": {"40"}}.Encode()
+	expectStatus(t, s.do(t, http.MethodPost, "/api/v1/instances/"+inst.ID+"/form", "application/x-www-form-urlencoded", "", form), http.StatusOK)
+
+	resp := s.do(t, http.MethodPost, "/api/v1/instances/"+inst.ID+"/form", "application/x-www-form-urlencoded", "", form)
+	expectStatus(t, resp, http.StatusConflict)
+	if err := decodeError(t, resp); err.Code != "no_pending_form" {
+		t.Errorf("code = %q", err.Code)
+	}
+
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID+"/form", "", "", "")
+	expectStatus(t, resp, http.StatusConflict)
+}
+
+func TestSubmitMalformedJSON(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	resp := s.do(t, http.MethodPost, "/api/v1/instances/"+inst.ID+"/form", "application/json", "", `{"user_name":`)
+	expectStatus(t, resp, http.StatusBadRequest)
+	if err := decodeError(t, resp); err.Code != "bad_request" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestFormContentNegotiation(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	path := "/api/v1/instances/" + inst.ID + "/form"
+
+	resp := s.do(t, http.MethodGet, path, "", "text/html,application/xhtml+xml,*/*;q=0.8", "")
+	expectStatus(t, resp, http.StatusOK)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") ||
+		!strings.Contains(string(body), `action="`+path+`"`) {
+		t.Errorf("expected an HTML form posting to %s, got %s", path, body)
+	}
+
+	resp = s.do(t, http.MethodGet, path, "", "application/json", "")
+	expectStatus(t, resp, http.StatusOK)
+	var form FormResponse
+	decode(t, resp, &form)
+	if form.Node != "collect_info_form" || len(form.Fields) != 3 || form.Action != path {
+		t.Errorf("form = %+v", form)
+	}
+}
+
+func TestHTMLFormSubmission(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "my_first_workflow")
+	path := "/api/v1/instances/" + inst.ID + "/form"
+	accept := "text/html"
+
+	resp := s.do(t, http.MethodPost, path, "application/x-www-form-urlencoded", accept, url.Values{"user_age": {"old"}}.Encode())
+	expectStatus(t, resp, http.StatusUnprocessableEntity)
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "<form") {
+		t.Errorf("expected the form to be re-rendered, got %s", body)
+	}
+
+	resp = s.do(t, http.MethodPost, path, "application/x-www-form-urlencoded", accept,
+		url.Values{"user_name": {"Tim"}, "user_age": {"17"}}.Encode())
+	expectStatus(t, resp, http.StatusSeeOther)
+	if got := resp.Header.Get("Location"); got != "/api/v1/instances/"+inst.ID {
+		t.Fatalf("Location = %q", got)
+	}
+
+	resp = s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID, "", accept, "")
+	expectStatus(t, resp, http.StatusOK)
+	body, _ = io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "Sorry, you are under age.") || !strings.Contains(string(body), "Tim, 17") {
+		t.Errorf("end page = %s", body)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	s := newTestServer(t)
+	inst := s.start(t, "approval_process")
+	s.clock.Advance(time.Minute)
+
+	resp := s.do(t, http.MethodGet, "/api/v1/instances/"+inst.ID+"/history", "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+	var history []HistoryEntry
+	decode(t, resp, &history)
+	var nodes []string
+	for _, h := range history {
+		nodes = append(nodes, h.NodeID)
+	}
+	if got, want := strings.Join(nodes, ","), "start_node,request_approval,timeout_handler,end_node"; got != want {
+		t.Errorf("history = %s, want %s", got, want)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodPost, "/api/v1/signals/approved", "", "", "")
+	expectStatus(t, resp, http.StatusAccepted)
+	var ack SignalResponse
+	decode(t, resp, &ack)
+	if ack.Signal != "approved" {
+		t.Errorf("signal = %q", ack.Signal)
+	}
+}
+
+func TestShuttingDown(t *testing.T) {
+	s := newTestServer(t)
+	s.engine.Close()
+	resp := s.do(t, http.MethodPost, "/api/v1/workflows/my_first_workflow/instances", "", "", "")
+	expectStatus(t, resp, http.StatusServiceUnavailable)
+	if err := decodeError(t, resp); err.Code != "shutting_down" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestUnknownRouteAndMethod(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodGet, "/api/v1/nothing", "", "", "")
+	expectStatus(t, resp, http.StatusNotFound)
+	if err := decodeError(t, resp); err.Code != "route_not_found" {
+		t.Errorf("code = %q", err.Code)
+	}
+
+	resp = s.do(t, http.MethodDelete, "/api/v1/instances/x", "", "", "")
+	expectStatus(t, resp, http.StatusMethodNotAllowed)
+	if err := decodeError(t, resp); err.Code != "method_not_allowed" {
+		t.Errorf("code = %q", err.Code)
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	s := newTestServer(t)
+	resp := s.do(t, http.MethodGet, "/start/my_first_workflow", "", "", "")
+	expectStatus(t, resp, http.StatusCreated)
+	var inst InstanceResponse
+	decode(t, resp, &inst)
+
+	resp = s.do(t, http.MethodGet, "/status/"+inst.ID, "", "", "")
+	expectStatus(t, resp, http.StatusOK)
+}
+
+func TestWantsHTML(t *testing.T) {
+	cases := map[string]bool{
+		"":                 false,
+		"*/*":              false,
+		"application/json": false,
+		"text/html":        true,
+		"text/html,application/xhtml+xml,*/*;q=0.8": true,
+		"application/json, text/html;q=0.9":         false,
+		"text/html;q=0.5, application/json;q=0.4":   true,
+		"text/html;q=0": false,
+	}
+	for accept, want := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", accept)
+		if got := wantsHTML(req); got != want {
+			t.Errorf("wantsHTML(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a manually driven clock for tests. Time only moves when Advance or Set
+// is called, and timers whose deadline is reached fire synchronously on the
+// goroutine that moved the clock, in deadline order.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	seq    int
+}
+
+type fakeTimer struct {
+	clock *Fake
+	at    time.Time
+	seq   int
+	f     func()
+}
+
+// NewFake returns a Fake clock set to start.
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// Now returns the fake current time.
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc schedules f to run once the clock has been advanced by d. Timers are
+// never fired from within AfterFunc itself; a timer with d <= 0 fires on the next
+// call to Advance, including Advance(0).
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	t := &fakeTimer{clock: c, at: c.now.Add(d), seq: c.seq, f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that becomes due.
+// Timers scheduled by fired callbacks also fire if they fall within the window.
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	for {
+		next := c.nextDue(target)
+		if next == nil {
+			break
+		}
+		if next.at.After(c.now) {
+			c.now = next.at
+		}
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	if target.After(c.now) {
+		c.now = target
+	}
+	c.mu.Unlock()
+}
+
+// Set moves the clock to t, firing every timer due by then. Moving backwards
+// only fires timers that are already overdue.
+func (c *Fake) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// Pending returns the number of timers that have not fired or been stopped.
+func (c *Fake) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// nextDue removes and returns the earliest timer due at or before target.
+// c.mu must be held.
+func (c *Fake) nextDue(target time.Time) *fakeTimer {
+	if len(c.timers) == 0 {
+		return nil
+	}
+	sort.Slice(c.timers, func(i, j int) bool {
+		if c.timers[i].at.Equal(c.timers[j].at) {
+			return c.timers[i].seq < c.timers[j].seq
+		}
+		return c.timers[i].at.Before(c.timers[j].at)
+	})
+	if c.timers[0].at.After(target) {
+		return nil
+	}
+	next := c.timers[0]
+	c.timers = c.timers[1:]
+	return next
+}
+
+// Stop removes the timer if it has not fired yet.
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, pending := range c.timers {
+		if pending == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package clock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeFiresTimersInDeadlineOrder(t *testing.T) {
+	c := NewFake(start)
+	var fired []string
+	at := make(map[string]time.Time)
+	timer := func(name string, d time.Duration) {
+		c.AfterFunc(d, func() {
+			fired = append(fired, name)
+			at[name] = c.Now()
+		})
+	}
+	timer("c", 3*time.Minute)
+	timer("a", time.Minute)
+	timer("b1", 2*time.Minute)
+	timer("b2", 2*time.Minute) // same deadline: fires after b1, which was scheduled first
+	c.AfterFunc(90*time.Second, func() {
+		fired = append(fired, "nested")
+		// Falls within the window being advanced, so it fires before c.
+		timer("from-callback", time.Minute)
+	})
+	timer("later", 10*time.Minute)
+
+	c.Advance(5 * time.Minute)
+	want := []string{"a", "nested", "b1", "b2", "from-callback", "c"}
+	if !reflect.DeepEqual(fired, want) {
+		t.Errorf("fired %v, want %v", fired, want)
+	}
+	// Each callback sees the clock at its own deadline.
+	if !at["a"].Equal(start.Add(time.Minute)) || !at["from-callback"].Equal(start.Add(150*time.Second)) {
+		t.Errorf("callbacks ran at %v", at)
+	}
+	if !c.Now().Equal(start.Add(5*time.Minute)) || c.Pending() != 1 {
+		t.Errorf("now %v with %d timers pending, want %v with 1", c.Now(), c.Pending(), start.Add(5*time.Minute))
+	}
+
+	c.Set(start.Add(10 * time.Minute))
+	if fired[len(fired)-1] != "later" || c.Pending() != 0 {
+		t.Errorf("fired %v with %d pending after Set", fired, c.Pending())
+	}
+}
+
+func TestFakeTimerWithoutDelayFiresOnNextAdvance(t *testing.T) {
+	c := NewFake(start)
+	fired := false
+	c.AfterFunc(0, func() { fired = true })
+	if fired {
+		t.Fatal("AfterFunc fired the timer itself")
+	}
+	c.Advance(0)
+	if !fired || !c.Now().Equal(start) {
+		t.Errorf("fired %v at %v, want true at %v", fired, c.Now(), start)
+	}
+}
+
+func TestFakeStop(t *testing.T) {
+	c := NewFake(start)
+	stopped := c.AfterFunc(time.Minute, func() { t.Error("stopped timer fired") })
+	kept := false
+	other := c.AfterFunc(time.Minute, func() { kept = true })
+
+	if !stopped.Stop() {
+		t.Error("Stop of a pending timer returned false")
+	}
+	if stopped.Stop() {
+		t.Error("second Stop returned true")
+	}
+	if c.Pending() != 1 {
+		t.Errorf("%d timers pending, want 1", c.Pending())
+	}
+	c.Advance(time.Minute)
+	if !kept {
+		t.Error("the timer that was not stopped did not fire")
+	}
+	if other.Stop() {
+		t.Error("Stop of a fired timer returned true")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"jbpmn-engine/api"
+	"jbpmn-engine/db"
+	"jbpmn-engine/workflow"
+)
+
+// client talks to the /api/v1 routes of an engine, either over the network or
+// in-process against a local database.
+type client struct {
+	base  string
+	http  *http.Client
+	close func() error
+}
+
+// newHTTPClient returns a client for the server at baseURL, e.g. http://localhost:8080.
+func newHTTPClient(baseURL string, timeout time.Duration) *client {
+	return &client{
+		base:  strings.TrimRight(baseURL, "/") + api.Prefix,
+		http:  &http.Client{Timeout: timeout},
+		close: func() error { return nil },
+	}
+}
+
+// newLocalClient opens the SQLite database at path and serves the API in-process on
+// top of it. Only requests that do not change the database are allowed, so a server
+// may keep running on the same file.
+func newLocalClient(path string) (*client, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	store, err := db.Open("file:" + path + "?mode=rw&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	engine, err := workflow.New(workflow.WithStore(store), workflow.WithLogger(logger))
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return &client{
+		base:  "http://local" + api.Prefix,
+		http:  &http.Client{Transport: localTransport{api.NewServer(engine, api.WithLogger(logger))}},
+		close: store.Close,
+	}, nil
+}
+
+// localTransport serves requests with an in-process handler.
+type localTransport struct {
+	handler http.Handler
+}
+
+func (t localTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.URL.Query().Get("dryRun") != "true" {
+		return nil, fmt.Errorf("%s %s changes the engine state and needs a running server; use -server instead of -db", req.Method, req.URL.Path)
+	}
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+	return rec.Result(), nil
+}
+
+// apiError is an error envelope returned by the server.
+type apiError struct {
+	Status   int
+	envelope *api.Error
+}
+
+func (e *apiError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%d %s)", e.envelope.Message, e.Status, e.envelope.Code)
+	keys := make([]string, 0, len(e.envelope.Fields))
+	for key := range e.envelope.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, "\n  %s: %s", key, e.envelope.Fields[key])
+	}
+	return b.String()
+}
+
+// request is one API call. Body is sent as is if it is a []byte and as JSON otherwise.
+type request struct {
+	method         string
+	path           string
+	query          url.Values
+	body           interface{}
+	idempotencyKey string
+}
+
+// do performs req and decodes the JSON response into out. It returns the status
+// code so callers can tell, e.g., a new deployment from an unchanged one.
+func (c *client) do(req request, out interface{}) (int, error) {
+	target := c.base + req.path
+	if len(req.query) > 0 {
+		target += "?" + req.query.Encode()
+	}
+
+	var body io.Reader
+	if req.body != nil {
+		data, ok := req.body.([]byte)
+		if !ok {
+			var err error
+			if data, err = json.Marshal(req.body); err != nil {
+				return 0, err
+			}
+		}
+		body = bytes.NewReader(data)
+	}
+
+	httpReq, err := http.NewRequest(req.method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	httpReq.Header.Set("Accept", "application/json")
+	if body != nil {
+		httpReq.Header.Set("Content-Type", "application/json")
+	}
+	if req.idempotencyKey != "" {
+		httpReq.Header.Set("Idempotency-Key", req.idempotencyKey)
+	}
+
+	resp, err := c.http.Do(httpReq)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var envelope struct {
+			Error *api.Error `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || envelope.Error == nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %s", req.method, target, resp.Status)
+		}
+		return resp.StatusCode, &apiError{Status: resp.StatusCode, envelope: envelope.Error}
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, fmt.Errorf("error decoding response of %s %s: %w", req.method, target, err)
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"jbpmn-engine/api"
+	"jbpmn-engine/workflow"
+)
+
+// runValidate checks definitions with the validator the engine uses when deploying.
+// It runs locally, so it needs neither a server nor a database, e.g. in CI.
+func runValidate(e *env, args []string) error {
+	files, err := parseArgs(flag.NewFlagSet("validate", flag.ContinueOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	invalid := 0
+	for _, file := range files {
+		data, err := e.readInput(file)
+		if err != nil {
+			return err
+		}
+		result := api.ValidationResponse{Valid: true, Issues: []workflow.ValidationIssue{}}
+		wf, err := workflow.ParseDefinition(data)
+		var defErr *workflow.DefinitionError
+		switch {
+		case errors.As(err, &defErr):
+			result.Valid = false
+			result.Issues = defErr.Issues
+			invalid++
+		case err != nil:
+			return fmt.Errorf("%s: %w", file, err)
+		default:
+			result.WorkflowID = wf.ID
+			result.Warnings = workflow.Warnings(wf, data)
+		}
+
+		switch {
+		case e.json:
+			if err := e.printJSON(result); err != nil {
+				return err
+			}
+		case result.Valid:
+			for _, warning := range result.Warnings {
+				warning.Message = "warning: " + warning.Message
+				fmt.Fprintf(e.stdout, "%s:%s\n", file, formatIssue(warning))
+			}
+			fmt.Fprintf(e.stdout, "%s: ok (%s)\n", file, result.WorkflowID)
+		default:
+			for _, issue := range result.Issues {
+				fmt.Fprintf(e.stdout, "%s:%s\n", file, formatIssue(issue))
+			}
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d definitions are invalid", invalid, len(files))
+	}
+	return nil
+}
+
+// formatIssue renders an issue like a compiler message: "3:13: path: message".
+func formatIssue(issue workflow.ValidationIssue) string {
+	var b strings.Builder
+	if issue.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", issue.Line, issue.Column)
+	}
+	b.WriteString(" ")
+	if issue.Path != "" {
+		b.WriteString(issue.Path + ": ")
+	}
+	b.WriteString(issue.Message)
+	return b.String()
+}
+
+func runDeploy(e *env, args []string) error {
+	files, err := parseArgs(flag.NewFlagSet("deploy", flag.ContinueOnError), args, 1, -1)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := e.readInput(file)
+		if err != nil {
+			return err
+		}
+		var def api.DefinitionResponse
+		status, err := e.client.do(request{method: http.MethodPost, path: "/definitions", body: data}, &def)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		if e.json {
+			if err := e.printJSON(def); err != nil {
+				return err
+			}
+			continue
+		}
+		state := "unchanged"
+		if status == http.StatusCreated {
+			state = "deployed"
+		}
+		fmt.Fprintf(e.stdout, "%s: %s %s version %d\n", file, state, def.ID, def.Version)
+	}
+	return nil
+}
+
+func runStart(e *env, args []string) error {
+	fs := flag.NewFlagSet("start", flag.ContinueOnError)
+	var vars stringList
+	fs.Var(&vars, "var", "variable as `name=value`; values are parsed as JSON if they can be (repeatable)")
+	varsFile := fs.String("vars", "", "JSON `file` with an object of variables (- for stdin)")
+	businessKey := fs.String("business-key", "", "business key of the instance")
+	startNode := fs.String("start-node", "", "start node to begin at")
+	parent := fs.String("parent", "", "ID of the parent instance")
+	key := fs.String("idempotency-key", "", "Idempotency-Key of the request")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	req := api.StartRequest{BusinessKey: *businessKey, StartNode: *startNode, ParentID: *parent}
+	if *varsFile != "" {
+		data, err := e.readInput(*varsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &req.Variables); err != nil {
+			return fmt.Errorf("%s must contain a JSON object: %w", *varsFile, err)
+		}
+	}
+	for _, v := range vars {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return usageError(fmt.Sprintf("-var %q is not of the form name=value", v))
+		}
+		if req.Variables == nil {
+			req.Variables = make(map[string]interface{})
+		}
+		req.Variables[name] = parseValue(value)
+	}
+
+	var instance api.InstanceResponse
+	if _, err := e.client.do(request{method: http.MethodPost, path: "/workflows/" + url.PathEscape(positional[0]) + "/instances", body: req, idempotencyKey: *key}, &instance); err != nil {
+		return err
+	}
+	return e.printInstance(&instance)
+}
+
+// parseValue interprets a -var value as JSON, e.g. a number or boolean, falling back
+// to the plain string.
+func parseValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err == nil {
+		return v
+	}
+	return s
+}
+
+func runSignal(e *env, args []string) error {
+	fs := flag.NewFlagSet("signal", flag.ContinueOnError)
+	key := fs.String("idempotency-key", "", "Idempotency-Key of the request")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	var resp api.SignalResponse
+	if _, err := e.client.do(request{method: http.MethodPost, path: "/signals/" + url.PathEscape(positional[0]), idempotencyKey: *key}, &resp); err != nil {
+		return err
+	}
+	if e.json {
+		return e.printJSON(resp)
+	}
+	fmt.Fprintln(e.stdout, resp.Message)
+	return nil
+}
+
+func runSubmit(e *env, args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ContinueOnError)
+	key := fs.String("idempotency-key", "", "Idempotency-Key of the request")
+	positional, err := parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	data, err := e.readInput(positional[1])
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%s must contain a JSON object: %w", positional[1], err)
+	}
+
+	var instance api.InstanceResponse
+	if _, err := e.client.do(request{method: http.MethodPost, path: "/instances/" + url.PathEscape(positional[0]) + "/form", body: fields, idempotencyKey: *key}, &instance); err != nil {
+		return err
+	}
+	return e.printInstance(&instance)
+}
+
+func runList(e *env, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	workflowID := fs.String("workflow", "", "only instances of this workflow `ID`")
+	status := fs.String("status", "", "only instances with this `status` (active, suspended or cancelled)")
+	incidents := fs.Bool("incidents", false, "only instances whose last node execution failed")
+	limit := fs.Int("limit", 50, "maximum number of instances; 0 for all")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *workflowID != "" {
+		query.Set("workflow_id", *workflowID)
+	}
+	if *status != "" {
+		query.Set("status", *status)
+	}
+	if *incidents {
+		query.Set("incident", "true")
+	}
+	if *limit > 0 {
+		query.Set("limit", strconv.Itoa(*limit))
+	}
+	var instances []api.InstanceResponse
+	if _, err := e.client.do(request{method: http.MethodGet, path: "/instances", query: query}, &instances); err != nil {
+		return err
+	}
+	if e.json {
+		return e.printJSON(instances)
+	}
+
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tWORKFLOW\tSTATUS\tNODE\tUPDATED\tINCIDENT")
+	for _, instance := range instances {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", instance.ID, instance.WorkflowID, displayStatus(&instance),
+			instance.CurrentNode, instance.UpdatedAt.Local().Format(time.DateTime), firstLine(instance.Incident))
+	}
+	return tw.Flush()
+}
+
+func runInspect(e *env, args []string) error {
+	positional, err := parseArgs(flag.NewFlagSet("inspect", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	var instance api.InstanceResponse
+	if _, err := e.client.do(request{method: http.MethodGet, path: "/instances/" + url.PathEscape(positional[0])}, &instance); err != nil {
+		return err
+	}
+	return e.printJSON(instance)
+}
+
+func runHistory(e *env, args []string) error {
+	positional, err := parseArgs(flag.NewFlagSet("history", flag.ContinueOnError), args, 1, 1)
+	if err != nil {
+		return err
+	}
+	var entries []api.HistoryEntry
+	if _, err := e.client.do(request{method: http.MethodGet, path: "/instances/" + url.PathEscape(positional[0]) + "/history"}, &entries); err != nil {
+		return err
+	}
+	if e.json {
+		return e.printJSON(entries)
+	}
+
+	tw := tabwriter.NewWriter(e.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tNODE\tEVENT\tOPERATOR\tDETAIL")
+	for _, entry := range entries {
+		event := entry.Event
+		if event == "" {
+			event = "entered"
+			if entry.WaitingSignal != "" {
+				event += ", waiting for " + entry.WaitingSignal
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", entry.CreatedAt.Local().Format(time.DateTime), entry.NodeID, event, entry.Operator, firstLine(entry.Detail))
+	}
+	return tw.Flush()
+}
+
+func runRetry(e *env, args []string) error {
+	fs := flag.NewFlagSet("retry", flag.ContinueOnError)
+	operator := fs.String("operator", envOr("USER", ""), "who is retrying, recorded in the history")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	var instance api.InstanceResponse
+	_, err = e.client.do(request{method: http.MethodPost, path: "/instances/" + url.PathEscape(positional[0]) + "/retry", body: api.RetryRequest{Operator: *operator}}, &instance)
+	if err != nil {
+		return err
+	}
+	if err := e.printInstance(&instance); err != nil {
+		return err
+	}
+	if instance.Incident != "" {
+		return errors.New("the node failed again")
+	}
+	return nil
+}
+
+// printInstance summarizes an instance after a command changed it.
+func (e *env) printInstance(instance *api.InstanceResponse) error {
+	if e.json {
+		return e.printJSON(instance)
+	}
+	fmt.Fprintf(e.stdout, "%s: %s at %s (%s)\n", instance.ID, displayStatus(instance), instance.CurrentNode, instance.CurrentNodeType)
+	if instance.WaitingSignal != "" {
+		fmt.Fprintf(e.stdout, "waiting for signal %s\n", instance.WaitingSignal)
+	}
+	if instance.Incident != "" {
+		fmt.Fprintf(e.stdout, "incident: %s\n", instance.Incident)
+	}
+	return nil
+}
+
+// displayStatus is the status of an instance, or "ended" once it reached an end node.
+func displayStatus(instance *api.InstanceResponse) string {
+	if instance.Ended && instance.Status == "active" {
+		return "ended"
+	}
+	return instance.Status
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,184 @@
+// Command jbpmnctl operates a jBPMN workflow engine from the command line.
+//
+// It talks to a running server over HTTP, or, with -db, reads a local SQLite
+// database directly for offline inspection. Definitions are validated locally:
+//
+//	jbpmnctl validate workflows/*.json
+//	jbpmnctl deploy workflows/approval_process.json
+//	jbpmnctl start approval_process -var requester=alice -var amount=250
+//	jbpmnctl signal payment_received
+//	jbpmnctl submit 3f2c... form.json
+//	jbpmnctl list -workflow approval_process -status active
+//	jbpmnctl inspect 3f2c...
+//	jbpmnctl history 3f2c...
+//	jbpmnctl list -incidents
+//	jbpmnctl retry -operator alice 3f2c...
+//	jbpmnctl -db ./jbpmn.db list
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// command is a subcommand of jbpmnctl.
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(env *env, args []string) error
+}
+
+var commands = []command{
+	{"validate", "FILE...", "Check definition files without deploying them", runValidate},
+	{"deploy", "FILE...", "Deploy definition files as new versions", runDeploy},
+	{"start", "[-var name=value]... [-vars FILE] WORKFLOW", "Start an instance of a workflow", runStart},
+	{"signal", "NAME", "Resume the instances waiting for a signal", runSignal},
+	{"submit", "INSTANCE FILE", "Submit the form an instance waits for with data from a JSON file (- for stdin)", runSubmit},
+	{"list", "[-workflow ID] [-status STATUS] [-incidents] [-limit N]", "List instances, most recent first", runList},
+	{"inspect", "INSTANCE", "Show the state and context of an instance", runInspect},
+	{"history", "INSTANCE", "Show the nodes and events an instance went through", runHistory},
+	{"retry", "[-operator NAME] INSTANCE", "Execute the node an instance failed at again", runRetry},
+}
+
+// env is what commands share: the client and where to write.
+type env struct {
+	client *client
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run executes jbpmnctl with args and returns the exit code: 0 on success, 1 if the
+// command failed and 2 for usage errors.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	global := flag.NewFlagSet("jbpmnctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	server := global.String("server", envOr("JBPMN_SERVER", "http://localhost:8080"), "URL of the engine `server` (or $JBPMN_SERVER)")
+	dbPath := global.String("db", "", "read the SQLite database at `path` instead of talking to a server; only for inspection")
+	timeout := global.Duration("timeout", 30*time.Second, "HTTP request timeout")
+	asJSON := global.Bool("json", false, "print responses as JSON")
+	global.Usage = func() { usage(global, stderr) }
+	if err := global.Parse(args); err != nil {
+		return 2
+	}
+	if global.NArg() == 0 {
+		global.Usage()
+		return 2
+	}
+
+	name := global.Arg(0)
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(stderr, "jbpmnctl: unknown command %q\n", name)
+		global.Usage()
+		return 2
+	}
+
+	var c *client
+	if *dbPath != "" {
+		var err error
+		if c, err = newLocalClient(*dbPath); err != nil {
+			fmt.Fprintf(stderr, "jbpmnctl: %v\n", err)
+			return 1
+		}
+	} else {
+		c = newHTTPClient(*server, *timeout)
+	}
+	defer c.close()
+
+	e := &env{client: c, json: *asJSON, stdin: stdin, stdout: stdout, stderr: stderr}
+	if err := cmd.run(e, global.Args()[1:]); err != nil {
+		var usageErr usageError
+		if errors.As(err, &usageErr) {
+			if usageErr != "" {
+				fmt.Fprintf(stderr, "jbpmnctl %s: %s\n", cmd.name, string(usageErr))
+			}
+			fmt.Fprintf(stderr, "usage: jbpmnctl %s %s\n", cmd.name, cmd.args)
+			return 2
+		}
+		fmt.Fprintf(stderr, "jbpmnctl %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(global *flag.FlagSet, w io.Writer) {
+	fmt.Fprintln(w, "usage: jbpmnctl [flags] COMMAND [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nFlags:")
+	global.PrintDefaults()
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// usageError reports a malformed command line.
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// parseArgs parses the flags of a command, which may come before or after its
+// arguments, and checks the number of arguments.
+func parseArgs(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	fs.SetOutput(io.Discard)
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, usageError(err.Error())
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) < min || (max >= 0 && len(positional) > max) {
+		return nil, usageError("")
+	}
+	return positional, nil
+}
+
+// printJSON writes v as indented JSON.
+func (e *env) printJSON(v interface{}) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// readInput reads a file, or stdin if path is "-".
+func (e *env) readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(e.stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// stringList collects a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jbpmn-engine/api"
+	"jbpmn-engine/db"
+	"jbpmn-engine/workflow"
+)
+
+// newServer serves an engine backed by the SQLite file at path.
+func newServer(t *testing.T, path string) *httptest.Server {
+	t.Helper()
+	store, err := db.Open(path)
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	engine, err := workflow.New(
+		workflow.WithStore(store),
+		workflow.WithLogger(logger),
+		workflow.WithExecutor(&workflow.InlineExecutor{}),
+	)
+	if err != nil {
+		t.Fatalf("creating engine: %v", err)
+	}
+	srv := httptest.NewServer(api.NewServer(engine, api.WithLogger(logger)))
+	t.Cleanup(func() {
+		srv.Close()
+		engine.Close()
+		store.Close()
+	})
+	return srv
+}
+
+// jbpmnctl runs the command line and returns its exit code and output.
+func jbpmnctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "jbpmn.db")
+	srv := newServer(t, dbPath)
+	server := "-server=" + srv.URL
+
+	if code, out, errOut := jbpmnctl(t, "", server, "deploy", "../../workflows/approval_process.json"); code != 0 || !strings.Contains(out, "deployed approval_process version 1") {
+		t.Fatalf("deploy: exit %d, %q %q", code, out, errOut)
+	}
+
+	code, out, errOut := jbpmnctl(t, "", server, "-json", "start", "approval_process", "-var", "requester=alice", "-var", "amount=250")
+	if code != 0 {
+		t.Fatalf("start: exit %d, %s", code, errOut)
+	}
+	var instance api.InstanceResponse
+	if err := json.Unmarshal([]byte(out), &instance); err != nil {
+		t.Fatalf("start output %q: %v", out, err)
+	}
+	if instance.CurrentNode != "request_approval" || instance.Context["amount"] != 250.0 || instance.Context["requester"] != "alice" {
+		t.Errorf("started instance = %+v", instance)
+	}
+
+	form := `{"request_details": "New laptop", "amount": 1200}`
+	if code, out, errOut := jbpmnctl(t, form, server, "submit", instance.ID, "-"); code != 0 || !strings.Contains(out, "ended at end_node") {
+		t.Errorf("submit: exit %d, %q %q", code, out, errOut)
+	}
+
+	if code, out, _ := jbpmnctl(t, "", server, "list", "-workflow", "approval_process"); code != 0 || !strings.Contains(out, instance.ID) {
+		t.Errorf("list: exit %d, %q", code, out)
+	}
+	if code, out, _ := jbpmnctl(t, "", server, "history", instance.ID); code != 0 || !strings.Contains(out, "request_approval") || !strings.Contains(out, "end_node") {
+		t.Errorf("history: exit %d, %q", code, out)
+	}
+	if code, _, errOut := jbpmnctl(t, "", server, "inspect", "no-such-instance"); code != 1 || !strings.Contains(errOut, "instance_not_found") {
+		t.Errorf("inspect unknown instance: exit %d, %q", code, errOut)
+	}
+	if code, _, errOut := jbpmnctl(t, "", server, "retry", instance.ID); code != 1 || !strings.Contains(errOut, "no_incident") {
+		t.Errorf("retry without incident: exit %d, %q", code, errOut)
+	}
+
+	// The same data can be inspected offline, but not changed.
+	if code, out, errOut := jbpmnctl(t, "", "-db", dbPath, "inspect", instance.ID); code != 0 || !strings.Contains(out, `"current_node": "end_node"`) {
+		t.Errorf("local inspect: exit %d, %q %q", code, out, errOut)
+	}
+	if code, _, errOut := jbpmnctl(t, "", "-db", dbPath, "signal", "anything"); code != 1 || !strings.Contains(errOut, "needs a running server") {
+		t.Errorf("local signal: exit %d, %q", code, errOut)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	invalid := filepath.Join(t.TempDir(), "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"id": "x", "nodes": [{"id": "start_node", "type": "start", "next": "nope"}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, out, _ := jbpmnctl(t, "", "validate", "../../workflows/my_first_workflow.json", invalid)
+	if code != 1 {
+		t.Errorf("exit %d, want 1", code)
+	}
+	if !strings.Contains(out, "my_first_workflow.json: ok") || !strings.Contains(out, invalid+":1:69: nodes[0].next: refers to unknown node 'nope'") {
+		t.Errorf("output = %q", out)
+	}
+
+	legacy := filepath.Join(t.TempDir(), "legacy.json")
+	if err := os.WriteFile(legacy, []byte(`{"id": "x", "nodes": [
+  {"id": "start_node", "type": "start", "next": "route"},
+  {"id": "route", "type": "gateway", "conditions": [{"when": "status == aproved", "next": "done"}, {"else": true, "next": "done"}]},
+  {"id": "done", "type": "end"}
+]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	code, out, _ = jbpmnctl(t, "", "validate", legacy)
+	if code != 0 || !strings.Contains(out, legacy+":3:62: nodes[1].conditions[0].when: warning: compares with the unquoted word aproved") || !strings.Contains(out, legacy+": ok (x)") {
+		t.Errorf("legacy condition: exit %d, output %q", code, out)
+	}
+
+	if code, _, errOut := jbpmnctl(t, "", "validate"); code != 2 || !strings.Contains(errOut, "usage: jbpmnctl validate") {
+		t.Errorf("validate without files: exit %d, %q", code, errOut)
+	}
+}
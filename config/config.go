@@ -0,0 +1,403 @@
+// Package config loads the server configuration.
+//
+// Settings are taken from, in increasing order of precedence: built-in defaults, a
+// YAML or JSON file named by -config or $JBPMN_CONFIG, environment variables and
+// command-line flags. Every setting has a JBPMN_* environment variable and a flag;
+// jbpmn-engine -h lists them.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective configuration of the server.
+type Config struct {
+	Database    Database    `yaml:"database" json:"database"`
+	Definitions Definitions `yaml:"definitions" json:"definitions"`
+	HTTP        HTTP        `yaml:"http" json:"http"`
+	Engine      Engine      `yaml:"engine" json:"engine"`
+	Log         Log         `yaml:"log" json:"log"`
+	Retention   Retention   `yaml:"retention" json:"retention"`
+}
+
+// Database configures the SQLite store.
+type Database struct {
+	DSN string `yaml:"dsn" json:"dsn"` // File name or file: URI passed to the SQLite driver
+}
+
+// Definitions configures where workflow definitions are loaded from.
+type Definitions struct {
+	Dirs []string `yaml:"dirs" json:"dirs"` // Directories of *.json definitions; the first wins on duplicate IDs
+	// ReloadInterval is how often the directories are polled for changed definitions.
+	// 0 disables reloading.
+	ReloadInterval Duration `yaml:"reload_interval" json:"reload_interval"`
+	// Libraries is the directory of the script libraries definitions can list, e.g.
+	// lib/pricing.js for "lib/pricing".
+	Libraries string `yaml:"libraries" json:"libraries"`
+}
+
+// HTTP configures the API server.
+type HTTP struct {
+	Listen          string   `yaml:"listen" json:"listen"`
+	ReadTimeout     Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout    Duration `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout     Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	TLS             TLS      `yaml:"tls" json:"tls"`
+}
+
+// TLS enables HTTPS when both files are set.
+type TLS struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+}
+
+// Enabled reports whether the server should serve HTTPS.
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Engine configures workflow execution.
+type Engine struct {
+	// Workers is the number of node executions that may run at once. 0 runs every
+	// execution in its own goroutine.
+	Workers int `yaml:"workers" json:"workers"`
+	// ScriptTimeout is how long a script node may run before it is interrupted. A
+	// node's own timeout lowers it for that node; 0 removes the limit.
+	ScriptTimeout Duration `yaml:"script_timeout" json:"script_timeout"`
+	// ScriptMaxCallStack is how deeply the functions of a script may call each other;
+	// 0 removes the limit.
+	ScriptMaxCallStack int `yaml:"script_max_call_stack" json:"script_max_call_stack"`
+	// ScriptMaxMemoryMB is how many MiB of the process's heap growth a script may
+	// account for before it is interrupted; 0 removes the limit. The limit is
+	// approximate, see scripts.Limits.MaxMemory.
+	ScriptMaxMemoryMB int `yaml:"script_max_memory_mb" json:"script_max_memory_mb"`
+	// ShutdownTimeout is how long in-flight executions may take to drain on shutdown.
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+}
+
+// Log configures logging.
+type Log struct {
+	Level  string `yaml:"level" json:"level"`   // debug, info, warn or error
+	Format string `yaml:"format" json:"format"` // text or json
+}
+
+// Retention configures how long bookkeeping data is kept.
+type Retention struct {
+	IdempotencyKeys Duration `yaml:"idempotency_keys" json:"idempotency_keys"`
+	// ScriptLogs is how long the console output of scripts is kept; 0 keeps it forever.
+	ScriptLogs Duration `yaml:"script_logs" json:"script_logs"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" in config files.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+// MarshalText implements encoding.TextMarshaler.
+func (d Duration) MarshalText() ([]byte, error) { return []byte(d.String()), nil }
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the configuration used when nothing is configured. It matches the
+// settings the server had before it was configurable.
+func Default() *Config {
+	return &Config{
+		Database:    Database{DSN: "./jbpmn.db"},
+		Definitions: Definitions{Dirs: []string{"./workflows/"}, ReloadInterval: Duration(5 * time.Second), Libraries: "./scripts/"},
+		HTTP: HTTP{
+			Listen:          ":8080",
+			ReadTimeout:     Duration(10 * time.Second),
+			WriteTimeout:    Duration(10 * time.Second),
+			IdleTimeout:     Duration(30 * time.Second),
+			ShutdownTimeout: Duration(5 * time.Second),
+		},
+		Engine: Engine{
+			ScriptTimeout:      Duration(30 * time.Second),
+			ScriptMaxCallStack: 10000,
+			ScriptMaxMemoryMB:  256,
+			ShutdownTimeout:    Duration(30 * time.Second),
+		},
+		Log:       Log{Level: "info", Format: "text"},
+		Retention: Retention{IdempotencyKeys: Duration(24 * time.Hour), ScriptLogs: Duration(30 * 24 * time.Hour)},
+	}
+}
+
+// setting binds one configuration value to its environment variable and flag.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"JBPMN_DB_DSN", "db", "SQLite database `dsn`", (*stringValue)(&c.Database.DSN)},
+		{"JBPMN_DEFINITION_DIRS", "definitions", "comma-separated `dirs` of workflow definitions", (*listValue)(&c.Definitions.Dirs)},
+		{"JBPMN_DEFINITION_RELOAD_INTERVAL", "reload-interval", "how often to poll for changed definitions; 0 disables reloading", (*durationValue)(&c.Definitions.ReloadInterval)},
+		{"JBPMN_SCRIPT_LIBRARIES", "libraries", "`dir` of the script libraries definitions can require", (*stringValue)(&c.Definitions.Libraries)},
+		{"JBPMN_HTTP_LISTEN", "listen", "`address` the HTTP server listens on", (*stringValue)(&c.HTTP.Listen)},
+		{"JBPMN_HTTP_READ_TIMEOUT", "read-timeout", "HTTP read timeout", (*durationValue)(&c.HTTP.ReadTimeout)},
+		{"JBPMN_HTTP_WRITE_TIMEOUT", "write-timeout", "HTTP write timeout", (*durationValue)(&c.HTTP.WriteTimeout)},
+		{"JBPMN_HTTP_IDLE_TIMEOUT", "idle-timeout", "HTTP keep-alive idle timeout", (*durationValue)(&c.HTTP.IdleTimeout)},
+		{"JBPMN_HTTP_SHUTDOWN_TIMEOUT", "http-shutdown-timeout", "time open HTTP requests get to finish on shutdown", (*durationValue)(&c.HTTP.ShutdownTimeout)},
+		{"JBPMN_TLS_CERT_FILE", "tls-cert", "TLS certificate `file`; enables HTTPS with -tls-key", (*stringValue)(&c.HTTP.TLS.CertFile)},
+		{"JBPMN_TLS_KEY_FILE", "tls-key", "TLS private key `file`", (*stringValue)(&c.HTTP.TLS.KeyFile)},
+		{"JBPMN_WORKERS", "workers", "number of node executions that may run at once; 0 for no limit", (*intValue)(&c.Engine.Workers)},
+		{"JBPMN_SCRIPT_TIMEOUT", "script-timeout", "how long a script node may run; 0 for no limit", (*durationValue)(&c.Engine.ScriptTimeout)},
+		{"JBPMN_SCRIPT_MAX_CALL_STACK", "script-max-call-stack", "how deeply script functions may call each other; 0 for no limit", (*intValue)(&c.Engine.ScriptMaxCallStack)},
+		{"JBPMN_SCRIPT_MAX_MEMORY_MB", "script-max-memory-mb", "MiB a script may allocate; 0 for no limit", (*intValue)(&c.Engine.ScriptMaxMemoryMB)},
+		{"JBPMN_ENGINE_SHUTDOWN_TIMEOUT", "engine-shutdown-timeout", "time in-flight executions get to drain on shutdown", (*durationValue)(&c.Engine.ShutdownTimeout)},
+		{"JBPMN_LOG_LEVEL", "log-level", "log `level`: debug, info, warn or error", (*stringValue)(&c.Log.Level)},
+		{"JBPMN_LOG_FORMAT", "log-format", "log `format`: text or json", (*stringValue)(&c.Log.Format)},
+		{"JBPMN_IDEMPOTENCY_RETENTION", "idempotency-retention", "how long Idempotency-Keys are remembered", (*durationValue)(&c.Retention.IdempotencyKeys)},
+		{"JBPMN_SCRIPT_LOG_RETENTION", "script-log-retention", "how long the console output of scripts is kept; 0 keeps it forever", (*durationValue)(&c.Retention.ScriptLogs)},
+	}
+}
+
+// Options are the command-line switches that are not settings.
+type Options struct {
+	File        string // Config file that was loaded, if any
+	PrintConfig bool   // Print the effective configuration and exit
+}
+
+// Load builds the configuration from the defaults, the config file, the environment
+// (looked up with lookupEnv, like os.LookupEnv) and the command-line args, then
+// validates it. A variable set to an empty value counts as set. For -h it returns
+// flag.ErrHelp after printing the usage to output.
+func Load(args []string, lookupEnv func(string) (string, bool), output io.Writer) (*Config, *Options, error) {
+	// Flags are parsed first to find the config file, but applied last.
+	var opts Options
+	parsed := Default()
+	fs := newFlagSet(parsed, &opts, output)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	if opts.File == "" {
+		opts.File, _ = lookupEnv("JBPMN_CONFIG")
+	}
+	cfg := Default()
+	if opts.File != "" {
+		if err := cfg.loadFile(opts.File); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var problems []string
+	flagged := parsed.settings()
+	for i, s := range cfg.settings() {
+		if v, ok := lookupEnv(s.env); ok {
+			if err := s.value.Set(v); err != nil {
+				problems = append(problems, fmt.Sprintf("$%s: %v", s.env, err))
+			}
+		}
+		if set[s.flag] {
+			if err := s.value.Set(flagged[i].value.String()); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s: %v", s.flag, err))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		problems = cfg.validate()
+	}
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return cfg, &opts, nil
+}
+
+func newFlagSet(cfg *Config, opts *Options, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("jbpmn-engine", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.StringVar(&opts.File, "config", "", "YAML or JSON config `file` (or $JBPMN_CONFIG)")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the effective configuration as YAML and exit")
+	for _, s := range cfg.settings() {
+		fs.Var(s.value, s.flag, s.usage+" (or $"+s.env+")")
+	}
+	fs.Usage = func() {
+		fmt.Fprintln(output, "usage: jbpmn-engine [flags]")
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// loadFile overlays the settings in a YAML or JSON file. Unknown keys are errors so
+// typos do not go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if errors.Is(err, io.EOF) { // empty file
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Database.DSN == "" {
+		add("database.dsn is required")
+	}
+	if len(c.Definitions.Dirs) == 0 {
+		add("definitions.dirs needs at least one directory")
+	}
+	for i, dir := range c.Definitions.Dirs {
+		if dir == "" {
+			add("definitions.dirs[%d] is empty", i)
+		}
+	}
+	if c.HTTP.Listen == "" {
+		add("http.listen is required")
+	}
+	durations := map[string]Duration{
+		"definitions.reload_interval": c.Definitions.ReloadInterval,
+		"http.read_timeout":           c.HTTP.ReadTimeout,
+		"http.write_timeout":          c.HTTP.WriteTimeout,
+		"http.idle_timeout":           c.HTTP.IdleTimeout,
+		"http.shutdown_timeout":       c.HTTP.ShutdownTimeout,
+		"engine.script_timeout":       c.Engine.ScriptTimeout,
+		"engine.shutdown_timeout":     c.Engine.ShutdownTimeout,
+		"retention.idempotency_keys":  c.Retention.IdempotencyKeys,
+		"retention.script_logs":       c.Retention.ScriptLogs,
+	}
+	names := make([]string, 0, len(durations))
+	for name := range durations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if durations[name] < 0 {
+			add("%s must not be negative", name)
+		}
+	}
+	if (c.HTTP.TLS.CertFile == "") != (c.HTTP.TLS.KeyFile == "") {
+		add("http.tls needs both cert_file and key_file")
+	}
+	if c.Engine.Workers < 0 {
+		add("engine.workers must not be negative")
+	}
+	if c.Engine.ScriptMaxCallStack < 0 {
+		add("engine.script_max_call_stack must not be negative")
+	}
+	if c.Engine.ScriptMaxMemoryMB < 0 {
+		add("engine.script_max_memory_mb must not be negative")
+	}
+	if _, err := c.LogLevel(); err != nil {
+		add("log.level: %v", err)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		add("log.format must be text or json, not %q", c.Log.Format)
+	}
+	return problems
+}
+
+// LogLevel returns the configured log level.
+func (c *Config) LogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(c.Log.Level))
+	return level, err
+}
+
+// Logger returns a logger writing to w in the configured format and level.
+func (c *Config) Logger(w io.Writer) *slog.Logger {
+	level, _ := c.LogLevel()
+	opts := &slog.HandlerOptions{Level: level}
+	if c.Log.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// WriteYAML writes the configuration in the format of a config file.
+func (c *Config) WriteYAML(w io.Writer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// flag.Value implementations bound to Config fields.
+
+type stringValue string
+
+func (v *stringValue) String() string     { return string(*v) }
+func (v *stringValue) Set(s string) error { *v = stringValue(s); return nil }
+
+type intValue int
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", s)
+	}
+	*v = intValue(n)
+	return nil
+}
+
+type durationValue Duration
+
+func (v *durationValue) String() string     { return Duration(*v).String() }
+func (v *durationValue) Set(s string) error { return (*Duration)(v).UnmarshalText([]byte(s)) }
+
+// listValue is a comma-separated list. Setting it replaces the whole list.
+type listValue []string
+
+func (v *listValue) String() string { return strings.Join(*v, ",") }
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func environment(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	cfg, opts, err := Load(nil, environment(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("config = %+v, want the defaults", cfg)
+	}
+	if opts.File != "" || opts.PrintConfig {
+		t.Errorf("options = %+v", opts)
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	file := writeFile(t, "jbpmn.yaml", `
+database:
+  dsn: /var/lib/jbpmn/file.db
+definitions:
+  dirs: [/etc/jbpmn/workflows, ./workflows]
+http:
+  listen: ":9000"
+  read_timeout: 1m
+engine:
+  workers: 4
+log:
+  level: debug
+`)
+	env := environment(map[string]string{
+		"JBPMN_CONFIG":       file,
+		"JBPMN_HTTP_LISTEN":  ":9100",
+		"JBPMN_WORKERS":      "8",
+		"JBPMN_LOG_FORMAT":   "json",
+		"JBPMN_TLS_KEY_FILE": "key.pem",
+	})
+	cfg, opts, err := Load([]string{"-workers", "2", "-tls-cert", "cert.pem", "-print-config"}, env, io.Discard)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if opts.File != file || !opts.PrintConfig {
+		t.Errorf("options = %+v", opts)
+	}
+
+	want := Default()
+	want.Database.DSN = "/var/lib/jbpmn/file.db"                            // file
+	want.Definitions.Dirs = []string{"/etc/jbpmn/workflows", "./workflows"} // file
+	want.HTTP.Listen = ":9100"                                              // env over file
+	want.HTTP.ReadTimeout = Duration(time.Minute)                           // file
+	want.HTTP.TLS = TLS{CertFile: "cert.pem", KeyFile: "key.pem"}           // flag and env
+	want.Engine.Workers = 2                                                 // flag over env over file
+	want.Log = Log{Level: "debug", Format: "json"}                          // file and env
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config =\n%+v\nwant\n%+v", cfg, want)
+	}
+}
+
+func TestJSONFile(t *testing.T) {
+	file := writeFile(t, "jbpmn.json", `{"definitions": {"dirs": ["a", "b"]}, "retention": {"idempotency_keys": "1h"}}`)
+	cfg, _, err := Load([]string{"-config", file, "-definitions", "c, d"}, environment(map[string]string{"JBPMN_SCRIPT_LOG_RETENTION": "0s"}), io.Discard)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.Definitions.Dirs, []string{"c", "d"}) || cfg.Retention.IdempotencyKeys != Duration(time.Hour) || cfg.Retention.ScriptLogs != 0 {
+		t.Errorf("config = %+v", cfg)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "unknown key",
+			file: "http:\n  listn: \":9000\"\n",
+			want: []string{"field listn not found"},
+		},
+		{
+			name: "unknown JSON key",
+			file: `{"http": {"listn": ":9000"}}`,
+			want: []string{`unknown field "listn"`},
+		},
+		{
+			name: "bad environment value",
+			env:  map[string]string{"JBPMN_WORKERS": "many", "JBPMN_HTTP_IDLE_TIMEOUT": "soon"},
+			want: []string{"$JBPMN_HTTP_IDLE_TIMEOUT", "$JBPMN_WORKERS: \"many\" is not a number"},
+		},
+		{
+			name: "empty environment value",
+			env:  map[string]string{"JBPMN_HTTP_LISTEN": ""},
+			want: []string{"http.listen is required"},
+		},
+		{
+			name: "semantic problems",
+			args: []string{"-listen", "", "-tls-key", "key.pem", "-workers", "-1", "-script-max-memory-mb", "-1", "-log-level", "loud", "-read-timeout", "-1s", "-definitions", ""},
+			want: []string{
+				"definitions.dirs needs at least one directory",
+				"http.listen is required",
+				"http.read_timeout must not be negative",
+				"http.tls needs both cert_file and key_file",
+				"engine.workers must not be negative",
+				"engine.script_max_memory_mb must not be negative",
+				"log.level",
+			},
+		},
+		{
+			name: "positional argument",
+			args: []string{"serve"},
+			want: []string{"unexpected arguments: serve"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				name := "jbpmn.yaml"
+				if strings.HasPrefix(tt.file, "{") {
+					name = "jbpmn.json"
+				}
+				args = append([]string{"-config", writeFile(t, name, tt.file)}, args...)
+			}
+			_, _, err := Load(args, environment(tt.env), io.Discard)
+			if err == nil {
+				t.Fatal("Load succeeded")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHelp(t *testing.T) {
+	var out bytes.Buffer
+	if _, _, err := Load([]string{"-h"}, environment(nil), &out); !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("err = %v, want flag.ErrHelp", err)
+	}
+	if !strings.Contains(out.String(), "$JBPMN_DB_DSN") {
+		t.Errorf("usage does not list the environment variables:\n%s", out.String())
+	}
+}
+
+func TestWriteYAMLRoundTrips(t *testing.T) {
+	cfg := Default()
+	cfg.Engine.Workers = 3
+	cfg.HTTP.IdleTimeout = Duration(90 * time.Second)
+	var out bytes.Buffer
+	if err := cfg.WriteYAML(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "idle_timeout: 1m30s") {
+		t.Errorf("output:\n%s", out.String())
+	}
+
+	loaded, _, err := Load([]string{"-config", writeFile(t, "printed.yaml", out.String())}, environment(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("loading printed config: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, cfg) {
+		t.Errorf("loaded %+v, want %+v", loaded, cfg)
+	}
+}
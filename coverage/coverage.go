@@ -0,0 +1,283 @@
+// Package coverage reports which nodes and gateway branches of workflow
+// definitions were exercised by a set of instances, typically a test run.
+package coverage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"jbpmn-engine/db"
+	"jbpmn-engine/workflow"
+)
+
+// Collector accumulates node and gateway branch hits per definition.
+// It is safe for concurrent use.
+type Collector struct {
+	mu          sync.Mutex
+	definitions map[string]*definitionHits
+}
+
+type definitionHits struct {
+	def       *workflow.Workflow
+	instances int
+	nodes     map[string]int
+	branches  map[branchKey]int
+}
+
+type branchKey struct {
+	gateway string
+	index   int
+}
+
+// NewCollector returns an empty Collector.
+func NewCollector() *Collector {
+	return &Collector{definitions: make(map[string]*definitionHits)}
+}
+
+// RecordHistory records one instance of def from its workflow_instance_nodes history.
+// Administrative moves are left out: the node an operator moved the instance to was
+// not reached through the definition, so it neither counts as entered nor as the
+// branch taken by a gateway before it.
+func (c *Collector) RecordHistory(def *workflow.Workflow, history []db.NodeInstanceRecord) {
+	var segments [][]string
+	path := make([]string, 0, len(history))
+	for i, rec := range history {
+		if rec.Event != "" {
+			continue // suspend, resume, cancel and move entries do not enter a node
+		}
+		if i+1 < len(history) && history[i+1].Event == "moved" && history[i+1].NodeID == rec.NodeID {
+			// The node entry written by a move is followed by its "moved" entry. What
+			// comes after the move does not continue the path before it.
+			segments = append(segments, path)
+			path = make([]string, 0, len(history)-i)
+			continue
+		}
+		path = append(path, rec.NodeID)
+	}
+	segments = append(segments, path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits := c.hits(def)
+	for _, segment := range segments {
+		hits.record(segment)
+	}
+}
+
+// RecordPath records one instance of def that entered the given nodes in order.
+// A gateway followed by node X counts as a hit for every condition of that gateway
+// leading to X; conditions sharing a target cannot be told apart from history.
+func (c *Collector) RecordPath(def *workflow.Workflow, path []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hits(def).record(path)
+}
+
+// hits returns the hits of def with one more instance counted. c.mu must be held.
+func (c *Collector) hits(def *workflow.Workflow) *definitionHits {
+	hits := c.definitions[def.ID]
+	if hits == nil {
+		hits = &definitionHits{
+			nodes:    make(map[string]int),
+			branches: make(map[branchKey]int),
+		}
+		c.definitions[def.ID] = hits
+	}
+	// Keep the most recent definition so reports reflect the deployed version.
+	hits.def = def
+	hits.instances++
+	return hits
+}
+
+// record counts the nodes and gateway branches of a path through h.def.
+func (h *definitionHits) record(path []string) {
+	for i, nodeID := range path {
+		// Consecutive records of the same node (e.g. signal receipt) are one visit.
+		if i > 0 && path[i-1] == nodeID {
+			continue
+		}
+		h.nodes[nodeID]++
+
+		if i+1 >= len(path) {
+			continue
+		}
+		node := h.def.GetNodeByID(nodeID)
+		if node == nil || node.Type != "gateway" {
+			continue
+		}
+		for index, condition := range node.Conditions {
+			if condition.Next == path[i+1] {
+				h.branches[branchKey{gateway: nodeID, index: index}]++
+			}
+		}
+	}
+}
+
+// Reports returns a report per recorded definition, sorted by workflow ID.
+func (c *Collector) Reports() []*Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reports := make([]*Report, 0, len(c.definitions))
+	for _, hits := range c.definitions {
+		reports = append(reports, hits.report())
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].WorkflowID < reports[j].WorkflowID })
+	return reports
+}
+
+// NodeCoverage is the hit count of a single node.
+type NodeCoverage struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+	Hits int    `json:"hits"`
+}
+
+// BranchCoverage is the hit count of a single gateway condition.
+type BranchCoverage struct {
+	Gateway string `json:"gateway"`
+	Index   int    `json:"index"`
+	When    string `json:"when,omitempty"`
+	Else    bool   `json:"else,omitempty"`
+	Next    string `json:"next"`
+	Hits    int    `json:"hits"`
+}
+
+// Label describes the condition, e.g. "user_age >= 30" or "else".
+func (b BranchCoverage) Label() string {
+	if b.Else {
+		return "else"
+	}
+	return b.When
+}
+
+// Report is the coverage of one workflow definition.
+type Report struct {
+	WorkflowID      string           `json:"workflow_id"`
+	Name            string           `json:"name,omitempty"`
+	Instances       int              `json:"instances"`
+	Nodes           []NodeCoverage   `json:"nodes"`
+	Branches        []BranchCoverage `json:"branches"`
+	NodesCovered    int              `json:"nodes_covered"`
+	BranchesCovered int              `json:"branches_covered"`
+
+	def *workflow.Workflow
+}
+
+func (h *definitionHits) report() *Report {
+	r := &Report{
+		WorkflowID: h.def.ID,
+		Name:       h.def.Name,
+		Instances:  h.instances,
+		def:        h.def,
+	}
+	for _, node := range h.def.Nodes {
+		nc := NodeCoverage{ID: node.ID, Name: node.Name, Type: node.Type, Hits: h.nodes[node.ID]}
+		if nc.Hits > 0 {
+			r.NodesCovered++
+		}
+		r.Nodes = append(r.Nodes, nc)
+
+		for index, condition := range node.Conditions {
+			bc := BranchCoverage{
+				Gateway: node.ID,
+				Index:   index,
+				When:    condition.When,
+				Else:    condition.Else,
+				Next:    condition.Next,
+				Hits:    h.branches[branchKey{gateway: node.ID, index: index}],
+			}
+			if bc.Hits > 0 {
+				r.BranchesCovered++
+			}
+			r.Branches = append(r.Branches, bc)
+		}
+	}
+	return r
+}
+
+// NodePercent returns the percentage of nodes that were entered at least once.
+func (r *Report) NodePercent() float64 {
+	return percent(r.NodesCovered, len(r.Nodes))
+}
+
+// BranchPercent returns the percentage of gateway conditions that were taken at least once.
+func (r *Report) BranchPercent() float64 {
+	return percent(r.BranchesCovered, len(r.Branches))
+}
+
+func percent(covered, total int) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(covered) * 100 / float64(total)
+}
+
+// WriteText writes a human-readable summary listing uncovered nodes and branches.
+func (r *Report) WriteText(w io.Writer) error {
+	fmt.Fprintf(w, "%s (%s): %d instance(s)\n", r.WorkflowID, r.Name, r.Instances)
+	fmt.Fprintf(w, "  nodes:    %d/%d (%.1f%%)\n", r.NodesCovered, len(r.Nodes), r.NodePercent())
+	fmt.Fprintf(w, "  branches: %d/%d (%.1f%%)\n", r.BranchesCovered, len(r.Branches), r.BranchPercent())
+
+	if r.NodesCovered < len(r.Nodes) {
+		fmt.Fprintln(w, "  uncovered nodes:")
+		for _, n := range r.Nodes {
+			if n.Hits == 0 {
+				fmt.Fprintf(w, "    - %s (%s)\n", n.ID, n.Type)
+			}
+		}
+	}
+	if r.BranchesCovered < len(r.Branches) {
+		fmt.Fprintln(w, "  uncovered branches:")
+		for _, b := range r.Branches {
+			if b.Hits == 0 {
+				fmt.Fprintf(w, "    - %s[%d] %s -> %s\n", b.Gateway, b.Index, b.Label(), b.Next)
+			}
+		}
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// WriteJSON writes the report as indented JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteFiles writes <workflow_id>.txt, .json and .html reports for every recorded
+// definition into dir, creating it if needed.
+func (c *Collector) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create coverage directory %s: %w", dir, err)
+	}
+	for _, r := range c.Reports() {
+		writers := map[string]func(io.Writer) error{
+			".txt":  r.WriteText,
+			".json": r.WriteJSON,
+			".html": r.WriteHTML,
+		}
+		for ext, write := range writers {
+			path := filepath.Join(dir, r.WorkflowID+ext)
+			f, err := os.Create(path)
+			if err != nil {
+				return fmt.Errorf("failed to create coverage report %s: %w", path, err)
+			}
+			if err := write(f); err != nil {
+				f.Close()
+				return fmt.Errorf("failed to write coverage report %s: %w", path, err)
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package coverage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"jbpmn-engine/db"
+	"jbpmn-engine/workflow"
+)
+
+const approvalDefinition = `{
+  "id": "approval",
+  "name": "Approval",
+  "input": [{"name": "amount", "type": "number"}],
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "route"},
+    {"id": "route", "type": "gateway", "conditions": [
+      {"when": "amount > 1000", "next": "review"},
+      {"when": "amount < 0", "next": "rejected"},
+      {"else": true, "next": "approved"}
+    ]},
+    {"id": "review", "type": "form", "fields": [{"id": "ok", "name": "OK", "type": "text"}], "next": "approved"},
+    {"id": "approved", "type": "end"},
+    {"id": "rejected", "type": "end"}
+  ]
+}`
+
+func approval(t *testing.T) *workflow.Workflow {
+	t.Helper()
+	var def workflow.Workflow
+	if err := json.Unmarshal([]byte(approvalDefinition), &def); err != nil {
+		t.Fatalf("parsing definition: %v", err)
+	}
+	return &def
+}
+
+func nodeHits(r *Report) map[string]int {
+	hits := make(map[string]int)
+	for _, n := range r.Nodes {
+		hits[n.ID] = n.Hits
+	}
+	return hits
+}
+
+func branchHits(r *Report) []int {
+	var hits []int
+	for _, b := range r.Branches {
+		hits = append(hits, b.Hits)
+	}
+	return hits
+}
+
+func TestCollectorCountsNodesAndBranches(t *testing.T) {
+	def := approval(t)
+	c := NewCollector()
+	c.RecordPath(def, []string{"start_node", "route", "approved"})
+	c.RecordPath(def, []string{"start_node", "route", "review", "review", "approved"})
+	c.RecordPath(def, []string{"start_node", "route", "approved"})
+
+	reports := c.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("got %d reports, want 1", len(reports))
+	}
+	r := reports[0]
+	if r.Instances != 3 || r.NodesCovered != 4 || r.BranchesCovered != 2 {
+		t.Errorf("instances %d, nodes %d, branches %d; want 3, 4 and 2", r.Instances, r.NodesCovered, r.BranchesCovered)
+	}
+	// Consecutive entries of review are one visit.
+	want := map[string]int{"start_node": 3, "route": 3, "review": 1, "approved": 3, "rejected": 0}
+	if got := nodeHits(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("node hits = %v, want %v", got, want)
+	}
+	if got := branchHits(r); !reflect.DeepEqual(got, []int{1, 0, 2}) {
+		t.Errorf("branch hits = %v, want [1 0 2]", got)
+	}
+	if r.NodePercent() != 80 || r.BranchPercent() != 200.0/3 {
+		t.Errorf("percentages %.1f and %.1f, want 80.0 and 66.7", r.NodePercent(), r.BranchPercent())
+	}
+}
+
+func TestRecordHistorySkipsAdministrativeEntries(t *testing.T) {
+	def := approval(t)
+	c := NewCollector()
+	c.RecordHistory(def, []db.NodeInstanceRecord{
+		{NodeID: "start_node"},
+		{NodeID: "route"},
+		{NodeID: "review"},
+		{NodeID: "review", Event: "suspended"},
+		{NodeID: "review", Event: "resumed"},
+		// An operator moved the instance from review to rejected and back to review.
+		{NodeID: "rejected"},
+		{NodeID: "rejected", Event: "moved", Operator: "ops"},
+		{NodeID: "review"},
+		{NodeID: "review", Event: "moved", Operator: "ops"},
+		{NodeID: "approved"},
+	})
+
+	r := c.Reports()[0]
+	want := map[string]int{"start_node": 1, "route": 1, "review": 1, "approved": 1, "rejected": 0}
+	if got := nodeHits(r); !reflect.DeepEqual(got, want) {
+		t.Errorf("node hits = %v, want %v", got, want)
+	}
+	if got := branchHits(r); !reflect.DeepEqual(got, []int{1, 0, 0}) {
+		t.Errorf("branch hits = %v, want [1 0 0]", got)
+	}
+
+	// A gateway directly followed by a move does not take the branch to the moved-to node.
+	c = NewCollector()
+	c.RecordHistory(def, []db.NodeInstanceRecord{
+		{NodeID: "start_node"},
+		{NodeID: "route"},
+		{NodeID: "rejected"},
+		{NodeID: "rejected", Event: "moved", Operator: "ops"},
+	})
+	r = c.Reports()[0]
+	if r.Instances != 1 || r.BranchesCovered != 0 || nodeHits(r)["rejected"] != 0 {
+		t.Errorf("instances %d, branch hits %v, node hits %v; want a single instance without rejected", r.Instances, branchHits(r), nodeHits(r))
+	}
+}
+
+func TestReportOutput(t *testing.T) {
+	def := approval(t)
+	c := NewCollector()
+	c.RecordPath(def, []string{"start_node", "route", "review", "approved"})
+	r := c.Reports()[0]
+
+	var text bytes.Buffer
+	if err := r.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	wantText := `approval (Approval): 1 instance(s)
+  nodes:    4/5 (80.0%)
+  branches: 1/3 (33.3%)
+  uncovered nodes:
+    - rejected (end)
+  uncovered branches:
+    - route[1] amount < 0 -> rejected
+    - route[2] else -> approved
+
+`
+	if text.String() != wantText {
+		t.Errorf("text report:\n%s\nwant:\n%s", text.String(), wantText)
+	}
+
+	var js bytes.Buffer
+	if err := r.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil {
+		t.Fatalf("decoding JSON report: %v", err)
+	}
+	decoded.def = r.def
+	if !reflect.DeepEqual(&decoded, r) {
+		t.Errorf("JSON report = %+v, want %+v", decoded, *r)
+	}
+
+	var html bytes.Buffer
+	if err := r.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	page := html.String()
+	for _, want := range []string{
+		"<title>Coverage: approval</title>",
+		"<td>Nodes</td><td>4/5 (80.0%)</td>",
+		"<td>Branches</td><td>1/3 (33.3%)</td>",
+		`<g class="node uncovered"><title>rejected (end): 0 hit(s)</title>`,
+		`<g class="node covered"><title>review (form): 1 hit(s)</title>`,
+		`amount &gt; 1000 (1)`,
+		`<text class="label uncovered"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("HTML report does not contain %q", want)
+		}
+	}
+	if got := strings.Count(page, `class="edge branch uncovered"`); got != 2 {
+		t.Errorf("HTML report has %d uncovered branch edges, want 2", got)
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	c := NewCollector()
+	c.RecordPath(approval(t), []string{"start_node", "route", "approved"})
+	dir := filepath.Join(t.TempDir(), "coverage")
+	if err := c.WriteFiles(dir); err != nil {
+		t.Fatalf("WriteFiles: %v", err)
+	}
+	for _, name := range []string{"approval.txt", "approval.json", "approval.html"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || info.Size() == 0 {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
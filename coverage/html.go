@@ -0,0 +1,168 @@
+package coverage
+
+import (
+	"html/template"
+	"io"
+	"sort"
+)
+
+const (
+	nodeWidth   = 170
+	nodeHeight  = 44
+	layerGap    = 240
+	rowGap      = 80
+	graphMargin = 30
+)
+
+type graphNode struct {
+	NodeCoverage
+	X, Y int
+}
+
+type graphEdge struct {
+	X1, Y1, X2, Y2 int
+	Label          string
+	Kind           string // "next", "timeout" or "branch"
+	Covered        bool
+	Hits           int
+}
+
+type graphView struct {
+	*Report
+	Width, Height         int
+	NodeWidth, NodeHeight int
+	GraphNodes            []graphNode
+	Edges                 []graphEdge
+}
+
+// layout places nodes in columns by their distance from the start node, so the
+// graph reads left to right. Nodes unreachable from the start go in a final column.
+func (r *Report) layout() graphView {
+	layers := make(map[string]int)
+	queue := []string{}
+	if r.def.GetNodeByID("start_node") != nil {
+		layers["start_node"] = 0
+		queue = append(queue, "start_node")
+	}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, next := range r.def.GetNodeByID(id).Successors() {
+			if _, seen := layers[next]; !seen && r.def.GetNodeByID(next) != nil {
+				layers[next] = layers[id] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	maxLayer := 0
+	for _, l := range layers {
+		if l > maxLayer {
+			maxLayer = l
+		}
+	}
+	for _, n := range r.Nodes {
+		if _, ok := layers[n.ID]; !ok {
+			layers[n.ID] = maxLayer + 1
+		}
+	}
+
+	rows := make(map[int]int)
+	positions := make(map[string]graphNode)
+	view := graphView{Report: r, NodeWidth: nodeWidth, NodeHeight: nodeHeight}
+	for _, n := range r.Nodes {
+		layer := layers[n.ID]
+		gn := graphNode{
+			NodeCoverage: n,
+			X:            graphMargin + layer*layerGap,
+			Y:            graphMargin + rows[layer]*rowGap,
+		}
+		rows[layer]++
+		positions[n.ID] = gn
+		view.GraphNodes = append(view.GraphNodes, gn)
+		if gn.X+nodeWidth+graphMargin > view.Width {
+			view.Width = gn.X + nodeWidth + graphMargin
+		}
+		if gn.Y+nodeHeight+graphMargin > view.Height {
+			view.Height = gn.Y + nodeHeight + graphMargin
+		}
+	}
+
+	edge := func(from, to string, kind, label string, hits int, covered bool) {
+		src, okSrc := positions[from]
+		dst, okDst := positions[to]
+		if !okSrc || !okDst {
+			return
+		}
+		view.Edges = append(view.Edges, graphEdge{
+			X1: src.X + nodeWidth, Y1: src.Y + nodeHeight/2,
+			X2: dst.X, Y2: dst.Y + nodeHeight/2,
+			Label: label, Kind: kind, Hits: hits, Covered: covered,
+		})
+	}
+
+	branches := make(map[string][]BranchCoverage)
+	for _, b := range r.Branches {
+		branches[b.Gateway] = append(branches[b.Gateway], b)
+	}
+	for _, n := range r.Nodes {
+		node := r.def.GetNodeByID(n.ID)
+		if node.Next != "" {
+			edge(node.ID, node.Next, "next", "", 0, positions[node.Next].Hits > 0 && n.Hits > 0)
+		}
+		if node.Timeout != nil && node.Timeout.Next != "" {
+			edge(node.ID, node.Timeout.Next, "timeout", "timeout "+node.Timeout.Duration, 0, positions[node.Timeout.Next].Hits > 0 && n.Hits > 0)
+		}
+		for _, b := range branches[node.ID] {
+			edge(node.ID, b.Next, "branch", b.Label(), b.Hits, b.Hits > 0)
+		}
+	}
+	sort.SliceStable(view.Edges, func(i, j int) bool { return view.Edges[i].Kind < view.Edges[j].Kind })
+	return view
+}
+
+var htmlTemplate = template.Must(template.New("coverage").Funcs(template.FuncMap{
+	"half": func(a, b int) int { return (a + b) / 2 },
+	"add":  func(a, b int) int { return a + b },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage: {{.WorkflowID}}</title>
+<style>
+body { font-family: sans-serif; margin: 20px; }
+.summary td { padding: 2px 12px 2px 0; }
+svg text { font-size: 12px; }
+.node rect { stroke: #333; stroke-width: 1; rx: 6; }
+.node.covered rect { fill: #c8f0c8; }
+.node.uncovered rect { fill: #f6c6c6; stroke: #b00; stroke-width: 2; }
+.edge { fill: none; stroke-width: 1.5; }
+.edge.next { stroke: #666; }
+.edge.timeout { stroke: #999; stroke-dasharray: 5 4; }
+.edge.branch.covered { stroke: #2a8a2a; stroke-width: 2.5; }
+.edge.branch.uncovered { stroke: #c00; stroke-width: 2.5; stroke-dasharray: 8 4; }
+.label { fill: #333; }
+.label.uncovered { fill: #c00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{.WorkflowID}}{{if .Name}} &mdash; {{.Name}}{{end}}</h1>
+<table class="summary">
+<tr><td>Instances</td><td>{{.Instances}}</td></tr>
+<tr><td>Nodes</td><td>{{.NodesCovered}}/{{len .Nodes}} ({{printf "%.1f" .NodePercent}}%)</td></tr>
+<tr><td>Branches</td><td>{{.BranchesCovered}}/{{len .Branches}} ({{printf "%.1f" .BranchPercent}}%)</td></tr>
+</table>
+<svg width="{{.Width}}" height="{{.Height}}" xmlns="http://www.w3.org/2000/svg">
+<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="7" markerHeight="7" orient="auto-start-reverse"><path d="M 0 0 L 10 5 L 0 10 z" fill="#555"/></marker></defs>
+{{range .Edges}}<line class="edge {{.Kind}} {{if .Covered}}covered{{else}}uncovered{{end}}" x1="{{.X1}}" y1="{{.Y1}}" x2="{{.X2}}" y2="{{.Y2}}" marker-end="url(#arrow)"/>
+{{if .Label}}<text class="label{{if and (eq .Kind "branch") (not .Covered)}} uncovered{{end}}" x="{{half .X1 .X2}}" y="{{add (half .Y1 .Y2) -4}}" text-anchor="middle">{{.Label}}{{if eq .Kind "branch"}} ({{.Hits}}){{end}}</text>{{end}}
+{{end}}{{range .GraphNodes}}<g class="node {{if .Hits}}covered{{else}}uncovered{{end}}"><title>{{.ID}} ({{.Type}}): {{.Hits}} hit(s)</title><rect x="{{.X}}" y="{{.Y}}" width="{{$.NodeWidth}}" height="{{$.NodeHeight}}"/><text x="{{add .X 8}}" y="{{add .Y 18}}">{{.ID}}</text><text x="{{add .X 8}}" y="{{add .Y 34}}">{{.Type}} &middot; {{.Hits}} hit(s)</text></g>
+{{end}}</svg>
+</body>
+</html>
+`))
+
+// WriteHTML writes a standalone HTML page with a graph of the definition in which
+// uncovered nodes and gateway branches are highlighted in red.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r.layout())
+}
@@ -2,35 +2,109 @@ package db
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"strings"
 	"time"
+	"unicode/utf8"
+
+	"jbpmn-engine/clock"
+
+	"github.com/google/uuid"
 )
 
+// DB is the connection opened by InitDB. It backs the package-level functions.
 var DB *sql.DB
 
 const TimeFormat = time.RFC3339
 
-func InitDB(dataSourceName string) error {
-	var err error
-	DB, err = sql.Open("sqlite3", dataSourceName)
-	if err != nil {
-		return fmt.Errorf("error opening database: %w", err)
-	}
+// logTimeFormat records the times of script logs in UTC with fixed-width nanoseconds,
+// so they compare as strings. time.RFC3339Nano parses them.
+const logTimeFormat = "2006-01-02T15:04:05.000000000Z07:00"
 
-	if err = DB.Ping(); err != nil {
-		DB.Close()
-		return fmt.Errorf("error connecting to database: %w", err)
-	}
+// defaultStore is the store used by the package-level functions.
+var defaultStore = &SQLiteStore{}
+
+// SQLiteStore persists workflow definitions, instances and node executions in SQLite.
+type SQLiteStore struct {
+	conn  *sql.DB
+	clock clock.Clock
+}
+
+// InstanceRecord is a row of the workflow_instances table.
+type InstanceRecord struct {
+	ID                    string
+	WorkflowID            string
+	WorkflowVersion       int // 0 for instances started before definitions were versioned
+	BusinessKey           string
+	ParentInstanceID      string
+	Status                string
+	StatusReason          string
+	Incident              string // Error of the last failed node execution, until the instance moves on
+	CurrentNodeInstanceID string
+	Context               string
+	WaitingSignal         string
+	ExpiresAt             *time.Time
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
+}
+
+// NodeInstanceRecord is a row of the workflow_instance_nodes table.
+type NodeInstanceRecord struct {
+	ID                 string
+	WorkflowInstanceID string
+	NodeID             string
+	Event              string // Empty for node entries; e.g. "suspended" for administrative actions
+	Detail             string // Reason or other detail of the event
+	Operator           string // Who performed an administrative action, if recorded
+	Context            string
+	WaitingSignal      string
+	ExpiresAt          *time.Time
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
 
-	createTablesSQL := `
+// ScriptLogRecord is a row of the script_logs table: one console call of a script.
+type ScriptLogRecord struct {
+	ID                 int64
+	WorkflowInstanceID string
+	NodeInstanceID     string // The workflow_instance_nodes entry of the script execution
+	NodeID             string
+	Level              string // "log", "warn" or "error"
+	Message            string
+	CreatedAt          time.Time
+}
+
+// WorkflowRecord is one version of a definition in the workflows table.
+type WorkflowRecord struct {
+	ID        string
+	Version   int
+	Name      string
+	Meta      string
+	RawJSON   string
+	Source    string // Where the version was deployed from, e.g. a file path or "api"
+	CreatedAt time.Time
+}
+
+// workflowsTableSQL creates the workflows table. Every deployment of a definition
+// is a new row; instances refer to the version they were started with.
+const workflowsTableSQL = `
     CREATE TABLE IF NOT EXISTS workflows (
-        id TEXT PRIMARY KEY,
+        id TEXT NOT NULL,
+        version INTEGER NOT NULL DEFAULT 1,
         name TEXT,
         meta TEXT,
-        raw_json TEXT
+        raw_json TEXT,
+        source TEXT NOT NULL DEFAULT '',
+        created_at DATETIME,
+        PRIMARY KEY (id, version)
     );
+`
+
+const createTablesSQL = workflowsTableSQL + `
 
     CREATE TABLE IF NOT EXISTS workflow_instances (
         id TEXT PRIMARY KEY,
@@ -55,12 +129,330 @@ func InitDB(dataSourceName string) error {
         -- Add any other relevant node-specific state here, e.g., 'status', 'output' etc.
         FOREIGN KEY (workflow_instance_id) REFERENCES workflow_instances(id)
     );
+
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+        scope TEXT NOT NULL,               -- What the key applies to, e.g. "start:approval_process"
+        key TEXT NOT NULL,                 -- Client-supplied Idempotency-Key
+        instance_id TEXT,                  -- Instance created or affected by the first request
+        created_at DATETIME,
+        PRIMARY KEY (scope, key)
+    );
+    CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
+
+    CREATE TABLE IF NOT EXISTS script_logs (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        workflow_instance_id TEXT NOT NULL, -- Instance whose script logged the message
+        node_instance_id TEXT NOT NULL,     -- workflow_instance_nodes entry of the script execution
+        node_id TEXT NOT NULL,              -- The ID of the script node definition
+        level TEXT NOT NULL,                -- "log", "warn" or "error"
+        message TEXT NOT NULL,
+        created_at DATETIME                 -- UTC in logTimeFormat, so times compare as text
+    );
+    CREATE INDEX IF NOT EXISTS idx_script_logs_instance ON script_logs(workflow_instance_id);
+    CREATE INDEX IF NOT EXISTS idx_script_logs_created_at ON script_logs(created_at);
     `
-	_, err = DB.Exec(createTablesSQL)
+
+// columnMigrations lists columns added after the original schema. They are added to
+// existing databases on open; new databases get them the same way.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"workflow_instances", "business_key", "TEXT NOT NULL DEFAULT ''"},
+	{"workflow_instances", "workflow_version", "INTEGER NOT NULL DEFAULT 0"},
+	{"workflow_instances", "parent_instance_id", "TEXT NOT NULL DEFAULT ''"},
+	{"workflow_instances", "status", "TEXT NOT NULL DEFAULT 'active'"},
+	{"workflow_instances", "status_reason", "TEXT NOT NULL DEFAULT ''"},
+	{"workflow_instances", "incident", "TEXT NOT NULL DEFAULT ''"},
+	{"workflow_instance_nodes", "event", "TEXT NOT NULL DEFAULT ''"},
+	{"workflow_instance_nodes", "detail", "TEXT NOT NULL DEFAULT ''"},
+	{"workflow_instance_nodes", "operator", "TEXT NOT NULL DEFAULT ''"},
+	{"idempotency_keys", "fingerprint", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrate adds any missing columns from columnMigrations, rebuilds a workflows
+// table that predates definition versions and applies the dataMigrations.
+func migrate(conn *sql.DB) error {
+	versioned, err := hasColumn(conn, "workflows", "version")
+	if err != nil {
+		return err
+	}
+	if !versioned {
+		if err := migrateWorkflowVersions(conn); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range columnMigrations {
+		exists, err := hasColumn(conn, m.table, m.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", m.table, m.column, err)
+		}
+	}
+
+	return migrateData(conn)
+}
+
+// dataMigrations rewrite stored rows once. A database's user_version counts those
+// applied to it; each runs in its own transaction with the version it reaches.
+var dataMigrations = []func(tx *sql.Tx) error{
+	migrateScriptEncodings,
+}
+
+// migrateData applies the dataMigrations a database has not had yet.
+func migrateData(conn *sql.DB) error {
+	var userVersion int
+	if err := conn.QueryRow("PRAGMA user_version").Scan(&userVersion); err != nil {
+		return fmt.Errorf("error reading database version: %w", err)
+	}
+	for version := userVersion + 1; version <= len(dataMigrations); version++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+		err = dataMigrations[version-1](tx)
+		if err == nil {
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error migrating database to version %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+// hasColumn reports whether table has a column named column.
+func hasColumn(conn *sql.DB, table, column string) (bool, error) {
+	rows, err := conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("error reading columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	exists := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return false, fmt.Errorf("error reading columns of %s: %w", table, err)
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	return exists, rows.Err()
+}
+
+// migrateWorkflowVersions rebuilds the original workflows table, keyed by ID alone,
+// with the (id, version) key. Existing definitions become version 1.
+func migrateWorkflowVersions(conn *sql.DB) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`ALTER TABLE workflows RENAME TO workflows_unversioned`,
+		workflowsTableSQL,
+		`INSERT INTO workflows (id, version, name, meta, raw_json) SELECT id, 1, name, meta, raw_json FROM workflows_unversioned`,
+		`DROP TABLE workflows_unversioned`,
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("error adding versions to the workflows table: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// migrateScriptEncodings sets "encoding": "base64" on the script code of stored
+// definitions that has no encoding but is entirely base64 of UTF-8 text. Such code
+// used to be decoded by guessing; it is now taken as plain JavaScript unless the
+// encoding says otherwise.
+func migrateScriptEncodings(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT id, version, raw_json FROM workflows")
+	if err != nil {
+		return fmt.Errorf("error reading workflows to mark script encodings: %w", err)
+	}
+	type update struct {
+		id      string
+		version int
+		rawJSON string
+	}
+	var updates []update
+	for rows.Next() {
+		var u update
+		var rawJSON sql.NullString
+		if err := rows.Scan(&u.id, &u.version, &rawJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading workflows to mark script encodings: %w", err)
+		}
+		marked, changed, err := markBase64Scripts([]byte(rawJSON.String))
+		if err != nil {
+			log.Printf("Not marking script encodings of workflow %s version %d: %v", u.id, u.version, err)
+			continue
+		}
+		if changed {
+			u.rawJSON = string(marked)
+			updates = append(updates, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading workflows to mark script encodings: %w", err)
+	}
+
+	for _, u := range updates {
+		if _, err := tx.Exec("UPDATE workflows SET raw_json = ? WHERE id = ? AND version = ?", u.rawJSON, u.id, u.version); err != nil {
+			return fmt.Errorf("error marking script encodings of workflow %s version %d: %w", u.id, u.version, err)
+		}
+	}
+	return nil
+}
+
+// markBase64Scripts returns the definition document rawJSON with "encoding": "base64"
+// added to every script whose code has no encoding and is entirely base64 of UTF-8
+// text, and whether there was any.
+func markBase64Scripts(rawJSON []byte) ([]byte, bool, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(rawJSON, &doc); err != nil {
+		return nil, false, err
+	}
+	var nodes []map[string]json.RawMessage
+	if raw, ok := doc["nodes"]; !ok {
+		return rawJSON, false, nil
+	} else if err := json.Unmarshal(raw, &nodes); err != nil {
+		return nil, false, err
+	}
+
+	changed := false
+	for _, node := range nodes {
+		var script map[string]json.RawMessage
+		if raw, ok := node["script"]; !ok || json.Unmarshal(raw, &script) != nil {
+			continue
+		}
+		var code string
+		if _, ok := script["encoding"]; ok || json.Unmarshal(script["code"], &code) != nil || code == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.Strict().DecodeString(code)
+		if err != nil || !utf8.Valid(decoded) {
+			continue
+		}
+		script["encoding"] = json.RawMessage(`"base64"`)
+		encoded, err := json.Marshal(script)
+		if err != nil {
+			return nil, false, err
+		}
+		node["script"] = encoded
+		changed = true
+	}
+	if !changed {
+		return rawJSON, false, nil
+	}
+
+	encoded, err := json.Marshal(nodes)
+	if err != nil {
+		return nil, false, err
+	}
+	doc["nodes"] = encoded
+	marked, err := json.MarshalIndent(doc, "", "  ")
+	return marked, err == nil, err
+}
+
+// Open opens the SQLite database at dataSourceName and ensures its tables exist.
+func Open(dataSourceName string) (*SQLiteStore, error) {
+	conn, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %w", err)
+	}
+
+	if err = conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error connecting to database: %w", err)
+	}
+
+	store, err := NewSQLiteStore(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// OpenInMemory opens a private in-memory database, e.g. for tests. Its contents
+// are lost when the store is closed.
+func OpenInMemory() (*SQLiteStore, error) {
+	store, err := Open(fmt.Sprintf("file:%s?mode=memory&cache=shared", uuid.New().String()))
 	if err != nil {
-		DB.Close()
-		return fmt.Errorf("error creating tables: %w", err)
+		return nil, err
+	}
+	// Every connection would otherwise see its own empty database once the first is closed.
+	store.conn.SetMaxOpenConns(1)
+	return store, nil
+}
+
+// NewSQLiteStore wraps an already opened connection and ensures its tables exist.
+func NewSQLiteStore(conn *sql.DB) (*SQLiteStore, error) {
+	if _, err := conn.Exec(createTablesSQL); err != nil {
+		return nil, fmt.Errorf("error creating tables: %w", err)
+	}
+	if err := migrate(conn); err != nil {
+		return nil, err
 	}
+	return &SQLiteStore{conn: conn, clock: clock.Real{}}, nil
+}
+
+// SetClock sets the clock used for created/updated timestamps and expiry checks.
+func (s *SQLiteStore) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// now returns the current time of the store's clock.
+func (s *SQLiteStore) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// Conn returns the underlying database connection.
+func (s *SQLiteStore) Conn() *sql.DB {
+	return s.conn
+}
+
+// Close closes the underlying database connection.
+func (s *SQLiteStore) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// DefaultStore returns the store backing the package-level functions.
+// It becomes usable once InitDB has been called.
+func DefaultStore() *SQLiteStore {
+	return defaultStore
+}
+
+func InitDB(dataSourceName string) error {
+	store, err := Open(dataSourceName)
+	if err != nil {
+		return err
+	}
+	DB = store.conn
+	defaultStore.conn = store.conn
+	defaultStore.clock = store.clock
 	log.Println("Database initialized and tables ensured.")
 	return nil
 }
@@ -77,24 +469,157 @@ func CloseDB() error {
 	return nil
 }
 
-func SaveWorkflow(id, name, meta, rawJSON string) error {
-	_, err := DB.Exec(
-		"INSERT INTO workflows (id, name, meta, raw_json) VALUES (?, ?, ?, ?) ON CONFLICT(id) DO UPDATE SET name=excluded.name, meta=excluded.meta, raw_json=excluded.raw_json",
-		id, name, meta, rawJSON,
+// SaveWorkflow stores a definition as a new version unless it equals the latest one.
+func SaveWorkflow(id, name, meta, rawJSON, source string) (version int, created bool, err error) {
+	return defaultStore.SaveWorkflow(id, name, meta, rawJSON, source)
+}
+
+// GetWorkflow retrieves the latest version of a definition.
+func GetWorkflow(id string) (*WorkflowRecord, error) {
+	return defaultStore.GetWorkflow(id)
+}
+
+// SaveNewInstance creates a new workflow instance and its initial node entry.
+// It returns the ID of the new instance and the ID of the initial node instance.
+func SaveNewInstance(instanceID, workflowID string, workflowVersion int, businessKey, initialNodeID, context, waitingSignal string, expiresAt *time.Time) (string, string, error) {
+	return defaultStore.SaveNewInstance(instanceID, workflowID, workflowVersion, businessKey, initialNodeID, context, waitingSignal, expiresAt)
+}
+
+// UpdateInstanceCurrentNodeAndContext updates the main workflow instance record
+// and creates a new entry in workflow_instance_nodes for the transition.
+func UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID string, newContext string, waitingSignal string, expiresAt *time.Time) (string, error) {
+	return defaultStore.UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID, newContext, waitingSignal, expiresAt)
+}
+
+// GetInstance retrieves a workflow instance by its ID.
+// This now returns the current_node_instance_id instead of current_node (the definition ID).
+func GetInstance(instanceID string) (id, workflowID, currentNodeInstanceID, context, waitingSignal string, expiresAt *time.Time, createdAt, updatedAt time.Time, err error) {
+	rec, err := defaultStore.GetInstance(instanceID)
+	if err != nil {
+		return
+	}
+	return rec.ID, rec.WorkflowID, rec.CurrentNodeInstanceID, rec.Context, rec.WaitingSignal, rec.ExpiresAt, rec.CreatedAt, rec.UpdatedAt, nil
+}
+
+// GetNodeInstance retrieves a specific workflow_instance_node by its ID.
+func GetNodeInstance(nodeInstanceID string) (id, workflowInstanceID, nodeID, context, waitingSignal string, expiresAt *time.Time, createdAt, updatedAt time.Time, err error) {
+	rec, err := defaultStore.GetNodeInstance(nodeInstanceID)
+	if err != nil {
+		return
+	}
+	return rec.ID, rec.WorkflowInstanceID, rec.NodeID, rec.Context, rec.WaitingSignal, rec.ExpiresAt, rec.CreatedAt, rec.UpdatedAt, nil
+}
+
+// GetInstancesWaitingForSignal retrieves instances waiting for a specific signal.
+func GetInstancesWaitingForSignal(signalName string) ([]string, error) {
+	return defaultStore.GetInstancesWaitingForSignal(signalName)
+}
+
+// GetExpiredInstances retrieves all workflow instances that have expired.
+func GetExpiredInstances() ([]string, error) {
+	return defaultStore.GetExpiredInstances()
+}
+
+// SaveInstanceTimer records the deadline of a pending node timeout so it can be re-armed
+// after a restart.
+func SaveInstanceTimer(instanceID, nodeInstanceID string, expiresAt time.Time) error {
+	return defaultStore.SaveInstanceTimer(instanceID, nodeInstanceID, expiresAt)
+}
+
+// GetInstancesWithTimers retrieves all workflow instances that have a pending timer.
+func GetInstancesWithTimers() ([]string, error) {
+	return defaultStore.GetInstancesWithTimers()
+}
+
+// SaveWorkflow stores a definition as a new version and returns its version number.
+// If rawJSON equals the latest version, nothing is stored and that version is
+// returned with created set to false.
+func (s *SQLiteStore) SaveWorkflow(id, name, meta, rawJSON, source string) (version int, created bool, err error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var latestRaw sql.NullString
+	err = tx.QueryRow("SELECT version, raw_json FROM workflows WHERE id = ? ORDER BY version DESC LIMIT 1", id).Scan(&version, &latestRaw)
+	switch {
+	case err == sql.ErrNoRows:
+		version = 0
+	case err != nil:
+		return 0, false, fmt.Errorf("failed to read latest version of workflow %s: %w", id, err)
+	case latestRaw.String == rawJSON:
+		return version, false, nil
+	}
+
+	version++
+	_, err = tx.Exec(
+		"INSERT INTO workflows (id, version, name, meta, raw_json, source, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		id, version, name, meta, rawJSON, source, s.now().Format(TimeFormat),
 	)
-	return err
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to save workflow %s version %d: %w", id, version, err)
+	}
+	return version, true, tx.Commit()
 }
 
-func GetWorkflow(id string) (id_ string, name, meta, rawJSON string, err error) {
-	row := DB.QueryRow("SELECT id, name, meta, raw_json FROM workflows WHERE id = ?", id)
-	err = row.Scan(&id_, &name, &meta, &rawJSON)
-	return
+const selectWorkflowSQL = "SELECT id, version, name, meta, raw_json, source, created_at FROM workflows"
+
+func scanWorkflow(row interface{ Scan(...interface{}) error }) (*WorkflowRecord, error) {
+	var rec WorkflowRecord
+	var name, meta, rawJSON, createdAt sql.NullString
+	if err := row.Scan(&rec.ID, &rec.Version, &name, &meta, &rawJSON, &rec.Source, &createdAt); err != nil {
+		return nil, err
+	}
+	rec.Name, rec.Meta, rec.RawJSON = name.String, meta.String, rawJSON.String
+	if createdAt.Valid {
+		rec.CreatedAt, _ = time.Parse(TimeFormat, createdAt.String)
+	}
+	return &rec, nil
+}
+
+// GetWorkflow retrieves the latest version of a definition.
+func (s *SQLiteStore) GetWorkflow(id string) (*WorkflowRecord, error) {
+	return scanWorkflow(s.conn.QueryRow(selectWorkflowSQL+" WHERE id = ? ORDER BY version DESC LIMIT 1", id))
+}
+
+// GetWorkflowVersion retrieves a specific version of a definition.
+func (s *SQLiteStore) GetWorkflowVersion(id string, version int) (*WorkflowRecord, error) {
+	return scanWorkflow(s.conn.QueryRow(selectWorkflowSQL+" WHERE id = ? AND version = ?", id, version))
+}
+
+// ListWorkflowVersions retrieves every version of a definition, oldest first.
+func (s *SQLiteStore) ListWorkflowVersions(id string) ([]WorkflowRecord, error) {
+	return s.queryWorkflows(selectWorkflowSQL+" WHERE id = ? ORDER BY version", id)
+}
+
+// ListWorkflows retrieves the latest version of every definition, ordered by ID.
+func (s *SQLiteStore) ListWorkflows() ([]WorkflowRecord, error) {
+	return s.queryWorkflows(selectWorkflowSQL + " w WHERE version = (SELECT MAX(version) FROM workflows WHERE id = w.id) ORDER BY id")
+}
+
+func (s *SQLiteStore) queryWorkflows(query string, args ...interface{}) ([]WorkflowRecord, error) {
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []WorkflowRecord
+	for rows.Next() {
+		rec, err := scanWorkflow(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	return records, rows.Err()
 }
 
 // SaveNewInstance creates a new workflow instance and its initial node entry.
 // It returns the ID of the new instance and the ID of the initial node instance.
-func SaveNewInstance(instanceID, workflowID, initialNodeID, context, waitingSignal string, expiresAt *time.Time) (string, string, error) {
-	now := time.Now()
+func (s *SQLiteStore) SaveNewInstance(instanceID, workflowID string, workflowVersion int, businessKey, initialNodeID, context, waitingSignal string, expiresAt *time.Time) (string, string, error) {
+	now := s.now()
 	var expiresAtStr *string
 	if expiresAt != nil {
 		s := expiresAt.Format(TimeFormat)
@@ -102,10 +627,10 @@ func SaveNewInstance(instanceID, workflowID, initialNodeID, context, waitingSign
 	}
 
 	// Insert into workflow_instances
-	_, err := DB.Exec(
-		`INSERT INTO workflow_instances (id, workflow_id, current_node_instance_id, context, waiting_signal, expires_at, created_at, updated_at)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
-		instanceID, workflowID, "", context, waitingSignal, expiresAtStr, now.Format(TimeFormat), now.Format(TimeFormat),
+	_, err := s.conn.Exec(
+		`INSERT INTO workflow_instances (id, workflow_id, workflow_version, business_key, current_node_instance_id, context, waiting_signal, expires_at, created_at, updated_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		instanceID, workflowID, workflowVersion, businessKey, "", context, waitingSignal, expiresAtStr, now.Format(TimeFormat), now.Format(TimeFormat),
 	)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to save new workflow instance: %w", err)
@@ -113,7 +638,7 @@ func SaveNewInstance(instanceID, workflowID, initialNodeID, context, waitingSign
 
 	// Create and save the initial workflow_instance_node entry
 	initialNodeInstanceID := initialNodeID + "-" + instanceID // A simple unique ID for the initial node instance
-	_, err = DB.Exec(
+	_, err = s.conn.Exec(
 		`INSERT INTO workflow_instance_nodes (id, workflow_instance_id, node_id, context, waiting_signal, expires_at, created_at, updated_at)
         VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 		initialNodeInstanceID, instanceID, initialNodeID, context, waitingSignal, expiresAtStr, now.Format(TimeFormat), now.Format(TimeFormat),
@@ -123,7 +648,7 @@ func SaveNewInstance(instanceID, workflowID, initialNodeID, context, waitingSign
 	}
 
 	// Update the workflow_instances table with the actual current_node_instance_id
-	_, err = DB.Exec(
+	_, err = s.conn.Exec(
 		`UPDATE workflow_instances SET current_node_instance_id = ? WHERE id = ?`,
 		initialNodeInstanceID, instanceID,
 	)
@@ -136,8 +661,8 @@ func SaveNewInstance(instanceID, workflowID, initialNodeID, context, waitingSign
 
 // UpdateInstanceCurrentNodeAndContext updates the main workflow instance record
 // and creates a new entry in workflow_instance_nodes for the transition.
-func UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID string, newContext string, waitingSignal string, expiresAt *time.Time) (string, error) {
-	now := time.Now()
+func (s *SQLiteStore) UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID string, newContext string, waitingSignal string, expiresAt *time.Time) (string, error) {
+	now := s.now()
 	var expiresAtStr *string
 	if expiresAt != nil {
 		s := expiresAt.Format(TimeFormat)
@@ -145,8 +670,8 @@ func UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID string, newContex
 	}
 
 	// First, insert the new node entry into workflow_instance_nodes
-	newNodeInstanceID := newNodeID + "-" + instanceID + "-" + fmt.Sprintf("%d", now.UnixNano()) // More unique ID
-	_, err := DB.Exec(
+	newNodeInstanceID := uuid.New().String() // Unique even when the clock does not move between transitions
+	_, err := s.conn.Exec(
 		`INSERT INTO workflow_instance_nodes (id, workflow_instance_id, node_id, context, waiting_signal, expires_at, created_at, updated_at)
         VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
 		newNodeInstanceID, instanceID, newNodeID, newContext, waitingSignal, expiresAtStr, now.Format(TimeFormat), now.Format(TimeFormat),
@@ -156,12 +681,13 @@ func UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID string, newContex
 	}
 
 	// Then, update the main workflow_instances record's current_node_instance_id
-	_, err = DB.Exec(
+	_, err = s.conn.Exec(
 		`UPDATE workflow_instances SET
             current_node_instance_id = ?,
             context = ?,
             waiting_signal = ?,
             expires_at = ?,
+            incident = '',
             updated_at = ?
         WHERE id = ?`,
 		newNodeInstanceID, newContext, waitingSignal, expiresAtStr, now.Format(TimeFormat), instanceID,
@@ -173,57 +699,133 @@ func UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID string, newContex
 	return newNodeInstanceID, nil
 }
 
-// GetInstance retrieves a workflow instance by its ID.
-// This now returns the current_node_instance_id instead of current_node (the definition ID).
-func GetInstance(instanceID string) (id, workflowID, currentNodeInstanceID, context, waitingSignal string, expiresAt *time.Time, createdAt, updatedAt time.Time, err error) {
+const selectInstanceSQL = "SELECT id, workflow_id, workflow_version, business_key, parent_instance_id, status, status_reason, incident, current_node_instance_id, context, waiting_signal, expires_at, created_at, updated_at FROM workflow_instances"
+
+func scanInstance(row interface{ Scan(...interface{}) error }) (*InstanceRecord, error) {
+	var rec InstanceRecord
 	var expiresAtStr, createdAtStr, updatedAtStr sql.NullString
-	row := DB.QueryRow("SELECT id, workflow_id, current_node_instance_id, context, waiting_signal, expires_at, created_at, updated_at FROM workflow_instances WHERE id = ?", instanceID)
-	err = row.Scan(&id, &workflowID, &currentNodeInstanceID, &context, &waitingSignal, &expiresAtStr, &createdAtStr, &updatedAtStr)
+	err := row.Scan(&rec.ID, &rec.WorkflowID, &rec.WorkflowVersion, &rec.BusinessKey, &rec.ParentInstanceID, &rec.Status, &rec.StatusReason, &rec.Incident, &rec.CurrentNodeInstanceID, &rec.Context, &rec.WaitingSignal, &expiresAtStr, &createdAtStr, &updatedAtStr)
+	if err != nil {
+		return nil, err
+	}
 
-	if err == nil {
-		if expiresAtStr.Valid {
-			t, parseErr := time.Parse(TimeFormat, expiresAtStr.String)
-			if parseErr == nil {
-				expiresAt = &t
-			}
-		}
-		if createdAtStr.Valid {
-			createdAt, _ = time.Parse(TimeFormat, createdAtStr.String)
-		}
-		if updatedAtStr.Valid {
-			updatedAt, _ = time.Parse(TimeFormat, updatedAtStr.String)
+	rec.ExpiresAt, rec.CreatedAt, rec.UpdatedAt = parseTimes(expiresAtStr, createdAtStr, updatedAtStr)
+	return &rec, nil
+}
+
+// GetInstance retrieves a workflow instance by its ID.
+// It returns sql.ErrNoRows if the instance does not exist.
+func (s *SQLiteStore) GetInstance(instanceID string) (*InstanceRecord, error) {
+	return scanInstance(s.conn.QueryRow(selectInstanceSQL+" WHERE id = ?", instanceID))
+}
+
+// InstanceFilter selects instances for ListInstances. Empty fields match everything.
+type InstanceFilter struct {
+	WorkflowID    string
+	Status        string
+	IncidentsOnly bool // only instances whose last node execution failed
+	Limit         int  // 0 for no limit
+}
+
+// ListInstances retrieves the instances matching filter, most recently created first.
+func (s *SQLiteStore) ListInstances(filter InstanceFilter) ([]InstanceRecord, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.WorkflowID != "" {
+		conditions = append(conditions, "workflow_id = ?")
+		args = append(args, filter.WorkflowID)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.IncidentsOnly {
+		conditions = append(conditions, "incident != ''")
+	}
+	query := selectInstanceSQL
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY created_at DESC, rowid DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := s.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []InstanceRecord
+	for rows.Next() {
+		rec, err := scanInstance(rows)
+		if err != nil {
+			return nil, err
 		}
+		records = append(records, *rec)
 	}
-	return
+	return records, rows.Err()
 }
 
 // GetNodeInstance retrieves a specific workflow_instance_node by its ID.
-func GetNodeInstance(nodeInstanceID string) (id, workflowInstanceID, nodeID, context, waitingSignal string, expiresAt *time.Time, createdAt, updatedAt time.Time, err error) {
+// It returns sql.ErrNoRows if the node instance does not exist.
+func (s *SQLiteStore) GetNodeInstance(nodeInstanceID string) (*NodeInstanceRecord, error) {
+	var rec NodeInstanceRecord
 	var expiresAtStr, createdAtStr, updatedAtStr sql.NullString
-	row := DB.QueryRow("SELECT id, workflow_instance_id, node_id, context, waiting_signal, expires_at, created_at, updated_at FROM workflow_instance_nodes WHERE id = ?", nodeInstanceID)
-	err = row.Scan(&id, &workflowInstanceID, &nodeID, &context, &waitingSignal, &expiresAtStr, &createdAtStr, &updatedAtStr)
+	row := s.conn.QueryRow("SELECT id, workflow_instance_id, node_id, event, detail, operator, context, waiting_signal, expires_at, created_at, updated_at FROM workflow_instance_nodes WHERE id = ?", nodeInstanceID)
+	err := row.Scan(&rec.ID, &rec.WorkflowInstanceID, &rec.NodeID, &rec.Event, &rec.Detail, &rec.Operator, &rec.Context, &rec.WaitingSignal, &expiresAtStr, &createdAtStr, &updatedAtStr)
+	if err != nil {
+		return nil, err
+	}
 
-	if err == nil {
-		if expiresAtStr.Valid {
-			t, parseErr := time.Parse(TimeFormat, expiresAtStr.String)
-			if parseErr == nil {
-				expiresAt = &t
-			}
-		}
-		if createdAtStr.Valid {
-			createdAt, _ = time.Parse(TimeFormat, createdAtStr.String)
+	rec.ExpiresAt, rec.CreatedAt, rec.UpdatedAt = parseTimes(expiresAtStr, createdAtStr, updatedAtStr)
+	return &rec, nil
+}
+
+// GetNodeHistory retrieves every workflow_instance_node of an instance in the order
+// the nodes were entered.
+func (s *SQLiteStore) GetNodeHistory(instanceID string) ([]NodeInstanceRecord, error) {
+	rows, err := s.conn.Query("SELECT id, workflow_instance_id, node_id, event, detail, operator, context, waiting_signal, expires_at, created_at, updated_at FROM workflow_instance_nodes WHERE workflow_instance_id = ? ORDER BY rowid", instanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []NodeInstanceRecord
+	for rows.Next() {
+		var rec NodeInstanceRecord
+		var expiresAtStr, createdAtStr, updatedAtStr sql.NullString
+		if err := rows.Scan(&rec.ID, &rec.WorkflowInstanceID, &rec.NodeID, &rec.Event, &rec.Detail, &rec.Operator, &rec.Context, &rec.WaitingSignal, &expiresAtStr, &createdAtStr, &updatedAtStr); err != nil {
+			return nil, err
 		}
-		if updatedAtStr.Valid {
-			updatedAt, _ = time.Parse(TimeFormat, updatedAtStr.String)
+		rec.ExpiresAt, rec.CreatedAt, rec.UpdatedAt = parseTimes(expiresAtStr, createdAtStr, updatedAtStr)
+		history = append(history, rec)
+	}
+	return history, rows.Err()
+}
+
+// parseTimes converts the nullable timestamp columns shared by instance and node rows.
+func parseTimes(expiresAtStr, createdAtStr, updatedAtStr sql.NullString) (expiresAt *time.Time, createdAt, updatedAt time.Time) {
+	if expiresAtStr.Valid {
+		t, parseErr := time.Parse(TimeFormat, expiresAtStr.String)
+		if parseErr == nil {
+			expiresAt = &t
 		}
 	}
+	if createdAtStr.Valid {
+		createdAt, _ = time.Parse(TimeFormat, createdAtStr.String)
+	}
+	if updatedAtStr.Valid {
+		updatedAt, _ = time.Parse(TimeFormat, updatedAtStr.String)
+	}
 	return
 }
 
-// GetInstancesWaitingForSignal retrieves instances waiting for a specific signal.
-// This now queries the workflow_instances table directly for the main signal field.
-func GetInstancesWaitingForSignal(signalName string) ([]string, error) {
-	rows, err := DB.Query("SELECT id FROM workflow_instances WHERE waiting_signal = ?", signalName)
+// GetInstancesWaitingForSignal retrieves active instances waiting for a specific signal.
+// Suspended instances are left out so they do not receive signals.
+func (s *SQLiteStore) GetInstancesWaitingForSignal(signalName string) ([]string, error) {
+	rows, err := s.conn.Query("SELECT id FROM workflow_instances WHERE waiting_signal = ? AND status = 'active'", signalName)
 	if err != nil {
 		return nil, err
 	}
@@ -241,9 +843,64 @@ func GetInstancesWaitingForSignal(signalName string) ([]string, error) {
 }
 
 // GetExpiredInstances retrieves all workflow instances that have expired.
-// This now queries the workflow_instances table directly for the main expires_at field.
-func GetExpiredInstances() ([]string, error) {
-	rows, err := DB.Query("SELECT id FROM workflow_instances WHERE expires_at IS NOT NULL AND expires_at <= ?", time.Now().Format(TimeFormat))
+func (s *SQLiteStore) GetExpiredInstances() ([]string, error) {
+	rows, err := s.conn.Query("SELECT id FROM workflow_instances WHERE expires_at IS NOT NULL AND expires_at <= ?", s.now().Format(TimeFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var instanceIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		instanceIDs = append(instanceIDs, id)
+	}
+	return instanceIDs, nil
+}
+
+// SaveInstanceTimer records the deadline of a pending node timeout so it can be re-armed
+// after a restart. The instance is only updated if it is still on the given node instance.
+func (s *SQLiteStore) SaveInstanceTimer(instanceID, nodeInstanceID string, expiresAt time.Time) error {
+	expiresAtStr := expiresAt.Format(TimeFormat)
+
+	_, err := s.conn.Exec(
+		`UPDATE workflow_instances SET expires_at = ? WHERE id = ? AND current_node_instance_id = ?`,
+		expiresAtStr, instanceID, nodeInstanceID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save timer for workflow instance: %w", err)
+	}
+
+	_, err = s.conn.Exec(
+		`UPDATE workflow_instance_nodes SET expires_at = ? WHERE id = ?`,
+		expiresAtStr, nodeInstanceID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to save timer for workflow instance node: %w", err)
+	}
+	return nil
+}
+
+// ClearInstanceTimer forgets the pending node timeout of an instance, e.g. because it
+// was cancelled. The instance is only updated if it is still on the given node instance.
+func (s *SQLiteStore) ClearInstanceTimer(instanceID, nodeInstanceID string) error {
+	_, err := s.conn.Exec(
+		`UPDATE workflow_instances SET expires_at = NULL WHERE id = ? AND current_node_instance_id = ?`,
+		instanceID, nodeInstanceID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to clear timer of workflow instance: %w", err)
+	}
+	return nil
+}
+
+// GetInstancesWithTimers retrieves all workflow instances that have a pending timer,
+// regardless of whether it has expired yet.
+func (s *SQLiteStore) GetInstancesWithTimers() ([]string, error) {
+	rows, err := s.conn.Query("SELECT id FROM workflow_instances WHERE expires_at IS NOT NULL AND expires_at != ''")
 	if err != nil {
 		return nil, err
 	}
@@ -258,4 +915,167 @@ func GetExpiredInstances() ([]string, error) {
 		instanceIDs = append(instanceIDs, id)
 	}
 	return instanceIDs, nil
-}
\ No newline at end of file
+}
+
+// ClaimIdempotencyKey records that the request identified by scope and key, whose
+// content hashes to fingerprint, affects instanceID. Keys recorded before
+// expiredBefore are discarded first, in the same transaction. If the key is already
+// held, claimed is false and owner and ownerFingerprint are those recorded by the
+// first request. Keys are recorded in UTC, so their times compare as strings.
+func (s *SQLiteStore) ClaimIdempotencyKey(scope, key, fingerprint, instanceID string, expiredBefore time.Time) (owner, ownerFingerprint string, claimed bool, err error) {
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return "", "", false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, expiredBefore.UTC().Format(TimeFormat)); err != nil {
+		return "", "", false, fmt.Errorf("failed to expire idempotency keys: %w", err)
+	}
+
+	res, err := tx.Exec(
+		`INSERT OR IGNORE INTO idempotency_keys (scope, key, fingerprint, instance_id, created_at) VALUES (?, ?, ?, ?, ?)`,
+		scope, key, fingerprint, instanceID, s.now().UTC().Format(TimeFormat),
+	)
+	if err != nil {
+		return "", "", false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return instanceID, fingerprint, true, tx.Commit()
+	}
+
+	var existing sql.NullString
+	if err := tx.QueryRow(`SELECT instance_id, fingerprint FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key).Scan(&existing, &ownerFingerprint); err != nil {
+		return "", "", false, fmt.Errorf("failed to read idempotency key: %w", err)
+	}
+	return existing.String, ownerFingerprint, false, tx.Commit()
+}
+
+// ReleaseIdempotencyKey forgets a claimed key, e.g. because the request it guarded failed.
+func (s *SQLiteStore) ReleaseIdempotencyKey(scope, key string) error {
+	_, err := s.conn.Exec(`DELETE FROM idempotency_keys WHERE scope = ? AND key = ?`, scope, key)
+	return err
+}
+
+// SetInstanceParent records that instanceID was started on behalf of parentInstanceID.
+func (s *SQLiteStore) SetInstanceParent(instanceID, parentInstanceID string) error {
+	_, err := s.conn.Exec(`UPDATE workflow_instances SET parent_instance_id = ? WHERE id = ?`, parentInstanceID, instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to set parent of workflow instance: %w", err)
+	}
+	return nil
+}
+
+// GetChildInstances retrieves the instances started on behalf of parentInstanceID.
+func (s *SQLiteStore) GetChildInstances(parentInstanceID string) ([]string, error) {
+	rows, err := s.conn.Query("SELECT id FROM workflow_instances WHERE parent_instance_id = ? ORDER BY rowid", parentInstanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var instanceIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		instanceIDs = append(instanceIDs, id)
+	}
+	return instanceIDs, rows.Err()
+}
+
+// SetInstanceStatus changes the status of an instance ("active", "suspended" or
+// "cancelled"). Cancelling an instance also clears its waiting signal and timer.
+func (s *SQLiteStore) SetInstanceStatus(instanceID, status, reason string) error {
+	query := `UPDATE workflow_instances SET status = ?, status_reason = ?, updated_at = ? WHERE id = ?`
+	if status == "cancelled" {
+		query = `UPDATE workflow_instances SET status = ?, status_reason = ?, updated_at = ?, waiting_signal = '', expires_at = NULL WHERE id = ?`
+	}
+	_, err := s.conn.Exec(query, status, reason, s.now().Format(TimeFormat), instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to set status of workflow instance: %w", err)
+	}
+	return nil
+}
+
+// SetInstanceIncident records the error of a failed node execution on an instance, or
+// clears it if message is empty. Moving the instance to another node also clears it.
+func (s *SQLiteStore) SetInstanceIncident(instanceID, message string) error {
+	_, err := s.conn.Exec(`UPDATE workflow_instances SET incident = ?, updated_at = ? WHERE id = ?`, message, s.now().Format(TimeFormat), instanceID)
+	if err != nil {
+		return fmt.Errorf("failed to set incident of workflow instance: %w", err)
+	}
+	return nil
+}
+
+// RecordInstanceEvent appends an event such as "suspended" to the node history of an
+// instance, with the operator who caused it if known. The entry records the current
+// context but does not become the current node instance, so pending timers and
+// signals are unaffected.
+func (s *SQLiteStore) RecordInstanceEvent(instanceID, nodeID, event, operator, detail string) error {
+	now := s.now().Format(TimeFormat)
+	_, err := s.conn.Exec(
+		`INSERT INTO workflow_instance_nodes (id, workflow_instance_id, node_id, event, detail, operator, context, waiting_signal, created_at, updated_at)
+        SELECT ?, id, ?, ?, ?, ?, context, '', ?, ? FROM workflow_instances WHERE id = ?`,
+		uuid.New().String(), nodeID, event, detail, operator, now, now, instanceID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record %s event for workflow instance: %w", event, err)
+	}
+	return nil
+}
+
+// SaveScriptLogs stores the console output of one script execution. Each record's
+// instance, node instance and node are taken from the arguments; ID is assigned.
+// Logs recorded before expiredBefore, of any instance, are deleted first, unless it
+// is the zero time.
+func (s *SQLiteStore) SaveScriptLogs(instanceID, nodeInstanceID, nodeID string, logs []ScriptLogRecord, expiredBefore time.Time) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	tx, err := s.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to save script logs: %w", err)
+	}
+	defer tx.Rollback()
+	if !expiredBefore.IsZero() {
+		if _, err := tx.Exec(`DELETE FROM script_logs WHERE created_at < ?`, expiredBefore.UTC().Format(logTimeFormat)); err != nil {
+			return fmt.Errorf("failed to delete expired script logs: %w", err)
+		}
+	}
+	for _, rec := range logs {
+		_, err := tx.Exec(
+			`INSERT INTO script_logs (workflow_instance_id, node_instance_id, node_id, level, message, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+			instanceID, nodeInstanceID, nodeID, rec.Level, rec.Message, rec.CreatedAt.UTC().Format(logTimeFormat),
+		)
+		if err != nil {
+			return fmt.Errorf("failed to save script logs: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// GetScriptLogs retrieves the console output of every script of an instance in the
+// order it was logged.
+func (s *SQLiteStore) GetScriptLogs(instanceID string) ([]ScriptLogRecord, error) {
+	rows, err := s.conn.Query("SELECT id, workflow_instance_id, node_instance_id, node_id, level, message, created_at FROM script_logs WHERE workflow_instance_id = ? ORDER BY id", instanceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []ScriptLogRecord
+	for rows.Next() {
+		var rec ScriptLogRecord
+		var createdAtStr sql.NullString
+		if err := rows.Scan(&rec.ID, &rec.WorkflowInstanceID, &rec.NodeInstanceID, &rec.NodeID, &rec.Level, &rec.Message, &createdAtStr); err != nil {
+			return nil, err
+		}
+		if createdAtStr.Valid {
+			rec.CreatedAt, _ = time.Parse(time.RFC3339Nano, createdAtStr.String)
+		}
+		logs = append(logs, rec)
+	}
+	return logs, rows.Err()
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"jbpmn-engine/clock"
+
+	"github.com/google/uuid"
+)
+
+func TestSetClock(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "engine.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	start := time.Date(2025, 1, 1, 9, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	store.SetClock(fake)
+
+	_, first, err := store.SaveNewInstance("i1", "orders", 1, "", "start_node", "{}", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Advance(time.Hour)
+	second, err := store.UpdateInstanceCurrentNodeAndContext("i1", "review", "{}", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := store.GetInstance("i1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !instance.CreatedAt.Equal(start) || !instance.UpdatedAt.Equal(start.Add(time.Hour)) {
+		t.Errorf("created %v, updated %v; want %v and %v", instance.CreatedAt, instance.UpdatedAt, start, start.Add(time.Hour))
+	}
+	for id, want := range map[string]time.Time{first: start, second: start.Add(time.Hour)} {
+		node, err := store.GetNodeInstance(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !node.CreatedAt.Equal(want) {
+			t.Errorf("node %s created %v, want %v", node.NodeID, node.CreatedAt, want)
+		}
+	}
+}
+
+func TestMigrateScriptEncodings(t *testing.T) {
+	conn, err := sql.Open("sqlite3", "file:"+uuid.New().String()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+	if _, err := conn.Exec(createTablesSQL); err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"id": "orders", "nodes": [
+  {"id": "guessed", "type": "script", "script": {"code": "cmV0dXJuIHt9Ow=="}},
+  {"id": "plain", "type": "script", "script": {"code": "return {};"}},
+  {"id": "explicit", "type": "script", "script": {"code": "cmV0dXJuIHt9Ow==", "encoding": "base64"}}
+]}`
+	if _, err := conn.Exec("INSERT INTO workflows (id, version, raw_json) VALUES ('orders', 1, ?)", legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewSQLiteStore(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := store.GetWorkflow("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Nodes []struct {
+			Script map[string]string `json:"script"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal([]byte(record.RawJSON), &doc); err != nil {
+		t.Fatal(err)
+	}
+	var encodings []string
+	for _, node := range doc.Nodes {
+		encodings = append(encodings, node.Script["encoding"])
+	}
+	if want := []string{"base64", "", "base64"}; !reflect.DeepEqual(encodings, want) {
+		t.Errorf("encodings = %q, want %q", encodings, want)
+	}
+
+	// Definitions stored afterwards are left as they are.
+	if _, _, err := store.SaveWorkflow("orders", "", "", legacy, "api"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSQLiteStore(conn); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := store.GetWorkflow("orders"); err != nil || record.RawJSON != legacy {
+		t.Errorf("version 2 = %v, %v; want it unchanged", record, err)
+	}
+}
+
+func TestScriptLogsExpireByTheirOwnTime(t *testing.T) {
+	store, err := OpenInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.FixedZone("CET", 3600))
+	save := func(instanceID string, at, expiredBefore time.Time) {
+		t.Helper()
+		logs := []ScriptLogRecord{{Level: "log", Message: "hi", CreatedAt: at}}
+		if err := store.SaveScriptLogs(instanceID, "n-"+instanceID, "script", logs, expiredBefore); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	save("old", start, time.Time{})
+	save("old", start.Add(time.Second), time.Time{})
+	// Expires the first log of old, at a whole second, but not the second one.
+	save("new", start.Add(1500*time.Millisecond), start.Add(500*time.Millisecond))
+
+	for instanceID, want := range map[string]int{"old": 1, "new": 1} {
+		logs, err := store.GetScriptLogs(instanceID)
+		if err != nil || len(logs) != want {
+			t.Errorf("logs of %s = %v, %v; want %d", instanceID, logs, err, want)
+		}
+	}
+	if logs, _ := store.GetScriptLogs("old"); len(logs) == 1 && !logs[0].CreatedAt.Equal(start.Add(time.Second)) {
+		t.Errorf("kept log of %v, want the one of %v", logs[0].CreatedAt, start.Add(time.Second))
+	}
+}
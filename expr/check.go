@@ -0,0 +1,251 @@
+package expr
+
+import (
+	"regexp"
+)
+
+// processData is the name under which scripts see the variables. Expressions accept
+// it too, so process_data.amount is the same as amount, unless a variable has that
+// name.
+const processData = "process_data"
+
+// check determines the type of root and reports operations that cannot succeed
+// with the types known from vars, e.g. comparing a number with a string.
+func check(root node, vars map[string]Type) (Type, error) {
+	c := &checker{vars: vars}
+	return c.typeOf(root)
+}
+
+type checker struct {
+	vars map[string]Type
+}
+
+// aliased reports whether n refers to all variables through process_data.
+func (c *checker) aliased(n node) bool {
+	v, ok := n.(*variable)
+	if !ok || v.name != processData {
+		return false
+	}
+	_, declared := c.vars[processData]
+	return !declared
+}
+
+func (c *checker) typeOf(n node) (Type, error) {
+	switch n := n.(type) {
+	case *literal:
+		return typeOfValue(n.value), nil
+	case *variable:
+		if c.aliased(n) {
+			return Object, nil
+		}
+		return c.vars[n.name], nil
+	case *member:
+		if c.aliased(n.object) {
+			return c.vars[n.name], nil
+		}
+		object, err := c.typeOf(n.object)
+		if err != nil {
+			return Any, err
+		}
+		if object != Any && object != Object && !(object == Null && n.optional) {
+			return Any, errorf(n.at, "%s is %s, which has no field %s", n.object, article(object), n.name)
+		}
+		return Any, nil
+	case *index:
+		object, err := c.typeOf(n.object)
+		if err != nil {
+			return Any, err
+		}
+		key, err := c.typeOf(n.key)
+		if err != nil {
+			return Any, err
+		}
+		switch {
+		case object == Array && key != Any && key != Number:
+			return Any, errorf(n.key.pos(), "%s is an array, so its index must be a number, not %s", n.object, article(key))
+		case object == Object && key != Any && key != String:
+			return Any, errorf(n.key.pos(), "%s is an object, so its key must be a string, not %s", n.object, article(key))
+		case object != Any && object != Array && object != Object && !(object == Null && n.optional):
+			return Any, errorf(n.at, "%s is %s, which cannot be indexed", n.object, article(object))
+		}
+		return Any, nil
+	case *array:
+		for _, item := range n.items {
+			if _, err := c.typeOf(item); err != nil {
+				return Any, err
+			}
+		}
+		return Array, nil
+	case *unary:
+		operand, err := c.typeOf(n.operand)
+		if err != nil {
+			return Any, err
+		}
+		if n.op == "!" {
+			return Bool, c.expect(n.operand, operand, "! needs", Bool, Null)
+		}
+		return Number, c.expect(n.operand, operand, "- needs", Number)
+	case *binary:
+		return c.binary(n)
+	case *call:
+		return c.call(n)
+	}
+	return Any, nil
+}
+
+func (c *checker) binary(n *binary) (Type, error) {
+	left, err := c.typeOf(n.left)
+	if err != nil {
+		return Any, err
+	}
+	right, err := c.typeOf(n.right)
+	if err != nil {
+		return Any, err
+	}
+	known := left != Any && right != Any && left != Null && right != Null
+	switch n.op {
+	case "??":
+		switch {
+		case left == Null:
+			return right, nil
+		case left == right:
+			return left, nil
+		}
+		return Any, nil
+	case "&&", "||":
+		if err := c.expect(n.left, left, n.op+" needs", Bool, Null); err != nil {
+			return Any, err
+		}
+		return Bool, c.expect(n.right, right, n.op+" needs", Bool, Null)
+	case "==", "!=":
+		if known && left != right {
+			return Any, errorf(n.at, "%s compares %s with %s, so it is always %t", n, article(left), article(right), n.op == "!=")
+		}
+		return Bool, nil
+	case "<", "<=", ">", ">=":
+		if known && (left != right || (left != Number && left != String)) {
+			return Any, errorf(n.at, "%s cannot order %s and %s; only two numbers or two strings", n.op, article(left), article(right))
+		}
+		for _, side := range []struct {
+			n node
+			t Type
+		}{{n.left, left}, {n.right, right}} {
+			if err := c.expect(side.n, side.t, n.op+" needs", Number, String, Null); err != nil {
+				return Any, err
+			}
+		}
+		return Bool, nil
+	case "in", "not in":
+		if err := c.expect(n.right, right, n.op+" needs", Array, String, Object); err != nil {
+			return Any, err
+		}
+		if (right == String || right == Object) && left != Any && left != String {
+			return Any, errorf(n.left.pos(), "%s needs a string to look for in %s, not %s", n.op, article(right), article(left))
+		}
+		return Bool, nil
+	case "+":
+		switch {
+		case left == String || right == String:
+			if known && left != right {
+				return Any, errorf(n.at, "+ cannot add %s and %s", article(left), article(right))
+			}
+			for _, side := range []struct {
+				n node
+				t Type
+			}{{n.left, left}, {n.right, right}} {
+				if err := c.expect(side.n, side.t, "+ needs", String); err != nil {
+					return Any, err
+				}
+			}
+			return String, nil
+		case left == Any || right == Any:
+			if err := c.expect(n.left, left, "+ needs", Number, String); err != nil {
+				return Any, err
+			}
+			return Any, c.expect(n.right, right, "+ needs", Number, String)
+		}
+		fallthrough
+	default: // - * / %
+		if err := c.expect(n.left, left, n.op+" needs", Number); err != nil {
+			return Any, err
+		}
+		return Number, c.expect(n.right, right, n.op+" needs", Number)
+	}
+}
+
+func (c *checker) call(n *call) (Type, error) {
+	fn, ok := functions[n.name]
+	if !ok {
+		return Any, errorf(n.at, "unknown function %s", n.name)
+	}
+	if len(n.args) < len(fn.params)-fn.optional || (!fn.variadic && len(n.args) > len(fn.params)) {
+		return Any, errorf(n.at, "%s takes %s", n.name, fn.arity())
+	}
+	for i, arg := range n.args {
+		t, err := c.typeOf(arg)
+		if err != nil {
+			return Any, err
+		}
+		if want := fn.param(i); want != Any {
+			if err := c.expect(arg, t, n.name+" needs", want, Null); err != nil {
+				return Any, err
+			}
+		}
+	}
+	if n.name == "matches" && len(n.args) == 2 {
+		if pattern, ok := n.args[1].(*literal); ok {
+			if source, ok := pattern.value.(string); ok {
+				re, err := regexp.Compile(source)
+				if err != nil {
+					return Any, errorf(pattern.at, "invalid pattern: %v", err)
+				}
+				n.regex = re
+			}
+		}
+	}
+	return fn.result, nil
+}
+
+// expect reports an error unless t is Any or one of allowed.
+func (c *checker) expect(n node, t Type, what string, allowed ...Type) error {
+	if t == Any {
+		return nil
+	}
+	for _, a := range allowed {
+		if t == a {
+			return nil
+		}
+	}
+	return errorf(n.pos(), "%s %s, but %s is %s", what, article(allowed[0]), n, article(t))
+}
+
+func typeOfValue(value interface{}) Type {
+	switch value.(type) {
+	case nil:
+		return Null
+	case bool:
+		return Bool
+	case string:
+		return String
+	case []interface{}:
+		return Array
+	case map[string]interface{}:
+		return Object
+	}
+	if _, ok := toNumber(value); ok {
+		return Number
+	}
+	return Any
+}
+
+// article names a type with its indefinite article, e.g. "a number".
+func article(t Type) string {
+	switch t {
+	case Null:
+		return "null"
+	case Array, Object, Any:
+		return "an " + t.String()
+	default:
+		return "a " + t.String()
+	}
+}
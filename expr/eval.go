@@ -0,0 +1,342 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+func eval(n node, vars map[string]interface{}) (interface{}, error) {
+	switch n := n.(type) {
+	case *literal:
+		return n.value, nil
+	case *variable:
+		value, ok := vars[n.name]
+		if !ok && n.name == processData {
+			return vars, nil
+		}
+		return value, nil
+	case *member, *index:
+		value, _, err := access(n, vars)
+		return value, err
+	case *array:
+		items := make([]interface{}, len(n.items))
+		for i, item := range n.items {
+			value, err := eval(item, vars)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = value
+		}
+		return items, nil
+	case *unary:
+		operand, err := eval(n.operand, vars)
+		if err != nil {
+			return nil, err
+		}
+		if n.op == "!" {
+			truth, err := truthOf(n.operand, operand, "!")
+			return !truth, err
+		}
+		number, ok := toNumber(operand)
+		if !ok {
+			return nil, fmt.Errorf("- needs a number, but %s is %s", n.operand, describe(operand))
+		}
+		return -number, nil
+	case *binary:
+		return evalBinary(n, vars)
+	case *call:
+		return evalCall(n, vars)
+	}
+	return nil, fmt.Errorf("cannot evaluate %s", n)
+}
+
+// access evaluates a field access or index. short is true if an optional access
+// found null, which makes the rest of the path null as well, e.g. all of
+// order?.items[0].sku when order is null.
+func access(n node, vars map[string]interface{}) (value interface{}, short bool, err error) {
+	var objectNode node
+	var optional bool
+	switch n := n.(type) {
+	case *member:
+		objectNode, optional = n.object, n.optional
+	case *index:
+		objectNode, optional = n.object, n.optional
+	default:
+		value, err := eval(n, vars)
+		return value, false, err
+	}
+
+	object, short, err := access(objectNode, vars)
+	if err != nil || short {
+		return nil, short, err
+	}
+	if object == nil {
+		if optional {
+			return nil, true, nil
+		}
+		return nil, false, fmt.Errorf("%s is null; use ?. to allow that", objectNode)
+	}
+
+	switch n := n.(type) {
+	case *member:
+		fields, ok := object.(map[string]interface{})
+		if !ok {
+			return nil, false, fmt.Errorf("%s is %s, which has no field %s", objectNode, describe(object), n.name)
+		}
+		return fields[n.name], false, nil
+	default:
+		n2 := n.(*index)
+		key, err := eval(n2.key, vars)
+		if err != nil {
+			return nil, false, err
+		}
+		switch object := object.(type) {
+		case []interface{}:
+			i, ok := toNumber(key)
+			if !ok || i != math.Trunc(i) {
+				return nil, false, fmt.Errorf("%s is an array, so its index must be a whole number, not %s", objectNode, describe(key))
+			}
+			if i < 0 || i >= float64(len(object)) {
+				return nil, false, nil
+			}
+			return object[int(i)], false, nil
+		case map[string]interface{}:
+			name, ok := key.(string)
+			if !ok {
+				return nil, false, fmt.Errorf("%s is an object, so its key must be a string, not %s", objectNode, describe(key))
+			}
+			return object[name], false, nil
+		default:
+			return nil, false, fmt.Errorf("%s is %s, which cannot be indexed", objectNode, describe(object))
+		}
+	}
+}
+
+func evalBinary(n *binary, vars map[string]interface{}) (interface{}, error) {
+	left, err := eval(n.left, vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "??":
+		if left != nil {
+			return left, nil
+		}
+		return eval(n.right, vars)
+	case "&&", "||":
+		truth, err := truthOf(n.left, left, n.op)
+		if err != nil || truth == (n.op == "||") {
+			return truth, err
+		}
+		right, err := eval(n.right, vars)
+		if err != nil {
+			return nil, err
+		}
+		return truthOf(n.right, right, n.op)
+	}
+
+	right, err := eval(n.right, vars)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n, left, right)
+	case "in":
+		return contains(n, left, right)
+	case "not in":
+		found, err := contains(n, left, right)
+		return !found, err
+	case "+":
+		if l, ok := left.(string); ok {
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		}
+	}
+
+	l, lok := toNumber(left)
+	r, rok := toNumber(right)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s cannot work on %s and %s", n.op, describe(left), describe(right))
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero in %s", n)
+		}
+		return l / r, nil
+	default: // %
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero in %s", n)
+		}
+		return math.Mod(l, r), nil
+	}
+}
+
+// truthOf returns the truth of a boolean operand. null counts as false.
+func truthOf(n node, value interface{}, op string) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	}
+	return false, fmt.Errorf("%s needs a boolean, but %s is %s", op, n, describe(value))
+}
+
+func compare(n *binary, left, right interface{}) (bool, error) {
+	var order int
+	l, lok := toNumber(left)
+	r, rok := toNumber(right)
+	ls, lsok := left.(string)
+	rs, rsok := right.(string)
+	switch {
+	case lok && rok:
+		switch {
+		case l < r:
+			order = -1
+		case l > r:
+			order = 1
+		}
+	case lsok && rsok:
+		order = strings.Compare(ls, rs)
+	default:
+		return false, fmt.Errorf("%s cannot order %s and %s; only two numbers or two strings", n.op, describe(left), describe(right))
+	}
+	switch n.op {
+	case "<":
+		return order < 0, nil
+	case "<=":
+		return order <= 0, nil
+	case ">":
+		return order > 0, nil
+	default:
+		return order >= 0, nil
+	}
+}
+
+// contains reports whether needle is an item of an array, a substring of a string or
+// a key of an object.
+func contains(n *binary, needle, haystack interface{}) (bool, error) {
+	switch h := haystack.(type) {
+	case nil:
+		return false, nil
+	case []interface{}:
+		for _, item := range h {
+			if equal(needle, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		s, ok := needle.(string)
+		if !ok {
+			return false, fmt.Errorf("%s needs a string to look for in a string, not %s", n.op, describe(needle))
+		}
+		return strings.Contains(h, s), nil
+	case map[string]interface{}:
+		s, ok := needle.(string)
+		if !ok {
+			return false, fmt.Errorf("%s needs a string to look for in an object, not %s", n.op, describe(needle))
+		}
+		_, found := h[s]
+		return found, nil
+	}
+	return false, fmt.Errorf("%s needs an array, string or object, but %s is %s", n.op, n.right, describe(haystack))
+}
+
+// equal compares values without type coercion. Numbers are equal by value whatever
+// their Go type; arrays and objects are equal if all their items are.
+func equal(a, b interface{}) bool {
+	if x, ok := toNumber(a); ok {
+		y, ok := toNumber(b)
+		return ok && x == y
+	}
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case string:
+		y, ok := b.(string)
+		return ok && x == y
+	case bool:
+		y, ok := b.(bool)
+		return ok && x == y
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, found := y[key]
+			if !found || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// toNumber converts the numeric types found in variables, e.g. float64 from JSON or
+// int64 from scripts, to float64.
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// describe names the type of a value for error messages, e.g. "a string".
+func describe(value interface{}) string {
+	return article(typeOfValue(value))
+}
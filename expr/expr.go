@@ -0,0 +1,156 @@
+// Package expr implements the expression language of gateway conditions and script
+// variable mappings: a small, side-effect-free language evaluated in Go, e.g.
+//
+//	order?.items[0].sku == 'w-1' && lower(customer.country) in ['de', 'at']
+//
+// Expressions are compiled once, checked against the types of the variables they
+// use where those are known, and evaluated against a map of variables.
+package expr
+
+import (
+	"fmt"
+)
+
+// Type is the type of a value or expression, as far as it is known before
+// evaluation.
+type Type int
+
+const (
+	Any Type = iota // unknown until evaluation
+	Null
+	Bool
+	Number
+	String
+	Array
+	Object
+)
+
+func (t Type) String() string {
+	switch t {
+	case Null:
+		return "null"
+	case Bool:
+		return "boolean"
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	case Array:
+		return "array"
+	case Object:
+		return "object"
+	default:
+		return "any"
+	}
+}
+
+// ParseType returns the Type for a variable schema type such as "integer". Unknown
+// and empty names are Any.
+func ParseType(name string) Type {
+	switch name {
+	case "string":
+		return String
+	case "number", "integer":
+		return Number
+	case "boolean":
+		return Bool
+	case "object":
+		return Object
+	case "array":
+		return Array
+	default:
+		return Any
+	}
+}
+
+// Error is a syntax or type error in an expression.
+type Error struct {
+	Pos int // byte offset in the source
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+func errorf(pos int, format string, args ...interface{}) *Error {
+	return &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Program is a compiled expression. It is safe for concurrent use.
+type Program struct {
+	source string
+	root   node
+	typ    Type
+}
+
+// Compile parses source and checks it against vars, the types of the variables it
+// may use. Variables missing from vars can have any type. Syntax and type errors
+// are reported as an *Error.
+func Compile(source string, vars map[string]Type) (*Program, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	typ, err := check(root, vars)
+	if err != nil {
+		return nil, err
+	}
+	return &Program{source: source, root: root, typ: typ}, nil
+}
+
+// Type returns the type of the program's result, or Any if it depends on values
+// only known at evaluation.
+func (p *Program) Type() Type { return p.typ }
+
+// String returns the source of the program.
+func (p *Program) String() string { return p.source }
+
+// Eval evaluates the program with vars. Numbers are returned as float64; values
+// taken from vars are returned as they are.
+func (p *Program) Eval(vars map[string]interface{}) (interface{}, error) {
+	return eval(p.root, vars)
+}
+
+// EvalBool evaluates a condition. null counts as false; other values that are not
+// booleans are an error.
+func (p *Program) EvalBool(vars map[string]interface{}) (bool, error) {
+	value, err := p.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	default:
+		return false, fmt.Errorf("condition is %s, not a boolean", describe(value))
+	}
+}
+
+// complements maps every comparison operator to the one that holds exactly when it
+// does not.
+var complements = map[string]string{"==": "!=", "!=": "==", "<": ">=", ">=": "<", ">": "<=", "<=": ">"}
+
+// Complementary reports whether b holds exactly when a does not, e.g. for
+// amount >= 100 and amount < 100, or approved and !approved.
+func Complementary(a, b *Program) bool {
+	if u, ok := a.root.(*unary); ok && u.op == "!" && u.operand.String() == b.root.String() {
+		return true
+	}
+	if u, ok := b.root.(*unary); ok && u.op == "!" && u.operand.String() == a.root.String() {
+		return true
+	}
+	x, ok := a.root.(*binary)
+	y, ok2 := b.root.(*binary)
+	if !ok || !ok2 || complements[x.op] == "" {
+		return false
+	}
+	return complements[x.op] == y.op && x.left.String() == y.left.String() && x.right.String() == y.right.String()
+}
@@ -0,0 +1,193 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEval(t *testing.T) {
+	vars := map[string]interface{}{
+		"amount":  150.0,
+		"count":   int64(3),
+		"status":  "approved",
+		"vip":     true,
+		"missing": nil,
+		"order": map[string]interface{}{
+			"items":    []interface{}{map[string]interface{}{"sku": "w-1", "qty": 2.0}},
+			"customer": map[string]interface{}{"email": " Ada@Example.com "},
+		},
+		"tags": []interface{}{"rush", "gift"},
+		"huge": 1e19,
+		"nan":  math.NaN(),
+	}
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		{"amount >= 100", true},
+		{"amount > 100 && count < 3", false},
+		{"amount > 100 && (count < 3 || vip)", true},
+		{"!vip || status == 'approved'", true},
+		{`status === "approved"`, true},
+		{"status != 'approved'", false},
+		{"amount * 1.2 - count", 177.0},
+		{"(amount + 50) / 4 % 7", 1.0},
+		{"-amount", -150.0},
+		{"count == 3", true},
+		{"'n' + string(count)", "n3"},
+		{"order?.items[0].sku", "w-1"},
+		{"order.items[0]['qty'] * 2", 4.0},
+		{"order.items[5]", nil},
+		{"tags[-1]", nil},
+		{"tags[huge]", nil},
+		{"tags[1e300]", nil},
+		{"tags[9223372036854775808]", nil},
+		{"nothing?.items[0].sku", nil},
+		{"nothing?.[0]", nil},
+		{"nothing ?? 'default'", "default"},
+		{"order.customer.name ?? 'anonymous'", "anonymous"},
+		{"process_data.amount", 150.0},
+		{"'rush' in tags", true},
+		{"'fast' not in tags", true},
+		{"status in ['approved', 'paid']", true},
+		{"'prov' in status", true},
+		{"'items' in order", true},
+		{"'x' in missing", false},
+		{"lower(trim(order.customer.email))", "ada@example.com"},
+		{"upper(status)", "APPROVED"},
+		{"len(tags) == 2 && len(status) == 8", true},
+		{"startsWith(status, 'app') && endsWith(status, 'ved') && contains(status, 'rov')", true},
+		{"substring(status, 2, 5)", "pro"},
+		{"substring(status, 4)", "oved"},
+		{"replace(status, 'p', 'P')", "aPProved"},
+		{"split('a,b', ',')", []interface{}{"a", "b"}},
+		{"join(tags, '+')", "rush+gift"},
+		{"matches(status, '^app.*d$')", true},
+		{"number('42') + 1", 43.0},
+		{"round(2.5) + floor(1.9) + ceil(0.1) + abs(-1)", 6.0},
+		{"max(count, amount, 7) - min(count, 1)", 149.0},
+		{"lower(order?.customer?.missing)", nil},
+		{"missing == null", true},
+		{"tags == ['rush', 'gift']", true},
+		{"vip && nothing", false},
+	}
+	for _, tt := range tests {
+		program, err := Compile(tt.source, nil)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.source, err)
+			continue
+		}
+		got, err := program.Eval(vars)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.source, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Eval(%q) = %#v, want %#v", tt.source, got, tt.want)
+		}
+	}
+
+	failures := []struct{ source, want string }{
+		{"order.nothing.sku", "order.nothing is null; use ?. to allow that"},
+		{"amount.total", "amount is a number, which has no field total"},
+		{"tags['first']", "must be a whole number"},
+		{"tags[nan]", "must be a whole number"},
+		{"status > 3", "> cannot order a string and a number"},
+		{"amount / (count - 3)", "division by zero"},
+		{"status && vip", "&& needs a boolean, but status is a string"},
+		{"number('many')", "'many' is not a number"},
+	}
+	for _, tt := range failures {
+		program, err := Compile(tt.source, nil)
+		if err != nil {
+			t.Errorf("Compile(%q): %v", tt.source, err)
+			continue
+		}
+		if _, err := program.Eval(vars); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Eval(%q) error = %v, want %q", tt.source, err, tt.want)
+		}
+	}
+
+	condition, _ := Compile("order?.paid", nil)
+	if ok, err := condition.EvalBool(vars); ok || err != nil {
+		t.Errorf("EvalBool of a missing field = %v, %v; want false", ok, err)
+	}
+	condition, _ = Compile("status", nil)
+	if _, err := condition.EvalBool(vars); err == nil || !strings.Contains(err.Error(), "condition is a string, not a boolean") {
+		t.Errorf("EvalBool of a string error = %v", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	vars := map[string]Type{"amount": Number, "status": String, "vip": Bool, "tags": Array, "order": Object}
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{"", "column 1: empty expression"},
+		{"amount >", "column 9: expected a value, found end of expression"},
+		{"amount >= 100 100", "column 15: expected an operator, found '100'"},
+		{"(amount", "column 8: expected ), found end of expression"},
+		{"'open", "column 1: unterminated string"},
+		{"amount # 2", "column 8: unexpected character '#'"},
+		{"order.", "column 7: expected a field name"},
+		{"amount == 'high'", "column 8: (amount == \"high\") compares a number with a string, so it is always false"},
+		{"status > 3", "column 8: > cannot order a string and a number"},
+		{"amount + status", "column 8: + cannot add a number and a string"},
+		{"amount.total", "column 7: amount is a number, which has no field total"},
+		{"tags['first']", "column 6: tags is an array, so its index must be a number, not a string"},
+		{"vip && amount", "column 8: && needs a boolean, but amount is a number"},
+		{"!status", "column 2: ! needs a boolean, but status is a string"},
+		{"'x' in amount", "in needs an array, but amount is a number"},
+		{"lower(amount)", "column 7: lower needs a string, but amount is a number"},
+		{"shout(status)", "column 1: unknown function shout"},
+		{"substring(status)", "column 1: substring takes 2 to 3 arguments"},
+		{"matches(status, '[')", "column 17: invalid pattern"},
+		{"process_data.amount == 'x'", "compares a number with a string"},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.source, vars)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Compile(%q) error = %v, want %q", tt.source, err, tt.want)
+		}
+	}
+
+	// Without declared types, the same expressions are only checked when evaluated.
+	for _, source := range []string{"amount == 'high'", "lower(amount)", "amount.total"} {
+		if _, err := Compile(source, nil); err != nil {
+			t.Errorf("Compile(%q) without types: %v", source, err)
+		}
+	}
+
+	program, err := Compile("amount * 2", vars)
+	if err != nil || program.Type() != Number {
+		t.Errorf("type of amount * 2 = %v, %v", program.Type(), err)
+	}
+}
+
+func TestComplementary(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"amount >= 100", "amount < 100", true},
+		{"amount>=100", "(amount < 100)", true},
+		{"status == 'a'", "status != \"a\"", true},
+		{"order?.paid", "!order?.paid", true},
+		{"amount >= 100", "amount <= 100", false},
+		{"amount >= 100", "amount < 99", false},
+		{"amount >= 100", "other < 100", false},
+	}
+	for _, tt := range tests {
+		a, errA := Compile(tt.a, nil)
+		b, errB := Compile(tt.b, nil)
+		if errA != nil || errB != nil {
+			t.Fatalf("Compile: %v, %v", errA, errB)
+		}
+		if got := Complementary(a, b); got != tt.want {
+			t.Errorf("Complementary(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
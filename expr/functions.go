@@ -0,0 +1,215 @@
+package expr
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// function is a built-in function. Every function returns null if one of its
+// arguments is null, so that e.g. lower(customer?.email) is null rather than an
+// error when there is no customer.
+type function struct {
+	params   []Type
+	optional int  // trailing params that may be left out
+	variadic bool // the last param may be repeated
+	result   Type
+	call     func(args []interface{}) (interface{}, error)
+}
+
+// param returns the type of the i-th argument.
+func (f *function) param(i int) Type {
+	if i >= len(f.params) {
+		return f.params[len(f.params)-1]
+	}
+	return f.params[i]
+}
+
+func (f *function) arity() string {
+	required := len(f.params) - f.optional
+	switch {
+	case f.variadic:
+		return fmt.Sprintf("at least %d arguments", required)
+	case f.optional > 0:
+		return fmt.Sprintf("%d to %d arguments", required, len(f.params))
+	case required == 1:
+		return "1 argument"
+	default:
+		return fmt.Sprintf("%d arguments", required)
+	}
+}
+
+var functions map[string]*function
+
+func init() {
+	str := func(f func(string) string) *function {
+		return &function{params: []Type{String}, result: String, call: func(args []interface{}) (interface{}, error) {
+			return f(args[0].(string)), nil
+		}}
+	}
+	test := func(f func(s, sub string) bool) *function {
+		return &function{params: []Type{String, String}, result: Bool, call: func(args []interface{}) (interface{}, error) {
+			return f(args[0].(string), args[1].(string)), nil
+		}}
+	}
+	num := func(f func(float64) float64) *function {
+		return &function{params: []Type{Number}, result: Number, call: func(args []interface{}) (interface{}, error) {
+			return f(args[0].(float64)), nil
+		}}
+	}
+	fold := func(f func(a, b float64) float64) *function {
+		return &function{params: []Type{Number, Number}, variadic: true, result: Number, call: func(args []interface{}) (interface{}, error) {
+			result := args[0].(float64)
+			for _, arg := range args[1:] {
+				result = f(result, arg.(float64))
+			}
+			return result, nil
+		}}
+	}
+
+	functions = map[string]*function{
+		"len":        {params: []Type{Any}, result: Number, call: length},
+		"lower":      str(strings.ToLower),
+		"upper":      str(strings.ToUpper),
+		"trim":       str(strings.TrimSpace),
+		"contains":   test(strings.Contains),
+		"startsWith": test(strings.HasPrefix),
+		"endsWith":   test(strings.HasSuffix),
+		"substring":  {params: []Type{String, Number, Number}, optional: 1, result: String, call: substring},
+		"replace": {params: []Type{String, String, String}, result: String, call: func(args []interface{}) (interface{}, error) {
+			return strings.ReplaceAll(args[0].(string), args[1].(string), args[2].(string)), nil
+		}},
+		"split": {params: []Type{String, String}, result: Array, call: func(args []interface{}) (interface{}, error) {
+			parts := strings.Split(args[0].(string), args[1].(string))
+			items := make([]interface{}, len(parts))
+			for i, part := range parts {
+				items[i] = part
+			}
+			return items, nil
+		}},
+		"join": {params: []Type{Array, String}, result: String, call: func(args []interface{}) (interface{}, error) {
+			items := args[0].([]interface{})
+			parts := make([]string, len(items))
+			for i, item := range items {
+				parts[i] = format(item)
+			}
+			return strings.Join(parts, args[1].(string)), nil
+		}},
+		"matches": {params: []Type{String, String}, result: Bool}, // see evalCall
+		"string": {params: []Type{Any}, result: String, call: func(args []interface{}) (interface{}, error) {
+			return format(args[0]), nil
+		}},
+		"number": {params: []Type{Any}, result: Number, call: func(args []interface{}) (interface{}, error) {
+			if s, ok := args[0].(string); ok {
+				n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil {
+					return nil, fmt.Errorf("number: '%s' is not a number", s)
+				}
+				return n, nil
+			}
+			if n, ok := toNumber(args[0]); ok {
+				return n, nil
+			}
+			return nil, fmt.Errorf("number needs a string or number, not %s", describe(args[0]))
+		}},
+		"abs":   num(math.Abs),
+		"floor": num(math.Floor),
+		"ceil":  num(math.Ceil),
+		"round": num(math.Round),
+		"min":   fold(math.Min),
+		"max":   fold(math.Max),
+	}
+}
+
+func evalCall(n *call, vars map[string]interface{}) (interface{}, error) {
+	fn := functions[n.name]
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := eval(arg, vars)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, nil
+		}
+		switch fn.param(i) {
+		case Number:
+			number, ok := toNumber(value)
+			if !ok {
+				return nil, fmt.Errorf("%s needs a number, but %s is %s", n.name, arg, describe(value))
+			}
+			value = number
+		case String, Array:
+			if typeOfValue(value) != fn.param(i) {
+				return nil, fmt.Errorf("%s needs %s, but %s is %s", n.name, article(fn.param(i)), arg, describe(value))
+			}
+		}
+		args[i] = value
+	}
+	if n.name == "matches" {
+		re := n.regex
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(args[1].(string)); err != nil {
+				return nil, fmt.Errorf("matches: invalid pattern: %w", err)
+			}
+		}
+		return re.MatchString(args[0].(string)), nil
+	}
+	return fn.call(args)
+}
+
+func length(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case string:
+		return float64(utf8.RuneCountInString(v)), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	}
+	return nil, fmt.Errorf("len needs a string, array or object, not %s", describe(args[0]))
+}
+
+// substring returns the characters of s from start up to, but not including, end,
+// or up to the end of s. Indexes are clamped to s, as in JavaScript.
+func substring(args []interface{}) (interface{}, error) {
+	runes := []rune(args[0].(string))
+	clamp := func(f float64) int {
+		return int(math.Max(0, math.Min(float64(len(runes)), math.Trunc(f))))
+	}
+	start, end := clamp(args[1].(float64)), len(runes)
+	if len(args) > 2 {
+		end = clamp(args[2].(float64))
+	}
+	if start > end {
+		start, end = end, start
+	}
+	return string(runes[start:end]), nil
+}
+
+// format converts a value to a string: strings as they are, whole numbers without a
+// fraction and other values as JSON.
+func format(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	if n, ok := toNumber(value); ok {
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	if value == nil {
+		return "null"
+	}
+	if b, ok := value.(bool); ok {
+		return strconv.FormatBool(b)
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
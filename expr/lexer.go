@@ -0,0 +1,148 @@
+package expr
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string      // the operator, identifier or source of the token
+	value interface{} // float64 for numbers, string for strings
+	pos   int         // byte offset in the source
+}
+
+// operators lists the operators and punctuation, longest first so that e.g. "==="
+// is not read as "==" followed by "=".
+var operators = []string{
+	"===", "!==",
+	"==", "!=", "<=", ">=", "&&", "||", "??", "?.",
+	"<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "[", "]", ",", ".",
+}
+
+// lex splits source into tokens, ending with a tokEOF token.
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(source); {
+		r, size := utf8.DecodeRuneInString(source[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+		case isDigit(r) || (r == '.' && pos+1 < len(source) && isDigit(rune(source[pos+1]))):
+			end := scanNumber(source, pos)
+			value, err := strconv.ParseFloat(source[pos:end], 64)
+			if err != nil {
+				return nil, errorf(pos, "invalid number %s", source[pos:end])
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: source[pos:end], value: value, pos: pos})
+			pos = end
+		case r == '"' || r == '\'':
+			value, end, err := scanString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: source[pos:end], value: value, pos: pos})
+			pos = end
+		case isIdentStart(r):
+			end := pos + size
+			for end < len(source) {
+				next, nextSize := utf8.DecodeRuneInString(source[end:])
+				if !isIdentStart(next) && !isDigit(next) {
+					break
+				}
+				end += nextSize
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: source[pos:end], pos: pos})
+			pos = end
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(source[pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, errorf(pos, "unexpected character %q", r)
+			}
+			tokens = append(tokens, token{kind: tokOperator, text: op, pos: pos})
+			pos += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(source)}), nil
+}
+
+func isDigit(r rune) bool { return r >= '0' && r <= '9' }
+
+func isIdentStart(r rune) bool { return r == '_' || r == '$' || unicode.IsLetter(r) }
+
+// scanNumber returns the end of the number starting at pos, e.g. 12, 0.5 or 1e-3.
+func scanNumber(source string, pos int) int {
+	end := pos
+	digits := func() {
+		for end < len(source) && isDigit(rune(source[end])) {
+			end++
+		}
+	}
+	digits()
+	if end < len(source) && source[end] == '.' {
+		end++
+		digits()
+	}
+	if end < len(source) && (source[end] == 'e' || source[end] == 'E') {
+		exp := end + 1
+		if exp < len(source) && (source[exp] == '+' || source[exp] == '-') {
+			exp++
+		}
+		if exp < len(source) && isDigit(rune(source[exp])) {
+			end = exp
+			digits()
+		}
+	}
+	return end
+}
+
+// scanString reads the quoted string starting at pos and returns its value and end.
+func scanString(source string, pos int) (string, int, error) {
+	quote := source[pos]
+	var b strings.Builder
+	for i := pos + 1; i < len(source); i++ {
+		c := source[i]
+		switch c {
+		case quote:
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(source) {
+				return "", 0, errorf(pos, "unterminated string")
+			}
+			switch source[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '\'', '"':
+				b.WriteByte(source[i])
+			default:
+				return "", 0, errorf(i-1, "unknown escape \\%c", source[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errorf(pos, "unterminated string")
+}
@@ -0,0 +1,358 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// node is an element of the syntax tree. String returns it in a canonical form, which
+// is the same for expressions that differ only in spacing or redundant parentheses.
+type node interface {
+	pos() int
+	String() string
+}
+
+type literal struct {
+	at    int
+	value interface{} // nil, bool, float64 or string
+}
+
+type variable struct {
+	at   int
+	name string
+}
+
+// member is object.name, or object?.name if optional.
+type member struct {
+	at       int
+	object   node
+	name     string
+	optional bool
+}
+
+// index is object[key], or object?.[key] if optional.
+type index struct {
+	at       int
+	object   node
+	key      node
+	optional bool
+}
+
+type call struct {
+	at    int
+	name  string
+	args  []node
+	regex *regexp.Regexp // compiled pattern of matches with a literal pattern
+}
+
+type unary struct {
+	at      int
+	op      string
+	operand node
+}
+
+type binary struct {
+	at          int
+	op          string
+	left, right node
+}
+
+type array struct {
+	at    int
+	items []node
+}
+
+func (n *literal) pos() int  { return n.at }
+func (n *variable) pos() int { return n.at }
+func (n *member) pos() int   { return n.at }
+func (n *index) pos() int    { return n.at }
+func (n *call) pos() int     { return n.at }
+func (n *unary) pos() int    { return n.at }
+func (n *binary) pos() int   { return n.at }
+func (n *array) pos() int    { return n.at }
+
+func (n *literal) String() string {
+	switch v := n.value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (n *variable) String() string { return n.name }
+
+func (n *member) String() string {
+	if n.optional {
+		return n.object.String() + "?." + n.name
+	}
+	return n.object.String() + "." + n.name
+}
+
+func (n *index) String() string {
+	if n.optional {
+		return n.object.String() + "?.[" + n.key.String() + "]"
+	}
+	return n.object.String() + "[" + n.key.String() + "]"
+}
+
+func (n *call) String() string { return n.name + "(" + joinNodes(n.args) + ")" }
+
+func (n *unary) String() string { return n.op + n.operand.String() }
+
+func (n *binary) String() string {
+	return "(" + n.left.String() + " " + n.op + " " + n.right.String() + ")"
+}
+
+func (n *array) String() string { return "[" + joinNodes(n.items) + "]" }
+
+func joinNodes(nodes []node) string {
+	parts := make([]string, len(nodes))
+	for i, n := range nodes {
+		parts[i] = n.String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+// binaryLevels lists the binary operators from the loosest binding to the tightest.
+var binaryLevels = [][]string{
+	{"??"},
+	{"||"},
+	{"&&"},
+	{"==", "!=", "===", "!=="},
+	{"<", "<=", ">", ">=", "in", "not in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// parser is a recursive descent parser over the tokens of an expression.
+type parser struct {
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token { return p.tokens[p.next] }
+
+func (p *parser) advance() token {
+	t := p.tokens[p.next]
+	if t.kind != tokEOF {
+		p.next++
+	}
+	return t
+}
+
+// is reports whether the next token is the operator or keyword op.
+func (p *parser) is(op string) bool {
+	t := p.peek()
+	switch {
+	case op == "in" || op == "not":
+		return t.kind == tokIdent && t.text == op
+	case op == "not in":
+		if !p.is("not") {
+			return false
+		}
+		after := p.tokens[p.next+1]
+		return after.kind == tokIdent && after.text == "in"
+	default:
+		return t.kind == tokOperator && t.text == op
+	}
+}
+
+func (p *parser) expect(op string) error {
+	if !p.is(op) {
+		return p.unexpected("%s", op)
+	}
+	p.advance()
+	return nil
+}
+
+// unexpected reports the next token where something else was expected.
+func (p *parser) unexpected(format string, args ...interface{}) error {
+	t := p.peek()
+	found := "'" + t.text + "'"
+	if t.kind == tokEOF {
+		found = "end of expression"
+	}
+	return errorf(t.pos, "expected %s, found %s", fmt.Sprintf(format, args...), found)
+}
+
+func (p *parser) parse() (node, error) {
+	if p.peek().kind == tokEOF {
+		return nil, errorf(0, "empty expression")
+	}
+	n, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("an operator")
+	}
+	return n, nil
+}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(binaryLevels) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range binaryLevels[level] {
+			if p.is(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		at := p.advance().pos
+		if op == "not in" {
+			p.advance()
+		}
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		// === and !== are accepted for readers used to JavaScript; there is no
+		// type coercion to tell them apart from == and !=.
+		switch op {
+		case "===":
+			op = "=="
+		case "!==":
+			op = "!="
+		}
+		left = &binary{at: at, op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.is("!") || p.is("-") {
+		t := p.advance()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{at: t.pos, op: t.text, operand: operand}, nil
+	}
+	return p.postfix()
+}
+
+// postfix parses an operand followed by any field accesses and indexes.
+func (p *parser) postfix() (node, error) {
+	n, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.is("."), p.is("?."):
+			t := p.advance()
+			if t.text == "?." && p.is("[") {
+				key, err := p.indexKey()
+				if err != nil {
+					return nil, err
+				}
+				n = &index{at: t.pos, object: n, key: key, optional: true}
+				continue
+			}
+			name := p.peek()
+			if name.kind != tokIdent {
+				return nil, p.unexpected("a field name")
+			}
+			p.advance()
+			n = &member{at: t.pos, object: n, name: name.text, optional: t.text == "?."}
+		case p.is("["):
+			at := p.peek().pos
+			key, err := p.indexKey()
+			if err != nil {
+				return nil, err
+			}
+			n = &index{at: at, object: n, key: key}
+		default:
+			return n, nil
+		}
+	}
+}
+
+// indexKey parses [key].
+func (p *parser) indexKey() (node, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	key, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	return key, p.expect("]")
+}
+
+func (p *parser) operand() (node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber, tokString:
+		p.advance()
+		return &literal{at: t.pos, value: t.value}, nil
+	case tokIdent:
+		p.advance()
+		switch t.text {
+		case "true":
+			return &literal{at: t.pos, value: true}, nil
+		case "false":
+			return &literal{at: t.pos, value: false}, nil
+		case "null":
+			return &literal{at: t.pos, value: nil}, nil
+		}
+		if p.is("(") {
+			p.advance()
+			args, err := p.list(")")
+			if err != nil {
+				return nil, err
+			}
+			return &call{at: t.pos, name: t.text, args: args}, nil
+		}
+		return &variable{at: t.pos, name: t.text}, nil
+	case tokOperator:
+		switch t.text {
+		case "(":
+			p.advance()
+			n, err := p.binary(0)
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "[":
+			p.advance()
+			items, err := p.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return &array{at: t.pos, items: items}, nil
+		}
+	}
+	return nil, p.unexpected("a value")
+}
+
+// list parses comma separated expressions up to and including end.
+func (p *parser) list(end string) ([]node, error) {
+	var items []node
+	for !p.is(end) {
+		item, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if !p.is(",") {
+			break
+		}
+		p.advance()
+	}
+	return items, p.expect(end)
+}
@@ -0,0 +1,73 @@
+// Package lru provides a size-bounded cache that evicts the least recently used
+// entry, for compiled scripts and expressions whose sources come and go with
+// definition versions.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// DefaultSize is the number of entries a Cache with no Size keeps.
+const DefaultSize = 1024
+
+// Cache maps keys to values, keeping at most Size entries. The zero value is ready
+// to use and is safe for concurrent use; a Cache must not be copied after first use.
+type Cache[K comparable, V any] struct {
+	// Size is the most entries kept; 0 means DefaultSize. Set it before first use.
+	Size int
+
+	mu      sync.Mutex
+	entries map[K]*list.Element
+	order   list.List // *entry, most recently used first
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// Get returns the value cached for key and marks it as recently used.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*entry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Add caches value for key, evicting the least recently used entry if the cache is
+// full.
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[K]*list.Element)
+	}
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+
+	size := c.Size
+	if size <= 0 {
+		size = DefaultSize
+	}
+	for c.order.Len() > size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry[K, V]).key)
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,43 @@
+package lru
+
+import "testing"
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := &Cache[string, int]{Size: 2}
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %d, %v", v, ok)
+	}
+	// b is now the least recently used.
+	c.Add("c", 3)
+	if _, ok := c.Get("b"); ok {
+		t.Error("b was kept")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.Get(key); !ok || v != want {
+			t.Errorf("Get(%s) = %d, %v; want %d", key, v, ok, want)
+		}
+	}
+
+	c.Add("a", 10)
+	if v, _ := c.Get("a"); v != 10 || c.Len() != 2 {
+		t.Errorf("after replacing a: Get(a) = %d with %d entries", v, c.Len())
+	}
+}
+
+func TestZeroCacheUsesDefaultSize(t *testing.T) {
+	var c Cache[int, int]
+	for i := 0; i < DefaultSize+10; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != DefaultSize {
+		t.Errorf("Len = %d, want %d", c.Len(), DefaultSize)
+	}
+	if _, ok := c.Get(0); ok {
+		t.Error("the oldest entry was kept")
+	}
+	if v, ok := c.Get(DefaultSize + 9); !ok || v != DefaultSize+9 {
+		t.Errorf("newest entry = %d, %v", v, ok)
+	}
+}
@@ -0,0 +1,27 @@
+package scripts
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/dop251/goja"
+)
+
+// Compile decodes a base64 encoded JavaScript and compiles it without running it,
+// reporting syntax errors with their line and column.
+func Compile(base64Script string) (*goja.Program, error) {
+	decoded, err := base64.StdEncoding.DecodeString(base64Script)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding base64 script: %w", err)
+	}
+	return CompileSource(string(decoded))
+}
+
+// CompileSource is Compile for a script given as plain JavaScript.
+func CompileSource(source string) (*goja.Program, error) {
+	program, err := goja.Compile("", wrapScript(source), false)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling script: %w", err)
+	}
+	return program, nil
+}
@@ -0,0 +1,115 @@
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// LogEntry is one call to console.log, console.warn or console.error.
+type LogEntry struct {
+	Level   string // "log", "warn" or "error"
+	Message string
+	Time    time.Time
+}
+
+// A script execution collects at most maxLogEntries console calls and maxLogBytes
+// bytes of messages. Output beyond either is dropped and a warning says so.
+const (
+	maxLogEntries = 1000
+	maxLogBytes   = 1 << 20
+)
+
+// consoleLevels are the console functions and the prefix their output has in the
+// Go log when no execution collects it.
+var consoleLevels = []struct{ level, prefix string }{
+	{"log", "[JS Log]"},
+	{"warn", "[JS Warn]"},
+	{"error", "[JS Error]"},
+}
+
+// setupConsole installs console.log, console.warn and console.error. Their output is
+// collected in the Logs of the execution, or written to the Go log if the script was
+// started without one.
+func setupConsole(v *vm) error {
+	console := v.NewObject()
+	for _, l := range consoleLevels {
+		level, prefix := l.level, l.prefix
+		err := console.Set(level, func(call goja.FunctionCall) goja.Value {
+			message := formatLog(v.ctx, call.Arguments)
+			if v.exec.detached {
+				log.Println(prefix, message)
+				return goja.Undefined()
+			}
+			v.exec.collectLog(level, message)
+			return goja.Undefined()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set console.%s: %w", level, err)
+		}
+	}
+	return v.Set("console", console)
+}
+
+// collectLog appends a console call to the Logs of exec unless they are full. The
+// call that overflows them is cut to the bytes left and followed by a warning.
+func (exec *Execution) collectLog(level, message string) {
+	if exec.LogsTruncated {
+		return
+	}
+	if len(exec.Logs) < maxLogEntries && exec.logBytes+len(message) <= maxLogBytes {
+		exec.logBytes += len(message)
+		exec.Logs = append(exec.Logs, LogEntry{Level: level, Message: message, Time: exec.now()})
+		return
+	}
+	if room := maxLogBytes - exec.logBytes; len(exec.Logs) < maxLogEntries && room > 0 {
+		// Cutting may split a character; its remaining bytes are dropped.
+		exec.Logs = append(exec.Logs, LogEntry{Level: level, Message: strings.ToValidUTF8(message[:room], ""), Time: exec.now()})
+	}
+	exec.LogsTruncated = true
+	exec.Logs = append(exec.Logs, LogEntry{
+		Level:   "warn",
+		Message: fmt.Sprintf("[console output truncated: a script execution keeps at most %d entries and %d bytes]", maxLogEntries, maxLogBytes),
+		Time:    exec.now(),
+	})
+}
+
+// formatLog joins the arguments of a console call with spaces. Strings are written as
+// they are and other values as JSON, e.g. {"total":42}.
+func formatLog(ctx context.Context, args []goja.Value) string {
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		parts[i] = formatLogValue(ctx, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+func formatLogValue(ctx context.Context, value goja.Value) string {
+	if _, isObject := value.(*goja.Object); !isObject {
+		if s, ok := value.Export().(string); ok {
+			return s
+		}
+	}
+	exported, ok, err := exportValue(ctx, value)
+	var tooLarge *ResultTooLargeError
+	if errors.As(err, &tooLarge) || ctx.Err() != nil {
+		return "[" + describe(value) + " too large to log]" // String could be as large
+	}
+	if err != nil || !ok {
+		return value.String()
+	}
+	if t, isTime := exported.(time.Time); isTime {
+		return t.Format(time.RFC3339Nano)
+	}
+	encoded, err := json.Marshal(exported)
+	if err != nil {
+		return value.String()
+	}
+	return string(encoded)
+}
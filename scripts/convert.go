@@ -0,0 +1,211 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// wrapScript turns the source of a script into a function body that is called right
+// away, so scripts can end with return and their variables do not leak into the
+// global scope. The function starts on the first line, so line numbers in errors
+// match the script.
+func wrapScript(source string) string {
+	return "(function () {" + source + "\n})()"
+}
+
+// toValue converts a Go value, typically part of an instance context, to a native
+// JavaScript value. Maps and slices are copied into JavaScript objects and arrays, so
+// a script cannot change the caller's context in place and arrays behave as usual,
+// e.g. with push.
+func toValue(rt *goja.Runtime, value interface{}) goja.Value {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		obj := rt.NewObject()
+		for key, item := range v {
+			obj.Set(key, toValue(rt, item))
+		}
+		return obj
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = toValue(rt, item)
+		}
+		return rt.NewArray(items...)
+	default:
+		return rt.ToValue(value)
+	}
+}
+
+// errCyclic is returned for values that contain themselves, which cannot be stored.
+var errCyclic = errors.New("value contains a reference to itself")
+
+// maxExportedValues bounds the array items and object fields, and maxExportedBytes
+// the bytes of the strings, that one value converted back to Go may hold at any depth.
+// Conversion runs after the script, outside its time and memory limits, so without
+// them an array whose length was set to 4e9 would be filled with as many nulls.
+const (
+	maxExportedValues = 1 << 20
+	maxExportedBytes  = 64 << 20
+)
+
+// ResultTooLargeError is returned when a value a script hands back exceeds
+// maxExportedValues or maxExportedBytes.
+type ResultTooLargeError struct {
+	What  string // "items and fields" or "bytes of strings"
+	Limit int
+}
+
+func (e *ResultTooLargeError) Error() string {
+	return fmt.Sprintf("value has more than %d %s", e.Limit, e.What)
+}
+
+// exporter converts one value with exportValue and keeps track of its size.
+type exporter struct {
+	ctx    context.Context
+	path   map[*goja.Object]bool // objects being converted, to detect cycles
+	values int
+	bytes  int
+}
+
+// exportValue converts a JavaScript value to Go the way JSON.stringify would see it,
+// but keeping integers apart from other numbers: objects become
+// map[string]interface{}, arrays []interface{}, integers int64 and other numbers
+// float64, at any depth. Dates become time.Time. Undefined values and functions
+// are left out of objects, and NaN and infinities become nil. ok is false for values
+// that are left out. Conversion stops with ctx's error when ctx is done, and with a
+// *ResultTooLargeError when the value is too large to store.
+func exportValue(ctx context.Context, value goja.Value) (result interface{}, ok bool, err error) {
+	e := &exporter{ctx: ctx, path: make(map[*goja.Object]bool)}
+	return e.export(value)
+}
+
+// count adds n items or fields to the size of the value.
+func (e *exporter) count(n int64) error {
+	if n > int64(maxExportedValues-e.values) {
+		return &ResultTooLargeError{What: "items and fields", Limit: maxExportedValues}
+	}
+	e.values += int(n)
+	return nil
+}
+
+func (e *exporter) export(value goja.Value) (interface{}, bool, error) {
+	if value == nil || goja.IsUndefined(value) {
+		return nil, false, nil
+	}
+	if goja.IsNull(value) {
+		return nil, true, nil
+	}
+	if _, isFunction := goja.AssertFunction(value); isFunction {
+		return nil, false, nil
+	}
+	obj, isObject := value.(*goja.Object)
+	if !isObject {
+		switch exported := value.Export().(type) {
+		case float64:
+			if math.IsNaN(exported) || math.IsInf(exported, 0) {
+				return nil, true, nil
+			}
+			return exported, true, nil
+		case string:
+			if e.bytes += len(exported); e.bytes > maxExportedBytes {
+				return nil, false, &ResultTooLargeError{What: "bytes of strings", Limit: maxExportedBytes}
+			}
+			return exported, true, nil
+		default:
+			return exported, true, nil
+		}
+	}
+
+	if err := e.ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	if e.path[obj] {
+		return nil, false, errCyclic
+	}
+	e.path[obj] = true
+	defer delete(e.path, obj)
+
+	switch obj.ClassName() {
+	case "Array":
+		length := obj.Get("length").ToInteger()
+		if err := e.count(length); err != nil {
+			return nil, false, err
+		}
+		items := make([]interface{}, 0, length)
+		for i := int64(0); i < length; i++ {
+			if i%4096 == 4095 {
+				if err := e.ctx.Err(); err != nil {
+					return nil, false, err
+				}
+			}
+			item, ok, err := e.export(obj.Get(strconv.FormatInt(i, 10)))
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				item = nil // as JSON.stringify does for undefined array items
+			}
+			items = append(items, item)
+		}
+		return items, true, nil
+	case "Object":
+		keys := obj.Keys()
+		if err := e.count(int64(len(keys))); err != nil {
+			return nil, false, err
+		}
+		fields := make(map[string]interface{}, len(keys))
+		for _, key := range keys {
+			field, ok, err := e.export(obj.Get(key))
+			if err != nil {
+				return nil, false, fmt.Errorf("%s: %w", key, err)
+			}
+			if ok {
+				fields[key] = field
+			}
+		}
+		return fields, true, nil
+	case "Date":
+		if t, isTime := obj.Export().(time.Time); isTime {
+			return t, true, nil
+		}
+	}
+	return obj.Export(), true, nil
+}
+
+// exportObject converts a JavaScript object to a map with exportValue.
+func exportObject(ctx context.Context, value goja.Value) (map[string]interface{}, error) {
+	exported, _, err := exportValue(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	fields, ok := exported.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("got %s instead of an object", describe(value))
+	}
+	return fields, nil
+}
+
+// describe names the type of a JavaScript value for error messages.
+func describe(value goja.Value) string {
+	if obj, ok := value.(*goja.Object); ok {
+		if obj.ClassName() == "Array" {
+			return "an array"
+		}
+		return "an object of class " + obj.ClassName()
+	}
+	switch value.Export().(type) {
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case int64, float64:
+		return "a number"
+	}
+	return value.String()
+}
@@ -0,0 +1,230 @@
+package scripts
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/google/uuid"
+)
+
+// Instance is the read-only view a script has of the instance running it, exposed
+// as the global instance.
+type Instance struct {
+	ID              string
+	WorkflowID      string
+	WorkflowVersion int
+	Node            string
+	BusinessKey     string
+}
+
+// Signal is a signal a script threw with throwSignal.
+type Signal struct {
+	Name    string
+	Payload map[string]interface{}
+}
+
+// Execution describes one script execution to the host functions and collects what
+// the script asked the host to do. Attach it to the context passed to ExecuteScript
+// with WithExecution.
+type Execution struct {
+	Instance Instance
+	// Now is the clock behind the time helpers. Defaults to time.Now.
+	Now func() time.Time
+
+	// HTTP limits the requests the script may make with http.fetch. Without a policy
+	// it cannot make any.
+	HTTP *HTTPPolicy
+	// Libraries holds the source of every library the script may require, by name,
+	// e.g. "lib/pricing".
+	Libraries map[string]string
+	// Strict removes eval and the Function constructors, so the script can only run
+	// the code it was deployed with.
+	Strict bool
+
+	// Signals are the signals thrown by the script, in order. They are for the caller
+	// to deliver once the script's changes are saved.
+	Signals []Signal
+	// Requests summarize the requests the script made, in order, including those that
+	// were refused or failed.
+	Requests []HTTPExchange
+	// Logs are the console.log, console.warn and console.error calls of the script,
+	// in order.
+	Logs []LogEntry
+	// LogsTruncated is set if the script logged more than an execution keeps. The
+	// last entry of Logs is then a warning saying so.
+	LogsTruncated bool
+
+	detached bool // not supplied by the caller, so nobody reads Logs
+	logBytes int  // bytes of the messages in Logs
+}
+
+type executionKey struct{}
+
+// WithExecution returns a context that makes exec available to the host functions.
+func WithExecution(ctx context.Context, exec *Execution) context.Context {
+	return context.WithValue(ctx, executionKey{}, exec)
+}
+
+func executionFrom(ctx context.Context) *Execution {
+	if exec, ok := ctx.Value(executionKey{}).(*Execution); ok {
+		return exec
+	}
+	return &Execution{detached: true}
+}
+
+func (x *Execution) now() time.Time {
+	if x.Now != nil {
+		return x.Now()
+	}
+	return time.Now()
+}
+
+// BusinessError is returned when a script calls fail(code, message) to report that
+// the instance cannot go on for a business reason, e.g. an order that is out of stock.
+type BusinessError struct {
+	Code    string
+	Message string
+}
+
+func (e *BusinessError) Error() string {
+	return fmt.Sprintf("business error %s: %s", e.Code, e.Message)
+}
+
+// reserved are the globals of the host library. Embedders cannot register
+// functions under these names.
+var reserved = map[string]bool{
+	"process_data": true, "console": true, "instance": true, "time": true, "uuid": true,
+	"base64": true, "hash": true, "http": true, "require": true, "throwSignal": true, "fail": true,
+}
+
+// Register exposes value, typically a Go function, to every script as the global
+// name, replacing any previous value of that name. Functions are converted
+// by goja, so plain Go functions such as func(string, float64) bool can be used.
+// Names of the host library, such as time or fail, are reserved; to replace them,
+// e.g. with a mock in a test, set Globals directly before running scripts.
+func (r *Runtime) Register(name string, value interface{}) error {
+	if reserved[name] {
+		return fmt.Errorf("%s is a reserved script global", name)
+	}
+	r.globalsMu.Lock()
+	defer r.globalsMu.Unlock()
+	if r.Globals == nil {
+		r.Globals = make(map[string]interface{})
+	}
+	r.Globals[name] = value
+	return nil
+}
+
+// setupHost installs the host library in a new vm. The functions read the execution
+// the vm is currently running for, so they are installed once per vm.
+//
+//	time.now()                  current time of the engine clock as an RFC 3339 string
+//	time.nowMillis()            the same in milliseconds since the Unix epoch
+//	time.add(timestamp, "36h")  timestamp moved by a Go duration
+//	time.diff(from, to)         milliseconds from one timestamp to another
+//	uuid()                      a random UUID
+//	base64.encode(s), base64.decode(s)
+//	hash.sha256(s), hash.sha1(s), hash.md5(s)   hex digests
+//	throwSignal(name, payload)  resume the instances waiting for a signal once the script is done
+//	fail(code, message)         stop the script with a *BusinessError; try/catch cannot intercept it
+//
+// http.fetch and require are installed by setupHTTP and setupRequire.
+// JSON is available as usual. The instance global is set per execution.
+func setupHost(v *vm) error {
+	rt := v.Runtime
+	throw := func(format string, args ...interface{}) {
+		panic(rt.NewTypeError(fmt.Sprintf(format, args...)))
+	}
+	parseTime := func(fn, s string) time.Time {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			throw("%s: %q is not an RFC 3339 timestamp", fn, s)
+		}
+		return t
+	}
+
+	timeObj := rt.NewObject()
+	timeObj.Set("now", func() string { return v.exec.now().Format(time.RFC3339Nano) })
+	timeObj.Set("nowMillis", func() int64 { return v.exec.now().UnixMilli() })
+	timeObj.Set("add", func(timestamp, duration string) string {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			throw("time.add: %q is not a duration", duration)
+		}
+		return parseTime("time.add", timestamp).Add(d).Format(time.RFC3339Nano)
+	})
+	timeObj.Set("diff", func(from, to string) int64 {
+		return parseTime("time.diff", to).Sub(parseTime("time.diff", from)).Milliseconds()
+	})
+
+	base64Obj := rt.NewObject()
+	base64Obj.Set("encode", func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) })
+	base64Obj.Set("decode", func(s string) string {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			throw("base64.decode: %v", err)
+		}
+		return string(decoded)
+	})
+
+	hashObj := rt.NewObject()
+	digest := func(newHash func() hash.Hash) func(string) string {
+		return func(s string) string {
+			h := newHash()
+			h.Write([]byte(s))
+			return hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	hashObj.Set("sha256", digest(sha256.New))
+	hashObj.Set("sha1", digest(sha1.New))
+	hashObj.Set("md5", digest(md5.New))
+
+	globals := map[string]interface{}{
+		"time":   timeObj,
+		"uuid":   func() string { return uuid.New().String() },
+		"base64": base64Obj,
+		"hash":   hashObj,
+		"throwSignal": func(name string, payload map[string]interface{}) {
+			if name == "" {
+				throw("throwSignal: a signal name is required")
+			}
+			v.exec.Signals = append(v.exec.Signals, Signal{Name: name, Payload: payload})
+		},
+		// An interrupt, unlike an exception, cannot be caught by the script.
+		"fail": func(code, message string) {
+			rt.Interrupt(&BusinessError{Code: code, Message: message})
+		},
+	}
+	for name, value := range globals {
+		if err := rt.Set(name, value); err != nil {
+			return fmt.Errorf("failed to set %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setupInstance exposes the instance of the current execution as a read-only object.
+func setupInstance(v *vm) error {
+	obj := v.NewObject()
+	info := v.exec.Instance
+	for key, value := range map[string]interface{}{
+		"id":              info.ID,
+		"workflowId":      info.WorkflowID,
+		"workflowVersion": info.WorkflowVersion,
+		"node":            info.Node,
+		"businessKey":     info.BusinessKey,
+	} {
+		if err := obj.DefineDataProperty(key, v.ToValue(value), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_TRUE); err != nil {
+			return err
+		}
+	}
+	return v.GlobalObject().DefineDataProperty("instance", obj, goja.FLAG_FALSE, goja.FLAG_TRUE, goja.FLAG_TRUE)
+}
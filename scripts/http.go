@@ -0,0 +1,278 @@
+package scripts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	// DefaultHTTPTimeout bounds a request made with http.fetch unless the policy
+	// sets another timeout.
+	DefaultHTTPTimeout = 10 * time.Second
+	// DefaultMaxResponseBytes caps the body of a response read by http.fetch unless
+	// the policy sets another cap.
+	DefaultMaxResponseBytes = 1 << 20
+)
+
+// HTTPPolicy limits the requests a script may make with http.fetch. Executions
+// without a policy cannot make requests.
+type HTTPPolicy struct {
+	// Allow lists the hosts requests may go to: a host name such as
+	// "api.example.com", a host and port such as "127.0.0.1:8080" or "[::1]:8080",
+	// or a wildcard such as "*.example.com" for its subdomains.
+	Allow []string
+	// Timeout bounds each request, including reading its response. 0 means
+	// DefaultHTTPTimeout. Requests never outlast the script's own time limit.
+	Timeout time.Duration
+	// MaxResponseBytes caps the body of each response. 0 means DefaultMaxResponseBytes.
+	MaxResponseBytes int64
+}
+
+// Allows reports whether the policy allows requests to u. An entry with a port only
+// allows URLs giving that port; IPv6 addresses are written with brackets when a port
+// follows, as in "[::1]:8080", and with or without them otherwise.
+func (p *HTTPPolicy) Allows(u *url.URL) bool {
+	if p == nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, entry := range p.Allow {
+		entryHost, entryPort, err := net.SplitHostPort(strings.ToLower(entry))
+		if err != nil {
+			entryHost, entryPort = strings.Trim(strings.ToLower(entry), "[]"), ""
+		}
+		if entryPort != "" && entryPort != u.Port() {
+			continue
+		}
+		if strings.HasPrefix(entryHost, "*.") {
+			if strings.HasSuffix(host, entryHost[1:]) {
+				return true
+			}
+		} else if host == entryHost {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPExchange summarizes a request made with http.fetch.
+type HTTPExchange struct {
+	Method   string
+	URL      string
+	Status   int // 0 if no response was received
+	Bytes    int // size of the response body
+	Duration time.Duration
+	Err      string // why the request failed, if it did
+}
+
+// String describes the exchange in one line, e.g.
+// "POST https://api.example.com/charges: 201, 312 bytes in 84ms".
+func (x HTTPExchange) String() string {
+	if x.Err != "" {
+		return fmt.Sprintf("%s %s: %s after %s", x.Method, x.URL, x.Err, x.Duration.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("%s %s: %d, %d bytes in %s", x.Method, x.URL, x.Status, x.Bytes, x.Duration.Round(time.Millisecond))
+}
+
+// client returns the HTTP client used by http.fetch.
+func (r *Runtime) client() *http.Client {
+	if r.HTTPClient != nil {
+		return r.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// fetchOptions are the options a script passes to http.fetch.
+type fetchOptions struct {
+	Method  string
+	Headers map[string]string
+	Body    interface{} // a string is sent as is, anything else as JSON
+}
+
+// setupHTTP installs http.fetch(url, options) in a new vm. It is synchronous from the
+// script's view and returns {status, ok, headers, body, json()}; the request is made
+// only if the execution's HTTP policy allows its host, and every request, allowed or
+// not, is recorded in the execution's Requests. Failed requests throw an error the
+// script can catch.
+func (r *Runtime) setupHTTP(v *vm) error {
+	rt := v.Runtime
+	fetch := func(call goja.FunctionCall) goja.Value {
+		opts, err := exportFetchOptions(call.Argument(1))
+		if err != nil {
+			panic(rt.NewTypeError(fmt.Sprintf("http.fetch: invalid options: %v", err)))
+		}
+		exchange := HTTPExchange{Method: strings.ToUpper(opts.Method), URL: call.Argument(0).String()}
+		if exchange.Method == "" {
+			exchange.Method = http.MethodGet
+		}
+		start := time.Now()
+		resp, err := r.fetch(v, &exchange, opts)
+		exchange.Duration = time.Since(start)
+		if err != nil {
+			exchange.Err = err.Error()
+		}
+		v.exec.Requests = append(v.exec.Requests, exchange)
+		if err != nil {
+			panic(rt.NewGoError(fmt.Errorf("http.fetch: %w", err)))
+		}
+		return fetchResponse(rt, resp)
+	}
+	obj := rt.NewObject()
+	if err := obj.Set("fetch", fetch); err != nil {
+		return err
+	}
+	return rt.Set("http", obj)
+}
+
+// exportFetchOptions reads {method, headers, body} from the options object.
+func exportFetchOptions(arg goja.Value) (fetchOptions, error) {
+	var opts fetchOptions
+	if goja.IsUndefined(arg) || goja.IsNull(arg) {
+		return opts, nil
+	}
+	fields, ok := arg.Export().(map[string]interface{})
+	if !ok {
+		return opts, errors.New("not an object")
+	}
+	if method, ok := fields["method"]; ok {
+		if opts.Method, ok = method.(string); !ok {
+			return opts, errors.New("method must be a string")
+		}
+	}
+	if headers, ok := fields["headers"]; ok {
+		values, ok := headers.(map[string]interface{})
+		if !ok {
+			return opts, errors.New("headers must be an object")
+		}
+		opts.Headers = make(map[string]string, len(values))
+		for name, value := range values {
+			opts.Headers[name] = fmt.Sprint(value)
+		}
+	}
+	opts.Body = fields["body"]
+	return opts, nil
+}
+
+type fetched struct {
+	status  int
+	headers map[string]string
+	body    []byte
+}
+
+// fetch makes the request described by exchange and opts, and reads its response.
+func (r *Runtime) fetch(v *vm, exchange *HTTPExchange, opts fetchOptions) (*fetched, error) {
+	policy := v.exec.HTTP
+	u, err := url.Parse(exchange.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if !policy.Allows(u) {
+		return nil, fmt.Errorf("host %s is not allowed", u.Host)
+	}
+
+	var body io.Reader
+	contentType := ""
+	switch b := opts.Body.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("encoding body: %w", err)
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+
+	timeout := policy.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	ctx, cancel := context.WithTimeout(v.ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, exchange.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range opts.Headers {
+		req.Header.Set(name, value)
+	}
+
+	// Redirects are followed only to allowed hosts.
+	client := *r.client()
+	client.CheckRedirect = func(next *http.Request, via []*http.Request) error {
+		if !policy.Allows(next.URL) {
+			return fmt.Errorf("redirect to host %s is not allowed", next.URL.Host)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		if errors.Is(err, context.DeadlineExceeded) && v.ctx.Err() == nil {
+			err = fmt.Errorf("no response within %s", timeout)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	exchange.Status = resp.StatusCode
+
+	limit := policy.MaxResponseBytes
+	if limit <= 0 {
+		limit = DefaultMaxResponseBytes
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	exchange.Bytes = len(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("response body exceeds %d bytes", limit)
+	}
+
+	headers := make(map[string]string, len(resp.Header))
+	for name := range resp.Header {
+		headers[strings.ToLower(name)] = resp.Header.Get(name)
+	}
+	return &fetched{status: resp.StatusCode, headers: headers, body: data}, nil
+}
+
+// fetchResponse converts a fetched response to the object http.fetch returns.
+func fetchResponse(rt *goja.Runtime, resp *fetched) goja.Value {
+	obj := rt.NewObject()
+	obj.Set("status", resp.status)
+	obj.Set("ok", resp.status >= 200 && resp.status < 300)
+	obj.Set("headers", resp.headers)
+	obj.Set("body", string(resp.body))
+	obj.Set("json", func() interface{} {
+		var value interface{}
+		if err := json.Unmarshal(resp.body, &value); err != nil {
+			panic(rt.NewTypeError(fmt.Sprintf("http.fetch: response is not JSON: %v", err)))
+		}
+		return value
+	})
+	return obj
+}
@@ -0,0 +1,129 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/price", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"sku": "` + r.URL.Query().Get("sku") + `", "price": 12.5, "key": "` + r.Header.Get("X-Api-Key") + `"}`))
+	})
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 2048)))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/away", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://blocked.example/", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	r := &Runtime{}
+	exec := &Execution{HTTP: &HTTPPolicy{Allow: []string{"127.0.0.1"}, Timeout: 100 * time.Millisecond, MaxResponseBytes: 1024}}
+	ctx := WithExecution(context.Background(), exec)
+	got, err := r.ExecuteScript(ctx, `
+		var price = http.fetch(process_data.base + "/price?sku=w-1", {headers: {"X-Api-Key": "secret"}});
+		process_data.status = price.status;
+		process_data.price = price.json().price;
+		process_data.key = price.json().key;
+		process_data.type = price.headers["content-type"];
+		process_data.created = http.fetch(process_data.base + "/orders", {method: "post", body: {sku: "w-1"}}).status;
+		var failures = [];
+		["http://blocked.example/", process_data.base + "/large", process_data.base + "/slow", process_data.base + "/away"].forEach(function (url) {
+			try { http.fetch(url); } catch (e) { failures.push(String(e)); }
+		});
+		process_data.failures = failures;
+	`, map[string]interface{}{"base": server.URL})
+	if err != nil {
+		t.Fatalf("ExecuteScript: %v", err)
+	}
+	want := map[string]interface{}{"status": int64(200), "price": 12.5, "key": "secret", "type": "application/json", "created": int64(201)}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v (%T), want %v", key, got[key], got[key], value)
+		}
+	}
+	failures, _ := got["failures"].([]interface{})
+	for i, want := range []string{"host blocked.example is not allowed", "exceeds 1024 bytes", "no response within 100ms", "redirect to host blocked.example is not allowed"} {
+		if i >= len(failures) || !strings.Contains(failures[i].(string), want) {
+			t.Errorf("failure %d = %v, want %q", i, failures, want)
+		}
+	}
+
+	if len(exec.Requests) != 6 {
+		t.Fatalf("recorded %d requests, want 6: %v", len(exec.Requests), exec.Requests)
+	}
+	if s := exec.Requests[1].String(); !strings.HasPrefix(s, "POST "+server.URL+"/orders: 201, 0 bytes in ") {
+		t.Errorf("summary = %q", s)
+	}
+	if exec.Requests[2].Status != 0 || exec.Requests[2].Err == "" {
+		t.Errorf("refused request = %+v", exec.Requests[2])
+	}
+
+	// Without a policy no request is made, and a request cannot outlast the script.
+	_, err = r.ExecuteScript(context.Background(), `http.fetch(process_data.base + "/price");`, map[string]interface{}{"base": server.URL})
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("err = %v, want the request refused", err)
+	}
+	exec = &Execution{HTTP: &HTTPPolicy{Allow: []string{"127.0.0.1"}}}
+	ctx, cancel := context.WithTimeout(WithExecution(context.Background(), exec), 50*time.Millisecond)
+	defer cancel()
+	_, err = r.ExecuteScript(ctx, `try { http.fetch(process_data.base + "/slow"); } catch (e) {} while (true) {}`, map[string]interface{}{"base": server.URL})
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+}
+
+func TestHTTPPolicyAllows(t *testing.T) {
+	policy := &HTTPPolicy{Allow: []string{"api.example.com", "127.0.0.1:8080", "*.internal.example", "[::1]:9090", "fe80::1", "[2001:db8::2]"}}
+	for _, tt := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://api.example.com/v1", true},
+		{"https://API.example.com:8443/v1", true},
+		{"https://other.example.com/", false},
+		{"http://127.0.0.1:8080/", true},
+		{"http://127.0.0.1:8081/", false},
+		{"http://127.0.0.1/", false},
+		{"https://billing.internal.example/", true},
+		{"https://internal.example/", false},
+		{"http://[::1]:9090/", true},
+		{"http://[::1]:9091/", false},
+		{"http://[::1]/", false},
+		{"http://[fe80::1]/", true},
+		{"http://[fe80::1]:8080/", true},
+		{"http://[2001:db8::2]:443/", true},
+		{"http://[2001:db8::3]/", false},
+	} {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := policy.Allows(u); got != tt.want {
+			t.Errorf("Allows(%s) = %v, want %v", tt.url, got, tt.want)
+		}
+	}
+	if (*HTTPPolicy)(nil).Allows(&url.URL{Host: "api.example.com"}) {
+		t.Error("a nil policy allowed a request")
+	}
+}
@@ -0,0 +1,213 @@
+package scripts
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Limits bound the resources a script may use besides time. Zero values
+// mean no limit.
+type Limits struct {
+	// MaxCallStackSize is how deeply functions may call each other, e.g. in a
+	// recursion. The script itself and every library it requires count as calls.
+	MaxCallStackSize int
+	// MaxMemory is how many bytes of the heap's growth a script may account for.
+	// Go cannot measure the memory of one VM, so the limit is process-wide: the heap
+	// is sampled periodically and its growth split evenly between the scripts
+	// running at the time, including growth caused by other work of the process.
+	// When shares exceed their limits, only the script with the largest share, the
+	// one that has been growing the heap for longest, is interrupted. The limit is
+	// approximate: a single large allocation can overshoot it before it is noticed,
+	// and a script over it runs on until a garbage collection confirms the growth,
+	// which is forced at most every 100ms.
+	MaxMemory int64
+}
+
+// SetLimits sets the limits of the scripts that start after it returns.
+func (r *Runtime) SetLimits(limits Limits) {
+	r.limits.Store(&limits)
+}
+
+func (r *Runtime) currentLimits() Limits {
+	if limits := r.limits.Load(); limits != nil {
+		return *limits
+	}
+	return Limits{}
+}
+
+// StackOverflowError is returned when a script calls functions more deeply than its
+// MaxCallStackSize allows.
+type StackOverflowError struct {
+	Limit int
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("script exceeded the maximum call stack size of %d", e.Limit)
+}
+
+// MemoryLimitError is returned when a script is interrupted because its share of the
+// heap's growth exceeded its MaxMemory.
+type MemoryLimitError struct {
+	Limit int64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("script exceeded its memory limit of %d bytes", e.Limit)
+}
+
+// setCallStackSize applies the call stack limit to vm.
+func setCallStackSize(vm *goja.Runtime, limits Limits) {
+	if limits.MaxCallStackSize > 0 {
+		vm.SetMaxCallStackSize(limits.MaxCallStackSize)
+	} else {
+		vm.SetMaxCallStackSize(math.MaxInt32)
+	}
+}
+
+// memoryCheckInterval is how often the heap is measured while scripts run.
+const memoryCheckInterval = 10 * time.Millisecond
+
+// memoryGCInterval is how often at most a garbage collection is forced to confirm
+// that scripts are over their limits. A collection stops every goroutine of the
+// process, so scripts over their limits run on until the next one is allowed.
+const memoryGCInterval = 100 * time.Millisecond
+
+// heapObjectsMetric counts the bytes of live objects and of garbage not yet swept.
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+func heapBytes() int64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+// memoryGuard tracks the share of the heap's growth of one running script.
+type memoryGuard struct {
+	vm    *goja.Runtime
+	limit int64
+	last  int64 // heap when the share was last updated
+	share int64
+}
+
+// memoryMonitor samples the heap for every guarded script with a single goroutine,
+// which runs while there are guards.
+type memoryMonitor struct {
+	mu      sync.Mutex
+	guards  map[*memoryGuard]bool
+	running bool
+	lastGC  time.Time // when sample last forced a garbage collection
+}
+
+var memory = &memoryMonitor{guards: make(map[*memoryGuard]bool)}
+
+// guardMemory interrupts vm with a *MemoryLimitError once its share of the heap's
+// growth exceeds limit bytes, until the returned stop function is called. Growth
+// only counts against scripts if it survives a garbage collection, which is forced
+// at most once per memoryGCInterval.
+func guardMemory(vm *goja.Runtime, limit int64) (stop func()) {
+	if limit <= 0 {
+		return func() {}
+	}
+	g := &memoryGuard{vm: vm, limit: limit, last: heapBytes()}
+	m := memory
+	m.mu.Lock()
+	m.guards[g] = true
+	if !m.running {
+		m.running = true
+		go m.sample()
+	}
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		delete(m.guards, g)
+		m.mu.Unlock()
+	}
+}
+
+// sample measures the heap until no script is guarded any more.
+func (m *memoryMonitor) sample() {
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mu.Lock()
+		if len(m.guards) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+		over := m.update(heapBytes())
+		collect := over && time.Since(m.lastGC) >= memoryGCInterval
+		if collect {
+			m.lastGC = time.Now()
+		}
+		m.mu.Unlock()
+		if !collect {
+			continue
+		}
+
+		runtime.GC()
+		m.mu.Lock()
+		if m.update(heapBytes()) {
+			m.interruptLargest()
+		}
+		m.mu.Unlock()
+	}
+}
+
+// interruptLargest interrupts the script with the largest share over its limit. As
+// the growth was split evenly, the other scripts' shares are likely the culprit's,
+// so they are forgiven; a script that keeps growing the heap soon exceeds its limit
+// again. m.mu must be held.
+func (m *memoryMonitor) interruptLargest() {
+	var culprit *memoryGuard
+	for g := range m.guards {
+		if g.share > g.limit && (culprit == nil || g.share > culprit.share) {
+			culprit = g
+		}
+	}
+	culprit.vm.Interrupt(&MemoryLimitError{Limit: culprit.limit})
+	delete(m.guards, culprit)
+	for g := range m.guards {
+		g.share = 0
+	}
+}
+
+// update splits the heap's growth since each guard's last update evenly between
+// the guards, and reports whether a guard is over its limit. Shrinking heaps reduce
+// the shares the same way. m.mu must be held.
+func (m *memoryMonitor) update(heap int64) (over bool) {
+	n := int64(len(m.guards))
+	for g := range m.guards {
+		g.share = max(0, g.share+(heap-g.last)/n)
+		g.last = heap
+		over = over || g.share > g.limit
+	}
+	return over
+}
+
+// restrictedScript removes the ways of turning strings into code from a vm: eval,
+// the Function constructor and the constructors reachable from functions, e.g.
+// (function () {}).constructor.
+const restrictedScript = `(function () {
+	var blocked = function () { throw new EvalError("code generation is not allowed in strict mode"); };
+	[function () {}, function* () {}, async function () {}].forEach(function (fn) {
+		Object.defineProperty(Object.getPrototypeOf(fn), "constructor", {value: blocked, writable: false, configurable: false});
+	});
+	delete globalThis.eval;
+	delete globalThis.Function;
+})()`
+
+// restrict prepares a new vm for strict executions.
+func restrict(v *vm) error {
+	_, err := v.RunString(restrictedScript)
+	return err
+}
@@ -0,0 +1,106 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimits(t *testing.T) {
+	r := &Runtime{}
+	r.SetLimits(Limits{MaxCallStackSize: 100, MaxMemory: 32 << 20})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	recurse := `function down(n) { return n === 0 ? 0 : 1 + down(n - 1); } return {depth: down(process_data.depth)};`
+	result, err := r.ExecuteScript(ctx, recurse, map[string]interface{}{"depth": 50})
+	if err != nil || result["depth"] != int64(50) {
+		t.Errorf("recursion within the limit = %v, %v", result, err)
+	}
+	_, err = r.ExecuteScript(ctx, recurse, map[string]interface{}{"depth": 1000})
+	var overflow *StackOverflowError
+	if !errors.As(err, &overflow) || overflow.Limit != 100 {
+		t.Errorf("deep recursion error = %v, want a *StackOverflowError", err)
+	}
+	// A stack overflow cannot be caught, not even inside a library.
+	libs := WithExecution(ctx, &Execution{Libraries: map[string]string{"deep": `exports.down = function down(n) { return n === 0 ? 0 : 1 + down(n - 1); }; exports.down(1000);`}})
+	_, err = r.ExecuteScript(libs, `try { require("deep"); } catch (e) { return {caught: String(e)}; }`, map[string]interface{}{})
+	if !errors.As(err, &overflow) {
+		t.Errorf("deep recursion in a library error = %v, want a *StackOverflowError", err)
+	}
+
+	_, err = r.ExecuteScript(ctx, `var rows = []; while (true) { rows.push({id: rows.length, name: "row " + rows.length}); }`, map[string]interface{}{})
+	var memory *MemoryLimitError
+	if !errors.As(err, &memory) || memory.Limit != 32<<20 {
+		t.Errorf("runaway allocation error = %v, want a *MemoryLimitError", err)
+	}
+
+	// The runtime is usable again afterwards.
+	if result, err := r.ExecuteScript(ctx, `return {ok: true};`, map[string]interface{}{}); err != nil || result["ok"] != true {
+		t.Errorf("script after the limits were hit = %v, %v", result, err)
+	}
+}
+
+func TestStrictExecution(t *testing.T) {
+	r := &Runtime{}
+	probe := `
+		var blocked = [];
+		var attempts = {
+			eval: function () { return eval("1 + 1"); },
+			Function: function () { return new Function("return 2")(); },
+			constructor: function () { return (function () {}).constructor("return 3")(); },
+			generator: function () { return Object.getPrototypeOf(function* () {}).constructor("yield 4"); },
+			redefine: function () { Function.prototype.constructor = function () { return 5; }; return (function () {}).constructor(); }
+		};
+		for (var name in attempts) {
+			try { attempts[name](); } catch (e) { blocked.push(name); }
+		}
+		return {blocked: blocked.join(",")};`
+
+	strict := WithExecution(context.Background(), &Execution{Strict: true})
+	result, err := r.ExecuteScript(strict, probe, map[string]interface{}{})
+	if err != nil || result["blocked"] != "eval,Function,constructor,generator,redefine" {
+		t.Errorf("strict script = %v, %v; want every attempt blocked", result, err)
+	}
+
+	// Strict and normal executions do not share runtimes.
+	result, err = r.ExecuteScript(context.Background(), `return {sum: eval("1 + 1")};`, map[string]interface{}{})
+	if err != nil || result["sum"] != int64(2) {
+		t.Errorf("normal script = %v, %v; want eval to work", result, err)
+	}
+	result, err = r.ExecuteScript(strict, probe, map[string]interface{}{})
+	if err != nil || result["blocked"] != "eval,Function,constructor,generator,redefine" {
+		t.Errorf("strict script after a normal one = %v, %v", result, err)
+	}
+}
+
+func TestMemoryLimitSharedHeap(t *testing.T) {
+	r := &Runtime{}
+	r.SetLimits(Limits{MaxMemory: 32 << 20})
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	heavy := make(chan error, 1)
+	go func() {
+		_, err := r.ExecuteScript(ctx, `var rows = []; while (true) { rows.push({id: rows.length, name: "row " + rows.length}); }`, map[string]interface{}{})
+		heavy <- err
+	}()
+	// The heavy script must be guarded first to have the larger share.
+	for guarded := 0; guarded == 0; time.Sleep(time.Millisecond) {
+		memory.mu.Lock()
+		guarded = len(memory.guards)
+		memory.mu.Unlock()
+	}
+
+	// A script that hardly allocates runs while the heap grows by more than the limit;
+	// that growth is not all counted against it.
+	_, err := r.ExecuteScript(ctx, `var end = Date.now() + 1500; while (Date.now() < end) {} return {};`, map[string]interface{}{})
+	if err != nil {
+		t.Errorf("light script error = %v", err)
+	}
+	var memory *MemoryLimitError
+	if err := <-heavy; !errors.As(err, &memory) {
+		t.Errorf("heavy script error = %v, want a *MemoryLimitError", err)
+	}
+}
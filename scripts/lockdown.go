@@ -0,0 +1,98 @@
+package scripts
+
+import (
+	"fmt"
+
+	"github.com/dop251/goja"
+)
+
+// lockdownScript freezes the objects reachable from the global scope of a new vm:
+// the JavaScript built-ins, their prototypes and the host objects. Pooled runtimes
+// are shared by every workflow, so a script must not be able to change what a later
+// one sees, e.g. by adding to Object.prototype or replacing JSON.stringify.
+//
+// Freezing a prototype also stops assignments to objects inheriting from it, so the
+// properties scripts commonly give objects of their own, e.g. this.name in an Error
+// subclass or toString on a prototype, first become accessors that define the
+// property on the object assigned to.
+//
+// It returns a function reporting whether the global object still has its prototype
+// and can be extended; release drops runtimes where a script changed either.
+const lockdownScript = `(function () {
+	var getPrototypeOf = Object.getPrototypeOf, isExtensible = Object.isExtensible,
+		describe = Object.getOwnPropertyDescriptor, define = Object.defineProperty,
+		freeze = Object.freeze, ownKeys = Reflect.ownKeys;
+
+	function overridable(proto, names) {
+		names.forEach(function (name) {
+			var desc = describe(proto, name);
+			if (!desc || !("value" in desc) || !desc.configurable) {
+				return;
+			}
+			var value = desc.value;
+			define(proto, name, {
+				get: function () { return value; },
+				set: function (v) {
+					if (this === proto) {
+						throw new TypeError("Cannot assign to read only property '" + String(name) + "' of a built-in object");
+					}
+					define(this, name, {value: v, writable: true, enumerable: true, configurable: true});
+				},
+				enumerable: desc.enumerable,
+				configurable: false
+			});
+		});
+	}
+	overridable(Object.prototype, ["constructor", "toString", "toLocaleString", "valueOf"]);
+	// Function is removed from the global scope of strict runtimes.
+	overridable(getPrototypeOf(function () {}), ["constructor", "toString"]);
+	[Error, EvalError, RangeError, ReferenceError, SyntaxError, TypeError, URIError].forEach(function (error) {
+		overridable(error.prototype, ["constructor", "name", "message", "toString"]);
+	});
+	overridable(Promise.prototype, ["constructor"]);
+
+	var frozen = new Set();
+	function lock(value) {
+		if ((typeof value !== "object" && typeof value !== "function") || value === null || value === globalThis || frozen.has(value)) {
+			return;
+		}
+		frozen.add(value);
+		freeze(value);
+		lock(getPrototypeOf(value));
+		ownKeys(value).forEach(function (key) {
+			var desc = describe(value, key);
+			lock(desc.value);
+			lock(desc.get);
+			lock(desc.set);
+		});
+	}
+	ownKeys(globalThis).forEach(function (key) {
+		lock(describe(globalThis, key).value);
+	});
+
+	var global = globalThis, globalProto = getPrototypeOf(global);
+	return function () {
+		return getPrototypeOf(global) === globalProto && isExtensible(global);
+	};
+})()`
+
+// lockdown freezes the built-ins and host objects of a new vm, once its globals are
+// installed and before any script runs, and records how to check its global object.
+func lockdown(v *vm) error {
+	intact, err := v.RunString(lockdownScript)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if v.intact, ok = goja.AssertFunction(intact); !ok {
+		return fmt.Errorf("lockdown did not return a function")
+	}
+	return nil
+}
+
+// globalIntact reports whether the global object of v still has the prototype and
+// extensibility lockdown left it with.
+func (v *vm) globalIntact() bool {
+	intact, err := v.intact(goja.Undefined())
+	return err == nil && intact.ToBoolean()
+}
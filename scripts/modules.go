@@ -0,0 +1,122 @@
+package scripts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// wrapModule turns the source of a library into a function expression taking the
+// CommonJS exports, require and module arguments.
+func wrapModule(source string) string {
+	return "(function (exports, require, module) {\n" + source + "\n})"
+}
+
+// CompileModule compiles the source of a script library without running it,
+// reporting syntax errors with their line and column.
+func CompileModule(name, source string) error {
+	if _, err := goja.Compile(name+".js", wrapModule(source), false); err != nil {
+		return fmt.Errorf("error compiling library %s: %w", name, err)
+	}
+	return nil
+}
+
+// ValidModuleName reports whether name can name a library, e.g. "lib/pricing": a
+// slash-separated path inside the library directory, without the .js extension.
+func ValidModuleName(name string) bool {
+	return filepath.IsLocal(name) && path.Clean(name) == name &&
+		!strings.HasSuffix(name, ".js") && !strings.Contains(name, `\`)
+}
+
+// ReadModule reads the library name, e.g. "lib/pricing" from <dir>/lib/pricing.js.
+// Only files inside dir can be read, so names cannot escape it, e.g. through
+// symbolic links.
+func ReadModule(dir, name string) (string, error) {
+	if !ValidModuleName(name) {
+		return "", fmt.Errorf("invalid library name %q", name)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return "", fmt.Errorf("opening library directory: %w", err)
+	}
+	defer root.Close()
+	file, err := root.Open(name + ".js")
+	if err != nil {
+		return "", fmt.Errorf("reading library %s: %w", name, err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("reading library %s: %w", name, err)
+	}
+	return string(data), nil
+}
+
+// setupRequire installs require(name) in a new vm. It loads a library of the current
+// execution as a CommonJS module: the library assigns what it offers to exports or
+// module.exports, and require returns it. A library runs at most once per execution,
+// however often it is required; its compiled form is cached like scripts are.
+func (r *Runtime) setupRequire(v *vm) error {
+	return v.Set("require", func(name string) goja.Value {
+		module, err := r.require(v, name)
+		if err != nil {
+			// Exceptions thrown by the library reach the script as they are, and
+			// interrupts, e.g. at the time limit, and stack overflows keep stopping it.
+			var exception *goja.Exception
+			var interrupted *goja.InterruptedError
+			var overflow *goja.StackOverflowError
+			switch {
+			case errors.As(err, &exception):
+				panic(exception)
+			case errors.As(err, &interrupted):
+				panic(interrupted)
+			case errors.As(err, &overflow):
+				panic(overflow)
+			}
+			panic(v.NewGoError(err))
+		}
+		return module.Get("exports")
+	})
+}
+
+func (r *Runtime) require(v *vm, name string) (*goja.Object, error) {
+	if module, ok := v.modules[name]; ok {
+		return module, nil
+	}
+	source, ok := v.exec.Libraries[name]
+	if !ok {
+		return nil, fmt.Errorf("require: unknown library %q; libraries must be listed in the definition", name)
+	}
+	program, err := r.program(wrapModule(source))
+	if err != nil {
+		return nil, fmt.Errorf("require: error compiling library %s: %w", name, err)
+	}
+	wrapper, err := v.RunProgram(program)
+	if err != nil {
+		return nil, err
+	}
+	call, ok := goja.AssertFunction(wrapper)
+	if !ok {
+		return nil, fmt.Errorf("require: library %s did not compile to a function", name)
+	}
+
+	exports := v.NewObject()
+	module := v.NewObject()
+	if err := module.Set("exports", exports); err != nil {
+		return nil, err
+	}
+	// Registered before it runs, so libraries requiring each other see the exports
+	// assigned so far instead of recursing.
+	v.modules[name] = module
+	if _, err := call(goja.Undefined(), exports, v.Get("require"), module); err != nil {
+		delete(v.modules, name)
+		return nil, err
+	}
+	return module, nil
+}
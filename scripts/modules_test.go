@@ -0,0 +1,86 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequire(t *testing.T) {
+	r := &Runtime{}
+	exec := &Execution{Libraries: map[string]string{
+		"lib/tax":     `exports.rate = 0.2; exports.loads = (exports.loads || 0) + 1;`,
+		"lib/pricing": `var tax = require("lib/tax"); module.exports = {gross: function (net) { return net * (1 + tax.rate); }};`,
+		"lib/broken":  `throw new Error("not configured");`,
+		"lib/endless": `while (true) {}`,
+	}}
+	ctx := WithExecution(context.Background(), exec)
+
+	got, err := r.ExecuteScript(ctx, `
+		var pricing = require("lib/pricing");
+		process_data.gross = pricing.gross(100);
+		process_data.loads = require("lib/tax").loads;
+		try { require("lib/broken"); } catch (e) { process_data.broken = e.message; }
+		try { require("lib/missing"); } catch (e) { process_data.missing = String(e); }
+	`, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("ExecuteScript: %v", err)
+	}
+	if got["gross"] != int64(120) {
+		t.Errorf("gross = %v (%T), want 120", got["gross"], got["gross"])
+	}
+	if got["loads"] != int64(1) {
+		t.Errorf("lib/tax ran %v times, want once", got["loads"])
+	}
+	if got["broken"] != "not configured" {
+		t.Errorf("broken = %v", got["broken"])
+	}
+	if missing, _ := got["missing"].(string); !strings.Contains(missing, `unknown library "lib/missing"`) {
+		t.Errorf("missing = %v", got["missing"])
+	}
+
+	// The next execution runs its libraries again.
+	got, err = r.ExecuteScript(ctx, `process_data.loads = require("lib/tax").loads;`, map[string]interface{}{})
+	if err != nil || got["loads"] != int64(1) {
+		t.Errorf("loads = %v, %v; want 1", got["loads"], err)
+	}
+
+	// A library is bound by the script's time limit, and cannot catch it.
+	deadline, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = r.ExecuteScript(deadline, `try { require("lib/endless"); } catch (e) {} process_data.after = true;`, map[string]interface{}{})
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+}
+
+func TestReadModule(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lib", "pricing.js"), []byte("exports.x = 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.js")
+	if err := os.WriteFile(outside, []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "lib", "link.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	if source, err := ReadModule(dir, "lib/pricing"); err != nil || source != "exports.x = 1;" {
+		t.Errorf("ReadModule = %q, %v", source, err)
+	}
+	for _, name := range []string{"../secret", "/etc/passwd", "lib/pricing.js", "lib/../lib/pricing", "", "lib/link"} {
+		if _, err := ReadModule(dir, name); err == nil {
+			t.Errorf("ReadModule(%q) succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package scripts
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/dop251/goja"
+)
+
+// program returns the compiled form of source. Programs are cached by content hash,
+// so every definition version sharing a script compiles it once. The cache keeps the
+// most recently used programs, so scripts of retired versions are eventually dropped.
+func (r *Runtime) program(source string) (*goja.Program, error) {
+	key := sha256.Sum256([]byte(source))
+	if cached, ok := r.programs.Get(key); ok {
+		return cached, nil
+	}
+	program, err := goja.Compile("", source, false)
+	if err != nil {
+		return nil, err
+	}
+	r.programs.Add(key, program)
+	return program, nil
+}
+
+// Precompile compiles a script, given as plain JavaScript, into the runtime's cache
+// ahead of its first execution, e.g. when the definition using it is loaded.
+func (r *Runtime) Precompile(source string) error {
+	if _, err := r.program(wrapScript(source)); err != nil {
+		return fmt.Errorf("error compiling script: %w", err)
+	}
+	return nil
+}
+
+// vm is a pooled Goja runtime together with the global scope it started with.
+type vm struct {
+	*goja.Runtime
+	builtins map[string]goja.Value
+	intact   goja.Callable           // checks the global object, see lockdownScript
+	exec     *Execution              // execution the vm is running for
+	ctx      context.Context         // context of that execution
+	modules  map[string]*goja.Object // libraries required by that execution
+	strict   bool                    // eval and the Function constructors are removed
+}
+
+// acquire returns a runtime from the pool, or a new one, set up for exec with
+// console, the host library, the runtime's extra globals and its limits. New
+// runtimes have their built-ins frozen by lockdown. Strict executions get runtimes
+// of their own pool, which never had eval.
+func (r *Runtime) acquire(ctx context.Context, exec *Execution) (*vm, error) {
+	v, ok := r.pool(exec.Strict).Get().(*vm)
+	if !ok {
+		v = &vm{Runtime: goja.New(), strict: exec.Strict}
+		if v.strict {
+			if err := restrict(v); err != nil {
+				return nil, fmt.Errorf("failed to restrict VM: %w", err)
+			}
+		}
+		if err := setupConsole(v); err != nil {
+			return nil, fmt.Errorf("failed to setup console in VM: %w", err)
+		}
+		if err := setupHost(v); err != nil {
+			return nil, fmt.Errorf("failed to setup host functions in VM: %w", err)
+		}
+		if err := r.setupHTTP(v); err != nil {
+			return nil, fmt.Errorf("failed to setup http in VM: %w", err)
+		}
+		if err := r.setupRequire(v); err != nil {
+			return nil, fmt.Errorf("failed to setup require in VM: %w", err)
+		}
+		if err := lockdown(v); err != nil {
+			return nil, fmt.Errorf("failed to lock down VM: %w", err)
+		}
+		global := v.GlobalObject()
+		v.builtins = make(map[string]goja.Value)
+		for _, name := range global.GetOwnPropertyNames() {
+			v.builtins[name] = global.Get(name)
+		}
+	}
+	v.exec, v.ctx, v.modules = exec, ctx, make(map[string]*goja.Object)
+	setCallStackSize(v.Runtime, r.currentLimits())
+	if err := setupInstance(v); err != nil {
+		return nil, fmt.Errorf("failed to set instance in VM: %w", err)
+	}
+	if err := r.setupGlobals(v.Runtime); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// release returns v to the pool once its global scope is back to how acquire handed
+// it out: globals a script added are deleted and built-ins it replaced are restored.
+// Runtimes whose scope cannot be restored, e.g. because a script declared a global
+// var through eval, which cannot be deleted, or changed the prototype of the global
+// object, are dropped instead.
+func (r *Runtime) release(v *vm) {
+	v.ClearInterrupt()
+	v.exec, v.ctx, v.modules = nil, nil, nil
+	r.globalsMu.RLock()
+	defer r.globalsMu.RUnlock()
+	global := v.GlobalObject()
+	for _, name := range global.GetOwnPropertyNames() {
+		if _, ok := r.Globals[name]; ok {
+			continue // set again by the next acquire
+		}
+		builtin, ok := v.builtins[name]
+		if !ok {
+			if err := global.Delete(name); err != nil {
+				return
+			}
+			continue
+		}
+		if !global.Get(name).SameAs(builtin) {
+			if err := global.Set(name, builtin); err != nil {
+				return
+			}
+		}
+	}
+	for name, builtin := range v.builtins {
+		if global.Get(name) == nil {
+			if err := global.Set(name, builtin); err != nil {
+				return
+			}
+		}
+	}
+	if !v.globalIntact() {
+		return
+	}
+	r.pool(v.strict).Put(v)
+}
+
+func (r *Runtime) pool(strict bool) *sync.Pool {
+	if strict {
+		return &r.strictVMs
+	}
+	return &r.vms
+}
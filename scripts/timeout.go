@@ -0,0 +1,86 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// TimeoutError is returned when a script is interrupted because it ran past its
+// time limit.
+type TimeoutError struct {
+	Limit time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("script did not finish within its time limit of %s", e.Limit)
+}
+
+// timeLimit returns the time left until the deadline of ctx, if it has one. Measured
+// when a script is handed over, it is the limit reported in a *TimeoutError.
+func timeLimit(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		return time.Until(deadline).Round(time.Millisecond)
+	}
+	return 0
+}
+
+// run runs program in vm until it finishes or ctx is done. Scripts still running at
+// the deadline of ctx are interrupted and reported as a *TimeoutError with the given
+// limit; scripts interrupted because ctx was cancelled report the context's error.
+// Scripts that overrun the memory or call stack size of limits report a
+// *MemoryLimitError or *StackOverflowError.
+func run(ctx context.Context, limit time.Duration, limits Limits, vm *goja.Runtime, program *goja.Program) (goja.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Wait for an interrupt racing with the end of the program, so it cannot hit
+	// whatever runs next in the pooled vm.
+	interruptDone := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		vm.Interrupt(ctx.Err())
+		close(interruptDone)
+	})
+	defer func() {
+		if !stop() {
+			<-interruptDone
+		}
+	}()
+	stopGuard := guardMemory(vm, limits.MaxMemory)
+	val, err := vm.RunProgram(program)
+	stopGuard()
+
+	var interrupted *goja.InterruptedError
+	var overflow *goja.StackOverflowError
+	switch {
+	case errors.As(err, &overflow):
+		return nil, &StackOverflowError{Limit: limits.MaxCallStackSize}
+	case errors.As(err, &interrupted):
+		switch value := interrupted.Value().(type) {
+		case *BusinessError:
+			return nil, value
+		case *MemoryLimitError:
+			return nil, value
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, &TimeoutError{Limit: limit}
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return val, err
+}
+
+// exportError reports a conversion of a script's result that ran past the deadline of
+// ctx as a *TimeoutError with the given limit, like the script itself would be.
+func exportError(ctx context.Context, limit time.Duration, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &TimeoutError{Limit: limit}
+	}
+	return err
+}
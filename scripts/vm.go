@@ -1,166 +1,120 @@
 package scripts
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log" // Ensure log package is imported
-	"reflect"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"jbpmn-engine/lru"
 
 	"github.com/dop251/goja"
 )
 
-// setupConsole configures a basic 'console' object in the Goja VM
-// that directs output to the Go application's log.
-func setupConsole(vm *goja.Runtime) error {
-    fmt.Println("--- DEBUG: setupConsole function is being called and new console is being set up! ---") // ADD THIS LINE
-
-    console := vm.NewObject()
-
-    // Implement console.log
-    err := console.Set("log", func(call goja.FunctionCall) goja.Value {
-        var args []interface{}
-        for _, arg := range call.Arguments {
-            args = append(args, arg.Export())
-        }
-        log.Println("[JS Log]", fmt.Sprint(args...))
-        return goja.Undefined()
-    })
-    if err != nil {
-        return fmt.Errorf("failed to set console.log: %w", err)
-    }
-
-    // Implement console.warn (optional)
-    err = console.Set("warn", func(call goja.FunctionCall) goja.Value {
-        var args []interface{}
-        for _, arg := range call.Arguments {
-            args = append(args, arg.Export())
-        }
-        log.Println("[JS Warn]", fmt.Sprint(args...))
-        return goja.Undefined()
-    })
-    if err != nil {
-        return fmt.Errorf("failed to set console.warn: %w", err)
-    }
-
-    // Implement console.error (optional)
-    err = console.Set("error", func(call goja.FunctionCall) goja.Value {
-        var args []interface{}
-        for _, arg := range call.Arguments {
-            args = append(args, arg.Export())
-        }
-        log.Println("[JS Error]", fmt.Sprint(args...))
-        return goja.Undefined()
-    })
-    if err != nil {
-        return fmt.Errorf("failed to set console.error: %w", err)
-    }
+// Runtime executes workflow scripts in Goja VMs.
+// The zero value is ready to use. Compiled programs are cached and VMs are reused
+// between executions, so a Runtime must not be copied after first use.
+type Runtime struct {
+	// Globals are extra values, typically Go functions, exposed to every script
+	// under their map key.
+	// Use Register to add globals while scripts may be running.
+	Globals   map[string]interface{}
+	globalsMu sync.RWMutex
+
+	// HTTPClient makes the requests of http.fetch. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	programs  lru.Cache[[sha256.Size]byte, *goja.Program] // by content hash
+	vms       sync.Pool // idle *vm
+	strictVMs sync.Pool // idle *vm for strict executions
+	limits    atomic.Pointer[Limits]
+}
 
-    return vm.Set("console", console)
+// setupGlobals sets the runtime's extra globals in the VM.
+func (r *Runtime) setupGlobals(vm *goja.Runtime) error {
+	r.globalsMu.RLock()
+	defer r.globalsMu.RUnlock()
+	for name, value := range r.Globals {
+		if err := vm.Set(name, value); err != nil {
+			return fmt.Errorf("failed to set global %s: %w", name, err)
+		}
+	}
+	return nil
 }
 
-// ExecuteScript runs a base64 encoded JavaScript in a Goja VM.
-// It takes initial context, executes the script, and returns the modified context.
-func ExecuteScript(base64Script string, context map[string]interface{}) (map[string]interface{}, error) {
-	decodedScript, err := base64.StdEncoding.DecodeString(base64Script)
+// defaultRuntime backs the package-level ExecuteScript.
+var defaultRuntime = &Runtime{}
+
+// ExecuteScript runs a base64 encoded JavaScript using the default runtime, without a
+// time limit.
+func ExecuteScript(base64Script string, vars map[string]interface{}) (map[string]interface{}, error) {
+	decoded, err := base64.StdEncoding.DecodeString(base64Script)
 	if err != nil {
 		return nil, fmt.Errorf("error decoding base64 script: %w", err)
 	}
+	return defaultRuntime.ExecuteScript(context.Background(), string(decoded), vars)
+}
 
-	vm := goja.New()
-
-	// Setup the console object in the VM
-	if err := setupConsole(vm); err != nil {
-		return nil, fmt.Errorf("failed to setup console in VM: %w", err)
+// ExecuteScript runs a script, given as plain JavaScript, in a Goja VM.
+// It takes initial context, executes the script, and returns the modified context:
+// process_data as the script left it, with the fields of the object the script
+// returned, if any, merged into it. Nested objects and arrays are converted back to
+// Go maps and slices.
+// A script still running when ctx reaches its deadline is interrupted and reported
+// as a *TimeoutError, and a script calling fail reports a *BusinessError. The host
+// functions see the Execution attached to ctx with WithExecution.
+func (r *Runtime) ExecuteScript(ctx context.Context, source string, vars map[string]interface{}) (map[string]interface{}, error) {
+	limit := timeLimit(ctx)
+	program, err := r.program(wrapScript(source))
+	if err != nil {
+		return nil, fmt.Errorf("error compiling script: %w", err)
 	}
 
-	// Convert Go map to Goja object
-	contextObj := vm.NewObject()
-	for k, v := range context {
-		err = contextObj.Set(k, vm.ToValue(v))
-		if err != nil {
-			return nil, fmt.Errorf("failed to set context value for key %s: %w", k, err)
-		}
+	vm, err := r.acquire(ctx, executionFrom(ctx))
+	if err != nil {
+		return nil, err
 	}
+	defer r.release(vm)
 
-	// Set process_data in the VM
-	err = vm.Set("process_data", contextObj)
+	// Set process_data in the VM, as a copy the script can change freely
+	err = vm.Set("process_data", toValue(vm.Runtime, vars))
 	if err != nil {
 		return nil, fmt.Errorf("failed to set process_data in VM: %w", err)
 	}
 
-	_, err = vm.RunString(string(decodedScript))
+	returned, err := run(ctx, limit, r.currentLimits(), vm.Runtime, program)
 	if err != nil {
 		return nil, fmt.Errorf("error executing script: %w", err)
 	}
 
 	// Get the modified process_data back from the VM
-	val := vm.Get("process_data")
-	if val == nil || goja.IsUndefined(val) || goja.IsNull(val) {
-		return context, nil // No changes, return original
-	}
-
-	exported := val.Export()
-
-	// Convert Goja exported value back to map[string]interface{}
-	// This might require a more robust conversion for nested objects/arrays
-	if newContext, ok := exported.(map[string]interface{}); ok {
-		return newContext, nil
-	} else if obj, ok := exported.(goja.Object); ok {
-		// If it's still a Goja object, convert it properly
-		newContext := make(map[string]interface{})
-		for _, key := range obj.Keys() {
-			newContext[key] = obj.Get(key).Export()
+	newContext := vars
+	if val := vm.Get("process_data"); val != nil && !goja.IsUndefined(val) && !goja.IsNull(val) {
+		if newContext, err = exportObject(ctx, val); err != nil {
+			return nil, fmt.Errorf("error reading process_data after script execution: %w", exportError(ctx, limit, err))
 		}
-		return newContext, nil
-	}
-
-	// Log if conversion is unexpected, but return existing context
-	log.Printf("Warning: process_data after script execution is not a map[string]interface{}. Type: %v", reflect.TypeOf(exported))
-	return context, nil
-}
-
-// EvaluateCondition runs a base64 encoded JavaScript condition in a Goja VM.
-// It takes initial context and returns a boolean result.
-func EvaluateCondition(base64Condition string, context map[string]interface{}) (bool, error) {
-	decodedCondition, err := base64.StdEncoding.DecodeString(base64Condition)
-	if err != nil {
-		return false, fmt.Errorf("error decoding base64 condition: %w", err)
 	}
 
-	vm := goja.New()
-
-	// Setup the console object in the VM for condition evaluation too
-	if err := setupConsole(vm); err != nil {
-		return false, fmt.Errorf("failed to setup console in VM for condition: %w", err)
-	}
-
-	// Convert Go map to Goja object
-	contextObj := vm.NewObject()
-	for k, v := range context {
-		err = contextObj.Set(k, vm.ToValue(v))
-		if err != nil {
-			return false, fmt.Errorf("failed to set context value for key %s: %w", k, err)
-		}
-	}
-	err = vm.Set("process_data", contextObj)
-	if err != nil {
-		return false, fmt.Errorf("failed to set process_data in VM for condition: %w", err)
+	// Merge the object the script returned, if any
+	if returned == nil || goja.IsUndefined(returned) || goja.IsNull(returned) {
+		return newContext, nil
 	}
-
-	val, err := vm.RunString(string(decodedCondition))
+	fields, err := exportObject(ctx, returned)
 	if err != nil {
-		return false, fmt.Errorf("error evaluating condition script: %w", err)
+		return nil, fmt.Errorf("error reading the value returned by the script: %w", exportError(ctx, limit, err))
 	}
-
-	if goja.IsUndefined(val) || goja.IsNull(val) {
-		return false, nil // Treat undefined/null as false
+	merged := make(map[string]interface{}, len(newContext)+len(fields))
+	for k, v := range newContext {
+		merged[k] = v
 	}
-
-	if result, ok := val.Export().(bool); ok {
-		return result, nil
+	for k, v := range fields {
+		merged[k] = v
 	}
-	return false, fmt.Errorf("condition script did not return a boolean value")
+	return merged, nil
 }
 
 // Convert a Go map to a JSON string
@@ -0,0 +1,449 @@
+package scripts
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func encode(source string) string {
+	return base64.StdEncoding.EncodeToString([]byte(source))
+}
+
+func TestExecuteScriptDecodesBase64(t *testing.T) {
+	result, err := ExecuteScript(encode(`return {greeting: "hello " + process_data.name};`), map[string]interface{}{"name": "Ada"})
+	if err != nil || result["greeting"] != "hello Ada" {
+		t.Errorf("ExecuteScript = %v, %v; want the base64 script run", result, err)
+	}
+	if _, err := ExecuteScript(`return {};`, nil); err == nil || !strings.Contains(err.Error(), "base64") {
+		t.Errorf("ExecuteScript with plain code = %v, want a base64 decoding error", err)
+	}
+}
+
+func TestPooledRuntimesStartWithCleanGlobals(t *testing.T) {
+	r := &Runtime{Globals: map[string]interface{}{"greet": func(name string) string { return "hello " + name }}}
+	ctx := context.Background()
+
+	polluting := `leaked = 1; var declared = 2; JSON = null; console = {}; greet = null; process_data.greeting = "x";`
+	if _, err := r.ExecuteScript(ctx, polluting, map[string]interface{}{}); err != nil {
+		t.Fatalf("polluting script: %v", err)
+	}
+	// Scripts run in a function, so declared vars are local, but assignments to
+	// undeclared variables and built-ins still reach the global scope.
+	if _, err := r.ExecuteScript(ctx, `leaked = 1; JSON = null; console = {}; greet = null;`, map[string]interface{}{}); err != nil {
+		t.Fatalf("polluting script: %v", err)
+	}
+
+	check := `
+		process_data.leaked = typeof leaked;
+		process_data.declared = typeof declared;
+		process_data.json = JSON.stringify({a: 1});
+		process_data.console = typeof console.log;
+		process_data.greeting = greet("ada");
+	`
+	for i := 0; i < 3; i++ {
+		got, err := r.ExecuteScript(ctx, check, map[string]interface{}{})
+		if err != nil {
+			t.Fatalf("check script: %v", err)
+		}
+		want := map[string]interface{}{"leaked": "undefined", "declared": "undefined", "json": `{"a":1}`, "console": "function", "greeting": "hello ada"}
+		for key, value := range want {
+			if got[key] != value {
+				t.Errorf("run %d: %s = %v, want %v", i, key, got[key], value)
+			}
+		}
+	}
+}
+
+func TestPooledRuntimesStartWithCleanBuiltins(t *testing.T) {
+	// Each attempt runs on its own, as most of them throw.
+	polluting := `
+		var attempts = [
+			function () { Object.prototype.pwned = "yes"; },
+			function () { Array.prototype.push = function () { return "evil"; }; },
+			function () { JSON.stringify = function () { return "evil"; }; },
+			function () { console.log = function () {}; },
+			function () { http.fetch = null; },
+			function () { time.now = function () { return "evil"; }; },
+			function () { hash.sha256 = function () { return "evil"; }; },
+			function () { Object.defineProperty(base64, "encode", {value: function () { return "evil"; }}); },
+			function () { Object.prototype.toString = function () { return "evil"; }; },
+			function () { Error.prototype.name = "evil"; },
+			function () { delete Math.max; },
+			function () { Object.preventExtensions(Map.prototype); },
+			function () { Object.setPrototypeOf(globalThis, {extra: "yes"}); }
+		];
+		var blocked = 0;
+		attempts.forEach(function (attempt) { try { attempt(); } catch (e) { blocked++; } });
+		return {blocked: blocked};`
+	check := `
+		var list = [];
+		list.push(1);
+		return {
+			pwned: typeof ({}).pwned,
+			extra: typeof extra,
+			push: list.length,
+			json: JSON.stringify({a: 1}),
+			log: typeof console.log,
+			fetch: typeof http.fetch,
+			now: time.now() !== "evil",
+			sha256: hash.sha256("") !== "evil",
+			base64: base64.encode("a"),
+			toString: ({}).toString(),
+			errorName: new Error().name,
+			max: Math.max(1, 2),
+			extensible: Object.isExtensible(Map.prototype)
+		};`
+	want := map[string]interface{}{
+		"pwned": "undefined", "extra": "undefined", "push": int64(1), "json": `{"a":1}`, "log": "function",
+		"fetch": "function", "now": true, "sha256": true, "base64": "YQ==", "toString": "[object Object]",
+		"errorName": "Error", "max": int64(2), "extensible": false,
+	}
+
+	for name, ctx := range map[string]context.Context{
+		"normal": context.Background(),
+		"strict": WithExecution(context.Background(), &Execution{Strict: true}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := &Runtime{}
+			if _, err := r.ExecuteScript(ctx, polluting, map[string]interface{}{}); err != nil {
+				t.Fatalf("polluting script: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				got, err := r.ExecuteScript(ctx, check, map[string]interface{}{})
+				if err != nil {
+					t.Fatalf("check script: %v", err)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("run %d after a polluting script: %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLockedBuiltinsCanBeOverriddenOnOwnObjects(t *testing.T) {
+	r := &Runtime{}
+	got, err := r.ExecuteScript(context.Background(), `
+		class NotFound extends Error {
+			constructor(message) { super(message); this.name = "NotFound"; }
+		}
+		function Money(amount) { this.amount = amount; }
+		Money.prototype.toString = function () { return this.amount + " EUR"; };
+		var point = {x: 1};
+		point.valueOf = function () { return 42; };
+		var e = new Error();
+		e.message = "late";
+		return {error: String(new NotFound("no order")), money: String(new Money(5)), point: point + 0, message: e.message};`,
+		map[string]interface{}{})
+	want := map[string]interface{}{"error": "NotFound: no order", "money": "5 EUR", "point": int64(42), "message": "late"}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("result = %v, %v; want %v", got, err, want)
+	}
+}
+
+func TestProgramCacheIsBounded(t *testing.T) {
+	r := &Runtime{}
+	r.programs.Size = 4
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		script := fmt.Sprintf("process_data.n = %d;", i)
+		got, err := r.ExecuteScript(ctx, script, map[string]interface{}{})
+		if err != nil || got["n"] != int64(i) {
+			t.Fatalf("script %d: %v, %v", i, got, err)
+		}
+	}
+	if n := r.programs.Len(); n != 4 {
+		t.Errorf("%d programs cached, want 4", n)
+	}
+	// An evicted script is compiled again.
+	if got, err := r.ExecuteScript(ctx, "process_data.n = 0;", map[string]interface{}{}); err != nil || got["n"] != int64(0) {
+		t.Errorf("evicted script: %v, %v", got, err)
+	}
+}
+
+// bundledScripts returns the scripts of the bundled workflow definitions.
+func bundledScripts(b *testing.B) []string {
+	files, err := filepath.Glob("../workflows/*.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var codes []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var def struct {
+			Nodes []struct {
+				Script *struct {
+					Code string `json:"code"`
+				} `json:"script"`
+			} `json:"nodes"`
+		}
+		if err := json.Unmarshal(data, &def); err != nil {
+			b.Fatalf("%s: %v", file, err)
+		}
+		for _, node := range def.Nodes {
+			if node.Script != nil {
+				codes = append(codes, node.Script.Code)
+			}
+		}
+	}
+	if len(codes) == 0 {
+		b.Fatal("no scripts in the bundled workflows")
+	}
+	return codes
+}
+
+// BenchmarkBundledScripts runs every script of the bundled workflows once per
+// iteration. "uncached" uses a new Runtime each time, so every execution compiles
+// its script and creates a VM as the runtime did before programs were cached and VMs
+// pooled, and also pays for freezing the built-ins of that VM; "cached" shares one
+// Runtime.
+func BenchmarkBundledScripts(b *testing.B) {
+	codes := bundledScripts(b)
+	vars := map[string]interface{}{"instanceID": "3f2c", "user_name": "Ada", "user_age": 36}
+	ctx := context.Background()
+
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, code := range codes {
+				if _, err := (&Runtime{}).ExecuteScript(ctx, code, vars); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		r := &Runtime{}
+		for i := 0; i < b.N; i++ {
+			for _, code := range codes {
+				if _, err := r.ExecuteScript(ctx, code, vars); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("cached-parallel", func(b *testing.B) {
+		b.ReportAllocs()
+		r := &Runtime{}
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				for _, code := range codes {
+					if _, err := r.ExecuteScript(ctx, code, vars); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}
+		})
+	})
+}
+
+func TestHostLibrary(t *testing.T) {
+	r := &Runtime{}
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	exec := &Execution{
+		Instance: Instance{ID: "3f2c", WorkflowID: "orders", WorkflowVersion: 2, Node: "charge", BusinessKey: "order-7"},
+		Now:      func() time.Time { return now },
+	}
+	ctx := WithExecution(context.Background(), exec)
+
+	got, err := r.ExecuteScript(ctx, `
+		process_data.now = time.now();
+		process_data.millis = time.nowMillis();
+		process_data.due = time.add(time.now(), "36h");
+		process_data.diff = time.diff("2025-03-01T00:00:00Z", time.now());
+		process_data.uuid = uuid();
+		process_data.encoded = base64.encode("hi");
+		process_data.decoded = base64.decode("aGk=");
+		process_data.sha256 = hash.sha256("abc");
+		process_data.instance = instance.id + "/" + instance.workflowId + "@" + instance.workflowVersion + "/" + instance.node + "/" + instance.businessKey;
+		instance.id = "changed";
+		process_data.unchanged = instance.id;
+		throwSignal("order_charged", {amount: 12});
+	`, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("ExecuteScript: %v", err)
+	}
+	want := map[string]interface{}{
+		"now":       "2025-03-01T12:00:00Z",
+		"millis":    now.UnixMilli(),
+		"due":       "2025-03-03T00:00:00Z",
+		"diff":      int64(12 * time.Hour / time.Millisecond),
+		"encoded":   "aGk=",
+		"decoded":   "hi",
+		"sha256":    "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		"instance":  "3f2c/orders@2/charge/order-7",
+		"unchanged": "3f2c",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v (%T), want %v", key, got[key], got[key], value)
+		}
+	}
+	if id, _ := got["uuid"].(string); len(id) != 36 {
+		t.Errorf("uuid = %v", got["uuid"])
+	}
+	if len(exec.Signals) != 1 || exec.Signals[0].Name != "order_charged" || exec.Signals[0].Payload["amount"] != int64(12) {
+		t.Errorf("signals = %+v", exec.Signals)
+	}
+
+	// fail cannot be caught and stops the script.
+	_, err = r.ExecuteScript(ctx, `try { fail("out_of_stock", "no more widgets"); } catch (e) {} process_data.after = true;`, map[string]interface{}{})
+	var failure *BusinessError
+	if !errors.As(err, &failure) || failure.Code != "out_of_stock" || failure.Message != "no more widgets" {
+		t.Errorf("err = %v, want a business error", err)
+	}
+
+	if err := r.Register("fail", func() {}); err == nil {
+		t.Error("registering a reserved name succeeded")
+	}
+	if err := r.Register("double", func(n int) int { return 2 * n }); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.ExecuteScript(ctx, `process_data.n = double(21);`, map[string]interface{}{})
+	if err != nil || got["n"] != int64(42) {
+		t.Errorf("registered function: %v, %v", got["n"], err)
+	}
+}
+
+func TestScriptResults(t *testing.T) {
+	r := &Runtime{}
+	ctx := context.Background()
+	vars := map[string]interface{}{
+		"order": map[string]interface{}{"items": []interface{}{map[string]interface{}{"sku": "w-1", "qty": 2.0}}},
+		"total": 10.5,
+	}
+
+	got, err := r.ExecuteScript(ctx, `
+		process_data.order.items.push({sku: "w-2", qty: 1});
+		process_data.order.items[0].qty = 3;
+		delete process_data.total;
+		process_data.when = new Date(Date.UTC(2025, 2, 1));
+		process_data.ratio = 1 / 4;
+		process_data.nothing = 0 / 0;
+		process_data.skipped = function () {};
+		process_data.sparse = [1, undefined, "x"];
+		return {logged: true, nested: {list: [1, [2, 3]]}};
+	`, vars)
+	if err != nil {
+		t.Fatalf("ExecuteScript: %v", err)
+	}
+	want := map[string]interface{}{
+		"order": map[string]interface{}{"items": []interface{}{
+			map[string]interface{}{"sku": "w-1", "qty": int64(3)},
+			map[string]interface{}{"sku": "w-2", "qty": int64(1)},
+		}},
+		"when":    time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC),
+		"ratio":   0.25,
+		"nothing": nil,
+		"sparse":  []interface{}{int64(1), nil, "x"},
+		"logged":  true,
+		"nested":  map[string]interface{}{"list": []interface{}{int64(1), []interface{}{int64(2), int64(3)}}},
+	}
+	if when, ok := got["when"].(time.Time); ok {
+		got["when"] = when.UTC()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("context = %#v\nwant %#v", got, want)
+	}
+	// The caller's context is not changed in place.
+	if items := vars["order"].(map[string]interface{})["items"].([]interface{}); len(items) != 1 || items[0].(map[string]interface{})["qty"] != 2.0 {
+		t.Errorf("input context changed: %v", vars)
+	}
+
+	for script, message := range map[string]string{
+		`return 42;`:                             "got a number instead of an object",
+		`return [1];`:                            "got an array instead of an object",
+		`var a = {}; a.self = a; return {a: a};`: "a: self: value contains a reference to itself",
+	} {
+		if _, err := r.ExecuteScript(ctx, script, map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: err = %v, want %q", script, err, message)
+		}
+	}
+}
+
+func TestLargeResults(t *testing.T) {
+	r := &Runtime{}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	started := time.Now()
+	for _, script := range []string{
+		`var a = []; a.length = 4e9; process_data.a = a;`,
+		`var a = []; a.length = 3e7; return {a: a};`,
+		`return {a: [new Array(600000), new Array(600000)]};`,
+	} {
+		_, err := r.ExecuteScript(ctx, script, map[string]interface{}{})
+		var tooLarge *ResultTooLargeError
+		if !errors.As(err, &tooLarge) || tooLarge.Limit != maxExportedValues {
+			t.Errorf("%s: err = %v, want a *ResultTooLargeError", script, err)
+		}
+	}
+	_, err := r.ExecuteScript(ctx, `var s = "x".repeat(1 << 20); var a = []; for (var i = 0; i < 65; i++) { a.push(s); } return {a: a};`, map[string]interface{}{})
+	var tooLarge *ResultTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Limit != maxExportedBytes {
+		t.Errorf("large strings err = %v, want a *ResultTooLargeError", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("rejecting large results took %s", elapsed)
+	}
+
+	result, err := r.ExecuteScript(ctx, `var a = []; a.length = 3; a[1] = "x"; return {a: a};`, map[string]interface{}{})
+	if err != nil || !reflect.DeepEqual(result["a"], []interface{}{nil, "x", nil}) {
+		t.Errorf("sparse array = %v, %v", result, err)
+	}
+
+	exec := &Execution{}
+	if _, err := r.ExecuteScript(WithExecution(ctx, exec), `var a = []; a.length = 4e9; console.log("big", a);`, map[string]interface{}{}); err != nil {
+		t.Fatalf("logging a large array: %v", err)
+	}
+	if len(exec.Logs) != 1 || exec.Logs[0].Message != "big [an array too large to log]" {
+		t.Errorf("logs = %+v", exec.Logs)
+	}
+}
+
+func TestConsoleOutputIsCapped(t *testing.T) {
+	r := &Runtime{}
+	ctx := context.Background()
+	truncated := fmt.Sprintf("[console output truncated: a script execution keeps at most %d entries and %d bytes]", maxLogEntries, maxLogBytes)
+
+	exec := &Execution{}
+	if _, err := r.ExecuteScript(WithExecution(ctx, exec), `for (var i = 0; i < 1500; i++) { console.log("line " + i); }`, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(exec.Logs) != maxLogEntries+1 || !exec.LogsTruncated {
+		t.Fatalf("%d entries, truncated %v; want %d and true", len(exec.Logs), exec.LogsTruncated, maxLogEntries+1)
+	}
+	if last := exec.Logs[maxLogEntries]; last.Level != "warn" || last.Message != truncated || exec.Logs[maxLogEntries-1].Message != "line 999" {
+		t.Errorf("last entries = %+v", exec.Logs[maxLogEntries-1:])
+	}
+
+	// The message that overflows the bytes is cut without splitting a character.
+	exec = &Execution{}
+	if _, err := r.ExecuteScript(WithExecution(ctx, exec), `
+		console.log("x".repeat(1000000));
+		console.log("é".repeat(100000));
+		console.log("dropped");
+	`, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(exec.Logs) != 3 || !exec.LogsTruncated || exec.Logs[2].Message != truncated {
+		t.Fatalf("%d entries, truncated %v", len(exec.Logs), exec.LogsTruncated)
+	}
+	if cut := exec.Logs[1].Message; len(cut) != (maxLogBytes-1000000)/2*2 || cut != strings.Repeat("é", len(cut)/2) {
+		t.Errorf("cut message has %d bytes", len(cut))
+	}
+}
@@ -0,0 +1,304 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Instance statuses. Only active instances execute nodes, receive signals and accept
+// form submissions.
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusCancelled = "cancelled"
+)
+
+// ErrInstanceNotActive is returned for work on an instance that is suspended, cancelled
+// or has ended.
+var ErrInstanceNotActive = errors.New("workflow instance is not active")
+
+// ErrInstanceNotSuspended is returned when resuming an instance that is not suspended.
+var ErrInstanceNotSuspended = errors.New("workflow instance is not suspended")
+
+// ErrInstanceBusy is returned when moving an instance while one of its nodes is
+// executing.
+var ErrInstanceBusy = errors.New("workflow instance is executing a node")
+
+// controlState tracks what suspended instances were about to do so Resume can pick
+// up where they stopped.
+type controlState struct {
+	mu     sync.Mutex
+	halted map[string]bool          // a node execution was skipped because the instance was suspended
+	due    map[string]*pendingTimer // timers that fired while the instance was suspended
+}
+
+// runnable reports whether instanceID may execute its current node. A suspended
+// instance is remembered as halted so Resume continues it.
+func (e *Engine) runnable(instanceID string) (bool, error) {
+	e.control.mu.Lock()
+	defer e.control.mu.Unlock()
+	rec, err := e.store.GetInstance(instanceID)
+	if err != nil {
+		return false, err
+	}
+	switch rec.Status {
+	case StatusSuspended:
+		e.control.halted[instanceID] = true
+		e.logger.Info("Instance is suspended; not executing node", "instance", instanceID)
+		return false, nil
+	case StatusCancelled:
+		e.logger.Info("Instance is cancelled; not executing node", "instance", instanceID)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Suspend stops an instance at its next node boundary. Until it is resumed, timers
+// that fire are held back, signals pass it by and form submissions are refused.
+func (e *Engine) Suspend(instanceID, reason string) (*WorkflowInstance, error) {
+	if !e.acceptingWork() {
+		return nil, ErrShuttingDown
+	}
+
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err == nil {
+		err = e.changeStatus(instance, StatusSuspended, reason)
+	}
+	e.control.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	e.logger.Info("Instance suspended", "instance", instanceID, "reason", reason)
+	return e.GetInstance(instanceID)
+}
+
+// Resume reactivates a suspended instance. A timer that fired while it was suspended
+// is delivered now; otherwise the node it was stopped at is executed.
+func (e *Engine) Resume(instanceID, reason string) (*WorkflowInstance, error) {
+	if !e.acceptingWork() {
+		return nil, ErrShuttingDown
+	}
+
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err != nil {
+		e.control.mu.Unlock()
+		return nil, err
+	}
+	if instance.Status != StatusSuspended {
+		e.control.mu.Unlock()
+		return nil, fmt.Errorf("%w: instance %s is %s", ErrInstanceNotSuspended, instanceID, instance.Status)
+	}
+	if err := e.changeStatus(instance, StatusActive, reason); err != nil {
+		e.control.mu.Unlock()
+		return nil, err
+	}
+	due := e.control.due[instanceID]
+	halted := e.control.halted[instanceID]
+	delete(e.control.due, instanceID)
+	delete(e.control.halted, instanceID)
+	e.control.mu.Unlock()
+
+	e.logger.Info("Instance resumed", "instance", instanceID, "reason", reason)
+
+	// Dispatch only after unlocking: an inline executor runs the task right away.
+	switch {
+	case due != nil:
+		e.deliverTimeout(due)
+	case halted || e.stoppedMidway(instance):
+		e.dispatch(instanceID, func() {
+			if execErr := e.executeNextNode(instanceID); execErr != nil {
+				e.logger.Error("Error executing node after resume", "instance", instanceID, "error", execErr)
+			}
+		})
+	}
+	return e.GetInstance(instanceID)
+}
+
+// stoppedMidway reports whether an instance with no record of being halted, e.g. one
+// suspended before a restart, sits at a node that would have run without waiting.
+func (e *Engine) stoppedMidway(instance *WorkflowInstance) bool {
+	if instance.WaitingSignal != "" || e.inflight(instance.ID) {
+		return false
+	}
+	switch instance.CurrentNodeDef.Type {
+	case "start", "script", "gateway":
+		return true
+	}
+	return false
+}
+
+// Cancel ends an instance for good, recording reason, and cancels its child instances.
+func (e *Engine) Cancel(instanceID, reason string) (*WorkflowInstance, error) {
+	if !e.acceptingWork() {
+		return nil, ErrShuttingDown
+	}
+	if err := e.cancel(instanceID, reason); err != nil {
+		return nil, err
+	}
+	return e.GetInstance(instanceID)
+}
+
+func (e *Engine) cancel(instanceID, reason string) error {
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err == nil {
+		err = e.changeStatus(instance, StatusCancelled, reason)
+	}
+	if err != nil {
+		e.control.mu.Unlock()
+		return err
+	}
+	delete(e.control.due, instanceID)
+	delete(e.control.halted, instanceID)
+	e.control.mu.Unlock()
+	e.cancelTimeout(instanceID)
+
+	e.logger.Info("Instance cancelled", "instance", instanceID, "reason", reason)
+
+	children, err := e.store.GetChildInstances(instanceID)
+	if err != nil {
+		return fmt.Errorf("error getting child instances of %s: %w", instanceID, err)
+	}
+	childReason := fmt.Sprintf("parent instance %s cancelled", instanceID)
+	if reason != "" {
+		childReason += ": " + reason
+	}
+	for _, childID := range children {
+		if err := e.cancel(childID, childReason); err != nil && !errors.Is(err, ErrInstanceNotActive) {
+			e.logger.Error("Error cancelling child instance", "instance", childID, "parent", instanceID, "error", err)
+		}
+	}
+	return nil
+}
+
+// changeStatus moves instance to status and records the change in its history. It
+// must be called with e.control.mu held.
+func (e *Engine) changeStatus(instance *WorkflowInstance, status, reason string) error {
+	if status != StatusActive && (instance.Status == StatusCancelled || instance.Status == status || instance.CurrentNodeDef.Type == "end") {
+		state := instance.Status
+		if instance.CurrentNodeDef.Type == "end" {
+			state = "ended"
+		}
+		return fmt.Errorf("%w: instance %s is %s", ErrInstanceNotActive, instance.ID, state)
+	}
+	if err := e.store.SetInstanceStatus(instance.ID, status, reason); err != nil {
+		return err
+	}
+	event := map[string]string{
+		StatusActive:    "resumed",
+		StatusSuspended: "suspended",
+		StatusCancelled: "cancelled",
+	}[status]
+	return e.store.RecordInstanceEvent(instance.ID, instance.CurrentNode, event, "", reason)
+}
+
+// MoveOptions configures an administrative move of an instance. See Engine.Move.
+type MoveOptions struct {
+	// Node is the ID of the node to move the instance to. It may be any node of the
+	// instance's definition, whether or not a transition leads there.
+	Node string
+	// Variables are merged into the instance context before the move. A nil value
+	// removes the variable.
+	Variables map[string]interface{}
+	// Execute runs the target node right away, arming its timeout. Otherwise the
+	// instance waits at the node until it is moved again, or, if it is suspended,
+	// resumed. A form node accepts submissions either way.
+	Execute bool
+	// Operator identifies who moved the instance. It is required.
+	Operator string
+	// Reason is recorded in the history with the operator.
+	Reason string
+}
+
+// Move puts an instance on an arbitrary node of its definition, bypassing the normal
+// transitions, e.g. to push it past a broken node or to re-run a step. The timer of
+// the node being left is disarmed and a "moved" entry naming the operator and reason
+// is added to the history right after the entry of the node moved to. If
+// opts.Execute is set, Move waits like Start for the instance to reach its next wait
+// state or for ctx to be done. Invalid options are reported as an
+// *InputValidationError. Ended instances can be moved back to re-run a step;
+// cancelled ones cannot be moved, and neither can instances executing a node, which
+// get ErrInstanceBusy.
+func (e *Engine) Move(ctx context.Context, instanceID string, opts MoveOptions) (*WorkflowInstance, error) {
+	if !e.acceptingWork() {
+		return nil, ErrShuttingDown
+	}
+
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err != nil {
+		e.control.mu.Unlock()
+		return nil, err
+	}
+	if instance.Status == StatusCancelled {
+		e.control.mu.Unlock()
+		return nil, fmt.Errorf("%w: instance %s is %s", ErrInstanceNotActive, instanceID, instance.Status)
+	}
+	// A running node would carry on from where it was once it finished, undoing the move.
+	if e.inflight(instanceID) {
+		e.control.mu.Unlock()
+		return nil, fmt.Errorf("%w: instance %s is at node '%s'; retry once it is waiting", ErrInstanceBusy, instanceID, instance.CurrentNode)
+	}
+
+	fieldErrors := make(map[string]string)
+	target := instance.WorkflowDef.GetNodeByID(opts.Node)
+	if opts.Node == "" {
+		fieldErrors["node"] = "is required"
+	} else if target == nil {
+		fieldErrors["node"] = fmt.Sprintf("'%s' is not a node of workflow %s", opts.Node, instance.WorkflowID)
+	}
+	if opts.Operator == "" {
+		fieldErrors["operator"] = "is required"
+	}
+	patch, err := prepareVariables(nil, opts.Variables)
+	if err != nil {
+		fieldErrors["variables"] = err.Error()
+	}
+	if len(fieldErrors) > 0 {
+		e.control.mu.Unlock()
+		return nil, &InputValidationError{Fields: fieldErrors}
+	}
+
+	newContext := instance.Context
+	for key, value := range patch {
+		if value == nil {
+			delete(newContext, key)
+		} else {
+			newContext[key] = value
+		}
+	}
+
+	from := instance.CurrentNode
+	if _, err := e.moveToNode(instanceID, target.ID, nil, newContext); err != nil {
+		e.control.mu.Unlock()
+		return nil, err
+	}
+	// Whatever the instance was about to do belongs to the node it left.
+	delete(e.control.due, instanceID)
+	delete(e.control.halted, instanceID)
+	recordErr := e.store.RecordInstanceEvent(instanceID, target.ID, "moved", opts.Operator, opts.Reason)
+	e.control.mu.Unlock()
+	if recordErr != nil {
+		return nil, fmt.Errorf("instance %s was moved to %s but the move was not recorded: %w", instanceID, target.ID, recordErr)
+	}
+
+	e.logger.Info("Instance moved by operator", "instance", instanceID, "from", from, "node", target.ID,
+		"operator", opts.Operator, "reason", opts.Reason, "execute", opts.Execute)
+
+	if opts.Execute && target.Type != "end" {
+		e.dispatch(instanceID, func() {
+			if execErr := e.executeNextNode(instanceID); execErr != nil {
+				e.logger.Error("Error executing node after move", "instance", instanceID, "node", target.ID, "error", execErr)
+			}
+		})
+		if err := e.waitIdle(ctx, instanceID); err != nil {
+			e.logger.Warn("Moved instance has not reached a wait state yet; returning its current state", "instance", instanceID, "error", err)
+		}
+	}
+	return e.GetInstance(instanceID)
+}
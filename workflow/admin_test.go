@@ -0,0 +1,100 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"jbpmn-engine/db"
+)
+
+func TestMoveRefusedWhileExecuting(t *testing.T) {
+	s := newBlockingScripts()
+	e := newTestEngine(t, WithScriptRuntime(s))
+	e.deploy(t, drainDefinition)
+	started := startInBackground(t, e, s, "drain")
+
+	var id string
+	e.exec.mu.Lock()
+	for candidate := range e.exec.inflight {
+		id = candidate
+	}
+	e.exec.mu.Unlock()
+	_, err := e.Move(context.Background(), id, MoveOptions{Node: "done", Operator: "ops"})
+	if !errors.Is(err, ErrInstanceBusy) {
+		t.Errorf("Move while a script runs = %v, want ErrInstanceBusy", err)
+	}
+
+	close(s.release)
+	<-started
+	if got := e.instance(t, id); got.CurrentNode != "done" {
+		t.Fatalf("instance is at %s, want done", got.CurrentNode)
+	}
+	moved, err := e.Move(context.Background(), id, MoveOptions{Node: "after", Operator: "ops"})
+	if err != nil || moved.CurrentNode != "after" {
+		t.Errorf("Move once idle = %v, %v; want the instance at after", moved, err)
+	}
+}
+
+const signalDefinition = `{
+  "id": "signalled",
+  "nodes": [
+    {"id": "start_node", "type": "start", "signal": {"catch": "go"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+// lookupHookStore runs afterLookup once instances waiting for a signal are looked up,
+// before the engine resumes them.
+type lookupHookStore struct {
+	*db.SQLiteStore
+	afterLookup func()
+}
+
+func (s *lookupHookStore) GetInstancesWaitingForSignal(signalName string) ([]string, error) {
+	ids, err := s.SQLiteStore.GetInstancesWaitingForSignal(signalName)
+	s.afterLookup()
+	return ids, err
+}
+
+func TestSignalSkipsInstancesSuspendedMeanwhile(t *testing.T) {
+	hooked := &lookupHookStore{afterLookup: func() {}}
+	e := newTestEngine(t)
+	hooked.SQLiteStore = e.store
+	e = reopenTestEngine(t, e.store, e.clock, WithStore(hooked))
+	e.deploy(t, signalDefinition)
+	suspended := e.start(t, "signalled")
+	waiting := e.start(t, "signalled")
+
+	hooked.afterLookup = func() {
+		if _, err := e.Suspend(suspended.ID, "hold"); err != nil {
+			t.Errorf("Suspend: %v", err)
+		}
+	}
+	if err := e.Signal("go"); err != nil {
+		t.Fatalf("Signal: %v", err)
+	}
+	if got := e.instance(t, suspended.ID); got.Status != StatusSuspended || got.WaitingSignal != "go" {
+		t.Errorf("suspended instance is %s waiting for %q, want suspended waiting for go", got.Status, got.WaitingSignal)
+	}
+	if got := e.instance(t, waiting.ID); got.WaitingSignal != "" || got.CurrentNode != "done" {
+		t.Errorf("active instance is at %s waiting for %q, want it resumed to done", got.CurrentNode, got.WaitingSignal)
+	}
+}
+
+func TestAdvanceAfterFormRefusesSuspendedInstances(t *testing.T) {
+	e := newTestEngine(t)
+	e.deploy(t, isolatedDefinition)
+	instance := e.start(t, "isolated")
+	if _, err := e.Suspend(instance.ID, "hold"); err != nil {
+		t.Fatalf("Suspend: %v", err)
+	}
+
+	err := e.advanceAfterForm(instance.ID, "done", map[string]interface{}{"ok": "yes"})
+	if !errors.Is(err, ErrInstanceNotActive) {
+		t.Errorf("advanceAfterForm on a suspended instance = %v, want ErrInstanceNotActive", err)
+	}
+	if got := e.instance(t, instance.ID); got.CurrentNode != "ask" {
+		t.Errorf("instance is at %s, want it left at ask", got.CurrentNode)
+	}
+}
@@ -0,0 +1,99 @@
+package workflow
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"jbpmn-engine/db"
+)
+
+var (
+	defaultEngine     *Engine
+	defaultEngineOnce sync.Once
+)
+
+// Default returns the engine behind the package-level functions. It is backed by
+// db.DefaultStore, so db.InitDB must be called before it is used.
+func Default() *Engine {
+	defaultEngineOnce.Do(func() {
+		e, err := New(WithStore(db.DefaultStore()))
+		if err != nil {
+			log.Fatalf("Failed to create default workflow engine: %v", err)
+		}
+		defaultEngine = e
+	})
+	return defaultEngine
+}
+
+func SetWorkflowDirectory(dir string) {
+	Default().SetDefinitionSource(NewDirSource(dir))
+	log.Printf("Workflow definitions will be primarily loaded from: %s", dir)
+}
+
+func LoadWorkflowsFromDir(dir string) error {
+	return Default().loadDefinitionsFrom(NewDirSource(dir))
+}
+
+func GetWorkflowDefinition(workflowID string) (*Workflow, error) {
+	return Default().Definition(workflowID)
+}
+
+// CreateNewInstance creates a new workflow instance and its initial node execution record
+// and runs it to its first wait state. See Engine.Start.
+func CreateNewInstance(workflowID string, opts StartOptions) (*WorkflowInstance, error) {
+	return Default().Start(context.Background(), workflowID, opts)
+}
+
+// ExecuteNextNode fetches the instance, determines the next node, and executes it.
+func ExecuteNextNode(instanceID string) error {
+	return Default().executeNextNode(instanceID)
+}
+
+// AdvanceInstanceAfterForm updates an instance's context and moves it to the next node.
+// This is specifically for advancing after a form submission.
+func AdvanceInstanceAfterForm(instanceID, nextNodeID string, formData map[string]interface{}) error {
+	if !Default().acceptingWork() {
+		return ErrShuttingDown
+	}
+	return Default().advanceAfterForm(instanceID, nextNodeID, formData)
+}
+
+// SubmitForm validates and applies a form submission to the instance waiting at a form node.
+func SubmitForm(instanceID string, input map[string]string) error {
+	return Default().SubmitForm(instanceID, input)
+}
+
+// GetInstanceAndDefinition loads a workflow instance and its associated definition.
+func GetInstanceAndDefinition(instanceID string) (*WorkflowInstance, error) {
+	return Default().GetInstance(instanceID)
+}
+
+// EmitSignal processes a signal, resuming any workflows waiting for it.
+func EmitSignal(signalName string) error {
+	return Default().Signal(signalName)
+}
+
+// ResumeWorkflowsBySignal finds and resumes instances waiting for a specific signal.
+func ResumeWorkflowsBySignal(signalName string) error {
+	if !Default().acceptingWork() {
+		return ErrShuttingDown
+	}
+	return Default().resumeWorkflowsBySignal(signalName, nil)
+}
+
+// ResolveGatewayConditions evaluates the conditions of a gateway node
+// and returns the ID of the next node to transition to, and any signal to throw.
+func ResolveGatewayConditions(instance *WorkflowInstance) (string, string, error) {
+	return Default().resolveGatewayConditions(instance)
+}
+
+// Shutdown drains the default engine. See Engine.Shutdown.
+func Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	return Default().Shutdown(ctx)
+}
+
+// RestorePendingTimers re-arms timers persisted by a previous Shutdown of the default engine.
+func RestorePendingTimers() error {
+	return Default().RestorePendingTimers()
+}
@@ -0,0 +1,297 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"jbpmn-engine/db"
+)
+
+// ErrDefinitionNotFound is returned when a workflow definition cannot be found.
+var ErrDefinitionNotFound = errors.New("workflow definition not found")
+
+// DefinitionSource supplies raw workflow definition JSON to an Engine.
+type DefinitionSource interface {
+	// List returns the locations of every definition held by the source.
+	List() ([]string, error)
+	// Read returns the raw JSON stored at location.
+	Read(location string) ([]byte, error)
+	// Locate returns the location where the definition with the given workflow ID is expected.
+	Locate(workflowID string) string
+}
+
+// DirSource reads workflow definitions from *.json files in a directory.
+type DirSource struct {
+	Dir string
+}
+
+// NewDirSource returns a DirSource for dir.
+func NewDirSource(dir string) *DirSource {
+	return &DirSource{Dir: dir}
+}
+
+// List returns the paths of all *.json files in the directory.
+func (s *DirSource) List() ([]string, error) {
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read workflow directory %s: %w", s.Dir, err)
+	}
+
+	var locations []string
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		locations = append(locations, filepath.Join(s.Dir, file.Name()))
+	}
+	return locations, nil
+}
+
+// Read returns the contents of the file at location.
+func (s *DirSource) Read(location string) ([]byte, error) {
+	return os.ReadFile(location)
+}
+
+// Locate returns <dir>/<workflowID>.json.
+func (s *DirSource) Locate(workflowID string) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%s.json", workflowID))
+}
+
+// MultiSource combines several sources, e.g. one DirSource per directory. When two
+// sources hold a definition with the same workflow ID, the first one wins.
+type MultiSource []DefinitionSource
+
+// List returns the locations of every source, in source order.
+func (m MultiSource) List() ([]string, error) {
+	var locations []string
+	for _, source := range m {
+		list, err := source.List()
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, list...)
+	}
+	return locations, nil
+}
+
+// Read returns the definition at location from the first source that has it.
+func (m MultiSource) Read(location string) ([]byte, error) {
+	err := fmt.Errorf("%s: %w", location, os.ErrNotExist)
+	for _, source := range m {
+		data, readErr := source.Read(location)
+		if readErr == nil {
+			return data, nil
+		}
+		if !errors.Is(readErr, os.ErrNotExist) {
+			err = readErr
+		}
+	}
+	return nil, err
+}
+
+// Locate returns the location of workflowID in the first source that has it, or in
+// the first source if none does.
+func (m MultiSource) Locate(workflowID string) string {
+	for _, source := range m {
+		location := source.Locate(workflowID)
+		if _, err := source.Read(location); err == nil {
+			return location
+		}
+	}
+	if len(m) == 0 {
+		return ""
+	}
+	return m[0].Locate(workflowID)
+}
+
+// SetDefinitionSource replaces the source used for definitions missing from the cache.
+func (e *Engine) SetDefinitionSource(source DefinitionSource) {
+	e.definitionsLock.Lock()
+	defer e.definitionsLock.Unlock()
+	e.source = source
+}
+
+// LoadDefinitions replaces the cached definitions with everything held by the engine's source.
+// Files that cannot be read or parsed are skipped with a warning.
+func (e *Engine) LoadDefinitions() error {
+	e.definitionsLock.RLock()
+	source := e.source
+	e.definitionsLock.RUnlock()
+
+	if source == nil {
+		return fmt.Errorf("no definition source configured")
+	}
+	return e.loadDefinitionsFrom(source)
+}
+
+func (e *Engine) loadDefinitionsFrom(source DefinitionSource) error {
+	locations, err := source.List()
+	if err != nil {
+		return err
+	}
+
+	e.reload.mu.Lock()
+	defer e.reload.mu.Unlock()
+	e.reload.hashes, e.reload.owners = nil, nil
+
+	definitions := make(map[string]*Workflow)
+	for _, location := range locations {
+		data, err := source.Read(location)
+		if err != nil {
+			e.logger.Warn("Failed to read workflow file", "location", location, "error", err)
+			continue
+		}
+		// Remember every file read, so a reload only reports the ones changed since.
+		e.reload.remember(location, contentHash(data), "")
+
+		wf, bundled, err := e.parseDefinition(data, location)
+		if err != nil {
+			e.logger.Warn("Rejected invalid workflow definition", "location", location, "error", err)
+			continue
+		}
+		if first, ok := definitions[wf.ID]; ok {
+			e.logger.Warn("Ignoring workflow definition with a duplicate ID", "location", location, "workflow", wf.ID, "version", first.Version)
+			continue
+		}
+		e.saveDefinition(wf, bundled, location)
+		e.reload.remember(location, e.definitionHash(location, data, wf), wf.ID)
+
+		definitions[wf.ID] = wf
+		e.logger.Info("Loaded workflow definition", "name", wf.Name, "workflow", wf.ID, "version", wf.Version)
+	}
+
+	e.definitionsLock.Lock()
+	e.definitions = definitions
+	e.retired = make(map[string]bool)
+	for _, wf := range definitions {
+		e.cacheVersion(wf)
+	}
+	e.definitionsLock.Unlock()
+	return nil
+}
+
+// saveDefinition stores wf as a new version unless it equals the latest one, and
+// sets wf.Version. Failures are logged and leave the definition unversioned.
+func (e *Engine) saveDefinition(wf *Workflow, data []byte, location string) {
+	metaJSON, _ := json.Marshal(wf.Meta)
+	version, created, err := e.store.SaveWorkflow(wf.ID, wf.Name, string(metaJSON), string(data), location)
+	if err != nil {
+		e.logger.Warn("Could not save workflow definition to DB", "workflow", wf.ID, "location", location, "error", err)
+		return
+	}
+	if created {
+		e.logger.Info("Saved new workflow definition version in DB", "workflow", wf.ID, "version", version)
+	}
+	wf.Version = version
+}
+
+// cacheVersion remembers a stored definition for instances pinned to its version
+// and compiles its scripts, logging the definition's Warnings. It must be called
+// with e.definitionsLock held.
+func (e *Engine) cacheVersion(wf *Workflow) {
+	if wf.Version > 0 {
+		key := definitionKey{wf.ID, wf.Version}
+		if _, ok := e.versions[key]; !ok {
+			for _, warning := range Warnings(wf, nil) {
+				e.logger.Warn("Workflow definition warning", "workflow", wf.ID, "version", wf.Version, "path", warning.Path, "warning", warning.Message)
+			}
+			e.precompileScripts(wf)
+		}
+		e.versions[key] = wf
+	}
+}
+
+// Definition returns the latest workflow definition with the given ID. Definitions
+// missing from the cache are read from the engine's source and saved to the store,
+// or, if the source does not have them, taken from the store.
+func (e *Engine) Definition(workflowID string) (*Workflow, error) {
+	e.definitionsLock.RLock()
+	wf, ok := e.definitions[workflowID]
+	source := e.source
+	e.definitionsLock.RUnlock()
+
+	if ok {
+		return wf, nil
+	}
+
+	if source == nil {
+		if stored, err := e.storedDefinition(workflowID); err == nil {
+			return stored, nil
+		}
+		return nil, fmt.Errorf("%w: '%s' is not loaded and no definition source is configured", ErrDefinitionNotFound, workflowID)
+	}
+
+	location := source.Locate(workflowID)
+	data, err := source.Read(location)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			if stored, storeErr := e.storedDefinition(workflowID); storeErr == nil {
+				return stored, nil
+			}
+			return nil, fmt.Errorf("%w: '%s' not found in memory or at '%s'", ErrDefinitionNotFound, workflowID, location)
+		}
+		return nil, fmt.Errorf("workflow definition '%s' not found in memory and failed to read from '%s': %w", workflowID, location, err)
+	}
+
+	newWf, bundled, err := e.parseDefinition(data, location)
+	if err != nil {
+		return nil, err
+	}
+	e.saveDefinition(newWf, bundled, location)
+
+	e.definitionsLock.Lock()
+	e.definitions[newWf.ID] = newWf
+	e.cacheVersion(newWf)
+	e.definitionsLock.Unlock()
+	e.logger.Info("Dynamically loaded workflow definition", "name", newWf.Name, "workflow", newWf.ID, "location", location, "version", newWf.Version)
+
+	return newWf, nil
+}
+
+// parseDefinitionAt parses and validates the definition read from location.
+func parseDefinitionAt(data []byte, location string) (*Workflow, error) {
+	wf, err := ParseDefinition(data)
+	var defErr *DefinitionError
+	if errors.As(err, &defErr) {
+		defErr.Location = location
+	}
+	return wf, err
+}
+
+// storedDefinition loads the latest stored version of a definition into the cache,
+// e.g. one deployed through the API in an earlier run.
+func (e *Engine) storedDefinition(workflowID string) (*Workflow, error) {
+	rec, err := e.store.GetWorkflow(workflowID)
+	if err != nil {
+		return nil, err
+	}
+	wf, err := definitionFromRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	e.definitionsLock.Lock()
+	defer e.definitionsLock.Unlock()
+	if cached, ok := e.definitions[workflowID]; ok {
+		return cached, nil
+	}
+	e.definitions[workflowID] = wf
+	e.cacheVersion(wf)
+	e.logger.Info("Loaded workflow definition from DB", "workflow", workflowID, "version", wf.Version)
+	return wf, nil
+}
+
+func definitionFromRecord(rec *db.WorkflowRecord) (*Workflow, error) {
+	var wf Workflow
+	if err := json.Unmarshal([]byte(rec.RawJSON), &wf); err != nil {
+		return nil, fmt.Errorf("error unmarshalling stored workflow %s version %d: %w", rec.ID, rec.Version, err)
+	}
+	wf.Version = rec.Version
+	return &wf, nil
+}
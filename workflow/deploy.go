@@ -0,0 +1,133 @@
+package workflow
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"jbpmn-engine/db"
+)
+
+// definitionKey identifies a stored version of a definition.
+type definitionKey struct {
+	id      string
+	version int
+}
+
+// DefinitionInfo describes one stored version of a workflow definition.
+type DefinitionInfo struct {
+	WorkflowID string
+	Version    int
+	Name       string
+	Meta       MetaData
+	Source     string // File the version was loaded from, or "api"
+	CreatedAt  time.Time
+}
+
+func newDefinitionInfo(rec db.WorkflowRecord) DefinitionInfo {
+	info := DefinitionInfo{
+		WorkflowID: rec.ID,
+		Version:    rec.Version,
+		Name:       rec.Name,
+		Source:     rec.Source,
+		CreatedAt:  rec.CreatedAt,
+	}
+	json.Unmarshal([]byte(rec.Meta), &info.Meta)
+	return info
+}
+
+// Deploy validates a workflow definition and stores it as a new version that new
+// instances start with right away. Running instances keep the version they were
+// started with. Deploying a document identical to the latest version stores nothing
+// and reports created as false. Invalid definitions are reported as a
+// *DefinitionError.
+func (e *Engine) Deploy(data []byte, source string) (info *DefinitionInfo, created bool, err error) {
+	wf, data, err := e.parseDefinition(data, "")
+	if err != nil {
+		return nil, false, err
+	}
+
+	metaJSON, _ := json.Marshal(wf.Meta)
+	version, created, err := e.store.SaveWorkflow(wf.ID, wf.Name, string(metaJSON), string(data), source)
+	if err != nil {
+		return nil, false, err
+	}
+	wf.Version = version
+
+	e.definitionsLock.Lock()
+	if latest, ok := e.definitions[wf.ID]; !ok || latest.Version <= version {
+		e.definitions[wf.ID] = wf
+	}
+	delete(e.retired, wf.ID)
+	e.cacheVersion(wf)
+	e.definitionsLock.Unlock()
+
+	if created {
+		e.logger.Info("Deployed workflow definition", "workflow", wf.ID, "version", version, "source", source)
+	}
+	rec, err := e.store.GetWorkflowVersion(wf.ID, version)
+	if err != nil {
+		return nil, false, err
+	}
+	deployed := newDefinitionInfo(*rec)
+	return &deployed, created, nil
+}
+
+// Definitions lists the latest stored version of every definition.
+func (e *Engine) Definitions() ([]DefinitionInfo, error) {
+	records, err := e.store.ListWorkflows()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]DefinitionInfo, 0, len(records))
+	for _, rec := range records {
+		infos = append(infos, newDefinitionInfo(rec))
+	}
+	return infos, nil
+}
+
+// DefinitionVersions lists every stored version of a definition, oldest first.
+func (e *Engine) DefinitionVersions(workflowID string) ([]DefinitionInfo, error) {
+	records, err := e.store.ListWorkflowVersions(workflowID)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: '%s' has not been deployed", ErrDefinitionNotFound, workflowID)
+	}
+	infos := make([]DefinitionInfo, 0, len(records))
+	for _, rec := range records {
+		infos = append(infos, newDefinitionInfo(rec))
+	}
+	return infos, nil
+}
+
+// DefinitionVersion returns a specific stored version of a definition.
+func (e *Engine) DefinitionVersion(workflowID string, version int) (*Workflow, error) {
+	key := definitionKey{workflowID, version}
+	e.definitionsLock.RLock()
+	wf, ok := e.versions[key]
+	e.definitionsLock.RUnlock()
+	if ok {
+		return wf, nil
+	}
+
+	rec, err := e.store.GetWorkflowVersion(workflowID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: '%s' version %d", ErrDefinitionNotFound, workflowID, version)
+		}
+		return nil, err
+	}
+	wf, err = definitionFromRecord(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	e.definitionsLock.Lock()
+	e.cacheVersion(wf)
+	e.definitionsLock.Unlock()
+	return wf, nil
+}
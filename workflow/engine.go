@@ -1,134 +1,206 @@
 package workflow
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
-	"path/filepath"
+	"log/slog"
 	"sync"
 	"time"
 
+	"jbpmn-engine/clock"
 	"jbpmn-engine/db"
+	"jbpmn-engine/expr"
+	"jbpmn-engine/lru"
 	"jbpmn-engine/scripts"
 
 	"github.com/google/uuid"
 )
 
-var (
-	workflowDefinitions     map[string]*Workflow
-	workflowDefinitionsLock sync.RWMutex
-	workflowDir             string
-)
+// ErrInstanceNotFound is returned when a workflow instance does not exist.
+var ErrInstanceNotFound = errors.New("workflow instance not found")
 
-func SetWorkflowDirectory(dir string) {
-	workflowDir = dir
-	log.Printf("Workflow definitions will be primarily loaded from: %s", workflowDir)
-}
+// ErrNoPendingForm is returned when a form is submitted to an instance that is not at a form node.
+var ErrNoPendingForm = errors.New("workflow instance is not waiting for a form submission")
 
-func LoadWorkflowsFromDir(dir string) error {
-	workflowDefinitionsLock.Lock()
-	defer workflowDefinitionsLock.Unlock()
+// FormValidationError reports the fields of a form submission that failed validation.
+type FormValidationError struct {
+	Fields map[string]string // field name -> error message
+}
 
-	workflowDefinitions = make(map[string]*Workflow)
+func (e *FormValidationError) Error() string {
+	return fmt.Sprintf("form validation failed for %d field(s)", len(e.Fields))
+}
 
-	files, err := os.ReadDir(dir)
-	if err != nil {
-		return fmt.Errorf("failed to read workflow directory %s: %w", dir, err)
-	}
+// ScriptRuntime executes the code of script nodes, given as plain JavaScript: base64
+// code is decoded and script files are read before it is called. Scripts still running
+// when ctx reaches its deadline must be stopped and reported as a *scripts.TimeoutError.
+type ScriptRuntime interface {
+	ExecuteScript(ctx context.Context, source string, vars map[string]interface{}) (map[string]interface{}, error)
+}
 
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-		if filepath.Ext(file.Name()) != ".json" {
-			continue
-		}
+// Engine runs workflow instances. It owns the definition cache, the in-flight
+// execution tracking and the armed timers; everything else is injected.
+type Engine struct {
+	store    Store
+	source   DefinitionSource
+	clock    clock.Clock
+	logger   *slog.Logger
+	scripts  ScriptRuntime
+	executor Executor
+
+	definitions     map[string]*Workflow // latest version of each definition
+	versions        map[definitionKey]*Workflow
+	retired         map[string]bool // workflows whose file was removed; they cannot be started
+	definitionsLock sync.RWMutex
+	reload          reloadState
+	libraryDir      string // directory of script libraries; see WithScriptLibraries
+
+	idempotencyRetention time.Duration
+	scriptLogRetention   time.Duration
+	scriptTimeout        time.Duration
+	scriptLimits         scripts.Limits
+	hostFunctions        []hostFunction
+	expressions          lru.Cache[string, *expr.Program] // compiled expressions by source; see expression
+	starting             sync.Map                         // chan struct{} by idempotency key owner, closed when its request is done; see claimKey
+
+	exec    executionState
+	control controlState
+}
 
-		filePath := filepath.Join(dir, file.Name())
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			log.Printf("Warning: Failed to read workflow file %s: %v", filePath, err)
-			continue
-		}
+// Option configures an Engine.
+type Option func(*Engine)
 
-		var wf Workflow
-		err = json.Unmarshal(data, &wf)
-		if err != nil {
-			log.Printf("Warning: Failed to unmarshal workflow JSON from %s: %v", filePath, err)
-			continue
-		}
+// WithStore sets the persistence layer. It is required.
+func WithStore(store Store) Option {
+	return func(e *Engine) { e.store = store }
+}
 
-		workflowDefinitions[wf.ID] = &wf
-		log.Printf("Loaded workflow definition: %s (ID: %s)", wf.Name, wf.ID)
-	}
-	return nil
+// WithDefinitionSource sets where definitions are loaded from.
+func WithDefinitionSource(source DefinitionSource) Option {
+	return func(e *Engine) { e.source = source }
 }
 
-func GetWorkflowDefinition(workflowID string) (*Workflow, error) {
-	workflowDefinitionsLock.RLock()
-	wf, ok := workflowDefinitions[workflowID]
-	workflowDefinitionsLock.RUnlock()
+// WithClock sets the clock used for timestamps and timeouts. Defaults to the wall clock.
+func WithClock(c clock.Clock) Option {
+	return func(e *Engine) { e.clock = c }
+}
 
-	if !ok {
-		if workflowDir == "" {
-			return nil, fmt.Errorf("workflow directory not set. Call SetWorkflowDirectory first in main.")
-		}
+// WithLogger sets the logger. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(e *Engine) { e.logger = logger }
+}
 
-		filePath := filepath.Join(workflowDir, fmt.Sprintf("%s.json", workflowID))
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("workflow definition '%s' not found in memory and failed to read from file '%s': %w", workflowID, filePath, err)
-		}
+// WithScriptRuntime sets the runtime used for script nodes. Defaults to a scripts.Runtime.
+func WithScriptRuntime(runtime ScriptRuntime) Option {
+	return func(e *Engine) { e.scripts = runtime }
+}
 
-		var newWf Workflow
-		err = json.Unmarshal(data, &newWf)
-		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling workflow JSON from %s: %w", filePath, err)
-		}
+// WithExecutor sets how node executions are run. Defaults to GoExecutor.
+func WithExecutor(executor Executor) Option {
+	return func(e *Engine) { e.executor = executor }
+}
 
-		workflowDefinitionsLock.Lock()
-		defer workflowDefinitionsLock.Unlock()
-		workflowDefinitions[newWf.ID] = &newWf
-		log.Printf("Dynamically loaded workflow definition: %s (ID: %s) from disk.", newWf.Name, newWf.ID)
-
-		_, _, _, existingRawJSON, _ := db.GetWorkflow(newWf.ID)
-		if existingRawJSON != string(data) {
-			log.Printf("Saving/Updating dynamically loaded workflow '%s' in DB.", newWf.ID)
-			metaJSON, _ := json.Marshal(newWf.Meta)
-			saveErr := db.SaveWorkflow(newWf.ID, newWf.Name, string(metaJSON), string(data))
-			if saveErr != nil {
-				log.Printf("Warning: Could not save dynamically loaded workflow %s to DB: %v", newWf.ID, saveErr)
-			}
-		}
+// New creates an Engine configured by opts.
+func New(opts ...Option) (*Engine, error) {
+	e := &Engine{
+		clock:       clock.Real{},
+		logger:      slog.Default(),
+		scripts:     &scripts.Runtime{},
+		executor:    GoExecutor{},
+		definitions: make(map[string]*Workflow),
+		versions:    make(map[definitionKey]*Workflow),
+		retired:     make(map[string]bool),
+
+		idempotencyRetention: DefaultIdempotencyRetention,
+		scriptLogRetention:   DefaultScriptLogRetention,
+		scriptTimeout:        DefaultScriptTimeout,
+		scriptLimits:         DefaultScriptLimits,
+	}
+	e.exec.inflight = make(map[string]int)
+	e.exec.idle = make(map[string][]chan struct{})
+	e.exec.timers = make(map[string]*pendingTimer)
+	e.control.halted = make(map[string]bool)
+	e.control.due = make(map[string]*pendingTimer)
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	if e.store == nil {
+		return nil, fmt.Errorf("workflow engine requires a store")
+	}
+	if err := e.registerHostFunctions(); err != nil {
+		return nil, err
+	}
+	if limiter, ok := e.scripts.(ScriptLimiter); ok {
+		limiter.SetLimits(e.scriptLimits)
+	}
+	return e, nil
+}
 
-		return &newWf, nil
+// Start creates a new instance of the workflow and, unless its start node waits for
+// a signal, executes it until it reaches its first wait state: a form, a signal, a
+// timer or an end node. The returned instance reflects that state. If ctx is done
+// first, the state persisted so far is returned and execution continues in the
+// background. Invalid options are reported as an *InputValidationError.
+func (e *Engine) Start(ctx context.Context, workflowID string, opts StartOptions) (*WorkflowInstance, error) {
+	if !e.acceptingWork() {
+		return nil, ErrShuttingDown
 	}
-	return wf, nil
+	return e.start(ctx, newInstanceID(), workflowID, opts)
 }
 
-// CreateNewInstance creates a new workflow instance and its initial node execution record.
-func CreateNewInstance(workflowID string) (*WorkflowInstance, error) {
-	wf, err := GetWorkflowDefinition(workflowID)
+// newInstanceID returns a fresh workflow instance ID.
+func newInstanceID() string {
+	return uuid.New().String()
+}
+
+// start creates and runs the instance instanceID. See Start.
+func (e *Engine) start(ctx context.Context, instanceID, workflowID string, opts StartOptions) (*WorkflowInstance, error) {
+	wf, err := e.Definition(workflowID)
 	if err != nil {
-		return nil, fmt.Errorf("workflow definition not found or invalid for ID %s: %v", workflowID, err)
+		return nil, fmt.Errorf("workflow definition not found or invalid for ID %s: %w", workflowID, err)
+	}
+	if !e.startable(workflowID) {
+		return nil, fmt.Errorf("%w: the file defining '%s' has been removed", ErrDefinitionNotFound, workflowID)
 	}
 
-	instanceID := uuid.New().String()
-	initialContext := make(map[string]interface{})
-	initialContext["instanceID"] = instanceID
+	startNodeID := opts.StartNode
+	if startNodeID == "" {
+		startNodeID = DefaultStartNode
+	}
+	startNode := wf.GetNodeByID(startNodeID)
+	if startNode == nil || startNode.Type != "start" {
+		if opts.StartNode == "" {
+			return nil, fmt.Errorf("workflow %s does not have a '%s'", workflowID, DefaultStartNode)
+		}
+		return nil, &InputValidationError{Fields: map[string]string{
+			"start_node": fmt.Sprintf("'%s' is not a start node of workflow %s", startNodeID, workflowID),
+		}}
+	}
 
-	startNode := wf.GetNodeByID("start_node")
-	if startNode == nil {
-		return nil, fmt.Errorf("workflow %s does not have a 'start_node'", workflowID)
+	if opts.ParentInstanceID != "" {
+		if _, err := e.store.GetInstance(opts.ParentInstanceID); err != nil {
+			return nil, &InputValidationError{Fields: map[string]string{
+				"parent_instance_id": fmt.Sprintf("instance '%s' does not exist", opts.ParentInstanceID),
+			}}
+		}
 	}
 
+	initialContext, err := prepareVariables(wf.Input, opts.Variables)
+	if err != nil {
+		return nil, err
+	}
+	initialContext["instanceID"] = instanceID
+
 	waitingSignal := ""
 	if startNode.Signal != nil && startNode.Signal.Catch != "" {
 		waitingSignal = startNode.Signal.Catch
-		log.Printf("Instance %s created for workflow %s. It is waiting for signal '%s' to start execution.", instanceID, workflowID, waitingSignal)
+		e.logger.Info("Instance created, waiting for signal to start execution", "instance", instanceID, "workflow", workflowID, "signal", waitingSignal)
 	} else {
-		log.Printf("Instance %s created for workflow %s. Starting auto-execution.", instanceID, workflowID)
+		e.logger.Info("Instance created, starting auto-execution", "instance", instanceID, "workflow", workflowID)
 	}
 
 	ctxJSON, err := json.Marshal(initialContext)
@@ -136,118 +208,118 @@ func CreateNewInstance(workflowID string) (*WorkflowInstance, error) {
 		return nil, fmt.Errorf("error marshalling initial context: %v", err)
 	}
 
-	// Use the new db.SaveNewInstance which handles both instance and initial node entry
-	_, initialNodeInstanceDBID, err := db.SaveNewInstance(instanceID, workflowID, startNode.ID, string(ctxJSON), waitingSignal, nil)
+	// SaveNewInstance handles both the instance and its initial node entry
+	_, initialNodeInstanceDBID, err := e.store.SaveNewInstance(instanceID, workflowID, wf.Version, opts.BusinessKey, startNode.ID, string(ctxJSON), waitingSignal, nil)
 	if err != nil {
 		return nil, fmt.Errorf("error saving new workflow instance and initial node to DB: %v", err)
 	}
+	if opts.ParentInstanceID != "" {
+		if err := e.store.SetInstanceParent(instanceID, opts.ParentInstanceID); err != nil {
+			return nil, err
+		}
+	}
 
+	now := e.clock.Now()
 	instance := &WorkflowInstance{
 		ID:                      instanceID,
 		WorkflowID:              workflowID,
-		CurrentNode:             startNode.ID, // Node definition ID
-		CurrentNodeInstanceDBID: initialNodeInstanceDBID, // UUID from db.workflow_instance_nodes
+		BusinessKey:             opts.BusinessKey,
+		ParentInstanceID:        opts.ParentInstanceID,
+		Status:                  StatusActive,
+		CurrentNode:             startNode.ID,            // Node definition ID
+		CurrentNodeInstanceDBID: initialNodeInstanceDBID, // ID from db.workflow_instance_nodes
 		Context:                 initialContext,
-		CreatedAt:               time.Now(),
-		UpdatedAt:               time.Now(),
+		CreatedAt:               now,
+		UpdatedAt:               now,
 		WorkflowDef:             wf,
 		CurrentNodeDef:          startNode,
 		WaitingSignal:           waitingSignal,
 	}
 
-	if waitingSignal == "" {
-		go func() {
-			execErr := ExecuteNextNode(instance.ID)
-			if execErr != nil {
-				log.Printf("Error during initial workflow execution for instance %s: %v", instance.ID, execErr)
-			}
-		}()
+	if waitingSignal != "" {
+		return instance, nil
 	}
 
+	e.dispatch(instance.ID, func() {
+		if execErr := e.executeNextNode(instance.ID); execErr != nil {
+			e.logger.Error("Error during initial workflow execution", "instance", instance.ID, "error", execErr)
+		}
+	})
+	if err := e.waitIdle(ctx, instance.ID); err != nil {
+		e.logger.Warn("Instance has not reached a wait state yet; returning its current state", "instance", instance.ID, "error", err)
+	}
+	if latest, err := e.GetInstance(instance.ID); err == nil {
+		return latest, nil
+	}
 	return instance, nil
 }
 
-// ExecuteNextNode fetches the instance, determines the next node, and executes it.
-func ExecuteNextNode(instanceID string) error {
-	instance, loadErr := GetInstanceAndDefinition(instanceID)
+// executeNextNode fetches the instance, determines the next node, and executes it.
+func (e *Engine) executeNextNode(instanceID string) error {
+	instance, loadErr := e.GetInstance(instanceID)
 	if loadErr != nil {
-		return fmt.Errorf("failed to load instance %s for execution: %v", instanceID, loadErr)
+		return fmt.Errorf("failed to load instance %s for execution: %w", instanceID, loadErr)
+	}
+	if ok, err := e.runnable(instanceID); err != nil || !ok {
+		return err
 	}
 
-	if instance.WaitingSignal != "" || (instance.ExpiresAt != nil && instance.ExpiresAt.Before(time.Now())) {
-		log.Printf("Instance %s is waiting for signal ('%s') or has expired. Not auto-executing.", instanceID, instance.WaitingSignal)
+	if instance.WaitingSignal != "" || (instance.ExpiresAt != nil && instance.ExpiresAt.Before(e.clock.Now())) {
+		e.logger.Info("Instance is waiting for a signal or has expired; not auto-executing", "instance", instanceID, "signal", instance.WaitingSignal)
 		return nil
 	}
 
-	log.Printf("Executing node %s (Type: %s) for instance %s", instance.CurrentNode, instance.CurrentNodeDef.Type, instance.ID)
-
-	if instance.CurrentNodeDef.Timeout != nil {
-		go func(instID string, timeoutCfg *TimeoutConfig, originalNodeID string, originalNodeInstanceDBID string) {
-			duration, err := time.ParseDuration(timeoutCfg.Duration)
-			if err != nil {
-				log.Printf("Error parsing timeout duration '%s' for instance %s: %v", timeoutCfg.Duration, instID, err)
-				return
-			}
-			time.Sleep(duration)
-
-			currentInstance, err := GetInstanceAndDefinition(instID)
-			if err != nil {
-				log.Printf("Error re-fetching instance %s for timeout check: %v", instID, err)
-				return
-			}
+	e.logger.Info("Executing node", "node", instance.CurrentNode, "type", instance.CurrentNodeDef.Type, "instance", instance.ID)
 
-			// Only transition on timeout if still on the same node *instance*
-			if currentInstance.CurrentNodeInstanceDBID == originalNodeInstanceDBID {
-				log.Printf("Instance %s timed out at node %s. Transitioning to %s.", instID, originalNodeID, timeoutCfg.Next)
-				// Use advanceInstance to handle the state update and new node instance creation
-				advErr := advanceInstance(instID, timeoutCfg.Next, nil)
-				if advErr != nil {
-					log.Printf("Error advancing instance %s after timeout transition: %v", instID, advErr)
-					return
-				}
-				// The advanceInstance function will already trigger ExecuteNextNode
-			}
-		}(instanceID, instance.CurrentNodeDef.Timeout, instance.CurrentNode, instance.CurrentNodeInstanceDBID)
+	// Scripts enforce their timeout themselves while they run; see executeScriptNode.
+	if instance.CurrentNodeDef.Timeout != nil && instance.CurrentNodeDef.Type != "script" {
+		duration, err := time.ParseDuration(instance.CurrentNodeDef.Timeout.Duration)
+		if err != nil {
+			e.logger.Error("Error parsing timeout duration", "duration", instance.CurrentNodeDef.Timeout.Duration, "instance", instanceID, "error", err)
+		} else {
+			e.scheduleTimeout(instanceID, instance.CurrentNode, instance.CurrentNodeInstanceDBID, instance.CurrentNodeDef.Timeout, e.clock.Now().Add(duration))
+		}
 	}
 
 	var execErr error
 	switch instance.CurrentNodeDef.Type {
 	case "start":
 		if instance.CurrentNodeDef.Next != "" {
-			execErr = advanceInstance(instanceID, instance.CurrentNodeDef.Next, nil)
+			execErr = e.advanceInstance(instanceID, instance.CurrentNodeDef.Next, nil, nil)
 		} else {
 			return fmt.Errorf("start node %s has no 'next' transition defined", instance.CurrentNode)
 		}
 	case "form":
-		log.Printf("Instance %s is at form node %s, waiting for user input.", instance.ID, instance.CurrentNode)
+		e.logger.Info("Instance is at form node, waiting for user input", "instance", instance.ID, "node", instance.CurrentNode)
 		return nil
 	case "script":
-		execErr = executeScriptNode(instance)
+		execErr = e.executeScriptNode(instance)
 	case "gateway":
-		nextNodeID, signalToThrow, gatewayErr := ResolveGatewayConditions(instance)
+		nextNodeID, signalToThrow, gatewayErr := e.resolveGatewayConditions(instance)
 		if gatewayErr != nil {
-			return fmt.Errorf("error processing gateway node %s for instance %s: %w", instance.CurrentNode, instance.ID, gatewayErr)
+			execErr = fmt.Errorf("error processing gateway node %s for instance %s: %w", instance.CurrentNode, instance.ID, gatewayErr)
+			break
 		}
 
 		if signalToThrow != "" {
-			log.Printf("Engine emitting signal '%s' from gateway %s for instance %s", signalToThrow, instance.CurrentNode, instance.ID)
-			go func() {
-				emitErr := EmitSignal(signalToThrow)
-				if emitErr != nil {
-					log.Printf("Error emitting signal '%s' from gateway %s for instance %s: %v", signalToThrow, instance.CurrentNode, instance.ID, emitErr)
+			e.logger.Info("Engine emitting signal from gateway", "signal", signalToThrow, "node", instance.CurrentNode, "instance", instance.ID)
+			e.dispatch(instance.ID, func() {
+				if emitErr := e.resumeWorkflowsBySignal(signalToThrow, nil); emitErr != nil {
+					e.logger.Error("Error emitting signal from gateway", "signal", signalToThrow, "node", instance.CurrentNode, "instance", instance.ID, "error", emitErr)
 				}
-			}()
+			})
 		}
-		execErr = advanceInstance(instance.ID, nextNodeID, nil)
+		execErr = e.advanceInstance(instance.ID, nextNodeID, nil, nil)
 
 	case "end":
-		execErr = executeEndNode(instance)
+		execErr = e.executeEndNode(instance)
 	default:
 		return fmt.Errorf("unsupported node type: %s for node %s", instance.CurrentNodeDef.Type, instance.CurrentNode)
 	}
 
 	if execErr != nil {
-		log.Printf("Error executing node %s for instance %s: %v", instance.CurrentNode, instance.ID, execErr)
+		e.logger.Error("Error executing node", "node", instance.CurrentNode, "instance", instance.ID, "error", execErr)
+		e.raiseIncident(instance, execErr)
 		return execErr
 	}
 
@@ -255,15 +327,40 @@ func ExecuteNextNode(instanceID string) error {
 }
 
 // advanceInstance updates the instance to the next node and saves a new node execution record.
-func advanceInstance(instanceID, nextNodeID string, waitingSignal *string) error {
-	instance, err := GetInstanceAndDefinition(instanceID)
+// If newContext is not nil it replaces the stored context, e.g. with the output of a script.
+func (e *Engine) advanceInstance(instanceID, nextNodeID string, waitingSignal *string, newContext map[string]interface{}) error {
+	instance, err := e.moveToNode(instanceID, nextNodeID, waitingSignal, newContext)
 	if err != nil {
-		return fmt.Errorf("failed to load instance %s to advance: %v", instanceID, err)
+		return err
+	}
+
+	// Form nodes are executed too so that their timeout gets armed; they stop there and wait for input.
+	if instance.CurrentNodeDef.Type != "end" && (waitingSignal == nil || *waitingSignal == "") {
+		e.dispatch(instanceID, func() {
+			if execErr := e.executeNextNode(instanceID); execErr != nil {
+				e.logger.Error("Error executing next node", "node", nextNodeID, "instance", instanceID, "error", execErr)
+			}
+		})
+	}
+
+	return nil
+}
+
+// moveToNode is the persisting half of advanceInstance: it records the move to
+// nextNodeID and disarms the timer of the node being left, without executing anything.
+func (e *Engine) moveToNode(instanceID, nextNodeID string, waitingSignal *string, newContext map[string]interface{}) (*WorkflowInstance, error) {
+	instance, err := e.GetInstance(instanceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load instance %s to advance: %w", instanceID, err)
+	}
+	if newContext != nil {
+		instance.Context = newContext
 	}
 
 	instance.CurrentNode = nextNodeID // Update in memory for immediate use
 	instance.CurrentNodeDef = instance.WorkflowDef.GetNodeByID(nextNodeID)
-	instance.UpdatedAt = time.Now()
+	instance.UpdatedAt = e.clock.Now()
+	instance.ExpiresAt = nil // Timers belong to the node being left
 
 	signalString := ""
 	if waitingSignal != nil {
@@ -275,32 +372,94 @@ func advanceInstance(instanceID, nextNodeID string, waitingSignal *string) error
 
 	ctxJSON, err := json.Marshal(instance.Context)
 	if err != nil {
-		return fmt.Errorf("error marshalling context for instance %s: %v", instance.ID, err)
+		return nil, fmt.Errorf("error marshalling context for instance %s: %v", instance.ID, err)
 	}
 
-	// Use db.UpdateInstanceCurrentNodeAndContext to create a new node entry and update the main instance
-	newNodeInstanceDBID, err := db.UpdateInstanceCurrentNodeAndContext(instance.ID, nextNodeID, string(ctxJSON), signalString, instance.ExpiresAt)
+	// Create a new node entry and update the main instance
+	newNodeInstanceDBID, err := e.store.UpdateInstanceCurrentNodeAndContext(instance.ID, nextNodeID, string(ctxJSON), signalString, instance.ExpiresAt)
 	if err != nil {
-		return fmt.Errorf("error saving instance %s after advancing to %s: %v", instance.ID, nextNodeID, err)
+		return nil, fmt.Errorf("error saving instance %s after advancing to %s: %v", instance.ID, nextNodeID, err)
 	}
 	instance.CurrentNodeInstanceDBID = newNodeInstanceDBID // Update in memory with the new DB ID
+	e.cancelTimeout(instanceID)
 
-	if instance.CurrentNodeDef.Type != "end" && instance.CurrentNodeDef.Type != "form" && (waitingSignal == nil || *waitingSignal == "") {
-		go func() {
-			execErr := ExecuteNextNode(instanceID)
-			if execErr != nil {
-				log.Printf("Error executing next node %s for instance %s: %v", nextNodeID, instanceID, execErr)
-			}
-		}()
+	return instance, nil
+}
+
+// SubmitForm validates input against the fields of the form node the instance is
+// waiting at, merges it into the instance context and moves on to the form's next node.
+// Validation failures are reported as a *FormValidationError.
+func (e *Engine) SubmitForm(instanceID string, input map[string]string) error {
+	if !e.acceptingWork() {
+		return ErrShuttingDown
 	}
 
+	// The status is checked and the submission saved under the control lock, so an
+	// instance suspended or cancelled meanwhile does not take the submission.
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err != nil {
+		e.control.mu.Unlock()
+		return err
+	}
+
+	if err := checkPendingForm(instance); err != nil {
+		e.control.mu.Unlock()
+		return err
+	}
+
+	if validationErrors := ValidateFormInput(instance.CurrentNodeDef.Fields, input); len(validationErrors) > 0 {
+		e.control.mu.Unlock()
+		return &FormValidationError{Fields: validationErrors}
+	}
+
+	formData := make(map[string]interface{})
+	MergeFormInputIntoContext(formData, instance.CurrentNodeDef.Fields, input)
+
+	err = e.saveFormSubmission(instanceID, instance.CurrentNodeDef.Next, formData)
+	e.control.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	e.executeAfterForm(instanceID, instance.CurrentNodeDef.Next)
+	return nil
+}
+
+// checkPendingForm reports whether instance is active and waiting at a form node.
+func checkPendingForm(instance *WorkflowInstance) error {
+	if instance.Status != StatusActive {
+		return fmt.Errorf("%w: instance %s is %s", ErrInstanceNotActive, instance.ID, instance.Status)
+	}
+	if instance.CurrentNodeDef.Type != "form" || instance.CurrentNodeDef.Fields == nil {
+		return fmt.Errorf("%w: instance %s is at %s node '%s'", ErrNoPendingForm, instance.ID, instance.CurrentNodeDef.Type, instance.CurrentNode)
+	}
 	return nil
 }
 
-// AdvanceInstanceAfterForm updates an instance's context and moves it to the next node.
-// This is specifically for advancing after a form submission.
-func AdvanceInstanceAfterForm(instanceID, nextNodeID string, formData map[string]interface{}) error {
-	instance, err := GetInstanceAndDefinition(instanceID)
+// advanceAfterForm updates an instance's context and moves it to the next node.
+// This is specifically for advancing after a form submission. Like SubmitForm, it
+// refuses instances that are not active or not waiting at a form node.
+func (e *Engine) advanceAfterForm(instanceID, nextNodeID string, formData map[string]interface{}) error {
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err == nil {
+		err = checkPendingForm(instance)
+	}
+	if err == nil {
+		err = e.saveFormSubmission(instanceID, nextNodeID, formData)
+	}
+	e.control.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	e.executeAfterForm(instanceID, nextNodeID)
+	return nil
+}
+
+// saveFormSubmission merges formData into the context of an instance and moves it to
+// nextNodeID. It must be called with e.control.mu held.
+func (e *Engine) saveFormSubmission(instanceID, nextNodeID string, formData map[string]interface{}) error {
+	instance, err := e.GetInstance(instanceID)
 	if err != nil {
 		return fmt.Errorf("failed to load instance %s to advance after form: %w", instanceID, err)
 	}
@@ -321,82 +480,75 @@ func AdvanceInstanceAfterForm(instanceID, nextNodeID string, formData map[string
 		return fmt.Errorf("error marshalling context after form submission for instance %s: %w", instanceID, err)
 	}
 
-	// Use db.UpdateInstanceCurrentNodeAndContext to create a new node entry and update the main instance
-	newNodeInstanceDBID, err := db.UpdateInstanceCurrentNodeAndContext(instance.ID, nextNodeID, string(ctxJSON), "", nil)
-	if err != nil {
+	// Create a new node entry and update the main instance
+	if _, err := e.store.UpdateInstanceCurrentNodeAndContext(instance.ID, nextNodeID, string(ctxJSON), "", nil); err != nil {
 		return fmt.Errorf("error saving instance %s after form submission: %w", instanceID, err)
 	}
-	instance.CurrentNodeInstanceDBID = newNodeInstanceDBID // Update in memory
-
-	log.Printf("Instance %s advanced to node %s after form submission.", instanceID, nextNodeID)
-
-	go func() {
-		execErr := ExecuteNextNode(instanceID)
-		if execErr != nil {
-			log.Printf("Error executing node after form submission for instance %s: %v", instanceID, execErr)
-		}
-	}()
-
+	e.cancelTimeout(instanceID)
 	return nil
 }
 
-func executeScriptNode(instance *WorkflowInstance) error {
-	scriptConfig := instance.CurrentNodeDef.Script
-	if scriptConfig == nil {
-		return fmt.Errorf("script configuration missing for node %s", instance.CurrentNode)
-	}
-
-	newContext, err := scripts.ExecuteScript(scriptConfig.Code, instance.Context)
-	if err != nil {
-		return fmt.Errorf("error executing script for node %s: %v", instance.CurrentNode, err)
-	}
+// executeAfterForm runs the node an instance moved to after a form submission. It is
+// called without e.control.mu held, as an inline executor runs the node right away.
+func (e *Engine) executeAfterForm(instanceID, nextNodeID string) {
+	e.logger.Info("Instance advanced after form submission", "instance", instanceID, "node", nextNodeID)
 
-	instance.Context = newContext
-
-	return advanceInstance(instance.ID, instance.CurrentNodeDef.Next, nil)
+	e.dispatch(instanceID, func() {
+		if execErr := e.executeNextNode(instanceID); execErr != nil {
+			e.logger.Error("Error executing node after form submission", "instance", instanceID, "error", execErr)
+		}
+	})
 }
 
-func executeEndNode(instance *WorkflowInstance) error {
-	log.Printf("Workflow instance %s ended at node %s.", instance.ID, instance.CurrentNode)
+func (e *Engine) executeEndNode(instance *WorkflowInstance) error {
+	e.logger.Info("Workflow instance ended", "instance", instance.ID, "node", instance.CurrentNode)
 
 	endConfig := instance.CurrentNodeDef.End
 	if endConfig != nil && endConfig.Signal != nil && endConfig.Signal.Emit != "" {
-		log.Printf("End node %s for instance %s emitting signal: %s", instance.CurrentNode, instance.ID, endConfig.Signal.Emit)
-		go func() {
-			emitErr := EmitSignal(endConfig.Signal.Emit)
-			if emitErr != nil {
-				log.Printf("Error emitting signal '%s' from end node %s for instance %s: %v", endConfig.Signal.Emit, instance.CurrentNode, instance.ID, emitErr)
+		e.logger.Info("End node emitting signal", "node", instance.CurrentNode, "instance", instance.ID, "signal", endConfig.Signal.Emit)
+		e.dispatch(instance.ID, func() {
+			if emitErr := e.resumeWorkflowsBySignal(endConfig.Signal.Emit, nil); emitErr != nil {
+				e.logger.Error("Error emitting signal from end node", "signal", endConfig.Signal.Emit, "node", instance.CurrentNode, "instance", instance.ID, "error", emitErr)
 			}
-		}()
+		})
 	}
 
 	return nil
 }
 
-// GetInstanceAndDefinition loads a workflow instance and its associated definition,
-// retrieving the current node's definition from the new workflow_instance_nodes table.
-func GetInstanceAndDefinition(instanceID string) (*WorkflowInstance, error) {
+// GetInstance loads a workflow instance and its associated definition,
+// retrieving the current node's definition from the workflow_instance_nodes table.
+// Unknown instances are reported with an error wrapping ErrInstanceNotFound.
+func (e *Engine) GetInstance(instanceID string) (*WorkflowInstance, error) {
 	// First, get the main instance record to find the current_node_instance_id
-	id, workflowID, currentNodeInstanceDBID, contextStr, waitingSignal, expiresAt, createdAt, updatedAt, err := db.GetInstance(instanceID)
+	rec, err := e.store.GetInstance(instanceID)
 	if err != nil {
-		return nil, fmt.Errorf("error getting instance %s from DB: %v", instanceID, err)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
+		}
+		return nil, fmt.Errorf("error getting instance %s from DB: %w", instanceID, err)
 	}
 
-	// Then, get the specific node instance details using currentNodeInstanceDBID
-	_, _, currentNodeDefinitionID, _, _, _, _, _, err := db.GetNodeInstance(currentNodeInstanceDBID)
+	// Then, get the specific node instance details using the current node instance ID
+	nodeRec, err := e.store.GetNodeInstance(rec.CurrentNodeInstanceID)
 	if err != nil {
-		return nil, fmt.Errorf("error getting current node instance details for instance %s (node instance %s): %v", instanceID, currentNodeInstanceDBID, err)
+		return nil, fmt.Errorf("error getting current node instance details for instance %s (node instance %s): %w", instanceID, rec.CurrentNodeInstanceID, err)
 	}
 
-	// Load the overall workflow definition
-	wf, err := GetWorkflowDefinition(workflowID)
+	// Load the workflow definition the instance was started with
+	var wf *Workflow
+	if rec.WorkflowVersion > 0 {
+		wf, err = e.DefinitionVersion(rec.WorkflowID, rec.WorkflowVersion)
+	} else {
+		wf, err = e.Definition(rec.WorkflowID)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("error getting workflow definition for instance %s (workflow %s): %v", instanceID, workflowID, err)
+		return nil, fmt.Errorf("error getting workflow definition for instance %s (workflow %s): %w", instanceID, rec.WorkflowID, err)
 	}
 
 	var ctx map[string]interface{}
-	if contextStr != "" {
-		err = json.Unmarshal([]byte(contextStr), &ctx)
+	if rec.Context != "" {
+		err = json.Unmarshal([]byte(rec.Context), &ctx)
 		if err != nil {
 			return nil, fmt.Errorf("error unmarshalling context for instance %s: %v", instanceID, err)
 		}
@@ -405,26 +557,42 @@ func GetInstanceAndDefinition(instanceID string) (*WorkflowInstance, error) {
 	}
 
 	instance := &WorkflowInstance{
-		ID:                      id,
-		WorkflowID:              workflowID,
-		CurrentNode:             currentNodeDefinitionID, // This is the node definition ID
-		CurrentNodeInstanceDBID: currentNodeInstanceDBID, // This is the UUID from workflow_instance_nodes
+		ID:                      rec.ID,
+		WorkflowID:              rec.WorkflowID,
+		BusinessKey:             rec.BusinessKey,
+		ParentInstanceID:        rec.ParentInstanceID,
+		Status:                  rec.Status,
+		StatusReason:            rec.StatusReason,
+		Incident:                rec.Incident,
+		CurrentNode:             nodeRec.NodeID,            // This is the node definition ID
+		CurrentNodeInstanceDBID: rec.CurrentNodeInstanceID, // This is the ID from workflow_instance_nodes
 		Context:                 ctx,
-		WaitingSignal:           waitingSignal,
-		ExpiresAt:               expiresAt,
-		CreatedAt:               createdAt,
-		UpdatedAt:               updatedAt,
+		WaitingSignal:           rec.WaitingSignal,
+		ExpiresAt:               rec.ExpiresAt,
+		CreatedAt:               rec.CreatedAt,
+		UpdatedAt:               rec.UpdatedAt,
 		WorkflowDef:             wf,
-		CurrentNodeDef:          wf.GetNodeByID(currentNodeDefinitionID),
+		CurrentNodeDef:          wf.GetNodeByID(nodeRec.NodeID),
 	}
 
 	if instance.CurrentNodeDef == nil {
-		return nil, fmt.Errorf("current node definition '%s' not found in workflow definition for instance %s", currentNodeDefinitionID, instanceID)
+		return nil, fmt.Errorf("current node definition '%s' not found in workflow definition for instance %s", nodeRec.NodeID, instanceID)
 	}
 
 	return instance, nil
 }
 
+// History returns the node executions of an instance in the order they were recorded.
+func (e *Engine) History(instanceID string) ([]db.NodeInstanceRecord, error) {
+	if _, err := e.store.GetInstance(instanceID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
+		}
+		return nil, fmt.Errorf("error getting instance %s from DB: %w", instanceID, err)
+	}
+	return e.store.GetNodeHistory(instanceID)
+}
+
 // GetNodeByID is a helper method on Workflow to find a node by its ID.
 func (wf *Workflow) GetNodeByID(nodeID string) *WorkflowNode {
 	for i := range wf.Nodes {
@@ -434,4 +602,4 @@ func (wf *Workflow) GetNodeByID(nodeID string) *WorkflowNode {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
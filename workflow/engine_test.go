@@ -0,0 +1,147 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"jbpmn-engine/clock"
+	"jbpmn-engine/db"
+)
+
+// epoch is the time the fake clock of every test engine starts at.
+var epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testEngine is an engine backed by an in-memory store and a fake clock. Instances
+// run inline unless another executor is given.
+type testEngine struct {
+	*Engine
+	store *db.SQLiteStore
+	clock *clock.Fake
+}
+
+func newTestEngine(t *testing.T, opts ...Option) *testEngine {
+	t.Helper()
+	store, err := db.OpenInMemory()
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	fake := clock.NewFake(epoch)
+	store.SetClock(fake)
+	return reopenTestEngine(t, store, fake, opts...)
+}
+
+// reopenTestEngine creates another engine on the store and clock of an earlier one,
+// as after a restart.
+func reopenTestEngine(t *testing.T, store *db.SQLiteStore, fake *clock.Fake, opts ...Option) *testEngine {
+	t.Helper()
+	e, err := New(append([]Option{
+		WithStore(store),
+		WithClock(fake),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+		WithExecutor(&InlineExecutor{}),
+	}, opts...)...)
+	if err != nil {
+		t.Fatalf("creating engine: %v", err)
+	}
+	t.Cleanup(func() { e.Shutdown(context.Background()) })
+	return &testEngine{Engine: e, store: store, clock: fake}
+}
+
+// deploy deploys a definition, failing the test if it is invalid.
+func (e *testEngine) deploy(t *testing.T, definition string) {
+	t.Helper()
+	if _, _, err := e.Deploy([]byte(definition), "test"); err != nil {
+		t.Fatalf("deploying definition: %v", err)
+	}
+}
+
+// start starts an instance of workflowID, failing the test if it cannot.
+func (e *testEngine) start(t *testing.T, workflowID string) *WorkflowInstance {
+	t.Helper()
+	instance, err := e.Start(context.Background(), workflowID, StartOptions{})
+	if err != nil {
+		t.Fatalf("starting %s: %v", workflowID, err)
+	}
+	return instance
+}
+
+// instance loads an instance, failing the test if it cannot.
+func (e *testEngine) instance(t *testing.T, id string) *WorkflowInstance {
+	t.Helper()
+	instance, err := e.GetInstance(id)
+	if err != nil {
+		t.Fatalf("loading instance %s: %v", id, err)
+	}
+	return instance
+}
+
+const isolatedDefinition = `{
+  "id": "isolated",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "ask"},
+    {"id": "ask", "type": "form", "fields": [{"id": "ok", "name": "OK", "type": "text"}], "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+// newIsolatedEngine creates an engine with its own database and definition directory,
+// which holds the given definitions by workflow ID.
+func newIsolatedEngine(t *testing.T, definitions map[string]string) *Engine {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := db.Open(filepath.Join(dir, "engine.db"))
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	for id, definition := range definitions {
+		if err := os.WriteFile(filepath.Join(dir, id+".json"), []byte(definition), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, err := New(
+		WithStore(store),
+		WithDefinitionSource(NewDirSource(dir)),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))),
+	)
+	if err != nil {
+		t.Fatalf("creating engine: %v", err)
+	}
+	t.Cleanup(func() { e.Shutdown(context.Background()) })
+	return e
+}
+
+func TestEnginesAreIsolated(t *testing.T) {
+	first := newIsolatedEngine(t, map[string]string{"isolated": isolatedDefinition})
+	second := newIsolatedEngine(t, nil)
+
+	instance, err := first.Start(context.Background(), "isolated", StartOptions{})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if _, err := second.Start(context.Background(), "isolated", StartOptions{}); err == nil {
+		t.Error("the second engine started a definition only the first one has")
+	}
+	if _, err := second.GetInstance(instance.ID); !errors.Is(err, ErrInstanceNotFound) {
+		t.Errorf("GetInstance on the second engine = %v, want ErrInstanceNotFound", err)
+	}
+	if _, err := first.GetInstance(instance.ID); err != nil {
+		t.Errorf("GetInstance on the first engine: %v", err)
+	}
+
+	// Shutting one engine down leaves the other accepting work.
+	if _, err := second.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := first.Start(context.Background(), "isolated", StartOptions{}); err != nil {
+		t.Errorf("Start on the first engine after the second shut down: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+package workflow
+
+import "sync"
+
+// Executor runs the node executions scheduled by an Engine.
+type Executor interface {
+	Execute(task func())
+}
+
+// GoExecutor runs every task in its own goroutine.
+type GoExecutor struct{}
+
+// Execute starts task in a new goroutine.
+func (GoExecutor) Execute(task func()) {
+	go task()
+}
+
+// InlineExecutor runs tasks on the calling goroutine, which makes node transitions
+// deterministic in tests: when Execute returns, the task and every task it scheduled
+// in turn have run to completion. Tasks scheduled while another task is running are
+// queued and run in order by the outermost Execute call instead of recursing.
+type InlineExecutor struct {
+	mu      sync.Mutex
+	queue   []func()
+	running bool
+}
+
+// Execute runs task, and anything it schedules, before returning. If called while
+// another goroutine is draining the queue, task is queued there instead.
+func (x *InlineExecutor) Execute(task func()) {
+	x.mu.Lock()
+	x.queue = append(x.queue, task)
+	if x.running {
+		x.mu.Unlock()
+		return
+	}
+	x.running = true
+	for len(x.queue) > 0 {
+		next := x.queue[0]
+		x.queue = x.queue[1:]
+		x.mu.Unlock()
+		next()
+		x.mu.Lock()
+	}
+	x.running = false
+	x.mu.Unlock()
+}
+
+// PoolExecutor runs tasks on a fixed number of worker goroutines, which bounds how
+// many node executions, e.g. scripts, run at once. Tasks wait in an unbounded queue,
+// so a task may schedule further tasks without blocking its worker.
+type PoolExecutor struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []func()
+	stopped bool
+	done    sync.WaitGroup
+}
+
+// NewPoolExecutor starts a PoolExecutor with the given number of workers.
+func NewPoolExecutor(workers int) *PoolExecutor {
+	x := &PoolExecutor{}
+	x.cond = sync.NewCond(&x.mu)
+	x.done.Add(workers)
+	for i := 0; i < workers; i++ {
+		go x.work()
+	}
+	return x
+}
+
+// Execute queues task for the next idle worker.
+func (x *PoolExecutor) Execute(task func()) {
+	x.mu.Lock()
+	x.queue = append(x.queue, task)
+	x.mu.Unlock()
+	x.cond.Signal()
+}
+
+// Stop lets the workers finish the queued tasks and waits for them to exit. Tasks
+// queued after Stop are not run.
+func (x *PoolExecutor) Stop() {
+	x.mu.Lock()
+	x.stopped = true
+	x.mu.Unlock()
+	x.cond.Broadcast()
+	x.done.Wait()
+}
+
+func (x *PoolExecutor) work() {
+	defer x.done.Done()
+	x.mu.Lock()
+	for {
+		for len(x.queue) == 0 && !x.stopped {
+			x.cond.Wait()
+		}
+		if len(x.queue) == 0 {
+			x.mu.Unlock()
+			return
+		}
+		task := x.queue[0]
+		x.queue = x.queue[1:]
+		x.mu.Unlock()
+		task()
+		x.mu.Lock()
+	}
+}
@@ -0,0 +1,32 @@
+package workflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInlineExecutorQueuesNestedTasks(t *testing.T) {
+	x := &InlineExecutor{}
+	var order []string
+	x.Execute(func() {
+		order = append(order, "outer start")
+		x.Execute(func() {
+			order = append(order, "first nested")
+			x.Execute(func() { order = append(order, "nested in nested") })
+		})
+		x.Execute(func() { order = append(order, "second nested") })
+		// Nested tasks wait for the running task instead of recursing.
+		order = append(order, "outer end")
+	})
+	want := []string{"outer start", "outer end", "first nested", "second nested", "nested in nested"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("ran %v, want %v", order, want)
+	}
+
+	// Once the queue is drained, the next Execute runs its task itself.
+	ran := false
+	x.Execute(func() { ran = true })
+	if !ran {
+		t.Error("task given after the queue was drained did not run")
+	}
+}
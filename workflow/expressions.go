@@ -0,0 +1,104 @@
+package workflow
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"jbpmn-engine/expr"
+)
+
+// variableTypes returns the types of the variables wf declares in its input, for
+// checking the expressions that use them.
+func (wf *Workflow) variableTypes() map[string]expr.Type {
+	types := make(map[string]expr.Type, len(wf.Input))
+	for _, v := range wf.Input {
+		types[v.Name] = expr.ParseType(v.Type)
+	}
+	return types
+}
+
+// legacyCondition matches conditions such as "status == approved", written before
+// conditions were expressions, which compare a variable with an unquoted word.
+var legacyCondition = regexp.MustCompile(`^\s*([A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*)\s*(==|!=)\s*([A-Za-z_$][\w$]*)\s*$`)
+
+// conditionSource returns the expression of a when clause. For compatibility, an
+// unquoted word compared with == or != is still a string unless the definition
+// declares a variable of that name. Warnings reports such conditions.
+func conditionSource(when string, types map[string]expr.Type) string {
+	if word, ok := legacyWord(when, types); ok {
+		m := legacyCondition.FindStringSubmatch(when)
+		return m[1] + " " + m[2] + " " + strconv.Quote(word)
+	}
+	return when
+}
+
+// legacyWord returns the unquoted word a legacy condition compares with, if when is
+// one whose word conditionSource takes as a string.
+func legacyWord(when string, types map[string]expr.Type) (string, bool) {
+	m := legacyCondition.FindStringSubmatch(when)
+	if m == nil {
+		return "", false
+	}
+	switch word := m[3]; word {
+	case "true", "false", "null":
+		return "", false
+	default:
+		if _, declared := types[word]; declared {
+			return "", false
+		}
+		return word, true
+	}
+}
+
+// compileCondition compiles the when clause of a gateway condition of wf.
+func (wf *Workflow) compileCondition(when string) (*expr.Program, error) {
+	types := wf.variableTypes()
+	return expr.Compile(conditionSource(when, types), types)
+}
+
+// expression returns the compiled form of source. Programs are cached by source like
+// scripts are, so a condition is parsed once however often it is evaluated, and like
+// scripts only the most recently used are kept. Type errors are reported by Validate
+// when the definition is loaded.
+func (e *Engine) expression(source string) (*expr.Program, error) {
+	if cached, ok := e.expressions.Get(source); ok {
+		return cached, nil
+	}
+	program, err := expr.Compile(source, nil)
+	if err != nil {
+		return nil, err
+	}
+	e.expressions.Add(source, program)
+	return program, nil
+}
+
+// evaluateCondition evaluates the when clause of a gateway condition of wf.
+func (e *Engine) evaluateCondition(wf *Workflow, when string, vars map[string]interface{}) (bool, error) {
+	program, err := e.expression(conditionSource(when, wf.variableTypes()))
+	if err != nil {
+		return false, err
+	}
+	return program.EvalBool(vars)
+}
+
+// mapVariables returns a variable for every entry of mapping, named by its key and
+// set to the value of the expression in its value, e.g. "order?.items[0].sku",
+// evaluated with the variables of from. Entries whose value is null are left out.
+func (e *Engine) mapVariables(mapping map[string]string, from map[string]interface{}) (map[string]interface{}, error) {
+	mapped := make(map[string]interface{}, len(mapping))
+	for _, name := range sortedKeys(mapping) {
+		program, err := e.expression(mapping[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		value, err := program.Eval(from)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if value != nil {
+			mapped[name] = value
+		}
+	}
+	return mapped, nil
+}
@@ -0,0 +1,87 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestExpressionCacheIsBounded(t *testing.T) {
+	e := newTestEngine(t)
+	e.expressions.Size = 2
+	mapping := map[string]string{"a": "x + 1", "b": "x + 2", "c": "x + 3"}
+	mapped, err := e.mapVariables(mapping, map[string]interface{}{"x": 1})
+	if err != nil {
+		t.Fatalf("mapVariables: %v", err)
+	}
+	if mapped["c"] == nil || e.expressions.Len() != 2 {
+		t.Errorf("mapped %v with %d expressions cached, want 2", mapped, e.expressions.Len())
+	}
+}
+
+// routeOrder labels an order with expressions and routes it on them.
+const routeOrder = `{
+  "id": "route_order",
+  "input": [{"name": "amount", "type": "number"}, {"name": "order", "type": "object"}],
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "label"},
+    {"id": "label", "type": "script", "script": {
+      "code": "return {label: process_data.sku || null};",
+      "inputs": {"sku": "upper(order?.items[0].sku)"},
+      "outputs": {"label": "label ?? 'none'"}
+    }, "next": "route"},
+    {"id": "route", "type": "gateway", "conditions": [
+      {"when": "status == rush", "next": "rush"},
+      {"when": "amount >= 1000 && region in ['EU', 'UK']", "next": "review"},
+      {"when": "startsWith(label, 'GIFT')", "next": "gift"},
+      {"else": true, "next": "standard"}
+    ]},
+    {"id": "rush", "type": "end"},
+    {"id": "review", "type": "end"},
+    {"id": "gift", "type": "end"},
+    {"id": "standard", "type": "end"}
+  ]
+}`
+
+func TestExpressions(t *testing.T) {
+	e := newTestEngine(t)
+	e.deploy(t, routeOrder)
+
+	tests := []struct {
+		variables   map[string]interface{}
+		node, label string
+	}{
+		{map[string]interface{}{"status": "rush"}, "rush", "none"},
+		{map[string]interface{}{"amount": 1500, "region": "EU"}, "review", "none"},
+		{map[string]interface{}{"amount": 1500, "region": "US"}, "standard", "none"},
+		{map[string]interface{}{"amount": 5, "order": map[string]interface{}{"items": []interface{}{map[string]interface{}{"sku": "gift-1"}}}}, "gift", "GIFT-1"},
+		// amount >= 1000 cannot be evaluated without an amount, so it is skipped.
+		{map[string]interface{}{"status": "late"}, "standard", "none"},
+	}
+	for _, tt := range tests {
+		instance, err := e.Start(context.Background(), "route_order", StartOptions{Variables: tt.variables})
+		if err != nil {
+			t.Fatalf("%v: Start: %v", tt.variables, err)
+		}
+		if instance.CurrentNode != tt.node || instance.Context["label"] != tt.label || instance.Incident != "" {
+			t.Errorf("%v: instance is at %s with label %v and incident %q, want %s with %s", tt.variables, instance.CurrentNode, instance.Context["label"], instance.Incident, tt.node, tt.label)
+		}
+	}
+}
+
+func TestExpressionsAreTypeChecked(t *testing.T) {
+	tests := []struct{ from, to, path, want string }{
+		{`"amount >= 1000`, `"amount == 'big'`, "nodes[2].conditions[1].when", "compares a number with a string"},
+		{`"startsWith(label, 'GIFT')"`, `"len(label)"`, "nodes[2].conditions[2].when", "must be a boolean"},
+		{`"upper(order?.items[0].sku)"`, `"upper(amount)"`, "nodes[1].script.inputs.sku", "upper needs a string, but amount is a number"},
+		{`"label ?? 'none'"`, `"label ??"`, "nodes[1].script.outputs.label", "expected a value"},
+	}
+	for _, tt := range tests {
+		_, err := ParseDefinition([]byte(strings.Replace(routeOrder, tt.from, tt.to, 1)))
+		var defErr *DefinitionError
+		if !errors.As(err, &defErr) || len(defErr.Issues) != 1 || defErr.Issues[0].Path != tt.path || !strings.Contains(defErr.Issues[0].Message, tt.want) {
+			t.Errorf("%s: error = %v, want %q at %s", tt.to, err, tt.want, tt.path)
+		}
+	}
+}
@@ -10,11 +10,11 @@ import (
 // It now takes []FormField directly instead of *FormConfig.
 func GenerateHTMLForm(formFields []FormField, context map[string]interface{}, instanceID string, errors map[string]string) (template.HTML, error) {
 	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf(`<form action="/form/%s" method="POST">`, instanceID))
+	sb.WriteString(fmt.Sprintf(`<form action="/api/v1/instances/%s/form" method="POST">`, instanceID))
 	sb.WriteString(`<table>`) // Use a table for better alignment, or div/flexbox for modern styling
 
 	for _, field := range formFields { // Loop directly over formFields
-		fieldName := field.Name
+		fieldName := field.Key()
 		fieldValue := ""
 		if val, ok := context[fieldName]; ok {
 			fieldValue = fmt.Sprintf("%v", val) // Convert any type to string
@@ -43,7 +43,7 @@ func GenerateHTMLForm(formFields []FormField, context map[string]interface{}, in
 		// Add more input types as needed (checkbox, radio, select)
 		default:
 			sb.WriteString(fmt.Sprintf(`<input type="text" id="%s" name="%s" value="%s" %s>`,
-				field.Type, fieldName, fieldName, template.HTMLEscapeString(fieldValue), requiredAttr)) // Default to field.Type, not just "text"
+				fieldName, fieldName, template.HTMLEscapeString(fieldValue), requiredAttr))
 		}
 		if errorMsg != "" {
 			sb.WriteString(fmt.Sprintf(`<span style="color: red;">%s</span>`, template.HTMLEscapeString(errorMsg)))
@@ -64,10 +64,10 @@ func ValidateFormInput(formFields []FormField, input map[string]string) map[stri
 	errors := make(map[string]string)
 
 	for _, field := range formFields {
-		value, exists := input[field.Name]
+		value, exists := input[field.Key()]
 
 		if field.Required && (!exists || strings.TrimSpace(value) == "") {
-			errors[field.Name] = "This field is required."
+			errors[field.Key()] = "This field is required."
 			continue // Don't check type if required field is missing
 		}
 
@@ -76,12 +76,12 @@ func ValidateFormInput(formFields []FormField, input map[string]string) map[stri
 			case "number":
 				_, err := fmt.Sscanf(value, "%f", new(float64)) // Check if it's a valid number
 				if err != nil {
-					errors[field.Name] = "Must be a valid number."
+					errors[field.Key()] = "Must be a valid number."
 				}
 			case "email":
 				// Basic email validation (can be enhanced with regex)
 				if !strings.Contains(value, "@") || !strings.Contains(value, ".") {
-					errors[field.Name] = "Must be a valid email address."
+					errors[field.Key()] = "Must be a valid email address."
 				}
 			// Add more type validations as needed
 			}
@@ -94,19 +94,19 @@ func ValidateFormInput(formFields []FormField, input map[string]string) map[stri
 // Input map values are string, context values can be various types based on form field type.
 func MergeFormInputIntoContext(context map[string]interface{}, formFields []FormField, input map[string]string) { // Loop directly over formFields
 	for _, field := range formFields {
-		if val, ok := input[field.Name]; ok {
+		if val, ok := input[field.Key()]; ok {
 			switch field.Type {
 			case "number":
 				var num float64
 				if _, err := fmt.Sscanf(val, "%f", &num); err == nil {
-					context[field.Name] = num
+					context[field.Key()] = num
 				} else {
-					context[field.Name] = val // Keep as string if conversion fails, or handle error
+					context[field.Key()] = val // Keep as string if conversion fails, or handle error
 				}
 			case "text", "email", "textarea":
-				context[field.Name] = val
+				context[field.Key()] = val
 			default:
-				context[field.Name] = val
+				context[field.Key()] = val
 			}
 		}
 	}
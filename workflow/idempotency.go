@@ -0,0 +1,214 @@
+package workflow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DefaultIdempotencyRetention is how long idempotency keys are remembered unless
+// WithIdempotencyRetention sets another window.
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// WithIdempotencyRetention sets how long idempotency keys are remembered. A retried
+// request with the same key after this window is treated as a new request.
+func WithIdempotencyRetention(d time.Duration) Option {
+	return func(e *Engine) {
+		e.idempotencyRetention = d
+	}
+}
+
+// ErrIdempotencyKeyConflict is returned when an idempotency key is reused for a
+// request that differs from the first one, or whose first request is still being
+// handled elsewhere.
+var ErrIdempotencyKeyConflict = errors.New("idempotency key conflict")
+
+// fingerprint hashes the content of a request, so a key reused for another request
+// can be told from a retry. Maps are encoded with sorted keys.
+func fingerprint(request interface{}) string {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// claimKey records key for scope on behalf of instanceID, the instance a start
+// creates, or for other scopes a token of the request. It returns the instance or
+// token recorded by an earlier request with the same key, and whether this call
+// claimed it. Requests still running keep a channel under it in e.starting.
+// A key held by a request with another fingerprint is an ErrIdempotencyKeyConflict;
+// keys recorded before fingerprints were are accepted for any request.
+func (e *Engine) claimKey(scope, key, digest, instanceID string) (string, bool, error) {
+	owner, ownerDigest, claimed, err := e.store.ClaimIdempotencyKey(scope, key, digest, instanceID, e.clock.Now().Add(-e.idempotencyRetention))
+	if err != nil {
+		return "", false, err
+	}
+	if !claimed && ownerDigest != "" && ownerDigest != digest {
+		return "", false, fmt.Errorf("%w: key '%s' was already used for a different request", ErrIdempotencyKeyConflict, key)
+	}
+	return owner, claimed, nil
+}
+
+// releaseKey forgets a key whose request failed so the client can retry it.
+func (e *Engine) releaseKey(scope, key string) {
+	if err := e.store.ReleaseIdempotencyKey(scope, key); err != nil {
+		e.logger.Error("Error releasing idempotency key", "scope", scope, "error", err)
+	}
+}
+
+// StartOnce is Start guarded by an idempotency key: a repeated call with the same
+// key, workflow and options within the retention window returns the instance created
+// by the first call, once it has reached a wait state, and reports replayed. A
+// repeated call that arrives while the first is still starting the instance waits
+// for it. Reusing the key with other options is an ErrIdempotencyKeyConflict. An
+// empty key always starts a new instance.
+func (e *Engine) StartOnce(ctx context.Context, key, workflowID string, opts StartOptions) (instance *WorkflowInstance, replayed bool, err error) {
+	if key == "" {
+		instance, err = e.Start(ctx, workflowID, opts)
+		return instance, false, err
+	}
+	if !e.acceptingWork() {
+		return nil, false, ErrShuttingDown
+	}
+
+	scope := "start:" + workflowID
+	digest := fingerprint(opts)
+	instanceID := newInstanceID()
+	starting := make(chan struct{})
+	e.starting.Store(instanceID, starting)
+	defer func() {
+		e.starting.Delete(instanceID)
+		close(starting)
+	}()
+
+	// A first request that fails releases its key, so a retry that waited for it
+	// claims the key itself on its second attempt.
+	for attempt := 1; ; attempt++ {
+		owner, claimed, err := e.claimKey(scope, key, digest, instanceID)
+		if err != nil {
+			return nil, false, err
+		}
+		if claimed {
+			break
+		}
+		e.logger.Info("Replaying start for idempotency key", "workflow", workflowID, "instance", owner)
+		if first, ok := e.starting.Load(owner); ok {
+			select {
+			case <-first.(chan struct{}):
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+		if err := e.waitIdle(ctx, owner); err != nil {
+			e.logger.Warn("Replayed instance has not reached a wait state yet", "instance", owner, "error", err)
+		}
+		instance, err = e.GetInstance(owner)
+		switch {
+		case err == nil:
+			return instance, true, nil
+		case !errors.Is(err, ErrInstanceNotFound):
+			return nil, false, err
+		case attempt > 1:
+			return nil, false, fmt.Errorf("%w: the request that first used key '%s' has not created its instance yet", ErrIdempotencyKeyConflict, key)
+		}
+	}
+
+	instance, err = e.start(ctx, instanceID, workflowID, opts)
+	if err != nil {
+		e.releaseKey(scope, key)
+		return nil, false, err
+	}
+	return instance, false, nil
+}
+
+// once runs request unless an earlier request with the same key, scope and digest
+// did, in which case it reports replayed. A repeated request that arrives while the
+// first is still running waits for it: if the first fails, it releases the key and
+// the repeated request runs itself, so it gets the outcome of its own attempt
+// instead of being told a failed request succeeded. Requests holding the key in
+// another engine sharing the store cannot be waited for and count as done.
+func (e *Engine) once(ctx context.Context, scope, key, digest string, request func() error) (replayed bool, err error) {
+	owner := newInstanceID()
+	running := make(chan struct{})
+	e.starting.Store(owner, running)
+	defer func() {
+		e.starting.Delete(owner)
+		close(running)
+	}()
+
+	for {
+		holder, claimed, err := e.claimKey(scope, key, digest, owner)
+		if err != nil {
+			return false, err
+		}
+		if claimed {
+			break
+		}
+		first, ok := e.starting.Load(holder)
+		if !ok {
+			return true, nil
+		}
+		select {
+		case <-first.(chan struct{}):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	if err := request(); err != nil {
+		e.releaseKey(scope, key)
+		return false, err
+	}
+	return false, nil
+}
+
+// SignalOnce is Signal guarded by an idempotency key: a repeated call with the same
+// key and signal within the retention window does not resume anything again and
+// reports replayed. A repeated call that arrives while the first is still emitting
+// the signal waits for it, see once. An empty key always emits the signal.
+func (e *Engine) SignalOnce(ctx context.Context, key, signalName string) (replayed bool, err error) {
+	if key == "" {
+		return false, e.Signal(signalName)
+	}
+	if !e.acceptingWork() {
+		return false, ErrShuttingDown
+	}
+
+	replayed, err = e.once(ctx, "signal:"+signalName, key, "", func() error {
+		return e.Signal(signalName)
+	})
+	if replayed {
+		e.logger.Info("Ignoring repeated signal for idempotency key", "signal", signalName)
+	}
+	return replayed, err
+}
+
+// SubmitFormOnce is SubmitForm guarded by an idempotency key: a repeated submission
+// to the same instance with the same key and input within the retention window is not
+// applied again and reports replayed, even though the instance has moved past the
+// form. A repeated submission that arrives while the first is still being applied
+// waits for it, see once. Reusing the key with other input is an
+// ErrIdempotencyKeyConflict. Failed submissions, including validation failures, do
+// not consume the key.
+func (e *Engine) SubmitFormOnce(ctx context.Context, key, instanceID string, input map[string]string) (replayed bool, err error) {
+	if key == "" {
+		return false, e.SubmitForm(instanceID, input)
+	}
+	if !e.acceptingWork() {
+		return false, ErrShuttingDown
+	}
+
+	replayed, err = e.once(ctx, "form:"+instanceID, key, fingerprint(input), func() error {
+		return e.SubmitForm(instanceID, input)
+	})
+	if replayed {
+		e.logger.Info("Ignoring repeated form submission for idempotency key", "instance", instanceID)
+	}
+	return replayed, err
+}
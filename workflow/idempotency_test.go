@@ -0,0 +1,104 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const ageFormDefinition = `{
+  "id": "age",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "ask"},
+    {"id": "ask", "type": "form", "fields": [{"id": "age", "name": "age", "type": "number", "required": true}], "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+type submission struct {
+	replayed bool
+	err      error
+}
+
+// submitConcurrently submits input twice with the same idempotency key, the second
+// time while the first submission holds the key but waits for the control lock.
+func submitConcurrently(t *testing.T, e *testEngine, id string, input map[string]string) []submission {
+	t.Helper()
+	results := make(chan submission, 2)
+	submit := func() {
+		replayed, err := e.SubmitFormOnce(context.Background(), "submit-1", id, input)
+		results <- submission{replayed, err}
+	}
+
+	e.control.mu.Lock()
+	go submit()
+	waitFor(t, func() bool { return countStarting(e) == 1 })
+	time.Sleep(20 * time.Millisecond) // let the first submission claim the key
+	go submit()
+	waitFor(t, func() bool { return countStarting(e) == 2 })
+	time.Sleep(20 * time.Millisecond) // let the second find the key held
+	e.control.mu.Unlock()
+
+	return []submission{<-results, <-results}
+}
+
+func countStarting(e *testEngine) int {
+	n := 0
+	e.starting.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+	}
+}
+
+func TestRepeatedSubmissionGetsOutcomeOfFailedFirst(t *testing.T) {
+	e := newTestEngine(t)
+	e.deploy(t, ageFormDefinition)
+	id := e.start(t, "age").ID
+
+	for i, s := range submitConcurrently(t, e, id, map[string]string{"age": "old"}) {
+		var invalid *FormValidationError
+		if s.replayed || !errors.As(s.err, &invalid) {
+			t.Errorf("submission %d = %v, %v; want a *FormValidationError", i, s.replayed, s.err)
+		}
+	}
+	if got := e.instance(t, id); got.CurrentNode != "ask" {
+		t.Errorf("instance is at %s, want ask", got.CurrentNode)
+	}
+	// Neither failed submission consumed the key.
+	if replayed, err := e.SubmitFormOnce(context.Background(), "submit-1", id, map[string]string{"age": "40"}); replayed || err != nil {
+		t.Errorf("corrected submission = %v, %v", replayed, err)
+	}
+}
+
+func TestRepeatedSubmissionWaitsForFirst(t *testing.T) {
+	e := newTestEngine(t)
+	e.deploy(t, ageFormDefinition)
+	id := e.start(t, "age").ID
+
+	replayed := 0
+	for i, s := range submitConcurrently(t, e, id, map[string]string{"age": "40"}) {
+		if s.err != nil {
+			t.Errorf("submission %d = %v", i, s.err)
+		}
+		if s.replayed {
+			replayed++
+		}
+	}
+	if replayed != 1 {
+		t.Errorf("%d submissions replayed, want 1", replayed)
+	}
+	if got := e.instance(t, id); got.CurrentNode != "done" {
+		t.Errorf("instance is at %s, want done", got.CurrentNode)
+	}
+}
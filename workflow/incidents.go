@@ -0,0 +1,88 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"jbpmn-engine/db"
+)
+
+// ErrNoIncident is returned when retrying an instance whose last node execution did
+// not fail.
+var ErrNoIncident = errors.New("workflow instance has no incident")
+
+// raiseIncident records that executing the current node of instance failed. The
+// instance stays at the node until it is retried or moved.
+func (e *Engine) raiseIncident(instance *WorkflowInstance, execErr error) {
+	message := execErr.Error()
+	if err := e.store.SetInstanceIncident(instance.ID, message); err != nil {
+		e.logger.Error("Error recording incident", "instance", instance.ID, "node", instance.CurrentNode, "error", err)
+		return
+	}
+	if err := e.store.RecordInstanceEvent(instance.ID, instance.CurrentNode, "incident", "", message); err != nil {
+		e.logger.Error("Error recording incident in history", "instance", instance.ID, "node", instance.CurrentNode, "error", err)
+	}
+}
+
+// Retry executes the node an instance failed at again, e.g. once a service its script
+// depends on is back. The attempt is recorded in the history with the operator; to
+// correct the instance's data first, use Move with Execute instead. Like Start, Retry
+// waits for the instance to reach its next wait state or for ctx to be done.
+// Instances without an incident are reported with ErrNoIncident.
+func (e *Engine) Retry(ctx context.Context, instanceID, operator string) (*WorkflowInstance, error) {
+	if !e.acceptingWork() {
+		return nil, ErrShuttingDown
+	}
+
+	e.control.mu.Lock()
+	instance, err := e.GetInstance(instanceID)
+	if err != nil {
+		e.control.mu.Unlock()
+		return nil, err
+	}
+	if instance.Status != StatusActive {
+		e.control.mu.Unlock()
+		return nil, fmt.Errorf("%w: instance %s is %s", ErrInstanceNotActive, instanceID, instance.Status)
+	}
+	if instance.Incident == "" {
+		e.control.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNoIncident, instanceID)
+	}
+	err = e.store.SetInstanceIncident(instanceID, "")
+	if err == nil {
+		err = e.store.RecordInstanceEvent(instanceID, instance.CurrentNode, "retried", operator, instance.Incident)
+	}
+	e.control.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	e.logger.Info("Retrying failed node", "instance", instanceID, "node", instance.CurrentNode, "operator", operator)
+	e.dispatch(instanceID, func() {
+		if execErr := e.executeNextNode(instanceID); execErr != nil {
+			e.logger.Error("Retried node failed again", "instance", instanceID, "node", instance.CurrentNode, "error", execErr)
+		}
+	})
+	if err := e.waitIdle(ctx, instanceID); err != nil {
+		e.logger.Warn("Retried instance has not reached a wait state yet; returning its current state", "instance", instanceID, "error", err)
+	}
+	return e.GetInstance(instanceID)
+}
+
+// Instances returns the instances matching filter, most recently created first.
+func (e *Engine) Instances(filter db.InstanceFilter) ([]*WorkflowInstance, error) {
+	records, err := e.store.ListInstances(filter)
+	if err != nil {
+		return nil, fmt.Errorf("error listing instances: %w", err)
+	}
+	instances := make([]*WorkflowInstance, 0, len(records))
+	for _, rec := range records {
+		instance, err := e.GetInstance(rec.ID)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
@@ -0,0 +1,163 @@
+package workflow
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"jbpmn-engine/scripts"
+)
+
+// WithScriptLibraries sets the directory script libraries are read from: a definition
+// listing "lib/pricing" in its libraries lets its scripts require("lib/pricing"), read
+// from <dir>/lib/pricing.js.
+func WithScriptLibraries(dir string) Option {
+	return func(e *Engine) {
+		e.libraryDir = dir
+	}
+}
+
+// parseDefinition parses and validates the definition read from location and bundles
+// the libraries and script files it uses. It returns the document to store, which
+// holds their source, so that a changed library or script file makes a new version of
+// the definition and instances keep the code they started with.
+func (e *Engine) parseDefinition(data []byte, location string) (*Workflow, []byte, error) {
+	wf, err := parseDefinitionAt(data, location)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = e.bundleLibraries(wf, data)
+	if err == nil {
+		data, err = e.bundleScriptFiles(wf, data, location)
+	}
+	var defErr *DefinitionError
+	if errors.As(err, &defErr) {
+		defErr.Location = location
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return wf, data, nil
+}
+
+// ValidateDefinition checks a definition like Deploy does, including that the
+// libraries it lists exist and compile, without storing it. Invalid definitions are
+// reported as a *DefinitionError.
+func (e *Engine) ValidateDefinition(data []byte) (*Workflow, error) {
+	wf, _, err := e.parseDefinition(data, "")
+	return wf, err
+}
+
+// bundleLibraries sets the library_code of wf and data to the current source of the
+// libraries wf lists. Without a library directory, the code already bundled in the
+// document is used, e.g. for a definition exported from another engine.
+func (e *Engine) bundleLibraries(wf *Workflow, data []byte) ([]byte, error) {
+	if len(wf.Libraries) == 0 {
+		return data, nil
+	}
+
+	code := make(map[string]string, len(wf.Libraries))
+	var issues []ValidationIssue
+	for i, name := range wf.Libraries {
+		path := fmt.Sprintf("libraries[%d]", i)
+		source, err := e.readLibrary(wf, name)
+		if err == nil {
+			err = scripts.CompileModule(name, source)
+		}
+		if err != nil {
+			issues = append(issues, ValidationIssue{Path: path, Message: err.Error()})
+			continue
+		}
+		code[name] = source
+	}
+	if len(issues) > 0 {
+		return nil, positionedError(data, issues)
+	}
+
+	if reflect.DeepEqual(code, wf.LibraryCode) {
+		return data, nil // bundled already, e.g. a document exported from the API
+	}
+	wf.LibraryCode = code
+	return withDocumentField(data, "library_code", code)
+}
+
+// positionedError reports issues found in data with their line and column.
+func positionedError(data []byte, issues []ValidationIssue) *DefinitionError {
+	positions := jsonPositions(data)
+	for i := range issues {
+		issues[i].Line, issues[i].Column = positions.find(issues[i].Path)
+	}
+	return &DefinitionError{Issues: issues}
+}
+
+// withDocumentField returns the JSON document data with its top-level field key set
+// to value.
+func withDocumentField(data []byte, key string, value interface{}) ([]byte, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if value == nil || reflect.ValueOf(value).IsNil() {
+		delete(doc, key)
+	} else {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		doc[key] = encoded
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// readLibrary returns the source of the library name for wf.
+func (e *Engine) readLibrary(wf *Workflow, name string) (string, error) {
+	if e.libraryDir != "" {
+		return scripts.ReadModule(e.libraryDir, name)
+	}
+	if source, ok := wf.LibraryCode[name]; ok {
+		return source, nil
+	}
+	return "", fmt.Errorf("library %s cannot be read: no script library directory is configured", name)
+}
+
+// definitionHash identifies the definition in data, read from location, together with
+// the current source of the libraries and script files of wf, the definition last
+// loaded from there, if any. Hot reload thus notices when only a library or script
+// file changed.
+func (e *Engine) definitionHash(location string, data []byte, wf *Workflow) string {
+	if wf == nil || (len(wf.Libraries) == 0 && len(wf.ScriptFiles) == 0) {
+		return contentHash(data)
+	}
+	combined := append([]byte(nil), data...)
+	if e.libraryDir != "" {
+		for _, name := range wf.Libraries {
+			source, err := scripts.ReadModule(e.libraryDir, name)
+			if err != nil {
+				source = err.Error()
+			}
+			combined = fmt.Appendf(combined, "\x00%s\x00%s", name, source)
+		}
+	}
+	if location != "" {
+		for _, name := range sortedKeys(wf.ScriptFiles) {
+			code, err := readLocalFile(filepath.Dir(location), name)
+			if err != nil {
+				code = err.Error()
+			}
+			combined = fmt.Appendf(combined, "\x00%s\x00%s", name, code)
+		}
+	}
+	return contentHash(combined)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,242 @@
+package workflow
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Reload outcomes reported per file by ReloadDefinitions.
+const (
+	ReloadAdded    = "added"    // A new file was deployed
+	ReloadUpdated  = "updated"  // A changed file was deployed as a new version
+	ReloadRejected = "rejected" // The file is invalid; the definition it held, if any, stays in use
+	ReloadRemoved  = "removed"  // The file is gone; its workflow can no longer be started
+)
+
+// FileReload is what ReloadDefinitions did with one changed file.
+type FileReload struct {
+	Location   string
+	Action     string
+	WorkflowID string // Empty if a rejected file could not be parsed far enough
+	Version    int    // Version deployed, or the version still in use after a rejection
+	Err        error  // Why the file was rejected
+}
+
+// ReloadReport lists the files that changed since the previous load, by location.
+// Unchanged files are not reported.
+type ReloadReport struct {
+	Files []FileReload
+}
+
+// reloadState is what the engine last loaded from its definition source, so a reload
+// only touches files that changed.
+type reloadState struct {
+	mu     sync.Mutex
+	hashes map[string]string // content hash of every file read, by location
+	owners map[string]string // workflow ID of every file whose definition is in use, by location
+}
+
+// remember records the content of location. If it holds the definition in use for
+// workflowID, it becomes that definition's file.
+func (s *reloadState) remember(location, hash, workflowID string) {
+	if s.hashes == nil {
+		s.hashes = make(map[string]string)
+		s.owners = make(map[string]string)
+	}
+	s.hashes[location] = hash
+	if workflowID != "" {
+		s.owners[location] = workflowID
+	}
+}
+
+// owner returns the location whose definition is in use for workflowID.
+func (s *reloadState) owner(workflowID string) (string, bool) {
+	for location, id := range s.owners {
+		if id == workflowID {
+			return location, true
+		}
+	}
+	return "", false
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// WatchDefinitions polls the engine's definition source every interval and reloads
+// changed definitions until ctx is done. Polling works with any source and file
+// system, at the cost of reading every definition once per interval.
+func (e *Engine) WatchDefinitions(ctx context.Context, interval time.Duration) {
+	for {
+		wake := make(chan struct{})
+		timer := e.clock.AfterFunc(interval, func() { close(wake) })
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-wake:
+		}
+		if _, err := e.ReloadDefinitions(); err != nil {
+			e.logger.Warn("Failed to reload workflow definitions", "error", err)
+		}
+	}
+}
+
+// ReloadDefinitions applies the changes to the engine's definition source since it was
+// last loaded. Added and changed files are validated and deployed as new versions;
+// files that fail validation are rejected and the definition loaded before, if any,
+// stays in use. Workflows whose file was removed can no longer be started, but their
+// running instances continue with the version they were started with. Every changed
+// file is logged and reported.
+func (e *Engine) ReloadDefinitions() (*ReloadReport, error) {
+	e.definitionsLock.RLock()
+	source := e.source
+	e.definitionsLock.RUnlock()
+	if source == nil {
+		return nil, fmt.Errorf("no definition source configured")
+	}
+
+	locations, err := source.List()
+	if err != nil {
+		return nil, err
+	}
+
+	e.reload.mu.Lock()
+	defer e.reload.mu.Unlock()
+
+	report := &ReloadReport{}
+	seen := make(map[string]bool, len(locations))
+	for _, location := range locations {
+		data, err := source.Read(location)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // removed since List; handled below
+		}
+		seen[location] = true
+		if err != nil {
+			e.logger.Warn("Failed to read workflow file", "location", location, "error", err)
+			continue
+		}
+		current, _ := e.cachedDefinition(e.reload.owners[location])
+		hash := e.definitionHash(location, data, current)
+		previous, known := e.reload.hashes[location]
+		if known && previous == hash {
+			continue
+		}
+		file := e.reloadFile(location, data, hash)
+		if !known && file.Action == ReloadUpdated {
+			file.Action = ReloadAdded
+		}
+		report.Files = append(report.Files, file)
+	}
+
+	var removed []string
+	for location := range e.reload.hashes {
+		if !seen[location] {
+			removed = append(removed, location)
+		}
+	}
+	sort.Strings(removed)
+	for _, location := range removed {
+		file := FileReload{Location: location, Action: ReloadRemoved, WorkflowID: e.reload.owners[location]}
+		delete(e.reload.hashes, location)
+		delete(e.reload.owners, location)
+		if file.WorkflowID == "" {
+			continue // it never held a definition in use
+		}
+		e.retireDefinition(file.WorkflowID)
+		report.Files = append(report.Files, file)
+	}
+
+	for _, file := range report.Files {
+		attrs := []interface{}{"location", file.Location, "action", file.Action}
+		if file.WorkflowID != "" {
+			attrs = append(attrs, "workflow", file.WorkflowID)
+		}
+		if file.Version > 0 {
+			attrs = append(attrs, "version", file.Version)
+		}
+		if file.Err != nil {
+			e.logger.Warn("Rejected changed workflow definition", append(attrs, "error", file.Err)...)
+		} else {
+			e.logger.Info("Reloaded workflow definition", attrs...)
+		}
+	}
+	if len(report.Files) > 0 {
+		e.logger.Info("Reloaded workflow definitions", "changed", len(report.Files))
+	}
+	return report, nil
+}
+
+// reloadFile validates and deploys the changed file at location. It must be called
+// with e.reload.mu held.
+func (e *Engine) reloadFile(location string, data []byte, hash string) FileReload {
+	file := FileReload{Location: location, Action: ReloadUpdated}
+	previousID := e.reload.owners[location]
+	e.reload.remember(location, hash, "")
+
+	wf, bundled, err := e.parseDefinition(data, location)
+	if err == nil {
+		if owner, ok := e.reload.owner(wf.ID); ok && owner != location {
+			err = fmt.Errorf("workflow ID '%s' is already defined in %s", wf.ID, owner)
+		}
+	}
+	if err != nil {
+		file.Action = ReloadRejected
+		file.Err = err
+		file.WorkflowID = previousID
+		if previousID != "" {
+			if current, ok := e.cachedDefinition(previousID); ok {
+				file.Version = current.Version
+			}
+		}
+		return file
+	}
+
+	e.saveDefinition(wf, bundled, location)
+	e.definitionsLock.Lock()
+	e.definitions[wf.ID] = wf
+	delete(e.retired, wf.ID)
+	e.cacheVersion(wf)
+	e.definitionsLock.Unlock()
+
+	e.reload.remember(location, e.definitionHash(location, data, wf), wf.ID)
+	if previousID != "" && previousID != wf.ID {
+		// The file now defines another workflow; the one it defined before is gone.
+		e.retireDefinition(previousID)
+	}
+	file.WorkflowID = wf.ID
+	file.Version = wf.Version
+	return file
+}
+
+// cachedDefinition returns the latest cached definition of workflowID.
+func (e *Engine) cachedDefinition(workflowID string) (*Workflow, bool) {
+	e.definitionsLock.RLock()
+	defer e.definitionsLock.RUnlock()
+	wf, ok := e.definitions[workflowID]
+	return wf, ok
+}
+
+// retireDefinition stops new instances of workflowID from being started. Its
+// versions stay cached and stored for the instances already running.
+func (e *Engine) retireDefinition(workflowID string) {
+	e.definitionsLock.Lock()
+	defer e.definitionsLock.Unlock()
+	delete(e.definitions, workflowID)
+	e.retired[workflowID] = true
+}
+
+// startable reports whether new instances of workflowID may be started.
+func (e *Engine) startable(workflowID string) bool {
+	e.definitionsLock.RLock()
+	defer e.definitionsLock.RUnlock()
+	return !e.retired[workflowID]
+}
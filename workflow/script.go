@@ -0,0 +1,286 @@
+package workflow
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"jbpmn-engine/db"
+	"jbpmn-engine/scripts"
+)
+
+// DefaultScriptTimeout is how long a script node may run unless WithScriptTimeout
+// sets another limit.
+const DefaultScriptTimeout = 30 * time.Second
+
+// WithScriptTimeout sets how long any script node may run before it is interrupted.
+// A node's own timeout lowers the limit for that node. 0 removes the engine-wide limit.
+func WithScriptTimeout(d time.Duration) Option {
+	return func(e *Engine) {
+		e.scriptTimeout = d
+	}
+}
+
+// DefaultScriptLimits bound the call stack and memory of scripts unless
+// WithScriptLimits sets other limits.
+var DefaultScriptLimits = scripts.Limits{MaxCallStackSize: 10000, MaxMemory: 256 << 20}
+
+// WithScriptLimits sets how deeply the functions of scripts may call each other and
+// how much memory they may allocate before they are interrupted.
+// Zero values remove a limit.
+func WithScriptLimits(limits scripts.Limits) Option {
+	return func(e *Engine) {
+		e.scriptLimits = limits
+	}
+}
+
+// ScriptLimiter is implemented by script runtimes that can bound the resources of
+// scripts, like scripts.Runtime. Other runtimes run scripts without these limits.
+type ScriptLimiter interface {
+	SetLimits(limits scripts.Limits)
+}
+
+// HostRegistry is implemented by script runtimes that let embedders add their own
+// functions to the script namespace, like scripts.Runtime.
+type HostRegistry interface {
+	Register(name string, value interface{}) error
+}
+
+type hostFunction struct {
+	name  string
+	value interface{}
+}
+
+// WithHostFunction exposes fn, typically a Go function, to every script as the
+// global name. The script runtime must implement HostRegistry.
+func WithHostFunction(name string, fn interface{}) Option {
+	return func(e *Engine) {
+		e.hostFunctions = append(e.hostFunctions, hostFunction{name, fn})
+	}
+}
+
+func (e *Engine) registerHostFunctions() error {
+	if len(e.hostFunctions) == 0 {
+		return nil
+	}
+	registry, ok := e.scripts.(HostRegistry)
+	if !ok {
+		return fmt.Errorf("script runtime %T does not support host functions", e.scripts)
+	}
+	for _, fn := range e.hostFunctions {
+		if err := registry.Register(fn.name, fn.value); err != nil {
+			return fmt.Errorf("registering host function %s: %w", fn.name, err)
+		}
+	}
+	return nil
+}
+
+// ScriptCompiler is implemented by script runtimes that can compile scripts ahead of
+// their first execution. The engine compiles the scripts of every definition version
+// it loads, so the first instance does not pay for it.
+type ScriptCompiler interface {
+	Precompile(source string) error
+}
+
+// precompileScripts compiles the scripts of wf if the script runtime supports it.
+// Failures are only logged; the script fails again when it is executed.
+func (e *Engine) precompileScripts(wf *Workflow) {
+	compiler, ok := e.scripts.(ScriptCompiler)
+	if !ok {
+		return
+	}
+	for _, node := range wf.Nodes {
+		if node.Script == nil {
+			continue
+		}
+		source, err := wf.ScriptSource(&node)
+		if err == nil {
+			err = compiler.Precompile(source)
+		}
+		if err != nil {
+			e.logger.Warn("Failed to compile script", "workflow", wf.ID, "version", wf.Version, "node", node.ID, "error", err)
+		}
+	}
+}
+
+// scriptLimit returns the time the script of node may run: the engine-wide limit or
+// the node's timeout, whichever is shorter. 0 means no limit.
+func (e *Engine) scriptLimit(node *WorkflowNode) time.Duration {
+	limit := e.scriptTimeout
+	if node.Timeout != nil {
+		if d, err := time.ParseDuration(node.Timeout.Duration); err == nil && d > 0 && (limit == 0 || d < limit) {
+			limit = d
+		}
+	}
+	return limit
+}
+
+// executeScriptNode runs the script of the current node and moves on with the context
+// it returns, restricted to the node's inputs and outputs if it maps any. A script
+// that overruns its time limit takes the node's timeout path if it has one; otherwise
+// the overrun is an error like any other script failure, as is a business error
+// raised with fail. Signals the script threw are delivered once the instance has
+// moved on.
+func (e *Engine) executeScriptNode(instance *WorkflowInstance) error {
+	node := instance.CurrentNodeDef
+	scriptConfig := node.Script
+	if scriptConfig == nil {
+		return fmt.Errorf("script configuration missing for node %s", instance.CurrentNode)
+	}
+
+	ctx := context.Background()
+	if limit := e.scriptLimit(node); limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+
+	exec := &scripts.Execution{
+		Instance: scripts.Instance{
+			ID:              instance.ID,
+			WorkflowID:      instance.WorkflowID,
+			WorkflowVersion: instance.WorkflowDef.Version,
+			Node:            instance.CurrentNode,
+			BusinessKey:     instance.BusinessKey,
+		},
+		Now:       e.clock.Now,
+		HTTP:      instance.WorkflowDef.HTTP.Policy(),
+		Libraries: instance.WorkflowDef.LibraryCode,
+		Strict:    instance.WorkflowDef.StrictScripts,
+	}
+	ctx = scripts.WithExecution(ctx, exec)
+
+	vars := instance.Context
+	if len(scriptConfig.Inputs) > 0 {
+		var err error
+		if vars, err = e.mapVariables(scriptConfig.Inputs, instance.Context); err != nil {
+			return fmt.Errorf("error mapping the inputs of node %s: %w", instance.CurrentNode, err)
+		}
+	}
+	source, err := instance.WorkflowDef.ScriptSource(node)
+	if err != nil {
+		return err
+	}
+	newContext, err := e.scripts.ExecuteScript(ctx, source, vars)
+	e.recordRequests(instance, exec.Requests)
+	e.recordLogs(instance, exec.Logs)
+	var timeoutErr *scripts.TimeoutError
+	if errors.As(err, &timeoutErr) && node.Timeout != nil && node.Timeout.Next != "" {
+		e.logger.Warn("Script timed out; taking the timeout path", "instance", instance.ID, "node", instance.CurrentNode, "next", node.Timeout.Next, "limit", timeoutErr.Limit)
+		return e.advanceInstance(instance.ID, node.Timeout.Next, nil, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("error executing script for node %s: %w", instance.CurrentNode, err)
+	}
+
+	switch {
+	case len(scriptConfig.Outputs) > 0:
+		outputs, err := e.mapVariables(scriptConfig.Outputs, newContext)
+		if err != nil {
+			return fmt.Errorf("error mapping the outputs of node %s: %w", instance.CurrentNode, err)
+		}
+		newContext = mergeVariables(instance.Context, outputs)
+	case len(scriptConfig.Inputs) > 0:
+		// The script saw only its inputs, so only they are written back; variables it
+		// did not see are kept and it cannot add others.
+		received := make(map[string]interface{}, len(scriptConfig.Inputs))
+		for name := range scriptConfig.Inputs {
+			if value, ok := newContext[name]; ok {
+				received[name] = value
+			}
+		}
+		newContext = mergeVariables(instance.Context, received)
+	}
+
+	if err := e.advanceInstance(instance.ID, node.Next, nil, newContext); err != nil {
+		return err
+	}
+	for _, signal := range exec.Signals {
+		signal := signal
+		e.logger.Info("Script emitting signal", "signal", signal.Name, "node", instance.CurrentNode, "instance", instance.ID)
+		e.dispatch(instance.ID, func() {
+			if emitErr := e.resumeWorkflowsBySignal(signal.Name, signal.Payload); emitErr != nil {
+				e.logger.Error("Error emitting signal from script", "signal", signal.Name, "node", instance.CurrentNode, "instance", instance.ID, "error", emitErr)
+			}
+		})
+	}
+	return nil
+}
+
+// recordRequests adds a summary of every HTTP request a script made to the history of
+// instance, whether or not the script succeeded.
+func (e *Engine) recordRequests(instance *WorkflowInstance, requests []scripts.HTTPExchange) {
+	for _, request := range requests {
+		e.logger.Info("Script made HTTP request", "instance", instance.ID, "node", instance.CurrentNode, "method", request.Method, "url", request.URL, "status", request.Status, "error", request.Err)
+		if err := e.store.RecordInstanceEvent(instance.ID, instance.CurrentNode, "http_request", "", request.String()); err != nil {
+			e.logger.Error("Error recording HTTP request", "instance", instance.ID, "node", instance.CurrentNode, "error", err)
+		}
+	}
+}
+
+// DefaultScriptLogRetention is how long the console output of scripts is kept unless
+// WithScriptLogRetention sets another period.
+const DefaultScriptLogRetention = 30 * 24 * time.Hour
+
+// WithScriptLogRetention sets how long the console output of scripts is kept. Older
+// output is deleted as new output is saved. 0 keeps it forever.
+func WithScriptLogRetention(d time.Duration) Option {
+	return func(e *Engine) {
+		e.scriptLogRetention = d
+	}
+}
+
+// recordLogs stores the console output of a script for the node execution of
+// instance that ran it and forwards it to the engine's logger, whether or not the
+// script succeeded.
+func (e *Engine) recordLogs(instance *WorkflowInstance, logs []scripts.LogEntry) {
+	if len(logs) == 0 {
+		return
+	}
+	records := make([]db.ScriptLogRecord, 0, len(logs))
+	for _, entry := range logs {
+		level := slog.LevelInfo
+		switch entry.Level {
+		case "warn":
+			level = slog.LevelWarn
+		case "error":
+			level = slog.LevelError
+		}
+		e.logger.Log(context.Background(), level, entry.Message, "instance", instance.ID, "workflow", instance.WorkflowID, "node", instance.CurrentNode)
+		records = append(records, db.ScriptLogRecord{Level: entry.Level, Message: entry.Message, CreatedAt: entry.Time})
+	}
+	var expiredBefore time.Time
+	if e.scriptLogRetention > 0 {
+		expiredBefore = e.clock.Now().Add(-e.scriptLogRetention)
+	}
+	if err := e.store.SaveScriptLogs(instance.ID, instance.CurrentNodeInstanceDBID, instance.CurrentNode, records, expiredBefore); err != nil {
+		e.logger.Error("Error saving script logs", "instance", instance.ID, "node", instance.CurrentNode, "error", err)
+	}
+}
+
+// ScriptLogs returns the console output of the scripts of an instance in the order it
+// was logged.
+func (e *Engine) ScriptLogs(instanceID string) ([]db.ScriptLogRecord, error) {
+	if _, err := e.store.GetInstance(instanceID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("%w: %s", ErrInstanceNotFound, instanceID)
+		}
+		return nil, fmt.Errorf("error getting instance %s from DB: %w", instanceID, err)
+	}
+	return e.store.GetScriptLogs(instanceID)
+}
+
+// mergeVariables returns a copy of vars with the variables of changes set in it.
+func mergeVariables(vars, changes map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(vars)+len(changes))
+	for name, value := range vars {
+		merged[name] = value
+	}
+	for name, value := range changes {
+		merged[name] = value
+	}
+	return merged
+}
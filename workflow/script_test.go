@@ -0,0 +1,380 @@
+package workflow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"jbpmn-engine/db"
+	"jbpmn-engine/scripts"
+)
+
+const loggingDefinition = `{
+  "id": "logging",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "log"},
+    {"id": "log", "type": "script", "script": {"code": "console.log('hello');"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptLogRetention(t *testing.T) {
+	e := newTestEngine(t, WithScriptLogRetention(30*24*time.Hour))
+	e.deploy(t, loggingDefinition)
+	old := e.start(t, "logging")
+
+	e.clock.Advance(29 * 24 * time.Hour)
+	recent := e.start(t, "logging")
+	logs, err := e.ScriptLogs(old.ID)
+	if err != nil || len(logs) != 1 {
+		t.Fatalf("logs within the retention period = %v, %v; want 1", logs, err)
+	}
+
+	// Saving new output deletes what has expired.
+	e.clock.Advance(2 * 24 * time.Hour)
+	e.start(t, "logging")
+	if logs, err := e.ScriptLogs(old.ID); err != nil || len(logs) != 0 {
+		t.Errorf("expired logs = %v, %v; want none", logs, err)
+	}
+	if logs, err := e.ScriptLogs(recent.ID); err != nil || len(logs) != 1 {
+		t.Errorf("recent logs = %v, %v; want 1", logs, err)
+	}
+}
+
+func TestScriptLogsKeptWithoutRetention(t *testing.T) {
+	e := newTestEngine(t, WithScriptLogRetention(0))
+	e.deploy(t, loggingDefinition)
+	old := e.start(t, "logging")
+	e.clock.Advance(10 * 365 * 24 * time.Hour)
+	e.start(t, "logging")
+	if logs, err := e.ScriptLogs(old.ID); err != nil || len(logs) != 1 {
+		t.Errorf("logs = %v, %v; want 1", logs, err)
+	}
+}
+
+// endlessDefinition spins forever at its script node, followed by further node
+// properties and nodes.
+const endlessDefinition = `{
+  "id": "endless",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "spin"},
+    {"id": "spin", "type": "script", "script": {"code": "while (true) {}"}, "next": "done"%s},
+    {"id": "done", "type": "end"}%s
+  ]
+}`
+
+func TestScriptTimeouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		timeout  []interface{} // node properties and nodes for endlessDefinition
+		node     string
+		incident string
+	}{
+		{
+			name:    "node timeout takes the timeout path",
+			timeout: []interface{}{`, "timeout": {"duration": "50ms", "next": "gave_up"}`, `, {"id": "gave_up", "type": "end"}`},
+			node:    "gave_up",
+		},
+		{
+			name:     "engine limit raises an incident",
+			opts:     []Option{WithScriptTimeout(50 * time.Millisecond)},
+			timeout:  []interface{}{"", ""},
+			node:     "spin",
+			incident: "time limit of 50ms",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine(t, tt.opts...)
+			e.deploy(t, fmt.Sprintf(endlessDefinition, tt.timeout...))
+			instance := e.start(t, "endless")
+			if instance.CurrentNode != tt.node || (instance.Incident == "") != (tt.incident == "") || !strings.Contains(instance.Incident, tt.incident) {
+				t.Errorf("instance is at %s with incident %q, want %s with incident %q", instance.CurrentNode, instance.Incident, tt.node, tt.incident)
+			}
+		})
+	}
+}
+
+const (
+	// awaitPayment waits at its start node for order_paid.
+	awaitPayment = `{
+  "id": "await_payment",
+  "nodes": [
+    {"id": "start_node", "type": "start", "signal": {"catch": "order_paid"}, "next": "paid"},
+    {"id": "paid", "type": "end"}
+  ]
+}`
+	// payOrder throws order_paid with its instance ID, or fails when out of stock.
+	payOrder = `{
+  "id": "pay_order",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "check_stock"},
+    {"id": "check_stock", "type": "script", "script": {"code": "if (process_data.stock < 1) { fail('out_of_stock', 'no more widgets'); }"}, "next": "pay"},
+    {"id": "pay", "type": "script", "script": {"code": "throwSignal('order_paid', {paid_by: instance.id});"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+)
+
+func TestScriptHostFunctions(t *testing.T) {
+	tests := []struct {
+		stock    int
+		node     string
+		incident string
+		resumed  bool // whether the instance waiting for order_paid moves on
+	}{
+		{stock: 0, node: "check_stock", incident: "business error out_of_stock: no more widgets"},
+		{stock: 5, node: "done", resumed: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("stock %d", tt.stock), func(t *testing.T) {
+			e := newTestEngine(t)
+			e.deploy(t, awaitPayment)
+			e.deploy(t, payOrder)
+			waiting := e.start(t, "await_payment")
+
+			payer, err := e.Start(context.Background(), "pay_order", StartOptions{Variables: map[string]interface{}{"stock": tt.stock}})
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if payer.CurrentNode != tt.node || (payer.Incident == "") != (tt.incident == "") || !strings.Contains(payer.Incident, tt.incident) {
+				t.Errorf("payer is at %s with incident %q, want %s with incident %q", payer.CurrentNode, payer.Incident, tt.node, tt.incident)
+			}
+
+			got := e.instance(t, waiting.ID)
+			if resumed := got.CurrentNode == "paid"; resumed != tt.resumed {
+				t.Errorf("waiting instance is at %s, want it resumed: %v", got.CurrentNode, tt.resumed)
+			}
+			if tt.resumed && got.Context["paid_by"] != payer.ID {
+				t.Errorf("paid_by = %v, want %s", got.Context["paid_by"], payer.ID)
+			}
+		})
+	}
+}
+
+// quotePrice fetches the price of an SKU from pricing_url, which is on an allowed host,
+// and tries to call payments.example, which is not.
+const quotePrice = `{
+  "id": "quote_price",
+  "http": {"allow": ["127.0.0.1"], "timeout": "2s"},
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "quote"},
+    {"id": "quote", "type": "script", "script": {"code": "var quote = http.fetch(process_data.pricing_url + '/price?sku=' + process_data.sku).json();\nprocess_data.price = quote.price;\ntry { http.fetch('http://payments.example/charge'); } catch (e) { process_data.blocked = String(e); }"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptHTTPRequests(t *testing.T) {
+	pricing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"sku": %q, "price": 12.5}`, r.URL.Query().Get("sku"))
+	}))
+	defer pricing.Close()
+
+	e := newTestEngine(t)
+	e.deploy(t, quotePrice)
+	instance, err := e.Start(context.Background(), "quote_price", StartOptions{Variables: map[string]interface{}{"pricing_url": pricing.URL, "sku": "w-1"}})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if instance.CurrentNode != "done" || instance.Context["price"] != 12.5 {
+		t.Fatalf("instance is at %s with context %v, want done with price 12.5", instance.CurrentNode, instance.Context)
+	}
+	if blocked, _ := instance.Context["blocked"].(string); !strings.Contains(blocked, "host payments.example is not allowed") {
+		t.Errorf("blocked = %q", blocked)
+	}
+
+	history, err := e.History(instance.ID)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	var requests []string
+	for _, entry := range history {
+		if entry.Event == "http_request" {
+			requests = append(requests, entry.Detail)
+		}
+	}
+	if len(requests) != 2 || !strings.HasPrefix(requests[0], "GET "+pricing.URL+"/price?sku=w-1: 200, ") || !strings.Contains(requests[1], "not allowed") {
+		t.Errorf("recorded requests = %q", requests)
+	}
+}
+
+// grossOrder sees only the net amount of the order and may only set order_total
+// and saw_secret. The outputs are left out by the cases that need to.
+const grossOrder = `{
+  "id": "gross_order",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "gross"},
+    {"id": "gross", "type": "script", "script": {
+      "code": "process_data.saw_secret = typeof process_data.secret;\nreturn {gross: process_data.net * 1.2, rounded: Math.round(process_data.net * 1.2)};",
+      "inputs": {"net": "order.net"},
+      "outputs": {"order_total": "gross", "saw_secret": "saw_secret"}
+    }, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptInputsAndOutputs(t *testing.T) {
+	order := map[string]interface{}{"net": 100.0, "lines": []interface{}{1.0, 2.0}}
+	tests := []struct {
+		name       string
+		definition string
+		want       map[string]interface{}
+	}{
+		{
+			name:       "outputs",
+			definition: grossOrder,
+			want:       map[string]interface{}{"order": order, "secret": "s3cr3t", "order_total": 120.0, "saw_secret": "undefined"},
+		},
+		{
+			// Without outputs, only the inputs are written back: what else the script
+			// sets or returns is dropped, and variables it did not see are kept.
+			name: "no outputs",
+			definition: strings.Replace(grossOrder, `,
+      "outputs": {"order_total": "gross", "saw_secret": "saw_secret"}`, "", 1),
+			want: map[string]interface{}{"order": order, "secret": "s3cr3t", "net": 100.0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine(t)
+			e.deploy(t, tt.definition)
+			instance, err := e.Start(context.Background(), "gross_order", StartOptions{Variables: map[string]interface{}{"order": order, "secret": "s3cr3t"}})
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			delete(instance.Context, "instanceID")
+			if instance.CurrentNode != "done" || !reflect.DeepEqual(instance.Context, tt.want) {
+				t.Errorf("instance is at %s with context %v, want done with %v", instance.CurrentNode, instance.Context, tt.want)
+			}
+		})
+	}
+}
+
+// tallyOrder logs while it counts the order lines, then fails in check.
+const tallyOrder = `{
+  "id": "tally_order",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "tally"},
+    {"id": "tally", "type": "script", "script": {
+      "code": "console.log('tallying', process_data.order);\nconsole.warn('lines:', process_data.order.lines.length);\nreturn {count: process_data.order.lines.length};"
+    }, "next": "check"},
+    {"id": "check", "type": "script", "script": {
+      "code": "console.error('too many lines');\nthrow new Error('rejected');"
+    }, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptLogs(t *testing.T) {
+	var logged bytes.Buffer
+	e := newTestEngine(t, WithLogger(slog.New(slog.NewJSONHandler(&logged, nil))))
+	e.deploy(t, tallyOrder)
+	instance, err := e.Start(context.Background(), "tally_order", StartOptions{Variables: map[string]interface{}{"order": map[string]interface{}{"lines": []interface{}{1, 2}}}})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if instance.CurrentNode != "check" || instance.Incident == "" {
+		t.Fatalf("instance is at %s with incident %q, want an incident at check", instance.CurrentNode, instance.Incident)
+	}
+
+	history, err := e.History(instance.ID)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	nodeEntries := make(map[string]string)
+	for _, entry := range history {
+		if entry.Event == "" {
+			nodeEntries[entry.NodeID] = entry.ID
+		}
+	}
+	logs, err := e.ScriptLogs(instance.ID)
+	if err != nil {
+		t.Fatalf("ScriptLogs: %v", err)
+	}
+	want := []db.ScriptLogRecord{
+		{NodeID: "tally", Level: "log", Message: `tallying {"lines":[1,2]}`},
+		{NodeID: "tally", Level: "warn", Message: "lines: 2"},
+		{NodeID: "check", Level: "error", Message: "too many lines"},
+	}
+	if len(logs) != len(want) {
+		t.Fatalf("logs = %+v, want %+v", logs, want)
+	}
+	for i, entry := range logs {
+		want[i].WorkflowInstanceID = instance.ID
+		want[i].NodeInstanceID = nodeEntries[want[i].NodeID]
+		want[i].CreatedAt = epoch
+		if entry.ID == 0 {
+			t.Errorf("log %d has no ID: %+v", i, entry)
+		}
+		entry.ID = 0
+		entry.CreatedAt = entry.CreatedAt.UTC()
+		if entry != want[i] {
+			t.Errorf("log %d = %+v, want %+v", i, entry, want[i])
+		}
+	}
+
+	// The output is forwarded to the engine's log at the level of the console call.
+	if out := logged.String(); !strings.Contains(out, `"level":"ERROR","msg":"too many lines","instance":"`+instance.ID+`"`) || !strings.Contains(out, `"node":"check"`) {
+		t.Errorf("engine log = %s", out)
+	}
+	if _, err := e.ScriptLogs("unknown"); !errors.Is(err, ErrInstanceNotFound) {
+		t.Errorf("ScriptLogs of an unknown instance = %v, want ErrInstanceNotFound", err)
+	}
+}
+
+// strictOrder may not generate code; its recursion depth comes from the context.
+const strictOrder = `{
+  "id": "strict_order",
+  "strict_scripts": true,
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "nest"},
+    {"id": "nest", "type": "script", "script": {
+      "code": "function nest(n) { return n === 0 ? 0 : 1 + nest(n - 1); }\nreturn {depth: nest(process_data.depth)};"
+    }, "next": "generate"},
+    {"id": "generate", "type": "script", "script": {
+      "code": "return {value: new Function('return 42')()};"
+    }, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestScriptLimits(t *testing.T) {
+	// Without strict_scripts, the same scripts may use Function.
+	lenientOrder := strings.Replace(strictOrder, `"strict_scripts": true,`, "", 1)
+	tests := []struct {
+		name       string
+		definition string
+		depth      int
+		node       string
+		incident   string
+	}{
+		{name: "call stack", definition: strictOrder, depth: 500, node: "nest", incident: "maximum call stack size of 50"},
+		{name: "strict", definition: strictOrder, depth: 10, node: "generate", incident: "Function is not defined"},
+		{name: "lenient", definition: lenientOrder, depth: 10, node: "done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestEngine(t, WithScriptLimits(scripts.Limits{MaxCallStackSize: 50}))
+			e.deploy(t, tt.definition)
+			instance, err := e.Start(context.Background(), "strict_order", StartOptions{Variables: map[string]interface{}{"depth": tt.depth}})
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if instance.CurrentNode != tt.node || (instance.Incident == "") != (tt.incident == "") || !strings.Contains(instance.Incident, tt.incident) {
+				t.Errorf("instance is at %s with incident %q, want %s with incident %q", instance.CurrentNode, instance.Incident, tt.node, tt.incident)
+			}
+			if tt.incident == "" && instance.Context["value"] != 42.0 {
+				t.Errorf("value = %v, want 42", instance.Context["value"])
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package workflow
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+
+	"jbpmn-engine/scripts"
+)
+
+// ScriptSource returns the JavaScript of a script node: its code, decoded if it is
+// base64, or the captured content of its file.
+func (wf *Workflow) ScriptSource(node *WorkflowNode) (string, error) {
+	if node.Script == nil {
+		return "", fmt.Errorf("script configuration missing for node %s", node.ID)
+	}
+	if node.Script.File != "" {
+		file, ok := wf.ScriptFiles[node.Script.File]
+		if !ok {
+			return "", fmt.Errorf("script file %s of node %s was not loaded", node.Script.File, node.ID)
+		}
+		return file.Code, nil
+	}
+	return node.Script.source()
+}
+
+// source returns the JavaScript in Code, decoded if its encoding is base64.
+func (c *ScriptConfig) source() (string, error) {
+	switch c.Encoding {
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(c.Code)
+		if err != nil {
+			return "", fmt.Errorf("error decoding base64 script: %w", err)
+		}
+		return string(decoded), nil
+	case "":
+		return c.Code, nil
+	default:
+		return "", fmt.Errorf("unknown encoding '%s'; use base64, or leave it out for plain JavaScript", c.Encoding)
+	}
+}
+
+// looksBase64 reports whether code without an encoding is entirely base64 of UTF-8
+// text, as every script was before plain code was accepted. It only explains why such
+// code fails to compile; it is never decoded without "encoding": "base64".
+func (c *ScriptConfig) looksBase64() bool {
+	if c.Encoding != "" || c.Code == "" {
+		return false
+	}
+	decoded, err := base64.StdEncoding.Strict().DecodeString(c.Code)
+	return err == nil && utf8.Valid(decoded)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// bundleScriptFiles sets the script_files of wf and data to the current content of
+// the files its script nodes refer to, read relative to location, together with its
+// hash. Definitions without a location, e.g. deployed through the API, can only use
+// files the document bundles already.
+func (e *Engine) bundleScriptFiles(wf *Workflow, data []byte, location string) ([]byte, error) {
+	files := make(map[string]ScriptFile)
+	var issues []ValidationIssue
+	for i, node := range wf.Nodes {
+		if node.Script == nil || node.Script.File == "" {
+			continue
+		}
+		name := node.Script.File
+		if _, ok := files[name]; ok {
+			continue
+		}
+		file, err := readScriptFile(wf, location, name)
+		if err == nil {
+			_, err = scripts.CompileSource(file.Code)
+		}
+		if err != nil {
+			issues = append(issues, ValidationIssue{Path: fmt.Sprintf("nodes[%d].script.file", i), Message: err.Error()})
+			continue
+		}
+		files[name] = file
+	}
+	if len(issues) > 0 {
+		return nil, positionedError(data, issues)
+	}
+
+	if len(files) == 0 {
+		files = nil
+	}
+	if reflect.DeepEqual(files, wf.ScriptFiles) {
+		return data, nil
+	}
+	wf.ScriptFiles = files
+	return withDocumentField(data, "script_files", files)
+}
+
+// readScriptFile reads the script file name of wf, relative to the definition at
+// location, or takes it from the definition if it has no location.
+func readScriptFile(wf *Workflow, location, name string) (ScriptFile, error) {
+	if location == "" {
+		if file, ok := wf.ScriptFiles[name]; ok {
+			return file, nil
+		}
+		return ScriptFile{}, fmt.Errorf("script file %s cannot be read: the definition was not loaded from a directory", name)
+	}
+	code, err := readLocalFile(filepath.Dir(location), name)
+	if err != nil {
+		return ScriptFile{}, err
+	}
+	return ScriptFile{SHA256: sha256Hex(code), Code: code}, nil
+}
+
+// readLocalFile reads the file name inside dir. Names cannot escape dir, e.g.
+// through .. or symbolic links.
+func readLocalFile(dir, name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("'%s' is not a path inside the definition's directory", name)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	file, err := root.Open(name)
+	if err != nil {
+		return "", fmt.Errorf("reading script file: %w", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return "", fmt.Errorf("reading script file: %w", err)
+	}
+	return string(data), nil
+}
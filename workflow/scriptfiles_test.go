@@ -0,0 +1,43 @@
+package workflow
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestScriptSourceEncodings(t *testing.T) {
+	for _, tt := range []struct {
+		config ScriptConfig
+		want   string
+	}{
+		{config: ScriptConfig{Code: "return {a: 1};"}, want: "return {a: 1};"},
+		{config: ScriptConfig{Code: "cmV0dXJuIHt9Ow==", Encoding: "base64"}, want: "return {};"},
+		{config: ScriptConfig{Code: "cmV0dXJuIHt9Ow=="}, want: "cmV0dXJuIHt9Ow=="},
+		{config: ScriptConfig{Code: "done"}, want: "done"},
+	} {
+		got, err := tt.config.source()
+		if err != nil || got != tt.want {
+			t.Errorf("source of %+v = %q, %v; want %q", tt.config, got, err, tt.want)
+		}
+	}
+	if _, err := (&ScriptConfig{Code: "x", Encoding: "hex"}).source(); err == nil {
+		t.Error("unknown encoding was accepted")
+	}
+}
+
+func TestBase64ScriptsNeedAnEncoding(t *testing.T) {
+	_, err := ParseDefinition([]byte(`{
+  "id": "encodings",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "unmarked"},
+    {"id": "unmarked", "type": "script", "script": {"code": "cmV0dXJuIHt9Ow=="}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`))
+	var defErr *DefinitionError
+	if !errors.As(err, &defErr) || len(defErr.Issues) != 1 || defErr.Issues[0].Path != "nodes[1].script.code" ||
+		!strings.Contains(defErr.Issues[0].Message, `add "encoding": "base64"`) {
+		t.Errorf("ParseDefinition error = %v, want a hint to add the encoding of nodes[1]", err)
+	}
+}
@@ -0,0 +1,375 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"jbpmn-engine/clock"
+)
+
+// ErrShuttingDown is returned by entry points that start new work once Shutdown has been called.
+var ErrShuttingDown = errors.New("workflow engine is shutting down")
+
+// PendingTimer describes a node timeout that had not fired yet when the engine shut down.
+type PendingTimer struct {
+	InstanceID     string    `json:"instance_id"`
+	NodeID         string    `json:"node_id"`
+	NodeInstanceID string    `json:"node_instance_id"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	Persisted      bool      `json:"persisted"`
+}
+
+// ShutdownReport summarizes what the engine left behind when it stopped.
+type ShutdownReport struct {
+	// PendingTimers are the timeouts that were stopped and written to the database
+	// so RestorePendingTimers can re-arm them on the next start.
+	PendingTimers []PendingTimer `json:"pending_timers,omitempty"`
+	// Unfinished lists instances whose node execution was still running when the
+	// shutdown context expired.
+	Unfinished []string `json:"unfinished,omitempty"`
+	// Parked lists instances that reached a persisted node but whose next execution
+	// was not started because the engine had already stopped.
+	Parked []string `json:"parked,omitempty"`
+}
+
+// Clean reports whether the engine stopped without leaving any work behind
+// other than persisted timers.
+func (r *ShutdownReport) Clean() bool {
+	return len(r.Unfinished) == 0 && len(r.Parked) == 0
+}
+
+// pendingTimer is an armed node timeout.
+type pendingTimer struct {
+	instanceID     string
+	nodeID         string
+	nodeInstanceID string
+	config         *TimeoutConfig
+	expiresAt      time.Time
+	timer          clock.Timer
+}
+
+// executionState tracks in-flight node executions and armed timers so the engine
+// can drain them on shutdown.
+type executionState struct {
+	mu        sync.Mutex
+	closing   bool // no new external work is accepted
+	stopped   bool // no new executions are started at all
+	running   int
+	inflight  map[string]int
+	idle      map[string][]chan struct{} // closed when the instance has no in-flight executions
+	timers    map[string]*pendingTimer   // keyed by instance ID
+	drained   chan struct{}
+	persisted []PendingTimer
+	parked    []string
+}
+
+// acceptingWork reports whether external callers may still start new work.
+func (e *Engine) acceptingWork() bool {
+	e.exec.mu.Lock()
+	defer e.exec.mu.Unlock()
+	return !e.exec.closing
+}
+
+// dispatch runs task on the engine's executor on behalf of instanceID and tracks it
+// until it returns. Once the engine has stopped, the task is dropped and the instance
+// is reported as parked.
+func (e *Engine) dispatch(instanceID string, task func()) bool {
+	s := &e.exec
+	s.mu.Lock()
+	if s.stopped {
+		s.parked = append(s.parked, instanceID)
+		s.mu.Unlock()
+		e.logger.Warn("Engine stopped; instance parked at its last persisted node", "instance", instanceID)
+		return false
+	}
+	s.running++
+	s.inflight[instanceID]++
+	s.mu.Unlock()
+
+	e.executor.Execute(func() {
+		defer s.finish(instanceID)
+		task()
+	})
+	return true
+}
+
+func (s *executionState) finish(instanceID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	if s.inflight[instanceID] <= 1 {
+		delete(s.inflight, instanceID)
+		for _, ch := range s.idle[instanceID] {
+			close(ch)
+		}
+		delete(s.idle, instanceID)
+	} else {
+		s.inflight[instanceID]--
+	}
+	if s.closing && s.running == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// waitIdle blocks until instanceID has no executions in flight, i.e. it has reached a
+// wait state or stopped, or until ctx is done. Executions chain by dispatching the next
+// node before the current one returns, so an instance is not idle between nodes.
+func (e *Engine) waitIdle(ctx context.Context, instanceID string) error {
+	s := &e.exec
+	s.mu.Lock()
+	if s.inflight[instanceID] == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	s.idle[instanceID] = append(s.idle[instanceID], ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// inflight reports whether instanceID has an execution in flight.
+func (e *Engine) inflight(instanceID string) bool {
+	e.exec.mu.Lock()
+	defer e.exec.mu.Unlock()
+	return e.exec.inflight[instanceID] > 0
+}
+
+// scheduleTimeout arms the timeout of a node execution and saves its deadline, so
+// RestorePendingTimers can re-arm it after any restart, including a crash. If the
+// engine is shutting down the timer is persisted instead of being armed.
+func (e *Engine) scheduleTimeout(instanceID, nodeID, nodeInstanceID string, cfg *TimeoutConfig, expiresAt time.Time) {
+	s := &e.exec
+	t := &pendingTimer{
+		instanceID:     instanceID,
+		nodeID:         nodeID,
+		nodeInstanceID: nodeInstanceID,
+		config:         cfg,
+		expiresAt:      expiresAt,
+	}
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		e.persistTimer(t)
+		return
+	}
+	if existing, ok := s.timers[instanceID]; ok {
+		existing.timer.Stop()
+	}
+	t.timer = e.clock.AfterFunc(expiresAt.Sub(e.clock.Now()), func() { e.fireTimeout(t) })
+	s.timers[instanceID] = t
+	s.mu.Unlock()
+
+	if err := e.store.SaveInstanceTimer(instanceID, nodeInstanceID, expiresAt); err != nil {
+		e.logger.Error("Error saving timeout", "instance", instanceID, "node", nodeID, "error", err)
+	}
+}
+
+// cancelTimeout disarms the pending timeout of an instance that has left its node and
+// clears its saved deadline.
+func (e *Engine) cancelTimeout(instanceID string) {
+	s := &e.exec
+	s.mu.Lock()
+	t, ok := s.timers[instanceID]
+	if ok {
+		t.timer.Stop()
+		delete(s.timers, instanceID)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		e.clearTimer(t)
+	}
+}
+
+// clearTimer clears the saved deadline of t if its instance is still on the node
+// execution that armed it. Moving to another node clears it too.
+func (e *Engine) clearTimer(t *pendingTimer) {
+	if err := e.store.ClearInstanceTimer(t.instanceID, t.nodeInstanceID); err != nil {
+		e.logger.Error("Error clearing timeout", "instance", t.instanceID, "node", t.nodeID, "error", err)
+	}
+}
+
+// fireTimeout transitions the instance along the timeout path if it is still on the
+// node execution that armed the timer.
+func (e *Engine) fireTimeout(t *pendingTimer) {
+	s := &e.exec
+	s.mu.Lock()
+	if s.timers[t.instanceID] != t {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.timers, t.instanceID)
+	closing := s.closing
+	s.mu.Unlock()
+
+	if closing {
+		e.persistTimer(t)
+		return
+	}
+
+	e.deliverTimeout(t)
+}
+
+// deliverTimeout transitions the instance along the timeout path if it is still on the
+// node execution that armed the timer. A suspended instance keeps the timer, and its
+// saved deadline, until it is resumed; otherwise the deadline is cleared, by the
+// transition itself or here if the timer is dropped.
+func (e *Engine) deliverTimeout(t *pendingTimer) {
+	e.dispatch(t.instanceID, func() {
+		e.control.mu.Lock()
+		currentInstance, err := e.GetInstance(t.instanceID)
+		if err != nil {
+			e.control.mu.Unlock()
+			e.logger.Error("Error re-fetching instance for timeout check", "instance", t.instanceID, "error", err)
+			return
+		}
+		if currentInstance.Status != StatusActive {
+			if currentInstance.Status == StatusSuspended {
+				e.control.due[t.instanceID] = t
+				e.logger.Info("Instance is suspended; holding back timeout until resumed", "instance", t.instanceID, "node", t.nodeID)
+			} else {
+				e.clearTimer(t)
+			}
+			e.control.mu.Unlock()
+			return
+		}
+		e.control.mu.Unlock()
+
+		// Only transition on timeout if still on the same node *instance*
+		if currentInstance.CurrentNodeInstanceDBID == t.nodeInstanceID {
+			e.logger.Info("Instance timed out", "instance", t.instanceID, "node", t.nodeID, "next", t.config.Next)
+			// advanceInstance handles the state update and triggers executeNextNode
+			if advErr := e.advanceInstance(t.instanceID, t.config.Next, nil, nil); advErr != nil {
+				e.logger.Error("Error advancing instance after timeout transition", "instance", t.instanceID, "error", advErr)
+			}
+		}
+	})
+}
+
+// persistTimer writes a pending timeout to the database so it survives a restart.
+func (e *Engine) persistTimer(t *pendingTimer) {
+	s := &e.exec
+	pending := PendingTimer{
+		InstanceID:     t.instanceID,
+		NodeID:         t.nodeID,
+		NodeInstanceID: t.nodeInstanceID,
+		ExpiresAt:      t.expiresAt,
+	}
+	if err := e.store.SaveInstanceTimer(t.instanceID, t.nodeInstanceID, t.expiresAt); err != nil {
+		e.logger.Error("Error persisting timeout", "instance", t.instanceID, "node", t.nodeID, "error", err)
+	} else {
+		pending.Persisted = true
+	}
+
+	s.mu.Lock()
+	s.persisted = append(s.persisted, pending)
+	s.mu.Unlock()
+}
+
+// Shutdown stops the engine from accepting new work, persists armed timers and waits
+// for in-flight node executions to finish or for ctx to expire, whichever comes first.
+// Executions still running at the deadline are abandoned and listed in the report.
+func (e *Engine) Shutdown(ctx context.Context) (*ShutdownReport, error) {
+	s := &e.exec
+
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil, ErrShuttingDown
+	}
+	s.closing = true
+	var stopped []*pendingTimer
+	for id, t := range s.timers {
+		// A timer that already fired but has not yet claimed its entry will find it
+		// gone and do nothing, so every removed timer is persisted here.
+		t.timer.Stop()
+		stopped = append(stopped, t)
+		delete(s.timers, id)
+	}
+	drained := make(chan struct{})
+	if s.running == 0 {
+		close(drained)
+	} else {
+		s.drained = drained
+	}
+	s.mu.Unlock()
+
+	// Timers held back for suspended instances are persisted too, so they are delivered
+	// once the instance is resumed after a restart.
+	e.control.mu.Lock()
+	for id, t := range e.control.due {
+		stopped = append(stopped, t)
+		delete(e.control.due, id)
+	}
+	e.control.mu.Unlock()
+
+	for _, t := range stopped {
+		e.persistTimer(t)
+	}
+
+	var waitErr error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+
+	report := &ShutdownReport{
+		PendingTimers: append([]PendingTimer(nil), s.persisted...),
+		Parked:        append([]string(nil), s.parked...),
+	}
+	for id := range s.inflight {
+		report.Unfinished = append(report.Unfinished, id)
+	}
+	sort.Strings(report.Unfinished)
+
+	return report, waitErr
+}
+
+// Close shuts the engine down, waiting for all in-flight executions to finish.
+func (e *Engine) Close() error {
+	_, err := e.Shutdown(context.Background())
+	return err
+}
+
+// RestorePendingTimers re-arms node timeouts saved before the engine last stopped,
+// whether by Shutdown or not. Timers whose deadline has already passed fire immediately.
+func (e *Engine) RestorePendingTimers() error {
+	instanceIDs, err := e.store.GetInstancesWithTimers()
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	for _, id := range instanceIDs {
+		instance, err := e.GetInstance(id)
+		if err != nil {
+			e.logger.Warn("Could not load instance to restore its timer", "instance", id, "error", err)
+			continue
+		}
+		if instance.ExpiresAt == nil || instance.CurrentNodeDef.Timeout == nil {
+			continue
+		}
+		e.scheduleTimeout(instance.ID, instance.CurrentNode, instance.CurrentNodeInstanceDBID, instance.CurrentNodeDef.Timeout, *instance.ExpiresAt)
+		restored++
+	}
+	if restored > 0 {
+		e.logger.Info("Restored pending timers", "count", restored)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package workflow
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingScripts is a script runtime whose scripts run until release is closed.
+type blockingScripts struct {
+	entered chan string // receives the source of every script that starts
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func newBlockingScripts() *blockingScripts {
+	return &blockingScripts{entered: make(chan string, 10), release: make(chan struct{})}
+}
+
+func (s *blockingScripts) ExecuteScript(ctx context.Context, source string, vars map[string]interface{}) (map[string]interface{}, error) {
+	s.calls.Add(1)
+	s.entered <- source
+	<-s.release
+	return vars, nil
+}
+
+const drainDefinition = `{
+  "id": "drain",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "work"},
+    {"id": "work", "type": "script", "script": {"code": "return {};"}, "next": "after"},
+    {"id": "after", "type": "script", "script": {"code": "return {after: true};"}, "next": "done"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+// startInBackground starts an instance of workflowID on its own goroutine and returns
+// once its first script is running.
+func startInBackground(t *testing.T, e *testEngine, s *blockingScripts, workflowID string) <-chan *WorkflowInstance {
+	t.Helper()
+	started := make(chan *WorkflowInstance, 1)
+	go func() {
+		instance, err := e.Start(context.Background(), workflowID, StartOptions{})
+		if err != nil {
+			t.Errorf("starting %s: %v", workflowID, err)
+		}
+		started <- instance
+	}()
+	select {
+	case <-s.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("script never started")
+	}
+	return started
+}
+
+func TestShutdownDrainsInFlightExecutions(t *testing.T) {
+	s := newBlockingScripts()
+	e := newTestEngine(t, WithScriptRuntime(s))
+	e.deploy(t, drainDefinition)
+	started := startInBackground(t, e, s, "drain")
+
+	shutdown := make(chan *ShutdownReport, 1)
+	go func() {
+		report, err := e.Shutdown(context.Background())
+		if err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+		shutdown <- report
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned while a script was running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := e.Start(context.Background(), "drain", StartOptions{}); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("Start during shutdown = %v, want ErrShuttingDown", err)
+	}
+
+	// The running instance finishes, including the nodes it reaches meanwhile.
+	close(s.release)
+	report := <-shutdown
+	instance := <-started
+	if !report.Clean() || len(report.PendingTimers) != 0 {
+		t.Errorf("report = %+v, want a clean shutdown", report)
+	}
+	if got := e.instance(t, instance.ID); got.CurrentNode != "done" || s.calls.Load() != 2 {
+		t.Errorf("instance is at %s after %d scripts, want done after 2", got.CurrentNode, s.calls.Load())
+	}
+}
+
+func TestShutdownParksWorkAfterDeadline(t *testing.T) {
+	s := newBlockingScripts()
+	e := newTestEngine(t, WithScriptRuntime(s))
+	e.deploy(t, drainDefinition)
+	started := startInBackground(t, e, s, "drain")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	report, err := e.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown error = %v, want the deadline", err)
+	}
+	// Start is still waiting for the instance; its ID is in the report.
+	if len(report.Unfinished) != 1 {
+		t.Fatalf("report = %+v, want one unfinished instance", report)
+	}
+	id := report.Unfinished[0]
+
+	// The abandoned script finishes after the engine stopped: the instance moves to
+	// the next node, which is persisted but not executed.
+	close(s.release)
+	<-started
+	if got := e.instance(t, id); got.CurrentNode != "after" || s.calls.Load() != 1 {
+		t.Errorf("instance is at %s after %d scripts, want parked at after after 1", got.CurrentNode, s.calls.Load())
+	}
+	e.exec.mu.Lock()
+	parked := append([]string(nil), e.exec.parked...)
+	e.exec.mu.Unlock()
+	if !reflect.DeepEqual(parked, []string{id}) {
+		t.Errorf("parked = %v, want [%s]", parked, id)
+	}
+	if e.dispatch(id, func() { t.Error("task dispatched after shutdown ran") }) {
+		t.Error("dispatch after shutdown reported the task as started")
+	}
+}
+
+const timeoutDefinition = `{
+  "id": "reminder",
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "approve"},
+    {"id": "approve", "type": "form", "fields": [{"id": "ok", "name": "OK", "type": "text"}],
+     "timeout": {"duration": "10m", "next": "escalated"}, "next": "done"},
+    {"id": "escalated", "type": "end"},
+    {"id": "done", "type": "end"}
+  ]
+}`
+
+func TestShutdownPersistsAndRestoresTimers(t *testing.T) {
+	e := newTestEngine(t)
+	e.deploy(t, timeoutDefinition)
+	instance := e.start(t, "reminder")
+	if instance.CurrentNode != "approve" || e.clock.Pending() != 1 {
+		t.Fatalf("instance is at %s with %d timers, want approve with 1", instance.CurrentNode, e.clock.Pending())
+	}
+
+	e.clock.Advance(4 * time.Minute)
+	report, err := e.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	want := []PendingTimer{{
+		InstanceID:     instance.ID,
+		NodeID:         "approve",
+		NodeInstanceID: instance.CurrentNodeInstanceDBID,
+		ExpiresAt:      epoch.Add(10 * time.Minute),
+		Persisted:      true,
+	}}
+	if !reflect.DeepEqual(report.PendingTimers, want) || !report.Clean() {
+		t.Errorf("report = %+v, want the timer %+v", report, want[0])
+	}
+	if e.clock.Pending() != 0 {
+		t.Errorf("%d timers still armed after shutdown", e.clock.Pending())
+	}
+
+	// After a restart, the timer fires once the rest of its 10 minutes have passed.
+	restarted := reopenTestEngine(t, e.store, e.clock)
+	restarted.deploy(t, timeoutDefinition)
+	if err := restarted.RestorePendingTimers(); err != nil {
+		t.Fatalf("RestorePendingTimers: %v", err)
+	}
+	e.clock.Advance(5*time.Minute + 59*time.Second)
+	if got := restarted.instance(t, instance.ID); got.CurrentNode != "approve" {
+		t.Fatalf("instance is at %s before its timeout, want approve", got.CurrentNode)
+	}
+	e.clock.Advance(time.Second)
+	if got := restarted.instance(t, instance.ID); got.CurrentNode != "escalated" {
+		t.Errorf("instance is at %s after its timeout, want escalated", got.CurrentNode)
+	}
+}
+
+func TestTimersSurviveACrash(t *testing.T) {
+	e := newTestEngine(t)
+	e.deploy(t, timeoutDefinition)
+	instance := e.start(t, "reminder")
+	cancelled := e.start(t, "reminder")
+	if _, err := e.Cancel(cancelled.ID, "no longer needed"); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+
+	// The engine dies without Shutdown, its timers with it; another one takes over
+	// its store.
+	e.exec.mu.Lock()
+	for _, timer := range e.exec.timers {
+		timer.timer.Stop()
+	}
+	e.exec.mu.Unlock()
+	restarted := reopenTestEngine(t, e.store, e.clock)
+	restarted.deploy(t, timeoutDefinition)
+	if ids, err := e.store.GetInstancesWithTimers(); err != nil || !reflect.DeepEqual(ids, []string{instance.ID}) {
+		t.Fatalf("instances with timers = %v, %v; want [%s]", ids, err, instance.ID)
+	}
+	if err := restarted.RestorePendingTimers(); err != nil {
+		t.Fatalf("RestorePendingTimers: %v", err)
+	}
+	e.clock.Advance(10 * time.Minute)
+	if got := restarted.instance(t, instance.ID); got.CurrentNode != "escalated" {
+		t.Errorf("instance is at %s after its timeout, want escalated", got.CurrentNode)
+	}
+	if ids, err := e.store.GetInstancesWithTimers(); err != nil || len(ids) != 0 {
+		t.Errorf("instances with timers after the timeout = %v, %v; want none", ids, err)
+	}
+}
@@ -3,68 +3,82 @@ package workflow
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-
-	"jbpmn-engine/db"
 )
 
-// EmitSignal processes a signal, resuming any workflows waiting for it.
+// Signal processes a signal, resuming any workflows waiting for it.
 // In a real-world scenario, this might be triggered by a message queue or another service.
-func EmitSignal(signalName string) error {
-	log.Printf("Signal Emitted: %s. Attempting to resume waiting workflows...", signalName)
-	// This function directly calls ResumeWorkflowsBySignal, which is also in this file.
-	return ResumeWorkflowsBySignal(signalName)
+func (e *Engine) Signal(signalName string) error {
+	if !e.acceptingWork() {
+		return ErrShuttingDown
+	}
+	e.logger.Info("Signal emitted, attempting to resume waiting workflows", "signal", signalName)
+	return e.resumeWorkflowsBySignal(signalName, nil)
 }
 
-// ResumeWorkflowsBySignal finds and resumes instances waiting for a specific signal.
-func ResumeWorkflowsBySignal(signalName string) error {
-	log.Printf("Attempting to resume workflows waiting for signal: %s", signalName)
-	instanceIDs, err := db.GetInstancesWaitingForSignal(signalName)
+// resumeWorkflowsBySignal finds and resumes instances waiting for a specific signal.
+// It is also used for signals thrown by gateways, end nodes and scripts while the
+// engine drains. The variables in payload, if any, are set in every resumed instance.
+func (e *Engine) resumeWorkflowsBySignal(signalName string, payload map[string]interface{}) error {
+	instanceIDs, err := e.store.GetInstancesWaitingForSignal(signalName)
 	if err != nil {
 		return fmt.Errorf("error getting instances waiting for signal %s: %w", signalName, err)
 	}
 
 	if len(instanceIDs) == 0 {
-		log.Printf("No instances found waiting for signal: %s", signalName)
+		e.logger.Info("No instances found waiting for signal", "signal", signalName)
 		return nil
 	}
 
 	for _, id := range instanceIDs {
-		// GetInstanceAndDefinition is in engine.go, but callable directly as it's in the same package.
-		instance, err := GetInstanceAndDefinition(id)
+		// The instance is reloaded and the signal cleared under the control lock, so an
+		// instance suspended or cancelled since the lookup is not resumed.
+		e.control.mu.Lock()
+		instance, err := e.GetInstance(id)
 		if err != nil {
-			log.Printf("Error loading instance %s to resume by signal %s: %v", id, signalName, err)
+			e.control.mu.Unlock()
+			e.logger.Error("Error loading instance to resume by signal", "instance", id, "signal", signalName, "error", err)
+			continue
+		}
+		if instance.Status != StatusActive || instance.WaitingSignal != signalName {
+			e.control.mu.Unlock()
+			e.logger.Info("Instance no longer waiting for signal; not resuming", "instance", id, "signal", signalName, "status", instance.Status)
 			continue
 		}
 
-		// Prepare context for saving (no changes to context itself, but it's part of the save payload)
+		// Prepare context for saving, with the signal's payload if it carries one
+		for k, v := range payload {
+			instance.Context[k] = v
+		}
 		ctxJSON, err := json.Marshal(instance.Context)
 		if err != nil {
-			log.Printf("Error marshalling context for instance %s before resuming: %v", id, err)
+			e.control.mu.Unlock()
+			e.logger.Error("Error marshalling context before resuming", "instance", id, "error", err)
 			continue
 		}
 
 		// Update the instance: clear the waiting signal and save a new node instance record.
 		// The node ID remains the same, but a new entry in workflow_instance_nodes marks the signal reception.
-		_, err = db.UpdateInstanceCurrentNodeAndContext(
+		_, err = e.store.UpdateInstanceCurrentNodeAndContext(
 			instance.ID,
 			instance.CurrentNode, // The current node definition ID remains the same
 			string(ctxJSON),
 			"", // Clear waiting signal
 			instance.ExpiresAt,
 		)
+		e.control.mu.Unlock()
 		if err != nil {
-			log.Printf("Error updating instance %s after clearing signal: %v", id, err)
+			e.logger.Error("Error updating instance after clearing signal", "instance", id, "error", err)
 			continue
 		}
 
-		log.Printf("Resuming instance %s which was waiting for signal '%s'.", id, signalName)
-		go func(instanceIDToResume string) {
-			execErr := ExecuteNextNode(instanceIDToResume) // Execute the node where it left off
-			if execErr != nil {
-				log.Printf("Error executing node for instance %s after signal %s: %v", instanceIDToResume, signalName, execErr)
+		e.logger.Info("Resuming instance waiting for signal", "instance", id, "signal", signalName)
+		instanceIDToResume := id
+		e.dispatch(instanceIDToResume, func() {
+			// Execute the node where it left off
+			if execErr := e.executeNextNode(instanceIDToResume); execErr != nil {
+				e.logger.Error("Error executing node after signal", "instance", instanceIDToResume, "signal", signalName, "error", execErr)
 			}
-		}(id)
+		})
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,42 @@
+package workflow
+
+import (
+	"time"
+
+	"jbpmn-engine/db"
+)
+
+// Store persists workflow definitions, instances and their node execution history.
+// Lookups of unknown definitions, instances or node instances must return an error
+// wrapping sql.ErrNoRows. *db.SQLiteStore is the standard implementation.
+type Store interface {
+	SaveWorkflow(id, name, meta, rawJSON, source string) (version int, created bool, err error)
+	GetWorkflow(id string) (*db.WorkflowRecord, error)
+	GetWorkflowVersion(id string, version int) (*db.WorkflowRecord, error)
+	ListWorkflowVersions(id string) ([]db.WorkflowRecord, error)
+	ListWorkflows() ([]db.WorkflowRecord, error)
+
+	SaveNewInstance(instanceID, workflowID string, workflowVersion int, businessKey, initialNodeID, context, waitingSignal string, expiresAt *time.Time) (string, string, error)
+	UpdateInstanceCurrentNodeAndContext(instanceID, newNodeID, newContext, waitingSignal string, expiresAt *time.Time) (string, error)
+	GetInstance(instanceID string) (*db.InstanceRecord, error)
+	ListInstances(filter db.InstanceFilter) ([]db.InstanceRecord, error)
+	GetNodeInstance(nodeInstanceID string) (*db.NodeInstanceRecord, error)
+	GetNodeHistory(instanceID string) ([]db.NodeInstanceRecord, error)
+	GetInstancesWaitingForSignal(signalName string) ([]string, error)
+	SetInstanceParent(instanceID, parentInstanceID string) error
+	GetChildInstances(parentInstanceID string) ([]string, error)
+	SetInstanceStatus(instanceID, status, reason string) error
+	SetInstanceIncident(instanceID, message string) error
+	RecordInstanceEvent(instanceID, nodeID, event, operator, detail string) error
+	SaveScriptLogs(instanceID, nodeInstanceID, nodeID string, logs []db.ScriptLogRecord, expiredBefore time.Time) error
+	GetScriptLogs(instanceID string) ([]db.ScriptLogRecord, error)
+
+	SaveInstanceTimer(instanceID, nodeInstanceID string, expiresAt time.Time) error
+	ClearInstanceTimer(instanceID, nodeInstanceID string) error
+	GetInstancesWithTimers() ([]string, error)
+
+	ClaimIdempotencyKey(scope, key, fingerprint, instanceID string, expiredBefore time.Time) (owner, ownerFingerprint string, claimed bool, err error)
+	ReleaseIdempotencyKey(scope, key string) error
+}
+
+var _ Store = (*db.SQLiteStore)(nil)
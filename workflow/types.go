@@ -1,13 +1,44 @@
 package workflow
 
-import "time"
+import (
+	"time"
+
+	"jbpmn-engine/scripts"
+)
 
 // Workflow represents a workflow definition.
 type Workflow struct {
 	ID    string     `json:"id"`
 	Name  string     `json:"name"`
 	Meta  MetaData   `json:"meta,omitempty"`
+	Input []VariableSchema `json:"input,omitempty"` // Variables accepted when an instance is started
 	Nodes []WorkflowNode `json:"nodes"`
+	HTTP  *HTTPConfig    `json:"http,omitempty"` // Hosts the workflow's scripts may call with http.fetch
+	// StrictScripts runs the workflow's scripts without eval and the Function
+	// constructors, so they can only run code deployed with the definition.
+	StrictScripts bool `json:"strict_scripts,omitempty"`
+
+	// Libraries are the script libraries the workflow's scripts may require, e.g.
+	// "lib/pricing". Their source is bundled into LibraryCode, by name, when the
+	// definition is loaded or deployed.
+	Libraries   []string          `json:"libraries,omitempty"`
+	LibraryCode map[string]string `json:"library_code,omitempty"`
+	// ScriptFiles holds the files script nodes refer to, by path, as they were when
+	// the definition was loaded.
+	ScriptFiles map[string]ScriptFile `json:"script_files,omitempty"`
+
+	// Version is the number the store assigned to this definition when it was
+	// deployed, or 0 if it was not stored.
+	Version int `json:"-"`
+}
+
+// VariableSchema declares a variable a workflow accepts when an instance is started.
+type VariableSchema struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type,omitempty"` // "string", "number", "integer", "boolean", "object", "array"; empty accepts any value
+	Required    bool        `json:"required,omitempty"`
+	Default     interface{} `json:"default,omitempty"`
+	Description string      `json:"description,omitempty"`
 }
 
 // MetaData holds additional information about the workflow.
@@ -27,6 +58,34 @@ type WorkflowNode struct {
 	End        *EndConfig       `json:"end,omitempty"`
 	Timeout    *TimeoutConfig   `json:"timeout,omitempty"`
 	Signal     *SignalConfig    `json:"signal,omitempty"` // This field is crucial for signal handling
+	HTML       string           `json:"html,omitempty"`   // End page content when given directly on an end node
+}
+
+// EndHTML returns the page shown when an instance finishes at this node, taken
+// from end.html or, for definitions that put it on the node itself, from html.
+func (n *WorkflowNode) EndHTML() string {
+	if n.End != nil && n.End.HTML != "" {
+		return n.End.HTML
+	}
+	return n.HTML
+}
+
+// Successors returns the IDs of every node this node can transition to:
+// its next node, its timeout target and the targets of its gateway conditions.
+func (n *WorkflowNode) Successors() []string {
+	var next []string
+	if n.Next != "" {
+		next = append(next, n.Next)
+	}
+	if n.Timeout != nil && n.Timeout.Next != "" {
+		next = append(next, n.Timeout.Next)
+	}
+	for _, condition := range n.Conditions {
+		if condition.Next != "" {
+			next = append(next, condition.Next)
+		}
+	}
+	return next
 }
 
 // FormField defines a single field within a form.
@@ -38,9 +97,53 @@ type FormField struct {
 	Required bool   `json:"required,omitempty"`
 }
 
+// Key returns the context key the field is stored under: its name, or its ID
+// for definitions that only give fields an id.
+func (f FormField) Key() string {
+	if f.Name != "" {
+		return f.Name
+	}
+	return f.ID
+}
+
 // ScriptConfig defines the structure for script nodes.
 type ScriptConfig struct {
-	Code string `json:"code"` // Base64 encoded JavaScript
+	Code     string `json:"code,omitempty"`     // JavaScript, or base64 encoded JavaScript with "encoding": "base64"
+	Encoding string `json:"encoding,omitempty"` // "base64", or empty for plain JavaScript
+	File     string `json:"file,omitempty"`     // JavaScript file relative to the definition, instead of code
+
+	// Inputs restricts the variables the script sees in process_data to the ones
+	// listed, each named by its key and taken from the context variable or path in
+	// its value, e.g. {"net": "order.net"}. Without Outputs, only these variables
+	// are written back to the context.
+	Inputs map[string]string `json:"inputs,omitempty"`
+	// Outputs restricts the variables the script can write to the context variables
+	// listed, each set from the process_data variable or path in its value, e.g.
+	// {"order_total": "gross"}. Other context variables are left as they are.
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// ScriptFile is a script file as it was when the definition using it was loaded.
+type ScriptFile struct {
+	SHA256 string `json:"sha256"` // Hex encoded SHA-256 of Code
+	Code   string `json:"code"`
+}
+
+// HTTPConfig allows the scripts of a workflow to make HTTP requests with http.fetch.
+type HTTPConfig struct {
+	Allow            []string `json:"allow"`                        // e.g. "api.example.com", "127.0.0.1:8080", "*.example.com"
+	Timeout          string   `json:"timeout,omitempty"`            // per request, e.g. "5s"; defaults to 10s
+	MaxResponseBytes int64    `json:"max_response_bytes,omitempty"` // defaults to 1 MiB
+}
+
+// Policy returns the limits for the requests of the workflow's scripts, or nil if they
+// may not make any.
+func (c *HTTPConfig) Policy() *scripts.HTTPPolicy {
+	if c == nil {
+		return nil
+	}
+	timeout, _ := time.ParseDuration(c.Timeout)
+	return &scripts.HTTPPolicy{Allow: c.Allow, Timeout: timeout, MaxResponseBytes: c.MaxResponseBytes}
 }
 
 // GatewayConfig defines the structure for gateway nodes.
@@ -50,7 +153,7 @@ type GatewayConfig struct {
 
 // GatewayCondition defines a single condition for a gateway.
 type GatewayCondition struct {
-	When   string `json:"when,omitempty"` // Base64 encoded JavaScript condition
+	When   string `json:"when,omitempty"` // expression such as "amount >= 100"; see package expr
 	Next   string `json:"next"`
 	Else   bool   `json:"else,omitempty"`
 	Signal *SignalConfig `json:"signal,omitempty"` // Signal to throw on this path (optional)
@@ -80,6 +183,11 @@ type SignalConfig struct {
 type WorkflowInstance struct {
 	ID                      string                 // UUID for the overall instance
 	WorkflowID              string                 // ID of the workflow definition this instance is based on
+	BusinessKey             string                 // Optional caller-supplied key, e.g. an order number
+	ParentInstanceID        string                 // Instance this one was started on behalf of, if any
+	Status                  string                 // StatusActive, StatusSuspended or StatusCancelled
+	StatusReason            string                 // Reason given for the last status change
+	Incident                string                 // Error of the last failed node execution; see Engine.Retry
 	CurrentNode             string                 // **DEFINITION ID** of the current node (e.g., "start_node", "task_form")
 	CurrentNodeInstanceDBID string                 // **UUID from workflow_instance_nodes table** for the *specific execution* of the current node
 	Context                 map[string]interface{} // Dynamic data passed through the workflow
@@ -0,0 +1,487 @@
+package workflow
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"jbpmn-engine/expr"
+	"jbpmn-engine/scripts"
+)
+
+// ValidationIssue is a problem found in a workflow definition.
+type ValidationIssue struct {
+	// Path locates the problem in the document, e.g. "nodes[2].timeout.next". It is
+	// empty for JSON syntax errors.
+	Path string `json:"path,omitempty"`
+	// Line and Column give the position of the offending value, or of the closest
+	// enclosing one if it is missing, when the document is available.
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// Location describes where the issue is, e.g. "nodes[2].next (line 14, column 15)".
+func (i ValidationIssue) Location() string {
+	position := ""
+	if i.Line > 0 {
+		position = fmt.Sprintf("line %d, column %d", i.Line, i.Column)
+	}
+	switch {
+	case i.Path == "":
+		return position
+	case position == "":
+		return i.Path
+	default:
+		return i.Path + " (" + position + ")"
+	}
+}
+
+func (i ValidationIssue) String() string {
+	if location := i.Location(); location != "" {
+		return location + ": " + i.Message
+	}
+	return i.Message
+}
+
+// DefinitionError reports why a workflow definition was rejected.
+type DefinitionError struct {
+	Location string // File or other origin of the definition, if known
+	Issues   []ValidationIssue
+}
+
+func (e *DefinitionError) Error() string {
+	parts := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		parts = append(parts, issue.String())
+	}
+	prefix := "invalid workflow definition"
+	if e.Location != "" {
+		prefix += " " + e.Location
+	}
+	return prefix + ": " + strings.Join(parts, "; ")
+}
+
+// ParseDefinition decodes and validates a workflow definition. Problems are reported
+// as a *DefinitionError listing every issue found with its line and column.
+func ParseDefinition(data []byte) (*Workflow, error) {
+	var wf Workflow
+	if err := json.Unmarshal(data, &wf); err != nil {
+		return nil, &DefinitionError{Issues: []ValidationIssue{jsonIssue(data, err)}}
+	}
+	if issues := Validate(&wf); len(issues) > 0 {
+		positions := jsonPositions(data)
+		for i := range issues {
+			issues[i].Line, issues[i].Column = positions.find(issues[i].Path)
+		}
+		return nil, &DefinitionError{Issues: issues}
+	}
+	return &wf, nil
+}
+
+// jsonIssue locates a decoding error by line and column.
+func jsonIssue(data []byte, err error) ValidationIssue {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	issue := ValidationIssue{Message: err.Error()}
+	var offset int64
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset - 1 // the offending byte has already been read
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset - 1
+		if typeErr.Field != "" {
+			issue.Path = typeErr.Field
+			issue.Message = fmt.Sprintf("must be of type %s, not %s", typeErr.Type, typeErr.Value)
+		}
+	default:
+		return issue
+	}
+	issue.Line, issue.Column = lineColumn(data, offset)
+	return issue
+}
+
+// lineColumn converts a byte offset in data to a 1-based line and column.
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	} else if offset < 0 {
+		offset = 0
+	}
+	line := bytes.Count(data[:offset], []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(data[:offset], '\n')
+	return line, column
+}
+
+// positions maps the path of every value in a JSON document, in the notation of
+// ValidationIssue.Path, to its line and column.
+type positions map[string][2]int
+
+// jsonPositions records where each value of a well-formed JSON document starts.
+func jsonPositions(data []byte) positions {
+	p := make(positions)
+	p.walk(json.NewDecoder(bytes.NewReader(data)), data, "")
+	return p
+}
+
+func (p positions) walk(dec *json.Decoder, data []byte, path string) bool {
+	// InputOffset is the end of the previous token; skip the separators after it.
+	offset := dec.InputOffset()
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[offset]) >= 0 {
+		offset++
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return false
+	}
+	line, column := lineColumn(data, offset)
+	p[path] = [2]int{line, column}
+
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return false
+			}
+			name, _ := key.(string)
+			child := name
+			if path != "" {
+				child = path + "." + name
+			}
+			if !p.walk(dec, data, child) {
+				return false
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			if !p.walk(dec, data, fmt.Sprintf("%s[%d]", path, i)) {
+				return false
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err == nil
+}
+
+// find returns the position of path or, for a value missing from the document, of
+// the closest enclosing value.
+func (p positions) find(path string) (int, int) {
+	for {
+		if pos, ok := p[path]; ok {
+			return pos[0], pos[1]
+		}
+		if path == "" {
+			return 0, 0
+		}
+		cut := strings.LastIndexAny(path, ".[")
+		if cut < 0 {
+			cut = 0
+		}
+		path = path[:cut]
+	}
+}
+
+// Validate checks a workflow definition without running it:
+//
+//   - it has an ID and unique node IDs of known types;
+//   - every next, timeout.next and conditions[].next refers to an existing node;
+//   - there is exactly one default start node, DefaultStartNode, of type start;
+//     other start nodes are entry points chosen with StartOptions.StartNode;
+//   - every node is reachable from a start node and can reach an end node;
+//   - gateways have an else branch or exhaustive conditions;
+//   - timeout durations parse and scripts decode and compile;
+//   - library names are valid and the http allowlist, if any, names hosts.
+func Validate(wf *Workflow) []ValidationIssue {
+	var issues []ValidationIssue
+	add := func(path, format string, args ...interface{}) {
+		issues = append(issues, ValidationIssue{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if wf.ID == "" {
+		add("id", "is required")
+	}
+	if len(wf.Nodes) == 0 {
+		add("nodes", "must contain at least one node")
+		return issues
+	}
+
+	index := make(map[string]int, len(wf.Nodes))
+	for i, node := range wf.Nodes {
+		path := fmt.Sprintf("nodes[%d]", i)
+		if node.ID == "" {
+			add(path+".id", "is required")
+		} else if first, ok := index[node.ID]; ok {
+			add(path+".id", "duplicate node ID '%s', first used by nodes[%d]", node.ID, first)
+		} else {
+			index[node.ID] = i
+		}
+	}
+	if i, ok := index[DefaultStartNode]; !ok {
+		add("nodes", "has no '%s'", DefaultStartNode)
+	} else if wf.Nodes[i].Type != "start" {
+		add(fmt.Sprintf("nodes[%d].type", i), "'%s' must be a start node", DefaultStartNode)
+	}
+
+	target := func(path, next string) {
+		if next == "" {
+			add(path, "is required")
+		} else if _, ok := index[next]; !ok {
+			add(path, "refers to unknown node '%s'", next)
+		}
+	}
+	for i, node := range wf.Nodes {
+		path := fmt.Sprintf("nodes[%d]", i)
+
+		switch node.Type {
+		case "start", "form", "script":
+			target(path+".next", node.Next)
+		case "gateway":
+			if len(node.Conditions) == 0 {
+				add(path+".conditions", "a gateway needs at least one condition")
+			}
+		case "end":
+			if node.Next != "" {
+				add(path+".next", "end nodes cannot have a next node")
+			}
+		case "":
+			add(path+".type", "is required")
+		default:
+			add(path+".type", "unknown node type '%s'", node.Type)
+		}
+
+		if node.Timeout != nil {
+			if d, err := time.ParseDuration(node.Timeout.Duration); err != nil {
+				add(path+".timeout.duration", "%v", err)
+			} else if d <= 0 {
+				add(path+".timeout.duration", "must be positive")
+			}
+			target(path+".timeout.next", node.Timeout.Next)
+		}
+
+		for j, condition := range node.Conditions {
+			cpath := fmt.Sprintf("%s.conditions[%d]", path, j)
+			if condition.When != "" {
+				if program, err := wf.compileCondition(condition.When); err != nil {
+					add(cpath+".when", "%v", err)
+				} else if t := program.Type(); t != expr.Bool && t != expr.Null && t != expr.Any {
+					add(cpath+".when", "must be a boolean, but it is of type %s", t)
+				}
+			} else if !condition.Else {
+				add(cpath, "needs a when expression or \"else\": true")
+			}
+			target(cpath+".next", condition.Next)
+		}
+		if node.Type == "gateway" && len(node.Conditions) > 0 && !wf.exhaustive(node.Conditions) {
+			add(path+".conditions", "needs an else branch; the conditions do not cover every case")
+		}
+
+		if node.Type == "script" {
+			switch {
+			case node.Script == nil || (node.Script.Code == "" && node.Script.File == ""):
+				add(path+".script.code", "is required")
+			case node.Script.File != "":
+				if node.Script.Code != "" {
+					add(path+".script", "needs either code or a file, not both")
+				} else if !filepath.IsLocal(node.Script.File) {
+					add(path+".script.file", "'%s' is not a path inside the definition's directory", node.Script.File)
+				} else if file, ok := wf.ScriptFiles[node.Script.File]; ok {
+					if _, err := scripts.CompileSource(file.Code); err != nil {
+						add(path+".script.file", "%v", err)
+					}
+				}
+			default:
+				if source, err := node.Script.source(); err != nil {
+					add(path+".script.encoding", "%v", err)
+				} else if _, err := scripts.CompileSource(source); err != nil {
+					if node.Script.looksBase64() {
+						add(path+".script.code", `%v; if it is base64, add "encoding": "base64"`, err)
+					} else {
+						add(path+".script.code", "%v", err)
+					}
+				}
+			}
+			if node.Script != nil {
+				checkMapping(add, path+".script.inputs", node.Script.Inputs, wf.variableTypes())
+				checkMapping(add, path+".script.outputs", node.Script.Outputs, nil)
+			}
+		}
+	}
+
+	listed := make(map[string]bool, len(wf.Libraries))
+	for i, name := range wf.Libraries {
+		path := fmt.Sprintf("libraries[%d]", i)
+		switch {
+		case !scripts.ValidModuleName(name):
+			add(path, "'%s' is not a library name such as lib/pricing", name)
+		case listed[name]:
+			add(path, "duplicate library '%s'", name)
+		}
+		listed[name] = true
+	}
+	for name := range wf.LibraryCode {
+		if !listed[name] {
+			add("library_code", "has code for '%s', which is not listed in libraries", name)
+		}
+	}
+
+	for _, name := range sortedKeys(wf.ScriptFiles) {
+		if file := wf.ScriptFiles[name]; file.SHA256 != sha256Hex(file.Code) {
+			add("script_files", "the sha256 of '%s' does not match its code", name)
+		}
+	}
+
+	if wf.HTTP != nil {
+		if len(wf.HTTP.Allow) == 0 {
+			add("http.allow", "must list at least one host")
+		}
+		for i, host := range wf.HTTP.Allow {
+			if host == "" || strings.ContainsAny(host, "/?#@") || strings.Contains(host[1:], "*") {
+				add(fmt.Sprintf("http.allow[%d]", i), "'%s' is not a host, host:port or *.domain", host)
+			}
+		}
+		if wf.HTTP.Timeout != "" {
+			if d, err := time.ParseDuration(wf.HTTP.Timeout); err != nil {
+				add("http.timeout", "%v", err)
+			} else if d <= 0 {
+				add("http.timeout", "must be positive")
+			}
+		}
+		if wf.HTTP.MaxResponseBytes < 0 {
+			add("http.max_response_bytes", "must not be negative")
+		}
+	}
+
+	return append(issues, checkPaths(wf, index)...)
+}
+
+// Warnings reports parts of a definition that Validate accepts but that are likely
+// mistakes: conditions comparing with an unquoted word that is not a declared
+// variable, e.g. "status == aproved", which compare with the string 'aproved'.
+// If data is the definition's document, warnings carry its line and column.
+func Warnings(wf *Workflow, data []byte) []ValidationIssue {
+	var warnings []ValidationIssue
+	types := wf.variableTypes()
+	for i, node := range wf.Nodes {
+		path := fmt.Sprintf("nodes[%d]", i)
+		for j, condition := range node.Conditions {
+			if word, ok := legacyWord(condition.When, types); ok {
+				warnings = append(warnings, ValidationIssue{
+					Path:    fmt.Sprintf("%s.conditions[%d].when", path, j),
+					Message: fmt.Sprintf("compares with the unquoted word %s, which is taken as the string '%s'; quote it, or declare an input variable of that name", word, word),
+				})
+			}
+		}
+	}
+	if len(warnings) > 0 && data != nil {
+		positions := jsonPositions(data)
+		for i := range warnings {
+			warnings[i].Line, warnings[i].Column = positions.find(warnings[i].Path)
+		}
+	}
+	return warnings
+}
+
+// checkMapping checks the inputs or outputs of a script: every entry needs a
+// variable name and an expression to take its value from. Inputs are checked against
+// the types of the definition's input variables; outputs see what the script returned,
+// so only their syntax is checked.
+func checkMapping(add func(path, format string, args ...interface{}), path string, mapping map[string]string, types map[string]expr.Type) {
+	for _, name := range sortedKeys(mapping) {
+		if name == "" {
+			add(path, "variable names cannot be empty")
+			continue
+		}
+		if _, err := expr.Compile(mapping[name], types); err != nil {
+			add(path+"."+name, "%v", err)
+		}
+	}
+}
+
+// exhaustive reports whether a gateway always takes one of its conditions: it has an
+// else branch, or two of its conditions are complements such as "age >= 18" and
+// "age < 18".
+func (wf *Workflow) exhaustive(conditions []GatewayCondition) bool {
+	var programs []*expr.Program
+	for _, condition := range conditions {
+		if condition.Else {
+			return true
+		}
+		program, err := wf.compileCondition(condition.When)
+		if err != nil {
+			continue
+		}
+		for _, other := range programs {
+			if expr.Complementary(other, program) {
+				return true
+			}
+		}
+		programs = append(programs, program)
+	}
+	return false
+}
+
+// checkPaths reports nodes that no start node leads to and nodes from which no end
+// node can be reached. Transitions to unknown nodes are ignored; Validate reports them.
+func checkPaths(wf *Workflow, index map[string]int) []ValidationIssue {
+	predecessors := make(map[string][]string)
+	for _, node := range wf.Nodes {
+		for _, next := range node.Successors() {
+			predecessors[next] = append(predecessors[next], node.ID)
+		}
+	}
+
+	walk := func(roots []string, edges func(id string) []string) map[string]bool {
+		seen := make(map[string]bool)
+		queue := roots
+		for _, id := range roots {
+			seen[id] = true
+		}
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			for _, next := range edges(id) {
+				if _, ok := index[next]; ok && !seen[next] {
+					seen[next] = true
+					queue = append(queue, next)
+				}
+			}
+		}
+		return seen
+	}
+
+	var starts, ends []string
+	for i, node := range wf.Nodes {
+		if node.ID == "" || index[node.ID] != i {
+			continue
+		}
+		switch node.Type {
+		case "start":
+			starts = append(starts, node.ID)
+		case "end":
+			ends = append(ends, node.ID)
+		}
+	}
+	reachable := walk(starts, func(id string) []string { return wf.Nodes[index[id]].Successors() })
+	finishes := walk(ends, func(id string) []string { return predecessors[id] })
+
+	var issues []ValidationIssue
+	for i, node := range wf.Nodes {
+		if node.ID == "" || index[node.ID] != i {
+			continue
+		}
+		path := fmt.Sprintf("nodes[%d]", i)
+		if !reachable[node.ID] {
+			issues = append(issues, ValidationIssue{Path: path, Message: fmt.Sprintf("node '%s' cannot be reached from a start node", node.ID)})
+		}
+		if !finishes[node.ID] {
+			issues = append(issues, ValidationIssue{Path: path, Message: fmt.Sprintf("no path from node '%s' reaches an end node", node.ID)})
+		}
+	}
+	return issues
+}
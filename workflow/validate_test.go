@@ -0,0 +1,195 @@
+package workflow
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validNodes is a definition that passes every check; each case of TestValidate
+// changes it to break one rule.
+const validNodes = `[
+  {"id": "start_node", "type": "start", "next": "check"},
+  {"id": "check", "type": "gateway", "conditions": [
+    {"when": "amount > 100", "next": "charge"},
+    {"else": true, "next": "done"}
+  ]},
+  {"id": "charge", "type": "script", "script": {"code": "return {charged: true};"}, "next": "done",
+   "timeout": {"duration": "5m", "next": "done"}},
+  {"id": "done", "type": "end"}
+]`
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		replace []string // pairs of old and new text in validNodes
+		want    []ValidationIssue
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name:    "duplicate node ID",
+			replace: []string{`{"id": "done", "type": "end"}`, `{"id": "done", "type": "end"}, {"id": "charge", "type": "end"}`},
+			want:    []ValidationIssue{{Path: "nodes[4].id", Message: "duplicate node ID 'charge', first used by nodes[2]"}},
+		},
+		{
+			name:    "unknown next node",
+			replace: []string{`"next": "check"`, `"next": "chek"`},
+			want: []ValidationIssue{
+				{Path: "nodes[0].next", Message: "refers to unknown node 'chek'"},
+				{Path: "nodes[0]", Message: "no path from node 'start_node' reaches an end node"},
+				{Path: "nodes[1]", Message: "node 'check' cannot be reached from a start node"},
+				{Path: "nodes[2]", Message: "node 'charge' cannot be reached from a start node"},
+				{Path: "nodes[3]", Message: "node 'done' cannot be reached from a start node"},
+			},
+		},
+		{
+			name:    "unreachable node",
+			replace: []string{`{"id": "done", "type": "end"}`, `{"id": "done", "type": "end"}, {"id": "orphan", "type": "end"}`},
+			want:    []ValidationIssue{{Path: "nodes[4]", Message: "node 'orphan' cannot be reached from a start node"}},
+		},
+		{
+			name: "dead end",
+			replace: []string{
+				`{"else": true, "next": "done"}`, `{"else": true, "next": "loop"}`,
+				`{"id": "done", "type": "end"}`, `{"id": "done", "type": "end"}, {"id": "loop", "type": "form", "fields": [], "next": "loop"}`,
+			},
+			want: []ValidationIssue{{Path: "nodes[4]", Message: "no path from node 'loop' reaches an end node"}},
+		},
+		{
+			name:    "gateway without else branch",
+			replace: []string{`{"else": true, "next": "done"}`, `{"when": "amount < 50", "next": "done"}`},
+			want:    []ValidationIssue{{Path: "nodes[1].conditions", Message: "needs an else branch; the conditions do not cover every case"}},
+		},
+		{
+			name:    "gateway with complementary conditions",
+			replace: []string{`{"else": true, "next": "done"}`, `{"when": "amount <= 100", "next": "done"}`},
+		},
+		{
+			name:    "unparsable duration",
+			replace: []string{`"duration": "5m"`, `"duration": "five minutes"`},
+			want:    []ValidationIssue{{Path: "nodes[2].timeout.duration", Message: `time: invalid duration "five minutes"`}},
+		},
+		{
+			name:    "negative duration",
+			replace: []string{`"duration": "5m"`, `"duration": "-5m"`},
+			want:    []ValidationIssue{{Path: "nodes[2].timeout.duration", Message: "must be positive"}},
+		},
+		{
+			name:    "script compile error",
+			replace: []string{`return {charged: true};`, `return {charged: };`},
+			want:    []ValidationIssue{{Path: "nodes[2].script.code", Message: "script-compile-error"}},
+		},
+		{
+			name:    "invalid script input",
+			replace: []string{`{"code": "return {charged: true};"}`, `{"code": "return {charged: true};", "inputs": {"net": "amount..net"}}`},
+			want:    []ValidationIssue{{Path: "nodes[2].script.inputs.net", Message: "column 8: expected a field name, found '.'"}},
+		},
+		{
+			name:    "missing start node",
+			replace: []string{`{"id": "start_node", "type": "start", "next": "check"}`, `{"id": "begin", "type": "start", "next": "check"}`},
+			want:    []ValidationIssue{{Path: "nodes", Message: "has no 'start_node'"}},
+		},
+		{
+			name:    "start node of another type",
+			replace: []string{`{"id": "start_node", "type": "start", "next": "check"}`, `{"id": "start_node", "type": "script", "script": {"code": "return {};"}, "next": "check"}`},
+			want: []ValidationIssue{
+				{Path: "nodes[0].type", Message: "'start_node' must be a start node"},
+				{Path: "nodes[0]", Message: "node 'start_node' cannot be reached from a start node"},
+				{Path: "nodes[1]", Message: "node 'check' cannot be reached from a start node"},
+				{Path: "nodes[2]", Message: "node 'charge' cannot be reached from a start node"},
+				{Path: "nodes[3]", Message: "node 'done' cannot be reached from a start node"},
+			},
+		},
+		{
+			name:    "duplicate start node",
+			replace: []string{`{"id": "done", "type": "end"}`, `{"id": "done", "type": "end"}, {"id": "start_node", "type": "start", "next": "done"}`},
+			want:    []ValidationIssue{{Path: "nodes[4].id", Message: "duplicate node ID 'start_node', first used by nodes[0]"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes := validNodes
+			for i := 0; i < len(tt.replace); i += 2 {
+				if !strings.Contains(nodes, tt.replace[i]) {
+					t.Fatalf("%q is not in the definition", tt.replace[i])
+				}
+				nodes = strings.Replace(nodes, tt.replace[i], tt.replace[i+1], 1)
+			}
+			var wf Workflow
+			document := `{"id": "payments", "input": [{"name": "amount", "type": "number"}], "nodes": ` + nodes + `}`
+			if err := json.Unmarshal([]byte(document), &wf); err != nil {
+				t.Fatalf("decoding definition: %v", err)
+			}
+
+			got := Validate(&wf)
+			// Compile errors come from the script engine; only their place is checked.
+			for i := range got {
+				if strings.HasSuffix(got[i].Path, ".script.code") && strings.Contains(got[i].Message, "SyntaxError") {
+					got[i].Message = "script-compile-error"
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnings(t *testing.T) {
+	document := []byte(`{
+  "id": "orders",
+  "input": [{"name": "approved", "type": "string"}],
+  "nodes": [
+    {"id": "start_node", "type": "start", "next": "route"},
+    {"id": "route", "type": "gateway", "conditions": [
+      {"when": "status == aproved", "next": "done"},
+      {"when": "status == approved", "next": "done"},
+      {"when": "status == 'rush'", "next": "done"},
+      {"when": "flag != true", "next": "done"},
+      {"else": true, "next": "done"}
+    ]},
+    {"id": "done", "type": "end"}
+  ]
+}`)
+	wf, err := ParseDefinition(document)
+	if err != nil {
+		t.Fatalf("ParseDefinition: %v", err)
+	}
+	want := []ValidationIssue{
+		{Path: "nodes[1].conditions[0].when", Line: 7, Column: 16, Message: "compares with the unquoted word aproved, which is taken as the string 'aproved'; quote it, or declare an input variable of that name"},
+	}
+	if got := Warnings(wf, document); !reflect.DeepEqual(got, want) {
+		t.Errorf("warnings:\n%v\nwant:\n%v", got, want)
+	}
+}
+
+func TestValidateHTTPPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []ValidationIssue
+	}{
+		{policy: `{"allow": ["127.0.0.1:8080", "*.example.com"], "timeout": "2s"}`},
+		{policy: `{"allow": []}`, want: []ValidationIssue{{Path: "http.allow", Message: "must list at least one host"}}},
+		{policy: `{"allow": ["http://127.0.0.1/", "api.*.com"]}`, want: []ValidationIssue{
+			{Path: "http.allow[0]", Message: "'http://127.0.0.1/' is not a host, host:port or *.domain"},
+			{Path: "http.allow[1]", Message: "'api.*.com' is not a host, host:port or *.domain"},
+		}},
+		{policy: `{"allow": ["127.0.0.1"], "timeout": "soon"}`, want: []ValidationIssue{{Path: "http.timeout", Message: `time: invalid duration "soon"`}}},
+		{policy: `{"allow": ["127.0.0.1"], "timeout": "-1s"}`, want: []ValidationIssue{{Path: "http.timeout", Message: "must be positive"}}},
+		{policy: `{"allow": ["127.0.0.1"], "max_response_bytes": -1}`, want: []ValidationIssue{{Path: "http.max_response_bytes", Message: "must not be negative"}}},
+	}
+	for _, tt := range tests {
+		var wf Workflow
+		document := `{"id": "payments", "http": ` + tt.policy + `, "input": [{"name": "amount", "type": "number"}], "nodes": ` + validNodes + `}`
+		if err := json.Unmarshal([]byte(document), &wf); err != nil {
+			t.Fatalf("decoding definition: %v", err)
+		}
+		if got := Validate(&wf); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: issues:\n%v\nwant:\n%v", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// DefaultStartNode is the node instances start at unless StartOptions names another.
+const DefaultStartNode = "start_node"
+
+// StartOptions configures a new workflow instance.
+type StartOptions struct {
+	// Variables are merged into the initial context. They are validated against the
+	// definition's input schema, if it declares one.
+	Variables map[string]interface{}
+	// BusinessKey is an optional caller-supplied identifier stored with the instance.
+	BusinessKey string
+	// StartNode is the ID of the start node to begin at. Defaults to DefaultStartNode.
+	StartNode string
+	// ParentInstanceID links the new instance to an existing one as its child.
+	// Cancelling the parent cancels the child too.
+	ParentInstanceID string
+}
+
+// InputValidationError reports start options that do not match the definition, keyed
+// by variable name, by "start_node" for an unusable start node or by
+// "parent_instance_id" for an unknown parent.
+type InputValidationError struct {
+	Fields map[string]string
+}
+
+func (e *InputValidationError) Error() string {
+	keys := make([]string, 0, len(e.Fields))
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s: %s", key, e.Fields[key]))
+	}
+	return "invalid start input: " + strings.Join(parts, "; ")
+}
+
+// prepareVariables converts variables to their JSON representation, applies the
+// defaults of the schema and checks required variables and types. Variables the
+// schema does not declare are passed through unchecked.
+func prepareVariables(schema []VariableSchema, variables map[string]interface{}) (map[string]interface{}, error) {
+	prepared := make(map[string]interface{})
+	if len(variables) > 0 {
+		data, err := json.Marshal(variables)
+		if err != nil {
+			return nil, fmt.Errorf("variables cannot be stored as JSON: %w", err)
+		}
+		if err := json.Unmarshal(data, &prepared); err != nil {
+			return nil, err
+		}
+	}
+
+	fieldErrors := make(map[string]string)
+	for _, v := range schema {
+		value, ok := prepared[v.Name]
+		if !ok || value == nil {
+			if v.Default != nil {
+				prepared[v.Name] = v.Default
+			} else if v.Required {
+				fieldErrors[v.Name] = "is required"
+			}
+			continue
+		}
+		if msg := checkType(v.Type, value); msg != "" {
+			fieldErrors[v.Name] = msg
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return nil, &InputValidationError{Fields: fieldErrors}
+	}
+	return prepared, nil
+}
+
+// checkType returns a message if value, as decoded from JSON, is not of the schema type.
+func checkType(typ string, value interface{}) string {
+	ok := true
+	switch typ {
+	case "", "any":
+	case "string":
+		_, ok = value.(string)
+	case "number":
+		_, ok = value.(float64)
+	case "integer":
+		f, isNumber := value.(float64)
+		ok = isNumber && f == math.Trunc(f)
+	case "boolean":
+		_, ok = value.(bool)
+	case "object":
+		_, ok = value.(map[string]interface{})
+	case "array":
+		_, ok = value.([]interface{})
+	default:
+		return fmt.Sprintf("has unknown schema type %q", typ)
+	}
+	if !ok {
+		return fmt.Sprintf("must be of type %s", typ)
+	}
+	return ""
+}
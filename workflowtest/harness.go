@@ -0,0 +1,325 @@
+// Package workflowtest runs workflow definitions in Go tests without HTTP.
+//
+// A Harness loads one definition into an engine backed by an in-memory store,
+// a fake clock and an inline executor, so every call returns only once the
+// instance has reached its next wait state:
+//
+//	h := workflowtest.New(t, "../workflows/my_first_workflow.json")
+//	inst := h.Start()
+//	inst.SubmitForm(map[string]string{"user_name": "Ada", "user_age": "36"})
+//	inst.AssertPassedThrough("check_age_gateway")
+//	inst.AssertEndedAt("adult_path_end")
+//	inst.AssertContext("is_adult", true)
+package workflowtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"jbpmn-engine/clock"
+	"jbpmn-engine/coverage"
+	"jbpmn-engine/db"
+	"jbpmn-engine/scripts"
+	"jbpmn-engine/workflow"
+)
+
+// Epoch is the time the fake clock of every Harness starts at.
+var Epoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// collector accumulates the paths of every instance started by any Harness.
+var collector = coverage.NewCollector()
+
+// Coverage returns the collector that records the node and gateway branch hits of
+// every instance started by a Harness in this test binary.
+func Coverage() *coverage.Collector {
+	return collector
+}
+
+// WriteCoverage writes text, JSON and HTML coverage reports for every definition
+// exercised so far into dir. Call it from TestMain after m.Run.
+func WriteCoverage(dir string) error {
+	return collector.WriteFiles(dir)
+}
+
+// Harness runs instances of a single workflow definition.
+type Harness struct {
+	t          testing.TB
+	Engine     *workflow.Engine
+	Store      *db.SQLiteStore
+	Clock      *clock.Fake
+	Definition *workflow.Workflow
+	scripts    *scripts.Runtime
+	instances  []*Instance
+}
+
+// New loads the workflow definition at path into a fresh engine. The engine and its
+// store are closed when the test finishes. Script libraries are read from the scripts
+// directory next to the definition's directory, e.g. scripts/ for
+// workflows/orders.json.
+func New(t testing.TB, path string) *Harness {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("workflowtest: reading definition: %v", err)
+	}
+	var wf workflow.Workflow
+	if err := json.Unmarshal(data, &wf); err != nil {
+		t.Fatalf("workflowtest: parsing definition %s: %v", path, err)
+	}
+
+	store, err := db.OpenInMemory()
+	if err != nil {
+		t.Fatalf("workflowtest: opening store: %v", err)
+	}
+	fake := clock.NewFake(Epoch)
+	store.SetClock(fake)
+
+	h := &Harness{
+		t:       t,
+		Store:   store,
+		Clock:   fake,
+		scripts: &scripts.Runtime{Globals: make(map[string]interface{})},
+	}
+
+	h.Engine, err = workflow.New(
+		workflow.WithStore(store),
+		workflow.WithDefinitionSource(fileSource(path)),
+		workflow.WithClock(fake),
+		workflow.WithLogger(slog.New(slog.NewTextHandler(testWriter{t}, nil))),
+		workflow.WithScriptRuntime(h.scripts),
+		workflow.WithScriptLibraries(filepath.Join(filepath.Dir(filepath.Dir(path)), "scripts")),
+		workflow.WithExecutor(&workflow.InlineExecutor{}),
+	)
+	if err != nil {
+		t.Fatalf("workflowtest: creating engine: %v", err)
+	}
+	if err := h.Engine.LoadDefinitions(); err != nil {
+		t.Fatalf("workflowtest: loading definition: %v", err)
+	}
+	h.Definition, err = h.Engine.Definition(wf.ID)
+	if err != nil {
+		t.Fatalf("workflowtest: %v", err)
+	}
+
+	t.Cleanup(func() {
+		h.recordCoverage()
+		if err := h.Engine.Close(); err != nil {
+			t.Errorf("workflowtest: closing engine: %v", err)
+		}
+		store.Close()
+	})
+	return h
+}
+
+// MockHostFunction exposes fn to scripts as the global name, replacing any
+// previous function of that name. fn is converted by goja, so plain Go functions
+// such as func(string, float64) bool can be used.
+func (h *Harness) MockHostFunction(name string, fn interface{}) {
+	h.scripts.Globals[name] = fn
+}
+
+// Start creates a new instance and runs it to its first wait state.
+func (h *Harness) Start() *Instance {
+	h.t.Helper()
+	return h.StartWith(workflow.StartOptions{})
+}
+
+// StartWith creates a new instance with initial variables, a business key or a start
+// node and runs it to its first wait state.
+func (h *Harness) StartWith(opts workflow.StartOptions) *Instance {
+	h.t.Helper()
+	instance, err := h.Engine.Start(context.Background(), h.Definition.ID, opts)
+	if err != nil {
+		h.t.Fatalf("workflowtest: starting %s: %v", h.Definition.ID, err)
+	}
+	inst := &Instance{h: h, ID: instance.ID}
+	h.instances = append(h.instances, inst)
+	return inst
+}
+
+// recordCoverage adds the history of every started instance to the coverage collector.
+func (h *Harness) recordCoverage() {
+	for _, inst := range h.instances {
+		history, err := h.Engine.History(inst.ID)
+		if err != nil {
+			h.t.Errorf("workflowtest: loading history for coverage: %v", err)
+			continue
+		}
+		collector.RecordHistory(h.Definition, history)
+	}
+}
+
+// Signal emits a signal and runs every resumed instance to its next wait state.
+func (h *Harness) Signal(name string) {
+	h.t.Helper()
+	if err := h.Engine.Signal(name); err != nil {
+		h.t.Fatalf("workflowtest: emitting signal %s: %v", name, err)
+	}
+}
+
+// Advance moves the fake clock forward, firing due timeouts synchronously.
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+}
+
+// Instance is a workflow instance started by a Harness.
+type Instance struct {
+	h  *Harness
+	ID string
+}
+
+// State reloads the instance.
+func (i *Instance) State() *workflow.WorkflowInstance {
+	i.h.t.Helper()
+	instance, err := i.h.Engine.GetInstance(i.ID)
+	if err != nil {
+		i.h.t.Fatalf("workflowtest: loading instance: %v", err)
+	}
+	return instance
+}
+
+// Path returns the IDs of the nodes the instance entered, in order. Consecutive
+// records of the same node, e.g. from a received signal, are collapsed.
+func (i *Instance) Path() []string {
+	i.h.t.Helper()
+	history, err := i.h.Engine.History(i.ID)
+	if err != nil {
+		i.h.t.Fatalf("workflowtest: loading history: %v", err)
+	}
+	var path []string
+	for _, rec := range history {
+		if len(path) > 0 && path[len(path)-1] == rec.NodeID {
+			continue
+		}
+		path = append(path, rec.NodeID)
+	}
+	return path
+}
+
+// SubmitForm submits data to the form the instance is waiting at.
+func (i *Instance) SubmitForm(data map[string]string) {
+	i.h.t.Helper()
+	if err := i.h.Engine.SubmitForm(i.ID, data); err != nil {
+		i.h.t.Fatalf("workflowtest: submitting form: %v", err)
+	}
+}
+
+// SubmitFormExpectingErrors submits data that must fail validation and returns
+// the per-field error messages.
+func (i *Instance) SubmitFormExpectingErrors(data map[string]string) map[string]string {
+	i.h.t.Helper()
+	err := i.h.Engine.SubmitForm(i.ID, data)
+	validationErr, ok := err.(*workflow.FormValidationError)
+	if !ok {
+		i.h.t.Fatalf("workflowtest: expected form validation errors, got %v", err)
+	}
+	return validationErr.Fields
+}
+
+// AssertPassedThrough fails the test unless the instance entered nodeID.
+func (i *Instance) AssertPassedThrough(nodeID string) {
+	i.h.t.Helper()
+	path := i.Path()
+	for _, id := range path {
+		if id == nodeID {
+			return
+		}
+	}
+	i.h.t.Errorf("instance did not pass through %q; path: %s", nodeID, strings.Join(path, " -> "))
+}
+
+// AssertNotPassedThrough fails the test if the instance entered nodeID.
+func (i *Instance) AssertNotPassedThrough(nodeID string) {
+	i.h.t.Helper()
+	path := i.Path()
+	for _, id := range path {
+		if id == nodeID {
+			i.h.t.Errorf("instance passed through %q; path: %s", nodeID, strings.Join(path, " -> "))
+			return
+		}
+	}
+}
+
+// AssertAt fails the test unless the instance is currently at nodeID.
+func (i *Instance) AssertAt(nodeID string) {
+	i.h.t.Helper()
+	if current := i.State().CurrentNode; current != nodeID {
+		i.h.t.Errorf("instance is at %q, want %q", current, nodeID)
+	}
+}
+
+// AssertEndedAt fails the test unless the instance finished at the end node nodeID.
+func (i *Instance) AssertEndedAt(nodeID string) {
+	i.h.t.Helper()
+	state := i.State()
+	if state.CurrentNodeDef.Type != "end" {
+		i.h.t.Errorf("instance has not ended; it is at %s node %q", state.CurrentNodeDef.Type, state.CurrentNode)
+		return
+	}
+	if state.CurrentNode != nodeID {
+		i.h.t.Errorf("instance ended at %q, want %q", state.CurrentNode, nodeID)
+	}
+}
+
+// AssertContext fails the test unless the context variable key equals want.
+// want is compared after a JSON round trip, so 36 matches a stored float64(36).
+func (i *Instance) AssertContext(key string, want interface{}) {
+	i.h.t.Helper()
+	got, ok := i.State().Context[key]
+	if !ok {
+		i.h.t.Errorf("context has no variable %q", key)
+		return
+	}
+	normalized, err := normalize(want)
+	if err != nil {
+		i.h.t.Fatalf("workflowtest: %v", err)
+	}
+	if !reflect.DeepEqual(got, normalized) {
+		i.h.t.Errorf("context[%q] = %#v, want %#v", key, got, normalized)
+	}
+}
+
+// AssertNoContext fails the test if the context has a variable key.
+func (i *Instance) AssertNoContext(key string) {
+	i.h.t.Helper()
+	if got, ok := i.State().Context[key]; ok {
+		i.h.t.Errorf("context[%q] = %#v, want no such variable", key, got)
+	}
+}
+
+// normalize converts v to the representation it has after being stored as JSON.
+func normalize(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compare %#v with context values: %w", v, err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// fileSource serves a single definition file to the engine.
+type fileSource string
+
+func (s fileSource) List() ([]string, error)              { return []string{string(s)}, nil }
+func (s fileSource) Read(location string) ([]byte, error) { return os.ReadFile(location) }
+func (s fileSource) Locate(workflowID string) string      { return string(s) }
+
+// testWriter sends engine log output to the test log.
+type testWriter struct{ t testing.TB }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
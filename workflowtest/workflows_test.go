@@ -0,0 +1,138 @@
+package workflowtest
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain writes workflow coverage reports when WORKFLOW_COVERAGE_DIR is set.
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if dir := os.Getenv("WORKFLOW_COVERAGE_DIR"); dir != "" {
+		if err := WriteCoverage(dir); err != nil {
+			fmt.Fprintf(os.Stderr, "writing workflow coverage: %v\n", err)
+			code = 1
+		}
+	}
+	os.Exit(code)
+}
+
+const (
+	myFirstWorkflow = "../workflows/my_first_workflow.json"
+	approvalProcess = "../workflows/approval_process.json"
+)
+
+func TestMyFirstWorkflowAdultPath(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	inst := h.Start()
+	inst.AssertAt("collect_info_form")
+
+	inst.SubmitForm(map[string]string{"user_name": "Ada", "user_age": "36"})
+
+	inst.AssertPassedThrough("process_data_script")
+	inst.AssertPassedThrough("check_age_gateway")
+	inst.AssertEndedAt("adult_path_end")
+	inst.AssertContext("user_name", "Ada")
+	inst.AssertContext("user_age", 36)
+	inst.AssertContext("is_adult", true)
+}
+
+func TestMyFirstWorkflowUnderAgePath(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	inst := h.Start()
+
+	inst.SubmitForm(map[string]string{"user_name": "Tim", "user_age": "17"})
+
+	inst.AssertPassedThrough("check_age_gateway")
+	inst.AssertEndedAt("under_age_end")
+	inst.AssertNoContext("is_adult")
+}
+
+func TestMyFirstWorkflowGatewayUsesFormAgeNotScriptFlag(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	inst := h.Start()
+
+	// 26 is an adult for the script (> 25) but not for the gateway (>= 30).
+	inst.SubmitForm(map[string]string{"user_name": "Sam", "user_age": "26"})
+
+	inst.AssertContext("is_adult", true)
+	inst.AssertEndedAt("under_age_end")
+}
+
+func TestMyFirstWorkflowValidation(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	inst := h.Start()
+
+	errs := inst.SubmitFormExpectingErrors(map[string]string{"user_age": "old", "user_email": "nope"})
+	for _, field := range []string{"user_name", "user_age", "user_email"} {
+		if errs[field] == "" {
+			t.Errorf("expected a validation error for %s, got %v", field, errs)
+		}
+	}
+	inst.AssertAt("collect_info_form")
+}
+
+func TestMyFirstWorkflowFormTimeout(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	inst := h.Start()
+
+	h.Advance(59 * time.Second)
+	inst.AssertAt("collect_info_form")
+
+	h.Advance(time.Second)
+	inst.AssertNotPassedThrough("process_data_script")
+	inst.AssertEndedAt("timeout_message_end")
+}
+
+func TestMyFirstWorkflowSubmissionCancelsTimeout(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	inst := h.Start()
+
+	inst.SubmitForm(map[string]string{"user_name": "Ada", "user_age": "40"})
+	h.Advance(time.Hour)
+
+	inst.AssertNotPassedThrough("timeout_message_end")
+	inst.AssertEndedAt("adult_path_end")
+}
+
+func TestMyFirstWorkflowMockedHostFunction(t *testing.T) {
+	h := New(t, myFirstWorkflow)
+	var logged []string
+	h.MockHostFunction("console", map[string]interface{}{
+		"log": func(msg string) { logged = append(logged, msg) },
+	})
+
+	inst := h.Start()
+	inst.SubmitForm(map[string]string{"user_name": "Ada", "user_age": "40"})
+
+	inst.AssertEndedAt("adult_path_end")
+	if len(logged) != 1 || logged[0] != "Processing data" {
+		t.Errorf("console.log calls = %v", logged)
+	}
+}
+
+func TestApprovalProcessApproved(t *testing.T) {
+	h := New(t, approvalProcess)
+	inst := h.Start()
+	inst.AssertAt("request_approval")
+
+	inst.SubmitForm(map[string]string{"request_details": "New laptop", "amount": "1200"})
+
+	inst.AssertNotPassedThrough("timeout_handler")
+	inst.AssertEndedAt("end_node")
+	inst.AssertContext("request_details", "New laptop")
+	inst.AssertContext("amount", 1200)
+}
+
+func TestApprovalProcessTimeout(t *testing.T) {
+	h := New(t, approvalProcess)
+	inst := h.Start()
+
+	h.Advance(time.Minute)
+
+	inst.AssertPassedThrough("timeout_handler")
+	inst.AssertEndedAt("end_node")
+	inst.AssertContext("status", "himachout")
+}